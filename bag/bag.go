@@ -0,0 +1,173 @@
+// Package bag stores recorded frames in an indexed, chunked log file.
+//
+// A bag starts with a magic and a version followed by records
+//
+//	[op][body length uint32][crc32 of body uint32][body]
+//
+// Connection records describe what was recorded (kind, name, mad type code and schema) and chunk records hold the messages.
+// Closing a bag appends an index record with the time range and message counts of every chunk and a trailer
+// pointing at it. A bag that was not closed (the recording process crashed) is read by scanning the records,
+// everything up to the last complete chunk is kept.
+package bag
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+// Kinds of connections written by spine
+const (
+	KindTopic    = "topic"
+	KindRequest  = "request"
+	KindResponse = "response"
+)
+
+const (
+	magic        = "SPINEBAG"
+	indexMagic   = "SPINEIDX"
+	version      = 2
+	headerLength = len(magic) + 1
+
+	recordHeaderLength = 1 + 4 + 4
+	trailerLength      = 8 + len(indexMagic)
+)
+
+const (
+	opConnection uint8 = 1
+	opChunk      uint8 = 2
+	opIndex      uint8 = 3
+)
+
+// chunk bodies start with [start unix nanos int64][end unix nanos int64][message count uint32]
+const chunkHeaderLength = 8 + 8 + 4
+
+// every message in a chunk is [connection id uint32][unix nanos int64][data length uint32][data]
+const messageHeaderLength = 4 + 8 + 4
+
+var ErrNotBag = errors.New("not a bag file")
+var ErrCorrupt = errors.New("bag is corrupted")
+
+// Connection is a recorded stream of messages
+type Connection struct {
+	ID   uint32
+	Kind string
+	Name string
+	// Code is the mad type code of the recorded payloads
+	Code string
+	// Schema is the text form of the payloads' schema, empty if the endpoint did not advertise it
+	Schema string
+}
+
+// Message is a recorded frame
+type Message struct {
+	Connection Connection
+	Time       time.Time
+	Data       []byte
+}
+
+type chunkInfo struct {
+	offset int64
+	start  int64
+	end    int64
+	counts map[uint32]uint32
+}
+
+func putRecordHeader(buf []byte, op uint8, body []byte) {
+	buf[0] = op
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(body)))
+	binary.BigEndian.PutUint32(buf[5:], crc32.ChecksumIEEE(body))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func appendConnection(buf []byte, c Connection) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, c.ID)
+	buf = appendString(buf, c.Kind)
+	buf = appendString(buf, c.Name)
+	buf = appendString(buf, c.Code)
+	return appendString(buf, c.Schema)
+}
+
+func appendChunkInfo(buf []byte, c chunkInfo) []byte {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.offset))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.start))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(c.end))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(c.counts)))
+	for id, count := range c.counts {
+		buf = binary.BigEndian.AppendUint32(buf, id)
+		buf = binary.BigEndian.AppendUint32(buf, count)
+	}
+	return buf
+}
+
+// decoder reads the fields of a record body, the first failed read sets err
+type decoder struct {
+	buf []byte
+	err error
+}
+
+// next returns the following n bytes, or nil once a read failed
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.buf) < n {
+		d.err = ErrCorrupt
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	b := d.next(2)
+	if b == nil {
+		return ""
+	}
+	return string(d.next(int(binary.BigEndian.Uint16(b))))
+}
+
+func (d *decoder) connection() Connection {
+	return Connection{
+		ID:     d.uint32(),
+		Kind:   d.string(),
+		Name:   d.string(),
+		Code:   d.string(),
+		Schema: d.string(),
+	}
+}
+
+func (d *decoder) chunkInfo() chunkInfo {
+	c := chunkInfo{
+		offset: d.int64(),
+		start:  d.int64(),
+		end:    d.int64(),
+	}
+	n := d.uint32()
+	if d.err != nil {
+		return c
+	}
+	c.counts = make(map[uint32]uint32, n)
+	for range n {
+		id := d.uint32()
+		c.counts[id] = d.uint32()
+	}
+	return c
+}
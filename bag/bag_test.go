@@ -0,0 +1,159 @@
+package bag
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func writeBag(t *testing.T, path string) *Writer {
+	w, err := Create(path, WithChunkSize(64), WithFlushInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	temperature, _ := w.AddConnection(Connection{Kind: KindTopic, Name: "temperature", Code: "2", Schema: "f32"})
+	pose, _ := w.AddConnection(Connection{Kind: KindTopic, Name: "pose", Code: "7333"})
+
+	start := time.Unix(1000, 0)
+	for i := range 20 {
+		if err := w.Write(temperature, start.Add(time.Duration(i)*time.Second), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(pose, start.Add(time.Duration(i)*time.Second), []byte{byte(i), byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w
+}
+
+func TestBag_Index(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.bag")
+	if err := writeBag(t, path).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if r.Recovered() {
+		t.Error("closed bag should have an index")
+	}
+	if len(r.chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(r.chunks))
+	}
+	if !r.Start().Equal(time.Unix(1000, 0)) || !r.End().Equal(time.Unix(1019, 0)) {
+		t.Errorf("unexpected range %v - %v", r.Start(), r.End())
+	}
+
+	var got []byte
+	query := Query{Start: time.Unix(1005, 0), End: time.Unix(1009, 0), Names: []string{"temperature"}}
+	for m, err := range r.Messages(query) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Connection.Name != "temperature" || m.Connection.Code != "2" || m.Connection.Schema != "f32" {
+			t.Fatalf("unexpected connection %+v", m.Connection)
+		}
+		got = append(got, m.Data...)
+	}
+	if string(got) != string([]byte{5, 6, 7, 8, 9}) {
+		t.Errorf("unexpected messages %v", got)
+	}
+}
+
+func TestBag_Recover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.bag")
+	w := writeBag(t, path)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of writing a chunk leaves a partial record behind
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{opChunk, 0, 0, 1, 0, 1, 2})
+	file.Close()
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if !r.Recovered() {
+		t.Error("bag without index should be recovered")
+	}
+	if len(r.Connections()) != 2 {
+		t.Fatalf("expected 2 connections, got %d", len(r.Connections()))
+	}
+
+	count := 0
+	for _, err := range r.Messages(Query{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 40 || r.MessageCount(0) != 20 {
+		t.Errorf("expected 40 messages, got %d", count)
+	}
+}
+
+func TestBag_CorruptLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.bag")
+	w := writeBag(t, path)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a record claiming more bytes than the file holds is rejected before its body is allocated
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{opChunk, 0xff, 0xff, 0xff, 0xf0, 0, 0, 0, 0})
+	file.Close()
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, _, err := r.readRecord(r.size - recordHeaderLength); err != ErrCorrupt {
+		t.Errorf("expected corrupted record, got %v", err)
+	}
+	if r.MessageCount(0) != 20 {
+		t.Errorf("expected 20 messages, got %d", r.MessageCount(0))
+	}
+}
+
+func TestBag_CorruptMessageLength(t *testing.T) {
+	// one message in a chunk claims 4GiB of data
+	chunk := make([]byte, chunkHeaderLength, chunkHeaderLength+messageHeaderLength)
+	binary.BigEndian.PutUint32(chunk[16:], 1)
+	chunk = binary.BigEndian.AppendUint32(chunk, 0)
+	chunk = binary.BigEndian.AppendUint64(chunk, 0)
+	chunk = binary.BigEndian.AppendUint32(chunk, 0xffffffff)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for _, err := range messages(chunk) {
+		if err != ErrCorrupt {
+			t.Errorf("expected a corrupted message, got %v", err)
+		}
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("expected the length to be rejected before allocating, %d bytes were allocated", allocated)
+	}
+}
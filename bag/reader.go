@@ -0,0 +1,303 @@
+package bag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"iter"
+	"os"
+	"slices"
+	"time"
+)
+
+// Reader reads a bag written by Writer
+type Reader struct {
+	file        *os.File
+	connections []Connection
+	chunks      []chunkInfo
+	recovered   bool
+	size        int64
+}
+
+// Query selects messages of a bag, zero fields select everything
+type Query struct {
+	Start time.Time
+	End   time.Time
+	// Names of the connections to read
+	Names []string
+}
+
+// Open opens the bag at path.
+// If the bag has no index because its writer never closed, the index is rebuilt from the complete records.
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Reader{file: file}
+	if err := r.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reader) load() error {
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(r.file, header); err != nil || string(header[:len(magic)]) != magic {
+		return ErrNotBag
+	}
+	if header[len(magic)] != version {
+		return fmt.Errorf("unsupported bag version %d", header[len(magic)])
+	}
+
+	info, err := r.file.Stat()
+	if err != nil {
+		return err
+	}
+	r.size = info.Size()
+
+	if info.Size() >= int64(headerLength+trailerLength) {
+		trailer := make([]byte, trailerLength)
+		if _, err := r.file.ReadAt(trailer, info.Size()-int64(trailerLength)); err != nil {
+			return err
+		}
+		if string(trailer[8:]) == indexMagic {
+			offset := int64(binary.BigEndian.Uint64(trailer))
+			if err := r.readIndex(offset); err == nil {
+				return nil
+			}
+		}
+	}
+
+	r.connections = nil
+	r.chunks = nil
+	r.recovered = true
+	return r.scan(info.Size())
+}
+
+func (r *Reader) readIndex(offset int64) error {
+	op, body, err := r.readRecord(offset)
+	if err != nil {
+		return err
+	}
+	if op != opIndex {
+		return ErrCorrupt
+	}
+
+	d := decoder{buf: body}
+	connections := d.uint32()
+	for range connections {
+		if d.err != nil {
+			break
+		}
+		r.connections = append(r.connections, d.connection())
+	}
+	chunks := d.uint32()
+	for range chunks {
+		if d.err != nil {
+			break
+		}
+		r.chunks = append(r.chunks, d.chunkInfo())
+	}
+	return d.err
+}
+
+// scan rebuilds the index from the records, it stops at the first incomplete or corrupted record
+func (r *Reader) scan(size int64) error {
+	offset := int64(headerLength)
+	for offset+recordHeaderLength <= size {
+		op, body, err := r.readRecord(offset)
+		if err != nil {
+			return nil
+		}
+
+		switch op {
+		case opConnection:
+			d := decoder{buf: body}
+			c := d.connection()
+			if d.err != nil {
+				return nil
+			}
+			r.connections = append(r.connections, c)
+
+		case opChunk:
+			info := chunkInfo{offset: offset, counts: make(map[uint32]uint32)}
+			for m, err := range messages(body) {
+				if err != nil {
+					return nil
+				}
+				info.counts[m.conn]++
+			}
+			d := decoder{buf: body}
+			info.start = d.int64()
+			info.end = d.int64()
+			r.chunks = append(r.chunks, info)
+
+		case opIndex:
+			return nil
+		}
+
+		offset += int64(recordHeaderLength + len(body))
+	}
+	return nil
+}
+
+func (r *Reader) readRecord(offset int64) (uint8, []byte, error) {
+	header := make([]byte, recordHeaderLength)
+	if _, err := r.file.ReadAt(header, offset); err != nil {
+		return 0, nil, err
+	}
+
+	// a corrupted length must not allocate more than the file holds
+	length := int64(binary.BigEndian.Uint32(header[1:]))
+	if length > r.size-offset-recordHeaderLength {
+		return 0, nil, ErrCorrupt
+	}
+	body := make([]byte, length)
+	if _, err := r.file.ReadAt(body, offset+recordHeaderLength); err != nil {
+		return 0, nil, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[5:]) {
+		return 0, nil, ErrCorrupt
+	}
+	return header[0], body, nil
+}
+
+type rawMessage struct {
+	conn uint32
+	time int64
+	data []byte
+}
+
+func messages(chunk []byte) iter.Seq2[rawMessage, error] {
+	return func(yield func(rawMessage, error) bool) {
+		if len(chunk) < chunkHeaderLength {
+			yield(rawMessage{}, ErrCorrupt)
+			return
+		}
+		count := binary.BigEndian.Uint32(chunk[16:])
+		d := decoder{buf: chunk[chunkHeaderLength:]}
+		for range count {
+			m := rawMessage{conn: d.uint32(), time: d.int64()}
+			m.data = d.next(int(d.uint32()))
+			if d.err != nil {
+				yield(rawMessage{}, d.err)
+				return
+			}
+			if !yield(m, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Recovered reports whether the bag was not closed and its index was rebuilt
+func (r *Reader) Recovered() bool {
+	return r.recovered
+}
+
+func (r *Reader) Connections() []Connection {
+	return slices.Clone(r.connections)
+}
+
+// Start returns the time of the earliest message
+func (r *Reader) Start() time.Time {
+	if len(r.chunks) == 0 {
+		return time.Time{}
+	}
+	start := r.chunks[0].start
+	for _, c := range r.chunks {
+		start = min(start, c.start)
+	}
+	return time.Unix(0, start)
+}
+
+// End returns the time of the latest message
+func (r *Reader) End() time.Time {
+	if len(r.chunks) == 0 {
+		return time.Time{}
+	}
+	end := r.chunks[0].end
+	for _, c := range r.chunks {
+		end = max(end, c.end)
+	}
+	return time.Unix(0, end)
+}
+
+// MessageCount returns how many messages connection conn recorded
+func (r *Reader) MessageCount(conn uint32) int {
+	count := 0
+	for _, c := range r.chunks {
+		count += int(c.counts[conn])
+	}
+	return count
+}
+
+// Messages returns the messages matching q in the order they were written.
+// Chunks outside the time range or without the selected connections are not read.
+func (r *Reader) Messages(q Query) iter.Seq2[Message, error] {
+	selected := make(map[uint32]Connection)
+	for _, c := range r.connections {
+		if len(q.Names) == 0 || slices.Contains(q.Names, c.Name) {
+			selected[c.ID] = c
+		}
+	}
+
+	start := int64(0)
+	if !q.Start.IsZero() {
+		start = q.Start.UnixNano()
+	}
+	end := int64(1<<63 - 1)
+	if !q.End.IsZero() {
+		end = q.End.UnixNano()
+	}
+
+	return func(yield func(Message, error) bool) {
+		for _, chunk := range r.chunks {
+			if chunk.end < start || chunk.start > end || !chunk.has(selected) {
+				continue
+			}
+
+			op, body, err := r.readRecord(chunk.offset)
+			if err == nil && op != opChunk {
+				err = ErrCorrupt
+			}
+			if err != nil {
+				yield(Message{}, err)
+				return
+			}
+
+			for m, err := range messages(body) {
+				if err != nil {
+					yield(Message{}, err)
+					return
+				}
+				c, ok := selected[m.conn]
+				if !ok || m.time < start || m.time > end {
+					continue
+				}
+				msg := Message{Connection: c, Time: time.Unix(0, m.time), Data: bytes.Clone(m.data)}
+				if !yield(msg, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (c chunkInfo) has(connections map[uint32]Connection) bool {
+	for id := range c.counts {
+		if _, ok := connections[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,250 @@
+package bag
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+const DefaultChunkSize = 1 << 20
+const DefaultFlushInterval = time.Second
+
+// WriterOption configures a Writer when it is created
+type WriterOption func(*Writer)
+
+// WithChunkSize sets how many bytes of messages are buffered before a chunk is written
+func WithChunkSize(size int) WriterOption {
+	return func(w *Writer) {
+		w.chunkSize = size
+	}
+}
+
+// WithFlushInterval sets how often buffered messages are written even if the chunk is not full.
+// It bounds what is lost when the recording process crashes.
+func WithFlushInterval(interval time.Duration) WriterOption {
+	return func(w *Writer) {
+		w.flushInterval = interval
+	}
+}
+
+// Writer appends messages to a bag, it is safe for concurrent use
+type Writer struct {
+	mu     sync.Mutex
+	file   *os.File
+	offset int64
+	closed bool
+	done   chan struct{}
+
+	chunkSize     int
+	flushInterval time.Duration
+
+	connections []Connection
+	// ids of the connections keyed by the connection with a zero ID
+	ids    map[Connection]uint32
+	chunks []chunkInfo
+
+	// the chunk being filled
+	chunk      []byte
+	chunkCount uint32
+	current    chunkInfo
+}
+
+// Create creates the bag at path, truncating it if it exists
+func Create(path string, opts ...WriterOption) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Writer{
+		file:          file,
+		done:          make(chan struct{}),
+		ids:           make(map[Connection]uint32),
+		chunkSize:     DefaultChunkSize,
+		flushInterval: DefaultFlushInterval,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+
+	header := append([]byte(magic), version)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.offset = int64(len(header))
+	w.resetChunk()
+
+	if w.flushInterval > 0 {
+		go w.runFlusher()
+	}
+	return w, nil
+}
+
+func (w *Writer) runFlusher() {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.Flush()
+		}
+	}
+}
+
+// AddConnection returns the id of the connection with the kind, name, code and schema of c,
+// adding it if it is new. The ID of c is ignored.
+func (w *Writer) AddConnection(c Connection) (uint32, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	c.ID = 0
+	if id, ok := w.ids[c]; ok {
+		return id, nil
+	}
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	id := uint32(len(w.connections))
+	if err := w.writeRecord(opConnection, appendConnection(nil, Connection{ID: id, Kind: c.Kind, Name: c.Name, Code: c.Code, Schema: c.Schema})); err != nil {
+		return 0, err
+	}
+	w.ids[c] = id
+	c.ID = id
+	w.connections = append(w.connections, c)
+	return id, nil
+}
+
+// Write adds a message of connection conn received at t
+func (w *Writer) Write(conn uint32, t time.Time, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+	if int(conn) >= len(w.connections) {
+		return errors.New("unknown connection")
+	}
+
+	nanos := t.UnixNano()
+	if w.chunkCount == 0 || nanos < w.current.start {
+		w.current.start = nanos
+	}
+	if nanos > w.current.end {
+		w.current.end = nanos
+	}
+	w.current.counts[conn]++
+	w.chunkCount++
+
+	w.chunk = binary.BigEndian.AppendUint32(w.chunk, conn)
+	w.chunk = binary.BigEndian.AppendUint64(w.chunk, uint64(nanos))
+	w.chunk = binary.BigEndian.AppendUint32(w.chunk, uint32(len(data)))
+	w.chunk = append(w.chunk, data...)
+
+	if len(w.chunk) >= w.chunkSize {
+		return w.flush()
+	}
+	return nil
+}
+
+// Flush writes the buffered messages as a chunk and syncs the file
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *Writer) flush() error {
+	if w.chunkCount == 0 {
+		return nil
+	}
+
+	binary.BigEndian.PutUint64(w.chunk, uint64(w.current.start))
+	binary.BigEndian.PutUint64(w.chunk[8:], uint64(w.current.end))
+	binary.BigEndian.PutUint32(w.chunk[16:], w.chunkCount)
+
+	w.current.offset = w.offset
+	if err := w.writeRecord(opChunk, w.chunk); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	w.chunks = append(w.chunks, w.current)
+	w.resetChunk()
+	return nil
+}
+
+func (w *Writer) resetChunk() {
+	w.chunk = make([]byte, chunkHeaderLength, chunkHeaderLength+w.chunkSize)
+	w.chunkCount = 0
+	w.current = chunkInfo{counts: make(map[uint32]uint32)}
+}
+
+func (w *Writer) writeRecord(op uint8, body []byte) error {
+	record := make([]byte, recordHeaderLength, recordHeaderLength+len(body))
+	putRecordHeader(record, op, body)
+	record = append(record, body...)
+
+	n, err := w.file.Write(record)
+	w.offset += int64(n)
+	return err
+}
+
+// Close writes the remaining messages and the index and closes the file
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	close(w.done)
+
+	if err := w.flush(); err != nil {
+		w.closed = true
+		w.file.Close()
+		return err
+	}
+	w.closed = true
+
+	index := binary.BigEndian.AppendUint32(nil, uint32(len(w.connections)))
+	for _, c := range w.connections {
+		index = appendConnection(index, c)
+	}
+	index = binary.BigEndian.AppendUint32(index, uint32(len(w.chunks)))
+	for _, c := range w.chunks {
+		index = appendChunkInfo(index, c)
+	}
+
+	indexOffset := w.offset
+	if err := w.writeRecord(opIndex, index); err != nil {
+		w.file.Close()
+		return err
+	}
+
+	trailer := binary.BigEndian.AppendUint64(nil, uint64(indexOffset))
+	trailer = append(trailer, indexMagic...)
+	if _, err := w.file.Write(trailer); err != nil {
+		w.file.Close()
+		return err
+	}
+
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,208 @@
+package spine
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock is the time of a namespace. Heartbeats, message timestamps and timers of endpoints use it.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+// WithClock makes the namespace use clock instead of the wall clock
+func WithClock(clock Clock) NamespaceOption {
+	return func(ns *Namespace) {
+		ns.clock = clock
+	}
+}
+
+// WithClockTopic makes the namespace follow the time published on topic as int64 unix nanoseconds.
+// Time stands still until the first message and whenever the topic stops.
+func WithClockTopic(topic string) NamespaceOption {
+	return func(ns *Namespace) {
+		ns.clockTopic = topic
+	}
+}
+
+// followClock drives the namespace's clock from its clock topic
+func (ns *Namespace) followClock() error {
+	sim, ok := ns.clock.(*SimClock)
+	if !ok {
+		sim = NewSimClock(time.Now())
+		ns.clock = sim
+	}
+
+	_, err := NewSubscriber(ns, ns.clockTopic, func(nanos int64) {
+		sim.Set(time.Unix(0, nanos))
+	})
+	return err
+}
+
+// wall clock
+
+type realClock struct{}
+
+type realTimer struct{ *time.Timer }
+
+type realTicker struct{ *time.Ticker }
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (t realTimer) C() <-chan time.Time  { return t.Timer.C }
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// SimClock is a clock that only moves when it is set
+type SimClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*simWaiter
+}
+
+// simWaiter is a timer, or a ticker when period is set
+type simWaiter struct {
+	clock    *SimClock
+	c        chan time.Time
+	deadline time.Time
+	period   time.Duration
+}
+
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set moves the clock to t and fires the timers and tickers that are due.
+// When the clock goes back, timers keep the time they had left.
+func (c *SimClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t.Before(c.now) {
+		back := c.now.Sub(t)
+		for _, w := range c.waiters {
+			w.deadline = w.deadline.Add(-back)
+		}
+	}
+	c.now = t
+
+	c.waiters = slices.DeleteFunc(c.waiters, func(w *simWaiter) bool {
+		if w.deadline.After(t) {
+			return false
+		}
+		select {
+		case w.c <- t:
+		default:
+		}
+		if w.period == 0 {
+			return true
+		}
+		// like time.Ticker, missed ticks are dropped
+		for !w.deadline.After(t) {
+			w.deadline = w.deadline.Add(w.period)
+		}
+		return false
+	})
+}
+
+// Advance moves the clock forward by d
+func (c *SimClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+func (c *SimClock) NewTimer(d time.Duration) Timer {
+	w := &simWaiter{clock: c, c: make(chan time.Time, 1)}
+	w.start(d, 0)
+	return w
+}
+
+func (c *SimClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for SimClock.NewTicker")
+	}
+	w := &simWaiter{clock: c, c: make(chan time.Time, 1)}
+	w.start(d, d)
+	return simTicker{w}
+}
+
+func (w *simWaiter) start(d time.Duration, period time.Duration) bool {
+	c := w.clock
+	c.mu.Lock()
+	active := w.remove()
+	w.deadline = c.now.Add(d)
+	w.period = period
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+
+	if d <= 0 {
+		c.Set(c.Now())
+	}
+	return active
+}
+
+// remove must be called with the clock locked
+func (w *simWaiter) remove() bool {
+	c := w.clock
+	i := slices.Index(c.waiters, w)
+	if i < 0 {
+		return false
+	}
+	c.waiters = slices.Delete(c.waiters, i, i+1)
+	return true
+}
+
+func (w *simWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+func (w *simWaiter) Stop() bool {
+	w.clock.mu.Lock()
+	defer w.clock.mu.Unlock()
+	return w.remove()
+}
+
+func (w *simWaiter) Reset(d time.Duration) bool {
+	return w.start(d, 0)
+}
+
+type simTicker struct{ w *simWaiter }
+
+func (t simTicker) C() <-chan time.Time { return t.w.c }
+func (t simTicker) Stop()               { t.w.Stop() }
+
+func (t simTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for SimClock.Ticker.Reset")
+	}
+	t.w.start(d, d)
+}
@@ -0,0 +1,75 @@
+package spine
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestSimClock(t *testing.T) {
+	clock := NewSimClock(time.Unix(0, 0))
+	timer := clock.NewTimer(time.Second)
+	ticker := clock.NewTicker(300 * time.Millisecond)
+	defer ticker.Stop()
+
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+	select {
+	case <-ticker.C():
+	default:
+		t.Fatal("ticker did not fire")
+	}
+
+	// the clock going back keeps the time the timer had left
+	clock.Set(time.Unix(0, 0))
+	clock.Advance(499 * time.Millisecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	clock.Advance(time.Millisecond)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(time.Unix(0, 0).Add(500 * time.Millisecond)) {
+			t.Errorf("unexpected time %v", now)
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+	if timer.Stop() {
+		t.Error("fired timer should not be active")
+	}
+}
+
+func TestClockTopic(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_clock", "secret", logger, WithClockTopic("clock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	pub, err := NewPublisher[int64](ns, "clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	simulated := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	timeout := time.After(5 * time.Second)
+	for !ns.Clock().Now().Equal(simulated) {
+		pub.Publish(simulated.UnixNano())
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("clock did not follow the topic, now %v", ns.Clock().Now())
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// spine-bridge forwards the topics and services its config file exports to a bridge on another site,
+// and serves there the ones the other side exports.
+//
+//	spine-bridge [-n namespace] [-s secret] -config bridge.json
+//
+// The namespace and secret default to SPINE_NAMESPACE and SPINE_SECRET.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"github.com/poisnoir/spine-go"
+	"github.com/poisnoir/spine-go/nsbridge"
+)
+
+func main() {
+	namespace := flag.String("n", os.Getenv("SPINE_NAMESPACE"), "namespace to join")
+	secret := flag.String("s", os.Getenv("SPINE_SECRET"), "secret of the namespace")
+	configPath := flag.String("config", "", "bridge config file")
+	flag.Parse()
+
+	if *namespace == "" || *configPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := nsbridge.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spine-bridge: %v\n", err)
+		os.Exit(1)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	ns, err := spine.JointNamespace(*namespace, *secret, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spine-bridge: %v\n", err)
+		os.Exit(1)
+	}
+	defer ns.Disconnect()
+
+	bridge, err := nsbridge.New(ns, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spine-bridge: %v\n", err)
+		os.Exit(1)
+	}
+	defer bridge.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	logger.Info("bridging", "namespace", *namespace, "transport", config.Transport, "exports", len(config.Exports))
+	<-ctx.Done()
+}
@@ -0,0 +1,81 @@
+// spine-gateway serves the services and topics of a namespace over HTTP and WebSockets.
+//
+//	spine-gateway [-n namespace] [-s secret] [-addr address] [-token token] [-allow patterns] [-origins origins]
+//
+// The namespace, secret and token default to SPINE_NAMESPACE, SPINE_SECRET and SPINE_GATEWAY_TOKEN.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/poisnoir/spine-go"
+	"github.com/poisnoir/spine-go/gateway"
+)
+
+func main() {
+	namespace := flag.String("n", os.Getenv("SPINE_NAMESPACE"), "namespace to join")
+	secret := flag.String("s", os.Getenv("SPINE_SECRET"), "secret of the namespace")
+	addr := flag.String("addr", ":8080", "address to listen on")
+	token := flag.String("token", os.Getenv("SPINE_GATEWAY_TOKEN"), "bearer token requests must carry, none if empty")
+	allow := flag.String("allow", "", "comma separated patterns of the names to expose, all if empty")
+	origins := flag.String("origins", "", "comma separated origins of the pages allowed to use the gateway, * for any")
+	timeout := flag.Duration("t", 10*time.Second, "how long to wait for endpoints and responses")
+	flag.Parse()
+
+	if *namespace == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	ns, err := spine.JointNamespace(*namespace, *secret, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spine-gateway: %v\n", err)
+		os.Exit(1)
+	}
+	defer ns.Disconnect()
+
+	opts := []gateway.Option{gateway.WithTimeout(*timeout)}
+	if *token != "" {
+		opts = append(opts, gateway.WithBearerToken(*token))
+	} else {
+		logger.Warn("no token is set, every request is accepted")
+	}
+	if *allow != "" {
+		opts = append(opts, gateway.WithAllowlist(strings.Split(*allow, ",")...))
+	}
+	if *origins != "" {
+		opts = append(opts, gateway.WithOrigins(strings.Split(*origins, ",")...))
+	}
+
+	g := gateway.New(ns, opts...)
+	defer g.Close()
+
+	server := &http.Server{Addr: *addr, Handler: g}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		g.Close() // ends the streams so the server can shut down
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("serving", "namespace", *namespace, "address", *addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(os.Stderr, "spine-gateway: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,58 @@
+// spine-mqtt forwards messages between a namespace and an MQTT broker as its config file maps them.
+//
+//	spine-mqtt [-n namespace] [-s secret] -config bridge.json
+//
+// The namespace and secret default to SPINE_NAMESPACE and SPINE_SECRET.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+
+	"github.com/poisnoir/spine-go"
+	"github.com/poisnoir/spine-go/mqttbridge"
+)
+
+func main() {
+	namespace := flag.String("n", os.Getenv("SPINE_NAMESPACE"), "namespace to join")
+	secret := flag.String("s", os.Getenv("SPINE_SECRET"), "secret of the namespace")
+	configPath := flag.String("config", "", "bridge config file")
+	flag.Parse()
+
+	if *namespace == "" || *configPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config, err := mqttbridge.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spine-mqtt: %v\n", err)
+		os.Exit(1)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	ns, err := spine.JointNamespace(*namespace, *secret, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spine-mqtt: %v\n", err)
+		os.Exit(1)
+	}
+	defer ns.Disconnect()
+
+	bridge, err := mqttbridge.New(ns, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spine-mqtt: %v\n", err)
+		os.Exit(1)
+	}
+	defer bridge.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	logger.Info("bridging", "namespace", *namespace, "broker", config.Broker, "mappings", len(config.Mappings))
+	<-ctx.Done()
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/poisnoir/spine-go"
+	"github.com/poisnoir/spine-go/internal/globals"
+	"github.com/poisnoir/spine-go/internal/jsonpayload"
+)
+
+func list(ctx context.Context, ns *spine.Namespace, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	timeout := fs.Duration("t", 2*time.Second, "how long to listen for endpoints")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	var endpoints []spine.Endpoint
+	var mu sync.Mutex
+	err := ns.Registry().Browse(ctx, func(e spine.Endpoint) {
+		mu.Lock()
+		endpoints = append(endpoints, e)
+		mu.Unlock()
+	})
+	if ctx.Err() == nil {
+		return err
+	}
+
+	slices.SortFunc(endpoints, func(a, b spine.Endpoint) int {
+		return cmp.Or(cmp.Compare(a.Type, b.Type), cmp.Compare(a.Name, b.Name))
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNAME\tNODE\tADDRESS")
+	nodes := make(map[string]int)
+	for _, e := range endpoints {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Type, e.Name, e.Node, e.Address)
+		if e.Node != "" {
+			nodes[e.Node]++
+		}
+	}
+	for _, node := range slices.Sorted(maps.Keys(nodes)) {
+		fmt.Fprintf(w, "node\t%s\t%d endpoints\t\n", node, nodes[node])
+	}
+	return w.Flush()
+}
+
+func info(ctx context.Context, ns *spine.Namespace, args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	timeout := fs.Duration("t", 5*time.Second, "how long to look for the endpoint")
+	name, err := parse(fs, args, "name")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	e, err := ns.Registry().Resolve(ctx, name)
+	if err != nil {
+		return fmt.Errorf("%s not found: %w", name, err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "name:\t%s\n", e.Name)
+	fmt.Fprintf(w, "type:\t%s\n", e.Type)
+	fmt.Fprintf(w, "address:\t%s\n", e.Address)
+	if e.Type == globals.ZERO_CONF_SERVICE {
+		fmt.Fprintf(w, "request code:\t%s\n", e.Code)
+		fmt.Fprintf(w, "response code:\t%s\n", e.ResponseCode)
+		if e.Schema != "" {
+			fmt.Fprintf(w, "request schema:\t%s\n", e.Schema)
+			fmt.Fprintf(w, "response schema:\t%s\n", e.ResponseSchema)
+		}
+	} else {
+		fmt.Fprintf(w, "code:\t%s\n", e.Code)
+		if e.Schema != "" {
+			fmt.Fprintf(w, "schema:\t%s\n", e.Schema)
+		}
+	}
+	if e.Compression != "" {
+		fmt.Fprintf(w, "compression:\t%s\n", e.Compression)
+	}
+	if e.Node != "" {
+		fmt.Fprintf(w, "node:\t%s (%s)\n", e.Node, e.NodeID)
+	}
+	return w.Flush()
+}
+
+// resolveTopic finds the publisher of topic
+func resolveTopic(ctx context.Context, ns *spine.Namespace, topic string) (spine.Endpoint, error) {
+	e, err := ns.Registry().Resolve(ctx, topic)
+	if err != nil {
+		return e, err
+	}
+	if e.Type != globals.ZERO_CONF_PUBLISHER {
+		return e, fmt.Errorf("%s is a %s, not a topic", topic, e.Type)
+	}
+	return e, nil
+}
+
+// decodeJSON returns payload of an endpoint with format as indented JSON
+func decodeJSON(format *jsonpayload.Format, payload []byte) (string, error) {
+	document, err := format.Decode(payload)
+	if err != nil {
+		return "", err
+	}
+	var text bytes.Buffer
+	if err := json.Indent(&text, document, "", "  "); err != nil {
+		return "", err
+	}
+	return text.String(), nil
+}
+
+func echo(ctx context.Context, ns *spine.Namespace, args []string) error {
+	fs := flag.NewFlagSet("echo", flag.ExitOnError)
+	count := fs.Int("c", 0, "exit after count messages")
+	raw := fs.Bool("x", false, "print payloads as hex even if the topic has a schema")
+	topic, err := parse(fs, args, "topic")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	e, err := resolveTopic(ctx, ns, topic)
+	if err != nil {
+		return err
+	}
+
+	// the schema is parsed once, topics without one are printed as hex
+	format, _ := jsonpayload.NewFormat(e.Code, e.Schema)
+
+	received := 0
+	sub, err := spine.NewRawSubscriber(ns, topic, e.Code, func(payload []byte, info spine.MessageInfo) {
+		fmt.Printf("seq: %d", info.Sequence)
+		if !info.SentAt.IsZero() {
+			fmt.Printf("  sent: %s", info.SentAt.Format(time.RFC3339Nano))
+		}
+		if info.PublisherNodeID != "" {
+			fmt.Printf("  node: %s", info.PublisherNodeID)
+		}
+		for k, v := range info.Headers {
+			fmt.Printf("  %s: %s", k, v)
+		}
+		var text string
+		if !*raw && format != nil {
+			if document, err := decodeJSON(format, payload); err == nil {
+				text = document + "\n"
+			}
+		}
+		if text == "" {
+			text = hex.Dump(payload)
+		}
+		fmt.Printf("\n%s---\n", text)
+
+		received++
+		if received == *count {
+			cancel()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Stop()
+
+	<-ctx.Done()
+	return nil
+}
+
+// hz measures the publish rate from the sequence numbers and send times the publisher stamps,
+// so messages replaced by newer ones before they were delivered still count
+func hz(ctx context.Context, ns *spine.Namespace, args []string) error {
+	fs := flag.NewFlagSet("hz", flag.ExitOnError)
+	window := fs.Int("w", 100, "number of messages the statistics are computed over")
+	topic, err := parse(fs, args, "topic")
+	if err != nil {
+		return err
+	}
+
+	type sample struct {
+		sequence uint64
+		sentAt   time.Time
+	}
+
+	var mu sync.Mutex
+	var samples []sample
+	delivered := 0
+
+	e, err := resolveTopic(ctx, ns, topic)
+	if err != nil {
+		return err
+	}
+
+	sub, err := spine.NewRawSubscriber(ns, topic, e.Code, func(_ []byte, info spine.MessageInfo) {
+		mu.Lock()
+		defer mu.Unlock()
+		samples = append(samples, sample{info.Sequence, info.SentAt})
+		if len(samples) > *window+1 {
+			samples = samples[1:]
+		}
+		delivered++
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Stop()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		mu.Lock()
+		// seconds per message between consecutive deliveries
+		var intervals []float64
+		published := uint64(0)
+		for i := 1; i < len(samples); i++ {
+			messages := samples[i].sequence - samples[i-1].sequence
+			if messages == 0 || samples[i].sequence < samples[i-1].sequence {
+				continue // the publisher restarted
+			}
+			published += messages
+			intervals = append(intervals, samples[i].sentAt.Sub(samples[i-1].sentAt).Seconds()/float64(messages))
+		}
+		span := 0.0
+		if len(samples) > 1 {
+			span = samples[len(samples)-1].sentAt.Sub(samples[0].sentAt).Seconds()
+		}
+		received := delivered
+		delivered = 0
+		mu.Unlock()
+
+		now := time.Now()
+		elapsed := now.Sub(last).Seconds()
+		last = now
+
+		if received == 0 || len(intervals) == 0 || span <= 0 {
+			fmt.Println("no new messages")
+			continue
+		}
+
+		mean := span / float64(published)
+		var variance float64
+		for _, d := range intervals {
+			variance += (d - mean) * (d - mean)
+		}
+		std := math.Sqrt(variance / float64(len(intervals)))
+
+		fmt.Printf("average rate: %.3f\n\tmin: %.3fs max: %.3fs std dev: %.5fs window: %d delivered: %.3f/s\n",
+			1/mean, slices.Min(intervals), slices.Max(intervals), std, published, float64(received)/elapsed)
+	}
+}
+
+func ping(ctx context.Context, ns *spine.Namespace, args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	count := fs.Int("c", 0, "exit after count pings")
+	interval := fs.Duration("i", time.Second, "time between pings")
+	service, err := parse(fs, args, "service")
+	if err != nil {
+		return err
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	pinger, err := spine.NewPinger(ns, service, connectCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer pinger.Close()
+
+	var rtts []time.Duration
+	defer func() {
+		if len(rtts) == 0 {
+			return
+		}
+		var sum time.Duration
+		for _, rtt := range rtts {
+			sum += rtt
+		}
+		fmt.Printf("--- %s ---\n%d pings, min/avg/max = %v/%v/%v\n",
+			service, len(rtts), slices.Min(rtts), sum/time.Duration(len(rtts)), slices.Max(rtts))
+	}()
+
+	for seq := 1; *count == 0 || seq <= *count; seq++ {
+		pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		rtt, err := pinger.Ping(pingCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("%s did not answer: %w", service, err)
+		}
+		rtts = append(rtts, rtt)
+		fmt.Printf("pong from %s: seq=%d time=%v\n", service, seq, rtt.Round(time.Microsecond))
+
+		if seq == *count {
+			break
+		}
+		select {
+		case <-time.After(*interval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// call encodes the JSON request with the schema the service advertises and prints the response as JSON
+func call(ctx context.Context, ns *spine.Namespace, args []string) error {
+	fs := flag.NewFlagSet("call", flag.ExitOnError)
+	timeout := fs.Duration("t", 10*time.Second, "how long to wait for the service and its response")
+	values, err := parseArgs(fs, args, "service", "json")
+	if err != nil {
+		return err
+	}
+	service, request := values[0], values[1]
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	e, err := ns.Registry().Resolve(ctx, service)
+	if err != nil {
+		return fmt.Errorf("%s not found: %w", service, err)
+	}
+	if e.Type != globals.ZERO_CONF_SERVICE {
+		return fmt.Errorf("%s is a %s, not a service", service, e.Type)
+	}
+	payload, err := jsonpayload.Encode(e.Code, e.Schema, []byte(request))
+	if err != nil {
+		return err
+	}
+
+	caller, err := spine.NewRawServiceCaller(ns, service, e.Code, e.ResponseCode)
+	if err != nil {
+		return err
+	}
+	defer caller.Close()
+
+	response, err := caller.Call(payload, ctx)
+	if err != nil {
+		return err
+	}
+	format, err := jsonpayload.NewFormat(e.ResponseCode, e.ResponseSchema)
+	if err != nil {
+		return err
+	}
+	text, err := decodeJSON(format, response)
+	if err != nil {
+		return err
+	}
+	fmt.Println(text)
+	return nil
+}
+
+// pub publishes a JSON message with the given schema on topic once, or at a rate until interrupted.
+// A topic has one publisher, so topics that are already published are refused.
+func pub(ctx context.Context, ns *spine.Namespace, args []string) error {
+	fs := flag.NewFlagSet("pub", flag.ExitOnError)
+	rate := fs.Float64("rate", 0, "messages per second, 0 publishes once")
+	count := fs.Int("c", 0, "exit after count messages when publishing at a rate")
+	schemaText := fs.String("schema", "", "schema of the topic")
+	wait := fs.Duration("w", 2*time.Second, "how long subscribers get to connect before the first message")
+	values, err := parseArgs(fs, args, "topic", "json")
+	if err != nil {
+		return err
+	}
+	topic, message := values[0], values[1]
+
+	if *schemaText == "" {
+		return fmt.Errorf("no schema given for %s", topic)
+	}
+	schema, err := spine.ParseSchema(*schemaText)
+	if err != nil {
+		return err
+	}
+	payload, err := jsonpayload.Encode(schema.Code(), *schemaText, []byte(message))
+	if err != nil {
+		return err
+	}
+
+	resolveCtx, cancel := context.WithTimeout(ctx, time.Second)
+	_, err = ns.Registry().Resolve(resolveCtx, topic)
+	cancel()
+	if err == nil {
+		return fmt.Errorf("%s is taken by another endpoint", topic)
+	}
+
+	publisher, err := spine.NewRawPublisher(ns, topic, schema.Code(), spine.WithSchema(schema))
+	if err != nil {
+		return err
+	}
+	defer publisher.Close()
+
+	select {
+	case <-time.After(*wait):
+	case <-ctx.Done():
+		return nil
+	}
+
+	var next <-chan time.Time
+	if *rate <= 0 {
+		*count = 1
+	} else {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		next = ticker.C
+	}
+
+	for sent := 1; ; sent++ {
+		publisher.Publish(payload)
+		if sent == *count {
+			break
+		}
+		select {
+		case <-next:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	// give the last message time to leave before the publisher closes
+	select {
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// spine inspects a live namespace and calls services or publishes from JSON.
+//
+//	spine [-n namespace] [-s secret] <command> [arguments]
+//
+// The namespace and secret default to SPINE_NAMESPACE and SPINE_SECRET.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/poisnoir/spine-go"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, ns *spine.Namespace, args []string) error
+}
+
+var commands = map[string]command{
+	"list": {"list [-t timeout]", list},
+	"info": {"info [-t timeout] <name>", info},
+	"echo": {"echo [-c count] [-x] <topic>", echo},
+	"hz":   {"hz [-w window] <topic>", hz},
+	"ping": {"ping [-c count] [-i interval] <service>", ping},
+	"call": {"call [-t timeout] <service> <json>", call},
+	"pub":  {"pub [-rate hz] [-c count] -schema schema <topic> <json>", pub},
+}
+
+var commandOrder = []string{"list", "info", "echo", "hz", "ping", "call", "pub"}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: spine [-n namespace] [-s secret] [-v] <command> [arguments]\n\ncommands:\n")
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	flag.PrintDefaults()
+}
+
+func main() {
+	namespace := flag.String("n", os.Getenv("SPINE_NAMESPACE"), "namespace to join")
+	secret := flag.String("s", os.Getenv("SPINE_SECRET"), "secret of the namespace")
+	verbose := flag.Bool("v", false, "log what the namespace does")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 || *namespace == "" {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "spine: unknown command %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	var handler slog.Handler = slog.NewTextHandler(io.Discard, nil)
+	if *verbose {
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	}
+
+	ns, err := spine.JointNamespace(*namespace, *secret, slog.New(handler))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "spine: %v\n", err)
+		os.Exit(1)
+	}
+	defer ns.Disconnect()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := cmd.run(ctx, ns, flag.Args()[1:]); err != nil && ctx.Err() == nil {
+		fmt.Fprintf(os.Stderr, "spine %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// parse parses the flags of a command and returns its single positional argument
+func parse(fs *flag.FlagSet, args []string, name string) (string, error) {
+	values, err := parseArgs(fs, args, name)
+	if err != nil {
+		return "", err
+	}
+	return values[0], nil
+}
+
+// parseArgs parses the flags of a command, which may come before or after its positional arguments,
+// and returns one positional argument per name
+func parseArgs(fs *flag.FlagSet, args []string, names ...string) ([]string, error) {
+	var values []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		values = append(values, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(values) != len(names) {
+		return nil, fmt.Errorf("expected %s", strings.Join(names, " and "))
+	}
+	return values, nil
+}
@@ -0,0 +1,148 @@
+package spine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/poisnoir/mad-go"
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+// Codec encodes the data of an endpoint. Code identifies the codec and the type,
+// both sides of a handshake must have the same code.
+type Codec[T any] interface {
+	Code() string
+	Encode(data *T, buf []byte) error
+	Decode(buf []byte, data *T) error
+	// Size is the number of bytes Encode writes
+	Size(data *T) int
+}
+
+// WithCodec encodes the endpoint's data of type T with codec instead of mad.
+// Services take one codec for their input and one for their output if the types differ.
+func WithCodec[T any](codec Codec[T]) Option {
+	return func(o *endpointOptions) {
+		o.codecs = append(o.codecs, codec)
+	}
+}
+
+// codecOf returns the codec of T given WithCodec, mad by default
+func codecOf[T any](o endpointOptions) (Codec[T], error) {
+	for _, c := range o.codecs {
+		if codec, ok := c.(Codec[T]); ok {
+			return codec, nil
+		}
+	}
+	return MadCodec[T]()
+}
+
+// checkCodecs returns an error if a codec given WithCodec encodes neither K nor V
+func checkCodecs[K any, V any](o endpointOptions) error {
+	for _, c := range o.codecs {
+		_, key := c.(Codec[K])
+		_, value := c.(Codec[V])
+		if !key && !value {
+			return fmt.Errorf("codec %T does not encode %v or %v", c, reflect.TypeFor[K](), reflect.TypeFor[V]())
+		}
+	}
+	return nil
+}
+
+// madSchema returns the schema of T if codec is mad, schemas describe mad encodings only
+func madSchema[T any](codec Codec[T]) *Schema {
+	if _, ok := codec.(madCodec[T]); !ok {
+		return nil
+	}
+	schema, _ := SchemaOf[T]()
+	return schema
+}
+
+// MadCodec returns the default codec, its code is the mad type code of T
+func MadCodec[T any]() (Codec[T], error) {
+	m, err := mad.NewMad[T]()
+	if err != nil {
+		return nil, err
+	}
+	return madCodec[T]{m}, nil
+}
+
+type madCodec[T any] struct {
+	*mad.Mad[T]
+}
+
+func (c madCodec[T]) Size(data *T) int {
+	return c.GetRequiredSize(data)
+}
+
+// JSONCodec encodes T with encoding/json, its code is "json" so it only checks
+// that both sides use JSON
+func JSONCodec[T any]() Codec[T] {
+	return jsonCodec[T]{}
+}
+
+type jsonCodec[T any] struct{}
+
+func (jsonCodec[T]) Code() string {
+	return "json"
+}
+
+func (jsonCodec[T]) Encode(data *T, buf []byte) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if len(buf) < len(encoded) {
+		return fmt.Errorf(globals.ERROR_PAYLOAD_SIZE)
+	}
+	copy(buf, encoded)
+	return nil
+}
+
+func (jsonCodec[T]) Decode(buf []byte, data *T) error {
+	var decoded T
+	if err := json.Unmarshal(buf, &decoded); err != nil {
+		return err
+	}
+	*data = decoded
+	return nil
+}
+
+// Size encodes data, Encode returns the error if it cannot be encoded
+func (jsonCodec[T]) Size(data *T) int {
+	encoded, _ := json.Marshal(data)
+	return len(encoded)
+}
+
+// RawCodec passes already encoded payloads through, code identifies their format
+// (for example a mad type code or "protobuf:robot.Status").
+// A payload must not be modified after it was published.
+func RawCodec(code string) Codec[[]byte] {
+	return rawCodec{code: code}
+}
+
+type rawCodec struct {
+	code string
+}
+
+func (r rawCodec) Code() string {
+	return r.code
+}
+
+func (rawCodec) Encode(data *[]byte, buf []byte) error {
+	if len(buf) < len(*data) {
+		return fmt.Errorf(globals.ERROR_PAYLOAD_SIZE)
+	}
+	copy(buf, *data)
+	return nil
+}
+
+func (rawCodec) Decode(buf []byte, data *[]byte) error {
+	*data = bytes.Clone(buf)
+	return nil
+}
+
+func (rawCodec) Size(data *[]byte) int {
+	return len(*data)
+}
@@ -0,0 +1,115 @@
+package spine
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jsonOrder has a map, which mad cannot encode
+type jsonOrder struct {
+	Item   string           `json:"item"`
+	Extras map[string]int32 `json:"extras"`
+}
+
+func TestJSONCodec(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_codec", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	_, err = NewService(ns, "order", func(o jsonOrder) (int32, error) {
+		return o.Extras["sugar"], nil
+	}, WithCodec(JSONCodec[jsonOrder]()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := NewServiceCaller[jsonOrder, int32](ns, "order", WithCodec(JSONCodec[jsonOrder]()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sugar, err := caller.Call(jsonOrder{Item: "tea", Extras: map[string]int32{"sugar": 2}}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sugar != 2 {
+		t.Errorf("expected 2, got %d", sugar)
+	}
+
+	endpoint, err := ns.Registry().Resolve(ctx, "order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Code != "json" || endpoint.Schema != "" || endpoint.ResponseCode != "2" || endpoint.ResponseSchema != "i32" {
+		t.Errorf("unexpected advertisement %+v", endpoint)
+	}
+
+	// a mad caller of the same name fails the handshake instead of misreading JSON
+	madCaller, err := NewServiceCaller[string, int32](ns, "order")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer madCaller.Close()
+
+	shortCtx, shortCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer shortCancel()
+	if _, err := madCaller.Call("tea", shortCtx); err == nil {
+		t.Error("expected the mad caller to be rejected")
+	}
+}
+
+func TestJSONCodec_EncodeError(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_codec_error", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	// JSON has no NaN, the response cannot be encoded
+	_, err = NewService(ns, "ratio", func(int32) (float64, error) {
+		return math.NaN(), nil
+	}, WithCodec(JSONCodec[float64]()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := NewServiceCaller[int32, float64](ns, "ratio", WithCodec(JSONCodec[float64]()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the service reports the failure instead of sending an empty response
+	if _, err := caller.Call(1, ctx); err == nil || !strings.HasPrefix(err.Error(), "call error") {
+		t.Errorf("expected a serializer error, got %v", err)
+	}
+}
+
+func TestWithCodec_WrongType(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_codec_type", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	if _, err := NewPublisher[int32](ns, "numbers", WithCodec(JSONCodec[string]())); err == nil {
+		t.Error("expected a codec of another type to be rejected")
+	}
+}
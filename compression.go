@@ -0,0 +1,149 @@
+package spine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+// Compression is an algorithm payloads are compressed with
+type Compression string
+
+const (
+	CompressionZstd Compression = "zstd"
+	CompressionLZ4  Compression = "lz4"
+	// CompressionSnappy is the snappy block format
+	CompressionSnappy Compression = "snappy"
+)
+
+// DefaultCompressionThreshold is the payload size compression starts at when WithCompression is given no threshold
+const DefaultCompressionThreshold = 512
+
+// supported compressions, the id sent in frame headers is the index plus one
+var compressions = []Compression{CompressionZstd, CompressionLZ4, CompressionSnappy}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(uint64(globals.MAX_DECOMPRESSED_SIZE)))
+)
+
+// WithCompression compresses the payloads a publisher sends or a service responds with using compression,
+// once they are at least threshold bytes (DefaultCompressionThreshold if threshold is 0).
+// Compression is only used with peers that accept it during the handshake and only when it makes the payload smaller.
+// A compressed payload has to fit in a packet, the uncompressed one does not.
+func WithCompression(compression Compression, threshold int) Option {
+	return func(o *endpointOptions) {
+		o.compression = compression
+		o.compressionThreshold = threshold
+		if threshold <= 0 {
+			o.compressionThreshold = DefaultCompressionThreshold
+		}
+	}
+}
+
+func (c Compression) id() uint8 {
+	return uint8(slices.Index(compressions, c) + 1)
+}
+
+func (c Compression) valid() bool {
+	return c == "" || slices.Contains(compressions, c)
+}
+
+// acceptedCompressions is the handshake value listing every compression this endpoint decompresses
+func acceptedCompressions() string {
+	names := make([]string, len(compressions))
+	for i, c := range compressions {
+		names[i] = string(c)
+	}
+	return strings.Join(names, ",")
+}
+
+// accepts reports whether the compressions a peer listed in its handshake contain c
+func accepts(accepted []byte, c Compression) bool {
+	for name := range strings.SplitSeq(string(accepted), ",") {
+		if name == string(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// compress appends the compressed src to dst
+func (c Compression) compress(dst []byte, src []byte) ([]byte, error) {
+	switch c {
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(src, dst), nil
+
+	case CompressionLZ4:
+		// lz4 blocks don't record their size
+		block := make([]byte, 4+lz4.CompressBlockBound(len(src)))
+		binary.BigEndian.PutUint32(block, uint32(len(src)))
+		n, err := lz4.CompressBlock(src, block[4:], nil)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("lz4: payload is incompressible")
+		}
+		return append(dst, block[:4+n]...), nil
+
+	case CompressionSnappy:
+		return append(dst, s2.EncodeSnappy(nil, src)...), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", c)
+}
+
+// decompress returns src decompressed with the compression whose id is id
+func decompress(id uint8, src []byte) ([]byte, error) {
+	if id == 0 || int(id) > len(compressions) {
+		return nil, fmt.Errorf("unknown compression %d", id)
+	}
+
+	switch compressions[id-1] {
+	case CompressionZstd:
+		return zstdDecoder.DecodeAll(src, nil)
+
+	case CompressionLZ4:
+		if len(src) < 4 {
+			return nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+		}
+		size := int(binary.BigEndian.Uint32(src))
+		if size > globals.MAX_DECOMPRESSED_SIZE {
+			return nil, fmt.Errorf("lz4: payload of %d bytes is too large", size)
+		}
+		dst := make([]byte, size)
+		n, err := lz4.UncompressBlock(src[4:], dst)
+		if err != nil {
+			return nil, err
+		}
+		return dst[:n], nil
+
+	default:
+		size, err := s2.DecodedLen(src)
+		if err != nil {
+			return nil, err
+		}
+		if size > globals.MAX_DECOMPRESSED_SIZE {
+			return nil, fmt.Errorf("snappy: payload of %d bytes is too large", size)
+		}
+		return s2.Decode(nil, src)
+	}
+}
+
+// compressPayload returns the payload to send and the id of its compression, 0 if it is sent as is
+func compressPayload(compression Compression, threshold int, payload []byte) ([]byte, uint8) {
+	if compression == "" || len(payload) < threshold {
+		return payload, 0
+	}
+	compressed, err := compression.compress(nil, payload)
+	if err != nil || len(compressed) >= len(payload) {
+		return payload, 0
+	}
+	return compressed, compression.id()
+}
@@ -0,0 +1,131 @@
+package spine
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestCompression_RoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("spine "), 1000)
+
+	for _, c := range compressions {
+		compressed, id := compressPayload(c, DefaultCompressionThreshold, payload)
+		if id == 0 || len(compressed) >= len(payload) {
+			t.Fatalf("%s: payload was not compressed", c)
+		}
+		decompressed, err := decompress(id, compressed)
+		if err != nil {
+			t.Fatalf("%s: %v", c, err)
+		}
+		if !bytes.Equal(decompressed, payload) {
+			t.Fatalf("%s: payload changed", c)
+		}
+	}
+
+	// payloads under the threshold are sent as they are
+	if _, id := compressPayload(CompressionZstd, DefaultCompressionThreshold, payload[:100]); id != 0 {
+		t.Error("expected a small payload to stay uncompressed")
+	}
+}
+
+// scan is larger than a packet but compresses well
+type scan struct {
+	Ranges [2000]float32
+}
+
+func TestCompression_PubSub(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_compression", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	if _, err := NewPublisher[scan](ns, "bad", WithCompression("gzip", 0)); err == nil {
+		t.Error("expected an unknown compression to be rejected")
+	}
+
+	pub, err := NewPublisher[scan](ns, "scan", WithCompression(CompressionZstd, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	received := make(chan scan, 10)
+	sub, err := NewSubscriber(ns, "scan", func(s scan) { received <- s })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	endpoint, err := ns.Registry().Resolve(ctx, "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Compression != string(CompressionZstd) {
+		t.Errorf("advertised compression %q", endpoint.Compression)
+	}
+
+	var message scan
+	for i := range message.Ranges {
+		message.Ranges[i] = 1.5
+	}
+
+	for {
+		pub.Publish(message)
+		select {
+		case s := <-received:
+			if s != message {
+				t.Error("unexpected message")
+			}
+			return
+		case <-ctx.Done():
+			t.Fatal("no message received")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestCompression_Service(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_compression_service", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	_, err = NewService(ns, "scan", func(value float32) (scan, error) {
+		var s scan
+		for i := range s.Ranges {
+			s.Ranges[i] = value
+		}
+		return s, nil
+	}, WithCompression(CompressionLZ4, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := NewServiceCaller[float32, scan](ns, "scan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := caller.Call(2, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Ranges[0] != 2 || s.Ranges[len(s.Ranges)-1] != 2 {
+		t.Errorf("unexpected response %v", s.Ranges[:4])
+	}
+}
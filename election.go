@@ -0,0 +1,526 @@
+package spine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+// ErrNotLeader is returned by calls to a service whose candidate does not lead its election
+var ErrNotLeader = errors.New(globals.ERROR_NOT_LEADER)
+
+// infix of the services the candidates of an election heartbeat each other through
+const candidatesInfix = "/candidates/"
+
+// Election picks one leader among the candidates that elect the same name in a namespace.
+//
+// Candidates find each other through zeroconf and heartbeat each other a few times per lease. The leader holds a
+// lease it renews with every heartbeat, a candidate takes over once it hasn't heard from a leader for a lease and
+// no live candidate with a smaller id is there to do it. A leader whose lease ran out, for example because its
+// process was paused, stops leading before any other candidate can take over.
+//
+// Every leader gets a fencing token larger than the tokens of the leaders its candidate has seen. A token holds the
+// term of the leadership in its upper 32 bits and a hash of the candidate id in its lower 32 bits, so two candidates
+// that take over at once get different tokens.
+//
+// The leader renews its lease on its own, no majority grants it. The lease only bounds how long a leader acts while
+// it is not running, it does not stop split brain: candidates that can't reach each other both lead until they hear
+// from each other, then the one with the older token steps down. Whatever the leader drives should therefore reject
+// tokens older than the newest one it has seen, which keeps the former leader out once the new one has acted.
+type Election struct {
+	namespace *Namespace
+	name      string
+	id        string
+	lease     time.Duration
+	logger    *slog.Logger
+
+	onAcquired func(token uint64)
+	onLost     func(token uint64)
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	service *ThreadedService[electionMessage, electionMessage]
+
+	mu      sync.Mutex
+	closed  bool
+	peers   map[string]*electionPeer
+	started time.Time
+	leading bool
+	// expiry of the lease while the candidate leads
+	expiry time.Time
+	// leader followed and its token, or the candidate and its token while it leads
+	leader     string
+	token      uint64
+	leaderSeen time.Time
+	// largest token seen, the next leader takes a token of the following term
+	maxToken uint64
+
+	// leadership the observers were told about, the services of the election advertise themselves while it is held.
+	// version counts its changes.
+	notified      bool
+	notifiedToken uint64
+	version       uint64
+	observers     map[int]*electionObserver
+	nextObserver  int
+
+	// notifyMu keeps the callbacks in order
+	notifyMu sync.Mutex
+}
+
+// electionObserver is told about the changes of the leadership in order, a change older than the last one it was
+// told about is dropped
+type electionObserver struct {
+	mu        sync.Mutex
+	version   uint64
+	advertise func(leading bool, token uint64)
+}
+
+func (o *electionObserver) update(version uint64, leading bool, token uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if version < o.version {
+		return
+	}
+	o.version = version
+	o.advertise(leading, token)
+}
+
+type electionPeer struct {
+	caller *ServiceCaller[electionMessage, electionMessage]
+	// last time the peer was heard from
+	seen time.Time
+	busy atomic.Bool
+}
+
+// electionMessage is the state a candidate heartbeats its peers with and answers their heartbeats with
+type electionMessage struct {
+	Candidate string `json:"candidate"`
+	Leading   bool   `json:"leading,omitempty"`
+	// Token is the leader's token while the candidate leads, the largest token it has seen otherwise
+	Token uint64 `json:"token"`
+	// Resigned is sent by a candidate that closes so its peers don't wait for its lease to run out
+	Resigned bool `json:"resigned,omitempty"`
+}
+
+// ElectionOption configures an election when it is joined
+type ElectionOption func(*electionOptions)
+
+type electionOptions struct {
+	lease      time.Duration
+	onAcquired func(token uint64)
+	onLost     func(token uint64)
+}
+
+// WithLease sets how long a leader leads without renewing its lease, 3s unless set.
+// Candidates heartbeat each other four times per lease.
+func WithLease(lease time.Duration) ElectionOption {
+	return func(o *electionOptions) {
+		o.lease = lease
+	}
+}
+
+// WithAcquired is called with the fencing token when the candidate becomes the leader
+func WithAcquired(onAcquired func(token uint64)) ElectionOption {
+	return func(o *electionOptions) {
+		o.onAcquired = onAcquired
+	}
+}
+
+// WithLost is called with the fencing token of the leadership the candidate lost
+func WithLost(onLost func(token uint64)) ElectionOption {
+	return func(o *electionOptions) {
+		o.onLost = onLost
+	}
+}
+
+// Elect joins the election of name as candidateID, which must be unique among its candidates.
+// The candidate waits a lease to find the others before it may lead.
+func Elect(namespace *Namespace, name string, candidateID string, opts ...ElectionOption) (*Election, error) {
+	options := electionOptions{lease: 3 * time.Second}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.lease <= 0 {
+		return nil, fmt.Errorf("invalid lease %s", options.lease)
+	}
+	if candidateID == "" || strings.ContainsAny(candidateID, "/~") {
+		return nil, fmt.Errorf("invalid candidate id %q", candidateID)
+	}
+
+	name, err := namespace.resolveName(name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join election: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(namespace.ctx)
+	now := time.Now()
+	e := &Election{
+		namespace: namespace,
+		name:      name,
+		id:        candidateID,
+		lease:     options.lease,
+		logger:    namespace.logger.With("election", name, "candidate", candidateID),
+
+		onAcquired: options.onAcquired,
+		onLost:     options.onLost,
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		peers:      make(map[string]*electionPeer),
+		started:    now,
+		leaderSeen: now,
+		observers:  make(map[int]*electionObserver),
+	}
+
+	e.service, err = NewThreadedService(namespace, e.candidateService(candidateID), e.handleHeartbeat,
+		WithCodec(JSONCodec[electionMessage]()), WithCodec(JSONCodec[electionMessage]()))
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to join election: %v", err)
+	}
+
+	go e.discover()
+	go e.run()
+	return e, nil
+}
+
+// candidateService is the global name of the heartbeat service of a candidate
+func (e *Election) candidateService(id string) string {
+	return "/" + e.name + candidatesInfix + id
+}
+
+func (e *Election) Name() string {
+	return e.name
+}
+
+func (e *Election) ID() string {
+	return e.id
+}
+
+// IsLeader reports whether the candidate leads and its lease has not run out
+func (e *Election) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading && time.Now().Before(e.expiry)
+}
+
+// Leader returns the leader the candidate knows about and its fencing token, an empty id if there is none
+func (e *Election) Leader() (string, uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leading || (e.leader != "" && time.Since(e.leaderSeen) < e.lease) {
+		return e.leader, e.token
+	}
+	return "", 0
+}
+
+// leadership reports whether the candidate leads and the token of its leadership
+func (e *Election) leadership() (bool, uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leading && time.Now().Before(e.expiry), e.token
+}
+
+// leads reports whether an endpoint of the election may serve, endpoints without an election always may
+func (e *Election) leads() bool {
+	return e == nil || e.IsLeader()
+}
+
+// Close leaves the election. A leader loses its leadership and its peers take over without waiting for its lease.
+func (e *Election) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	e.leading = false
+	e.leader = ""
+	message := e.message()
+	message.Resigned = true
+	peers := make([]*electionPeer, 0, len(e.peers))
+	for _, peer := range e.peers {
+		peers = append(peers, peer)
+	}
+	e.mu.Unlock()
+	e.notify()
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), e.lease/4)
+			defer cancel()
+			peer.caller.Call(message, ctx)
+		}()
+	}
+	wg.Wait()
+
+	e.cancel()
+	e.service.Close()
+	for _, peer := range peers {
+		peer.caller.Close()
+	}
+}
+
+// observe calls advertise with whether the candidate leads now and its token, and again whenever that changes,
+// until stop is called. advertise registers with zeroconf, so it is called without e.mu held and may still be
+// called once after stop.
+func (e *Election) observe(advertise func(leading bool, token uint64)) (stop func()) {
+	o := &electionObserver{advertise: advertise}
+	e.mu.Lock()
+	id := e.nextObserver
+	e.nextObserver++
+	e.observers[id] = o
+	version, leading, token := e.version, e.notified, e.notifiedToken
+	e.mu.Unlock()
+	o.update(version, leading, token)
+
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.observers, id)
+	}
+}
+
+// notify tells the observers and the callbacks about leadership they haven't seen yet
+func (e *Election) notify() {
+	e.notifyMu.Lock()
+	defer e.notifyMu.Unlock()
+
+	e.mu.Lock()
+	var lost, acquired uint64
+	if e.notified && (!e.leading || e.token != e.notifiedToken) {
+		e.notified, lost = false, e.notifiedToken
+		e.version++
+	}
+	lostVersion := e.version
+	if e.leading && !e.notified {
+		e.notified, e.notifiedToken, acquired = true, e.token, e.token
+		e.version++
+	}
+	acquiredVersion := e.version
+	observers := slices.Collect(maps.Values(e.observers))
+	e.mu.Unlock()
+
+	// tokens are never 0
+	if lost != 0 {
+		for _, o := range observers {
+			o.update(lostVersion, false, lost)
+		}
+		e.logger.Info("lost leadership", "token", lost)
+		if e.onLost != nil {
+			e.onLost(lost)
+		}
+	}
+	if acquired != 0 {
+		for _, o := range observers {
+			o.update(acquiredVersion, true, acquired)
+		}
+		e.logger.Info("acquired leadership", "token", acquired)
+		if e.onAcquired != nil {
+			e.onAcquired(acquired)
+		}
+	}
+}
+
+func (e *Election) run() {
+	ticker := time.NewTicker(e.lease / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.tick()
+		}
+	}
+}
+
+// tick renews or drops the lease of a leader, lets a follower take over and heartbeats the peers
+func (e *Election) tick() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if e.leading {
+		if now.After(e.expiry) {
+			// the candidate was not running for a lease, another one may lead by now
+			e.logger.Warn("lease ran out", "token", e.token)
+			e.leading = false
+			e.leaderSeen = now
+		} else {
+			e.expiry = now.Add(e.lease)
+		}
+	}
+	if !e.leading && e.canLead(now) {
+		e.maxToken = electionToken(tokenTerm(e.maxToken)+1, e.id)
+		e.leading, e.leader, e.token = true, e.id, e.maxToken
+		e.expiry = now.Add(e.lease)
+	}
+
+	message := e.message()
+	peers := make([]*electionPeer, 0, len(e.peers))
+	for _, peer := range e.peers {
+		peers = append(peers, peer)
+	}
+	e.mu.Unlock()
+
+	e.notify()
+	for _, peer := range peers {
+		// a peer that doesn't answer gets one heartbeat at a time
+		if peer.busy.CompareAndSwap(false, true) {
+			go e.heartbeat(peer, message)
+		}
+	}
+}
+
+// electionToken is the token of candidateID leading in term
+func electionToken(term uint64, candidateID string) uint64 {
+	h := fnv.New32a()
+	h.Write([]byte(candidateID))
+	return term<<32 | uint64(h.Sum32())
+}
+
+// tokenTerm is the term of an election token
+func tokenTerm(token uint64) uint64 {
+	return token >> 32
+}
+
+// canLead reports whether no leader was heard from for a lease and no live peer with a smaller id may take over
+func (e *Election) canLead(now time.Time) bool {
+	if now.Sub(e.started) < e.lease || (e.leader != "" && now.Sub(e.leaderSeen) < e.lease) {
+		return false
+	}
+	for id, peer := range e.peers {
+		if id < e.id && now.Sub(peer.seen) < e.lease {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Election) message() electionMessage {
+	if e.leading {
+		return electionMessage{Candidate: e.id, Leading: true, Token: e.token}
+	}
+	return electionMessage{Candidate: e.id, Token: e.maxToken}
+}
+
+func (e *Election) heartbeat(peer *electionPeer, message electionMessage) {
+	defer peer.busy.Store(false)
+
+	ctx, cancel := context.WithTimeout(e.ctx, e.lease/4)
+	defer cancel()
+	answer, err := peer.caller.Call(message, ctx)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	e.receive(answer)
+	e.mu.Unlock()
+}
+
+func (e *Election) handleHeartbeat(message electionMessage) (electionMessage, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.receive(message)
+	return e.message(), nil
+}
+
+// receive updates the state of the candidate with the state of a peer, e.mu must be held
+func (e *Election) receive(message electionMessage) {
+	if message.Candidate == e.id || e.closed {
+		return
+	}
+	now := time.Now()
+	e.maxToken = max(e.maxToken, message.Token)
+
+	if message.Resigned {
+		if peer, ok := e.peers[message.Candidate]; ok {
+			peer.caller.Close()
+			delete(e.peers, message.Candidate)
+		}
+		if e.leader == message.Candidate {
+			e.leader = ""
+		}
+		return
+	}
+	if peer := e.addPeer(message.Candidate); peer != nil {
+		peer.seen = now
+	}
+
+	// a leader with an older token than the one the candidate knows is stale, whether the candidate leads or follows
+	if !message.Leading || message.Token < e.token {
+		return
+	}
+	if e.leading {
+		// of two leaders the newer one stays, the other one steps down when it hears from it
+		if message.Token == e.token && message.Candidate > e.id {
+			return
+		}
+		e.logger.Warn("stepping down for another leader", "leader", message.Candidate, "token", message.Token)
+		e.leading = false
+	}
+	e.leader, e.token, e.leaderSeen = message.Candidate, message.Token, now
+}
+
+// addPeer returns the peer with id, creating it the first time, or nil if id can't be a candidate. e.mu must be held.
+func (e *Election) addPeer(id string) *electionPeer {
+	if peer, ok := e.peers[id]; ok {
+		return peer
+	}
+	if id == "" || strings.ContainsAny(id, "/~") {
+		return nil
+	}
+	if electionToken(0, id) == electionToken(0, e.id) {
+		e.logger.Error("candidates have tokens that only differ in their term, one of them should be renamed", "peer", id)
+	}
+	caller, err := NewServiceCaller[electionMessage, electionMessage](e.namespace, e.candidateService(id),
+		WithCodec(JSONCodec[electionMessage]()), WithCodec(JSONCodec[electionMessage]()))
+	if err != nil {
+		e.logger.Error("unable to call candidate", "peer", id, "error", err)
+		return nil
+	}
+	peer := &electionPeer{caller: caller}
+	e.peers[id] = peer
+	return peer
+}
+
+// discover adds the candidates found in the namespace as peers
+func (e *Election) discover() {
+	prefix := e.name + candidatesInfix
+	err := e.namespace.reg.Browse(e.ctx, func(endpoint Endpoint) {
+		id, ok := strings.CutPrefix(endpoint.Name, prefix)
+		if !ok || id == e.id {
+			return
+		}
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.closed {
+			return
+		}
+		// a candidate counts as live until it had a lease to answer, so it gets to lead first if its id is smaller
+		if peer := e.addPeer(id); peer != nil && peer.seen.IsZero() {
+			peer.seen = time.Now()
+		}
+	})
+	if err != nil && e.ctx.Err() == nil {
+		e.logger.Error("unable to discover candidates", "error", err)
+	}
+}
@@ -0,0 +1,143 @@
+package spine
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestElection(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+	type candidate struct {
+		election *Election
+		service  *Service[uint8, string]
+		acquired chan uint64
+		lost     chan uint64
+	}
+	candidates := make(map[string]*candidate)
+	for _, id := range []string{"a", "b"} {
+		ns, err := JointNamespace("test_election", "secret", logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ns.Disconnect()
+
+		c := &candidate{acquired: make(chan uint64, 1), lost: make(chan uint64, 1)}
+		c.election, err = Elect(ns, "motor_driver", id, WithLease(400*time.Millisecond),
+			WithAcquired(func(token uint64) { c.acquired <- token }),
+			WithLost(func(token uint64) { c.lost <- token }))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.election.Close()
+
+		c.service, err = NewService(ns, "motor_driver", func(uint8) (string, error) { return id, nil }, WithElection(c.election))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.service.Close()
+		candidates[id] = c
+	}
+
+	var leader, standby *candidate
+	var token uint64
+	select {
+	case token = <-candidates["a"].acquired:
+		leader, standby = candidates["a"], candidates["b"]
+	case token = <-candidates["b"].acquired:
+		leader, standby = candidates["b"], candidates["a"]
+	case <-time.After(5 * time.Second):
+		t.Fatal("no candidate was elected")
+	}
+	// heartbeats reach the standby within a lease
+	time.Sleep(200 * time.Millisecond)
+	if standby.election.IsLeader() {
+		t.Fatal("both candidates lead")
+	}
+	if id, leaderToken := standby.election.Leader(); id != leader.election.ID() || leaderToken != token {
+		t.Errorf("standby follows %s with token %d, expected %s with %d", id, leaderToken, leader.election.ID(), token)
+	}
+
+	callerNs, err := JointNamespace("test_election", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer callerNs.Disconnect()
+	caller, err := NewServiceCaller[uint8, string](callerNs, "motor_driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	// call retries until id answers
+	call := func(id string) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			answer, err := caller.Call(0, ctx)
+			cancel()
+			if err == nil && answer == id {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("%s never answered", id)
+	}
+	call(leader.election.ID())
+
+	leader.election.Close()
+	if lost := <-leader.lost; lost != token {
+		t.Errorf("expected to lose token %d, lost %d", token, lost)
+	}
+	select {
+	case next := <-standby.acquired:
+		if next <= token {
+			t.Errorf("expected a token after %d, got %d", token, next)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the standby did not take over")
+	}
+	call(standby.election.ID())
+}
+
+func TestElection_StaleLeader(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_election_stale", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	// the candidate doesn't lead itself within its first lease
+	election, err := Elect(ns, "gripper", "c", WithLease(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer election.Close()
+
+	token := electionToken(3, "b")
+	election.handleHeartbeat(electionMessage{Candidate: "b", Leading: true, Token: token})
+	if id, leaderToken := election.Leader(); id != "b" || leaderToken != token {
+		t.Fatalf("expected to follow b with token %d, follows %s with %d", token, id, leaderToken)
+	}
+
+	// a leader of an older term that hasn't stepped down yet is ignored
+	election.handleHeartbeat(electionMessage{Candidate: "a", Leading: true, Token: electionToken(2, "a")})
+	if id, leaderToken := election.Leader(); id != "b" || leaderToken != token {
+		t.Errorf("expected to keep following b with token %d, follows %s with %d", token, id, leaderToken)
+	}
+}
+
+func TestElectionToken(t *testing.T) {
+	a, b := electionToken(2, "a"), electionToken(2, "b")
+	if a == b {
+		t.Errorf("expected candidates taking over in one term to get different tokens, both got %d", a)
+	}
+	if next := electionToken(3, "a"); next <= max(a, b) || tokenTerm(next) != 3 {
+		t.Errorf("expected the token %d of the next term to be larger than %d and %d", next, a, b)
+	}
+}
@@ -13,7 +13,7 @@ func main() {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
 	ns, _ := spine.JointNamespace("example", "meow", logger)
 
-	ctx, _ := context.WithCancel(context.Background())
+	ctx := context.Background()
 
 	// will error if types are mismatched
 	c, _ := spine.NewServiceCaller[string, string](ns, "print")
@@ -0,0 +1,473 @@
+package spine
+
+import (
+	"cmp"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filters are boolean expressions over the fields of a message, for example
+//
+//	robot_id == 3 && (battery.level < 0.2 || status != "ok") && !joints[2].blocked
+//
+// Paths name struct fields, ignoring case and underscores, and index arrays.
+// Numbers, strings and booleans compare with ==, !=, <, <=, > and >=, a boolean field can be used on its own.
+
+// WithFilter makes a subscriber receive only messages matching expr.
+// The publisher evaluates the filter and never sends messages that don't match.
+func WithFilter(expr string) Option {
+	return func(o *endpointOptions) {
+		o.filter = expr
+	}
+}
+
+type filter struct {
+	expr string
+	eval func(reflect.Value) bool
+}
+
+func (f *filter) match(v reflect.Value) bool {
+	return f == nil || f.eval(v)
+}
+
+// compileFilter type checks expr against typ
+func compileFilter(expr string, typ reflect.Type) (*filter, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens, typ: typ}
+	eval, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEnd {
+		return nil, fmt.Errorf("filter: unexpected %q", p.peek().text)
+	}
+	return &filter{expr: expr, eval: eval}, nil
+}
+
+type tokenKind uint8
+
+const (
+	tokenEnd tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		c := rune(expr[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(expr) && (expr[j] == '_' || unicode.IsLetter(rune(expr[j])) || unicode.IsDigit(rune(expr[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{tokenIdent, expr[i:j]})
+			i = j
+
+		case unicode.IsDigit(c) || c == '-' && i+1 < len(expr) && unicode.IsDigit(rune(expr[i+1])):
+			j := i + 1
+			for j < len(expr) && strings.ContainsRune("0123456789.eE+-", rune(expr[j])) {
+				// a sign only belongs to the number right after an exponent
+				if (expr[j] == '+' || expr[j] == '-') && expr[j-1] != 'e' && expr[j-1] != 'E' {
+					break
+				}
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, expr[i:j]})
+			i = j
+
+		case c == '"':
+			j := i + 1
+			for j < len(expr) && expr[j] != '"' {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("filter: unterminated string")
+			}
+			s, err := strconv.Unquote(expr[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("filter: invalid string %s", expr[i:j+1])
+			}
+			tokens = append(tokens, token{tokenString, s})
+			i = j + 1
+
+		default:
+			op := ""
+			for _, candidate := range []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", ".", "[", "]"} {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("filter: unexpected %q", c)
+			}
+			tokens = append(tokens, token{tokenOperator, op})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEnd}), nil
+}
+
+type filterParser struct {
+	tokens []token
+	pos    int
+	typ    reflect.Type
+}
+
+func (p *filterParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokenOperator && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) or() (func(reflect.Value) bool, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(v reflect.Value) bool { return l(v) || right(v) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (func(reflect.Value) bool, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(v reflect.Value) bool { return l(v) && right(v) }
+	}
+	return left, nil
+}
+
+func (p *filterParser) unary() (func(reflect.Value) bool, error) {
+	if p.accept("!") {
+		inner, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v reflect.Value) bool { return !inner(v) }, nil
+	}
+	if p.accept("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, fmt.Errorf("filter: missing )")
+		}
+		return inner, nil
+	}
+	return p.comparison()
+}
+
+func (p *filterParser) comparison() (func(reflect.Value) bool, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek()
+	if op.kind != tokenOperator || !slices.Contains([]string{"==", "!=", "<", "<=", ">", ">="}, op.text) {
+		if left.kind != reflect.Bool {
+			return nil, fmt.Errorf("filter: %s is not a boolean", left.name)
+		}
+		return func(v reflect.Value) bool { return left.get(v).b }, nil
+	}
+	p.next()
+
+	right, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+
+	compare, err := comparer(left, right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.text {
+	case "==":
+		return func(v reflect.Value) bool { c, ok := compare(v); return ok && c == 0 }, nil
+	case "!=":
+		return func(v reflect.Value) bool { c, ok := compare(v); return !ok || c != 0 }, nil
+	}
+	if left.kind == reflect.Bool {
+		return nil, fmt.Errorf("filter: booleans can't be ordered")
+	}
+	switch op.text {
+	case "<":
+		return func(v reflect.Value) bool { c, ok := compare(v); return ok && c < 0 }, nil
+	case "<=":
+		return func(v reflect.Value) bool { c, ok := compare(v); return ok && c <= 0 }, nil
+	case ">":
+		return func(v reflect.Value) bool { c, ok := compare(v); return ok && c > 0 }, nil
+	default:
+		return func(v reflect.Value) bool { c, ok := compare(v); return ok && c >= 0 }, nil
+	}
+}
+
+// operand is a literal or a field of the message.
+// kind is reflect.Bool, reflect.String, reflect.Int64, reflect.Uint64 or reflect.Float64.
+type operand struct {
+	name string
+	kind reflect.Kind
+	get  func(reflect.Value) filterValue
+}
+
+type filterValue struct {
+	b bool
+	s string
+	i int64
+	u uint64
+	f float64
+}
+
+func (p *filterParser) operand() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		value := filterValue{s: t.text}
+		return operand{name: strconv.Quote(t.text), kind: reflect.String, get: func(reflect.Value) filterValue { return value }}, nil
+
+	case tokenNumber:
+		var value filterValue
+		var kind reflect.Kind
+		var err error
+		switch {
+		case strings.ContainsAny(t.text, ".eE"):
+			kind = reflect.Float64
+			value.f, err = strconv.ParseFloat(t.text, 64)
+		case strings.HasPrefix(t.text, "-"):
+			kind = reflect.Int64
+			value.i, err = strconv.ParseInt(t.text, 10, 64)
+		default:
+			kind = reflect.Uint64
+			value.u, err = strconv.ParseUint(t.text, 10, 64)
+		}
+		if err != nil {
+			return operand{}, fmt.Errorf("filter: invalid number %s", t.text)
+		}
+		return operand{name: t.text, kind: kind, get: func(reflect.Value) filterValue { return value }}, nil
+
+	case tokenIdent:
+		if t.text == "true" || t.text == "false" {
+			value := filterValue{b: t.text == "true"}
+			return operand{name: t.text, kind: reflect.Bool, get: func(reflect.Value) filterValue { return value }}, nil
+		}
+		p.pos--
+		return p.path()
+
+	default:
+		return operand{}, fmt.Errorf("filter: unexpected %q", t.text)
+	}
+}
+
+// path resolves a field path against the message type
+func (p *filterParser) path() (operand, error) {
+	var steps []func(reflect.Value) reflect.Value
+	var name strings.Builder
+	typ := p.typ
+
+	for {
+		t := p.next()
+		if t.kind != tokenIdent {
+			return operand{}, fmt.Errorf("filter: expected a field name after %q", name.String())
+		}
+		if typ.Kind() != reflect.Struct {
+			return operand{}, fmt.Errorf("filter: %s is not a struct", name.String())
+		}
+		field, ok := findField(typ, t.text)
+		if !ok {
+			return operand{}, fmt.Errorf("filter: %s has no field %s", typ, t.text)
+		}
+		if name.Len() > 0 {
+			name.WriteByte('.')
+		}
+		name.WriteString(t.text)
+		index := field.Index
+		steps = append(steps, func(v reflect.Value) reflect.Value { return v.FieldByIndex(index) })
+		typ = field.Type
+
+		for p.accept("[") {
+			t := p.next()
+			i, err := strconv.Atoi(t.text)
+			if t.kind != tokenNumber || err != nil || !p.accept("]") {
+				return operand{}, fmt.Errorf("filter: invalid index of %s", name.String())
+			}
+			if typ.Kind() != reflect.Array || i < 0 || i >= typ.Len() {
+				return operand{}, fmt.Errorf("filter: %s[%d] is out of range", name.String(), i)
+			}
+			fmt.Fprintf(&name, "[%d]", i)
+			steps = append(steps, func(v reflect.Value) reflect.Value { return v.Index(i) })
+			typ = typ.Elem()
+		}
+
+		if !p.accept(".") {
+			break
+		}
+	}
+
+	field := func(v reflect.Value) reflect.Value {
+		for _, step := range steps {
+			v = step(v)
+		}
+		return v
+	}
+
+	o := operand{name: name.String()}
+	switch typ.Kind() {
+	case reflect.Bool:
+		o.kind = reflect.Bool
+		o.get = func(v reflect.Value) filterValue { return filterValue{b: field(v).Bool()} }
+	case reflect.String:
+		o.kind = reflect.String
+		o.get = func(v reflect.Value) filterValue { return filterValue{s: field(v).String()} }
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		o.kind = reflect.Int64
+		o.get = func(v reflect.Value) filterValue { return filterValue{i: field(v).Int()} }
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		o.kind = reflect.Uint64
+		o.get = func(v reflect.Value) filterValue { return filterValue{u: field(v).Uint()} }
+	case reflect.Float32, reflect.Float64:
+		o.kind = reflect.Float64
+		o.get = func(v reflect.Value) filterValue { return filterValue{f: field(v).Float()} }
+	default:
+		return operand{}, fmt.Errorf("filter: %s can't be compared", o.name)
+	}
+	return o, nil
+}
+
+func findField(typ reflect.Type, name string) (reflect.StructField, bool) {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.ReplaceAll(s, "_", ""))
+	}
+	want := normalize(name)
+	for i := range typ.NumField() {
+		if f := typ.Field(i); normalize(f.Name) == want {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func isNumber(kind reflect.Kind) bool {
+	return kind == reflect.Int64 || kind == reflect.Uint64 || kind == reflect.Float64
+}
+
+// comparer returns a function comparing left to right, ok is false when they can't be compared
+func comparer(left operand, right operand) (func(reflect.Value) (int, bool), error) {
+	switch {
+	case left.kind == reflect.Bool && right.kind == reflect.Bool:
+		return func(v reflect.Value) (int, bool) {
+			if left.get(v).b == right.get(v).b {
+				return 0, true
+			}
+			return 1, true
+		}, nil
+
+	case left.kind == reflect.String && right.kind == reflect.String:
+		return func(v reflect.Value) (int, bool) {
+			return strings.Compare(left.get(v).s, right.get(v).s), true
+		}, nil
+
+	case isNumber(left.kind) && isNumber(right.kind):
+		return func(v reflect.Value) (int, bool) {
+			return compareNumbers(left.kind, left.get(v), right.kind, right.get(v))
+		}, nil
+	}
+	return nil, fmt.Errorf("filter: can't compare %s with %s", left.name, right.name)
+}
+
+func compareNumbers(ak reflect.Kind, a filterValue, bk reflect.Kind, b filterValue) (int, bool) {
+	if ak == reflect.Float64 || bk == reflect.Float64 {
+		af, bf := asFloat(ak, a), asFloat(bk, b)
+		switch {
+		case af < bf:
+			return -1, true
+		case af > bf:
+			return 1, true
+		case af == bf:
+			return 0, true
+		}
+		return 0, false // NaN
+	}
+
+	// negative ints are smaller than every uint
+	if ak == reflect.Int64 && a.i < 0 {
+		if bk == reflect.Int64 {
+			return cmp.Compare(a.i, b.i), true
+		}
+		return -1, true
+	}
+	if bk == reflect.Int64 && b.i < 0 {
+		return 1, true
+	}
+	return cmp.Compare(asUint(ak, a), asUint(bk, b)), true
+}
+
+func asFloat(kind reflect.Kind, v filterValue) float64 {
+	switch kind {
+	case reflect.Int64:
+		return float64(v.i)
+	case reflect.Uint64:
+		return float64(v.u)
+	}
+	return v.f
+}
+
+func asUint(kind reflect.Kind, v filterValue) uint64 {
+	if kind == reflect.Int64 {
+		return uint64(v.i)
+	}
+	return v.u
+}
@@ -0,0 +1,115 @@
+package spine
+
+import (
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type filterBattery struct {
+	Level float32
+}
+
+type filterJoint struct {
+	Blocked bool
+}
+
+type filterState struct {
+	RobotID uint8
+	Offset  int32
+	Status  string
+	Battery filterBattery
+	Joints  [3]filterJoint
+}
+
+func TestFilter(t *testing.T) {
+	state := filterState{RobotID: 3, Offset: -5, Status: "ok", Battery: filterBattery{Level: 0.1}}
+	state.Joints[2].Blocked = true
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`robot_id == 3`, true},
+		{`RobotID != 3`, false},
+		{`offset < 0 && offset >= -5`, true},
+		{`offset > 18446744073709551615`, false},
+		{`battery.level < 0.2`, true},
+		{`status == "ok" && !joints[2].blocked`, false},
+		{`joints[2].blocked || status == "ok"`, true},
+		{`!(robot_id == 3 || robot_id == 4)`, false},
+		{`joints[0].blocked == false`, true},
+	}
+
+	value := reflect.ValueOf(state)
+	for _, test := range tests {
+		f, err := compileFilter(test.expr, reflect.TypeFor[filterState]())
+		if err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+			continue
+		}
+		if got := f.match(value); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.expr, test.want, got)
+		}
+	}
+
+	for _, expr := range []string{`robot == 3`, `status == 3`, `robot_id`, `joints[3].blocked`, `battery < 1`, `robot_id == 3 &&`, `status == "ok`} {
+		if _, err := compileFilter(expr, reflect.TypeFor[filterState]()); err == nil {
+			t.Errorf("%s: expected an error", expr)
+		}
+	}
+}
+
+func TestSubscriber_Filter(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_filter", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	pub, err := NewPublisher[filterState](ns, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	received := make(chan filterState, 100)
+	sub, err := NewSubscriber(ns, "state", func(state filterState) {
+		received <- state
+	}, WithFilter("robot_id == 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	timeout := time.After(5 * time.Second)
+	matched := 0
+	for robot := uint8(0); matched < 3; robot = (robot + 1) % 5 {
+		pub.Publish(filterState{RobotID: robot})
+		select {
+		case state := <-received:
+			if state.RobotID != 3 {
+				t.Fatalf("received state of robot %d", state.RobotID)
+			}
+			matched++
+		case <-time.After(20 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("no message received")
+		}
+	}
+
+	// the filter is applied before sending
+	pub.clientMu.RLock()
+	filtered := len(pub.clients) == 1 && pub.filters[pub.clients[0]] != nil
+	pub.clientMu.RUnlock()
+	if !filtered {
+		t.Error("publisher does not filter for the subscriber")
+	}
+
+	if _, err := NewSubscriber(ns, "state", func(filterState) {}, WithFilter("robot == 3")); err == nil {
+		t.Error("expected invalid filter to be rejected")
+	}
+}
@@ -0,0 +1,224 @@
+package spine
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+// Frames exchanged between endpoints look like
+//
+//	[code][header fields length uint16][header fields][payload]
+//
+// and every header field is
+//
+//	[tag][value length uint16][value]
+//
+// Fields with unknown tags are skipped so the header can grow without breaking older peers.
+// Single byte frames (ping, pong and bare status codes) have no header.
+type frameHeader struct {
+	trace    SpanContext
+	metadata Metadata
+
+	// stamped on published messages, sequence starts at 1
+	sentAt   int64
+	sequence uint64
+	source   string
+
+	// id of the compression the payload is compressed with, 0 if it is not
+	compression uint8
+}
+
+const headerFieldOverhead = 3
+
+const traceFieldLength = 16 + 8 + 1
+
+// [sent at unix nanos int64][sequence uint64][source node id]
+const messageFieldLength = 8 + 8
+
+func (h *frameHeader) size() int {
+	size := globals.HEADER_LENGTH
+	if h.trace.IsValid() {
+		size += headerFieldOverhead + traceFieldLength
+	}
+	if len(h.metadata) > 0 {
+		size += headerFieldOverhead + metadataLength(h.metadata)
+	}
+	if h.sequence != 0 {
+		size += headerFieldOverhead + messageFieldLength + len(h.source)
+	}
+	if h.compression != 0 {
+		size += headerFieldOverhead + 1
+	}
+	return size
+}
+
+// encode writes code and the header to buf and returns the index the payload starts at
+func (h *frameHeader) encode(code uint8, buf []byte) int {
+	buf[globals.STATUS_CODE_INDEX] = code
+	i := globals.HEADER_LENGTH
+
+	if h.trace.IsValid() {
+		i += putHeaderField(buf[i:], globals.HEADER_TRACE, traceFieldLength)
+		i += copy(buf[i:], h.trace.TraceID[:])
+		i += copy(buf[i:], h.trace.SpanID[:])
+		buf[i] = h.trace.Flags
+		i++
+	}
+
+	if len(h.metadata) > 0 {
+		i += putHeaderField(buf[i:], globals.HEADER_METADATA, metadataLength(h.metadata))
+		i += putMetadata(buf[i:], h.metadata)
+	}
+
+	if h.sequence != 0 {
+		i += putHeaderField(buf[i:], globals.HEADER_MESSAGE_INFO, messageFieldLength+len(h.source))
+		binary.BigEndian.PutUint64(buf[i:], uint64(h.sentAt))
+		binary.BigEndian.PutUint64(buf[i+8:], h.sequence)
+		i += messageFieldLength
+		i += copy(buf[i:], h.source)
+	}
+
+	if h.compression != 0 {
+		i += putHeaderField(buf[i:], globals.HEADER_COMPRESSION, 1)
+		buf[i] = h.compression
+		i++
+	}
+
+	binary.BigEndian.PutUint16(buf[globals.HEADER_FIELDS_LENGTH_INDEX:], uint16(i-globals.HEADER_LENGTH))
+	return i
+}
+
+func putHeaderField(buf []byte, tag uint8, length int) int {
+	buf[0] = tag
+	binary.BigEndian.PutUint16(buf[1:], uint16(length))
+	return headerFieldOverhead
+}
+
+// decodeFrame splits a frame into its code, header and payload
+func decodeFrame(frame []byte) (uint8, frameHeader, []byte, error) {
+	var h frameHeader
+	if len(frame) == 0 {
+		return 0, h, nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+	}
+
+	code := frame[globals.STATUS_CODE_INDEX]
+	if len(frame) == 1 {
+		return code, h, nil, nil
+	}
+	if len(frame) < globals.HEADER_LENGTH {
+		return code, h, nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+	}
+
+	fieldsLength := int(binary.BigEndian.Uint16(frame[globals.HEADER_FIELDS_LENGTH_INDEX:]))
+	if len(frame) < globals.HEADER_LENGTH+fieldsLength {
+		return code, h, nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+	}
+
+	fields := frame[globals.HEADER_LENGTH : globals.HEADER_LENGTH+fieldsLength]
+	for len(fields) > 0 {
+		if len(fields) < headerFieldOverhead {
+			return code, h, nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+		}
+		tag := fields[0]
+		length := int(binary.BigEndian.Uint16(fields[1:]))
+		fields = fields[headerFieldOverhead:]
+		if len(fields) < length {
+			return code, h, nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+		}
+		value := fields[:length]
+		fields = fields[length:]
+
+		switch tag {
+		case globals.HEADER_TRACE:
+			if length != traceFieldLength {
+				return code, h, nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+			}
+			copy(h.trace.TraceID[:], value[:16])
+			copy(h.trace.SpanID[:], value[16:24])
+			h.trace.Flags = value[24]
+
+		case globals.HEADER_METADATA:
+			md, err := decodeMetadata(value)
+			if err != nil {
+				return code, h, nil, err
+			}
+			h.metadata = md
+
+		case globals.HEADER_MESSAGE_INFO:
+			if length < messageFieldLength {
+				return code, h, nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+			}
+			h.sentAt = int64(binary.BigEndian.Uint64(value))
+			h.sequence = binary.BigEndian.Uint64(value[8:])
+			h.source = string(value[messageFieldLength:])
+
+		case globals.HEADER_COMPRESSION:
+			if length != 1 {
+				return code, h, nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+			}
+			h.compression = value[0]
+		}
+	}
+
+	return code, h, frame[globals.HEADER_LENGTH+fieldsLength:], nil
+}
+
+// metadata is encoded as [count uint16] followed by [key length uint16][key][value length uint16][value] pairs
+func metadataLength(md Metadata) int {
+	length := 2
+	for k, v := range md {
+		length += 4 + len(k) + len(v)
+	}
+	return length
+}
+
+func putMetadata(buf []byte, md Metadata) int {
+	binary.BigEndian.PutUint16(buf, uint16(len(md)))
+	i := 2
+	for k, v := range md {
+		binary.BigEndian.PutUint16(buf[i:], uint16(len(k)))
+		i += 2
+		i += copy(buf[i:], k)
+		binary.BigEndian.PutUint16(buf[i:], uint16(len(v)))
+		i += 2
+		i += copy(buf[i:], v)
+	}
+	return i
+}
+
+func decodeMetadata(buf []byte) (Metadata, error) {
+	if len(buf) < 2 {
+		return nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+	}
+	count := int(binary.BigEndian.Uint16(buf))
+	buf = buf[2:]
+
+	readString := func() (string, bool) {
+		if len(buf) < 2 {
+			return "", false
+		}
+		length := int(binary.BigEndian.Uint16(buf))
+		if len(buf) < 2+length {
+			return "", false
+		}
+		str := string(buf[2 : 2+length])
+		buf = buf[2+length:]
+		return str, true
+	}
+
+	md := make(Metadata, count)
+	for range count {
+		k, ok := readString()
+		if !ok {
+			return nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+		}
+		v, ok := readString()
+		if !ok {
+			return nil, fmt.Errorf(globals.ERROR_CORRUPT_PAYLOAD)
+		}
+		md[k] = v
+	}
+	return md, nil
+}
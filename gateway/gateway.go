@@ -0,0 +1,544 @@
+// Package gateway exposes the services and topics of a namespace over HTTP, for browsers and programs without spine.
+// Payloads are converted to and from JSON with the schemas the endpoints advertise.
+//
+//	GET  /endpoints         endpoints of the namespace, found within the wait query parameter (1s by default)
+//	POST /services/{name}   calls a service with the JSON body and responds with its JSON response
+//	GET  /topics/{name}     streams a topic as a WebSocket or, without an upgrade, as server-sent events
+//	POST /topics/{name}     publishes the JSON body with the schema query parameter, unless the topic has another publisher
+//
+// Names may have slashes, as in /topics/left_arm/joint_states. Errors are responded with as {"error": "..."}.
+package gateway
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/poisnoir/spine-go"
+	"github.com/poisnoir/spine-go/internal/globals"
+	"github.com/poisnoir/spine-go/internal/jsonpayload"
+)
+
+// maxBodySize bounds request bodies, encoded payloads have to fit in a packet anyway
+const maxBodySize = 1 << 20
+
+// streamBuffer is the number of messages a slow stream falls behind by before messages are dropped
+const streamBuffer = 16
+
+// discoveryWait is how long the gateway looks for endpoints, when listing them or before it publishes a topic
+const discoveryWait = time.Second
+
+type options struct {
+	authenticate func(*http.Request) bool
+	allowlist    []string
+	origins      []string
+	timeout      time.Duration
+}
+
+type Option func(*options)
+
+// WithAuth rejects the requests authenticate returns false for
+func WithAuth(authenticate func(*http.Request) bool) Option {
+	return func(o *options) {
+		o.authenticate = authenticate
+	}
+}
+
+// WithBearerToken accepts only requests with the header "Authorization: Bearer <token>" or, since browsers can't set
+// headers on WebSockets and event streams, the query parameter access_token
+func WithBearerToken(token string) Option {
+	return WithAuth(func(r *http.Request) bool {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			given = r.URL.Query().Get("access_token")
+		}
+		return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+	})
+}
+
+// WithAllowlist exposes only the endpoints whose names match one of patterns (path.Match syntax),
+// every endpoint is exposed without it
+func WithAllowlist(patterns ...string) Option {
+	return func(o *options) {
+		o.allowlist = append(o.allowlist, patterns...)
+	}
+}
+
+// WithOrigins lets pages served from origins use the gateway, "*" allows any origin.
+// Without it only pages of the gateway's own origin can open WebSockets.
+func WithOrigins(origins ...string) Option {
+	return func(o *options) {
+		o.origins = append(o.origins, origins...)
+	}
+}
+
+// WithTimeout bounds finding an endpoint and waiting for a service's response, 10 seconds by default
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// Gateway is an http.Handler serving the endpoints of a namespace
+type Gateway struct {
+	namespace *spine.Namespace
+	options   options
+	mux       *http.ServeMux
+	upgrader  websocket.Upgrader
+	logger    *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// callers and publishers are kept between requests
+	mu         sync.Mutex
+	callers    map[string]*caller
+	publishers map[string]*publisher
+}
+
+type caller struct {
+	endpoint spine.Endpoint
+	caller   *spine.ServiceCaller[[]byte, []byte]
+}
+
+type publisher struct {
+	code      string
+	schema    string
+	publisher *spine.Publisher[[]byte]
+}
+
+// endpoint is an endpoint as it is listed
+type endpoint struct {
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	Code           string `json:"code"`
+	Schema         string `json:"schema,omitempty"`
+	ResponseCode   string `json:"response_code,omitempty"`
+	ResponseSchema string `json:"response_schema,omitempty"`
+	Node           string `json:"node,omitempty"`
+}
+
+// errNotFound is responded with 404
+var errNotFound = errors.New("not found")
+
+func New(namespace *spine.Namespace, opts ...Option) *Gateway {
+	options := options{timeout: 10 * time.Second}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	ctx, cancel := context.WithCancel(namespace.Context())
+
+	g := &Gateway{
+		namespace: namespace,
+		options:   options,
+		mux:       http.NewServeMux(),
+		logger:    namespace.Logger().With("gateway", namespace.Name()),
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		callers:    make(map[string]*caller),
+		publishers: make(map[string]*publisher),
+	}
+	if len(options.origins) > 0 {
+		g.upgrader.CheckOrigin = func(r *http.Request) bool {
+			return g.allowedOrigin(r.Header.Get("Origin"))
+		}
+	}
+
+	g.mux.HandleFunc("GET /endpoints", g.list)
+	g.mux.HandleFunc("POST /services/{name...}", g.call)
+	g.mux.HandleFunc("GET /topics/{name...}", g.stream)
+	g.mux.HandleFunc("POST /topics/{name...}", g.publish)
+	return g
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && g.allowedOrigin(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		// preflight requests carry no credentials
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	if g.options.authenticate != nil && !g.options.authenticate(r) {
+		writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	g.mux.ServeHTTP(w, r)
+}
+
+// Close stops the streams and closes the callers and publishers of the gateway
+func (g *Gateway) Close() {
+	g.cancel()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for name, c := range g.callers {
+		c.caller.Close()
+		delete(g.callers, name)
+	}
+	for name, p := range g.publishers {
+		p.publisher.Close()
+		delete(g.publishers, name)
+	}
+}
+
+func (g *Gateway) allowed(name string) bool {
+	if len(g.options.allowlist) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(g.options.allowlist, func(pattern string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+func (g *Gateway) allowedOrigin(origin string) bool {
+	return slices.Contains(g.options.origins, "*") || slices.Contains(g.options.origins, origin)
+}
+
+// resolve finds the allowed endpoint called name of type endpointType
+func (g *Gateway) resolve(ctx context.Context, name string, endpointType string) (spine.Endpoint, error) {
+	if !g.allowed(name) {
+		return spine.Endpoint{}, errNotFound
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, g.options.timeout)
+	defer cancel()
+
+	e, err := g.namespace.Registry().Resolve(ctx, name)
+	if err != nil || e.Type != endpointType {
+		return e, errNotFound
+	}
+	return e, nil
+}
+
+func (g *Gateway) list(w http.ResponseWriter, r *http.Request) {
+	wait := discoveryWait
+	if value := r.URL.Query().Get("wait"); value != "" {
+		var err error
+		if wait, err = time.ParseDuration(value); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), min(wait, g.options.timeout))
+	defer cancel()
+
+	var mu sync.Mutex
+	endpoints := []endpoint{}
+	err := g.namespace.Registry().Browse(ctx, func(e spine.Endpoint) {
+		if !g.allowed(e.Name) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		endpoints = append(endpoints, endpoint{
+			Name:           e.Name,
+			Type:           e.Type,
+			Code:           e.Code,
+			Schema:         e.Schema,
+			ResponseCode:   e.ResponseCode,
+			ResponseSchema: e.ResponseSchema,
+			Node:           e.Node,
+		})
+	})
+	if ctx.Err() == nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	slices.SortFunc(endpoints, func(a, b endpoint) int {
+		return cmp.Or(cmp.Compare(a.Type, b.Type), cmp.Compare(a.Name, b.Name))
+	})
+	writeJSON(w, endpoints)
+}
+
+func (g *Gateway) call(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	c, err := g.caller(r.Context(), name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("service %s %w", name, err))
+		return
+	}
+
+	request, err := jsonpayload.Encode(c.endpoint.Code, c.endpoint.Schema, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), g.options.timeout)
+	defer cancel()
+
+	response, err := c.caller.Call(request, ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// the service may have been replaced by one with other types, the next call finds it again
+		g.dropCaller(name, c)
+		writeError(w, http.StatusGatewayTimeout, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	document, err := jsonpayload.Decode(c.endpoint.ResponseCode, c.endpoint.ResponseSchema, response)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(document)
+}
+
+// caller returns the caller of the service called name, creating it on the first call
+func (g *Gateway) caller(ctx context.Context, name string) (*caller, error) {
+	g.mu.Lock()
+	c, ok := g.callers[name]
+	g.mu.Unlock()
+	if ok {
+		return c, nil
+	}
+
+	e, err := g.resolve(ctx, name, globals.ZERO_CONF_SERVICE)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if c, ok := g.callers[name]; ok {
+		return c, nil
+	}
+	sc, err := spine.NewRawServiceCaller(g.namespace, name, e.Code, e.ResponseCode)
+	if err != nil {
+		return nil, err
+	}
+	c = &caller{endpoint: e, caller: sc}
+	g.callers[name] = c
+	return c, nil
+}
+
+func (g *Gateway) dropCaller(name string, c *caller) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.callers[name] == c {
+		delete(g.callers, name)
+		c.caller.Close()
+	}
+}
+
+type message struct {
+	sequence uint64
+	document []byte
+}
+
+func (g *Gateway) stream(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	e, err := g.resolve(r.Context(), name, globals.ZERO_CONF_PUBLISHER)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("topic %s %w", name, err))
+		return
+	}
+
+	format, err := jsonpayload.NewFormat(e.Code, e.Schema)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Errorf("topic %s: %w", name, err))
+		return
+	}
+
+	logger := g.logger.With("topic", name)
+
+	// slow clients miss messages rather than holding up the subscriber
+	messages := make(chan message, streamBuffer)
+	sub, err := spine.NewRawSubscriber(g.namespace, name, e.Code, func(payload []byte, info spine.MessageInfo) {
+		document, err := format.Decode(payload)
+		if err != nil {
+			logger.Error("unable to decode message", "error", err)
+			return
+		}
+		select {
+		case messages <- message{info.Sequence, document}:
+		default:
+		}
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer sub.Stop()
+
+	if websocket.IsWebSocketUpgrade(r) {
+		g.streamWebSocket(w, r, messages, logger)
+	} else {
+		g.streamEvents(w, r, messages)
+	}
+}
+
+func (g *Gateway) streamWebSocket(w http.ResponseWriter, r *http.Request, messages <-chan message, logger *slog.Logger) {
+	conn, err := g.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // the upgrader responded
+	}
+	defer conn.Close()
+
+	// the client only sends control messages, reading ends when it closes the connection
+	ctx, cancel := context.WithCancel(g.ctx)
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		case m := <-messages:
+			if err := conn.WriteMessage(websocket.TextMessage, m.document); err != nil {
+				logger.Debug("stream closed", "error", err)
+				return
+			}
+		}
+	}
+}
+
+func (g *Gateway) streamEvents(w http.ResponseWriter, r *http.Request, messages <-chan message) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-g.ctx.Done():
+			return
+		case m := <-messages:
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", m.sequence, m.document); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// publish sends the body to a topic. The gateway keeps its publisher, so only the first messages
+// may be missed by subscribers that are still connecting.
+func (g *Gateway) publish(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	p, status, err := g.publisher(r.Context(), name, r.URL.Query().Get("schema"))
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	payload, err := jsonpayload.Encode(p.code, p.schema, body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	p.publisher.Publish(payload)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// publisher returns the gateway's publisher of the topic called name, creating it with schemaText on the first message.
+// Subscribers only follow one publisher, so a name another endpoint has is refused.
+func (g *Gateway) publisher(ctx context.Context, name string, schemaText string) (*publisher, int, error) {
+	if !g.allowed(name) {
+		return nil, http.StatusNotFound, fmt.Errorf("topic %s %w", name, errNotFound)
+	}
+
+	g.mu.Lock()
+	p, ok := g.publishers[name]
+	g.mu.Unlock()
+	if ok {
+		if schemaText != "" && schemaText != p.schema {
+			return nil, http.StatusConflict, fmt.Errorf("topic %s is published with schema %s", name, p.schema)
+		}
+		return p, 0, nil
+	}
+
+	if schemaText == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("no schema given for topic %s", name)
+	}
+	schema, err := spine.ParseSchema(schemaText)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	discoverCtx, cancel := context.WithTimeout(ctx, min(discoveryWait, g.options.timeout))
+	defer cancel()
+	if _, err := g.namespace.Registry().Resolve(discoverCtx, name); err == nil {
+		return nil, http.StatusConflict, fmt.Errorf("%s is taken by another endpoint", name)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if existing, ok := g.publishers[name]; ok {
+		return existing, 0, nil
+	}
+	p = &publisher{code: schema.Code(), schema: schemaText}
+	if p.publisher, err = spine.NewRawPublisher(g.namespace, name, p.code, spine.WithSchema(schema)); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	g.publishers[name] = p
+	return p, 0, nil
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
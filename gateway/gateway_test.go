@@ -0,0 +1,266 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/poisnoir/spine-go"
+)
+
+type reading struct {
+	Sensor uint8
+	Value  float32
+}
+
+func newNamespace(t *testing.T, name string) *spine.Namespace {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := spine.JointNamespace(name, "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ns.Disconnect)
+	return ns
+}
+
+func TestGateway_Call(t *testing.T) {
+	ns := newNamespace(t, "test_gateway_call")
+
+	_, err := spine.NewService(ns, "double", func(r reading) (reading, error) {
+		return reading{Sensor: r.Sensor, Value: r.Value * 2}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := New(ns, WithBearerToken("token"), WithAllowlist("double"), WithTimeout(5*time.Second))
+	defer g.Close()
+	server := httptest.NewServer(g)
+	defer server.Close()
+
+	post := func(path string, body string, token string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		text, _ := io.ReadAll(res.Body)
+		return res.StatusCode, strings.TrimSpace(string(text))
+	}
+
+	if status, text := post("/services/double", `{"sensor": 3, "value": 1.5}`, "token"); status != http.StatusOK || text != `{"Sensor":3,"Value":3}` {
+		t.Errorf("unexpected response %d %s", status, text)
+	}
+	if status, _ := post("/services/double", `{"sensor": 3}`, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("expected a wrong token to be rejected, got %d", status)
+	}
+	if status, _ := post("/services/double", `{"speed": 3}`, "token"); status != http.StatusBadRequest {
+		t.Errorf("expected an unknown field to be rejected, got %d", status)
+	}
+	if status, _ := post("/services/halve", `{}`, "token"); status != http.StatusNotFound {
+		t.Errorf("expected a service outside the allowlist to be hidden, got %d", status)
+	}
+
+	res, err := http.Get(server.URL + "/endpoints?wait=500ms&access_token=token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var endpoints []endpoint
+	if err := json.NewDecoder(res.Body).Decode(&endpoints); err != nil {
+		t.Fatal(err)
+	}
+	if len(endpoints) != 1 || endpoints[0].Name != "double" || endpoints[0].Schema != "{Sensor:u8,Value:f32}" {
+		t.Errorf("unexpected endpoints %+v", endpoints)
+	}
+}
+
+func TestGateway_Topics(t *testing.T) {
+	ns := newNamespace(t, "test_gateway_topics")
+
+	pub, err := spine.NewPublisher[reading](ns, "readings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	g := New(ns, WithTimeout(5*time.Second))
+	defer g.Close()
+	server := httptest.NewServer(g)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// publishes until the streams are connected
+	go func() {
+		for ctx.Err() == nil {
+			pub.Publish(reading{Sensor: 1, Value: 0.5})
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/topics/readings", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", res.Header.Get("Content-Type"))
+	}
+	events := bufio.NewScanner(res.Body)
+	for events.Scan() {
+		if data, ok := strings.CutPrefix(events.Text(), "data: "); ok {
+			if data != `{"Sensor":1,"Value":0.5}` {
+				t.Errorf("unexpected event %s", data)
+			}
+			break
+		}
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, "ws"+strings.TrimPrefix(server.URL, "http")+"/topics/readings", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"Sensor":1,"Value":0.5}` {
+		t.Errorf("unexpected message %s", data)
+	}
+}
+
+func TestGateway_HierarchicalName(t *testing.T) {
+	ns := newNamespace(t, "test_gateway_hierarchical")
+
+	pub, err := spine.NewPublisher[reading](ns, "left_arm/joint_states")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	g := New(ns, WithTimeout(5*time.Second))
+	defer g.Close()
+	server := httptest.NewServer(g)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		for ctx.Err() == nil {
+			pub.Publish(reading{Sensor: 4, Value: 1})
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/topics/left_arm/joint_states", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	events := bufio.NewScanner(res.Body)
+	for events.Scan() {
+		if data, ok := strings.CutPrefix(events.Text(), "data: "); ok {
+			if data != `{"Sensor":4,"Value":1}` {
+				t.Errorf("unexpected event %s", data)
+			}
+			return
+		}
+	}
+	t.Error("no event received")
+}
+
+func TestGateway_Publish(t *testing.T) {
+	ns := newNamespace(t, "test_gateway_publish")
+
+	g := New(ns, WithTimeout(time.Second))
+	defer g.Close()
+	server := httptest.NewServer(g)
+	defer server.Close()
+
+	received := make(chan reading, 10)
+	sub, err := spine.NewSubscriber(ns, "commands", func(r reading) { received <- r })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	// without a schema there is nothing to encode with
+	res, err := http.Post(server.URL+"/topics/commands", "application/json", strings.NewReader(`{"sensor": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a missing schema to be rejected, got %d", res.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for {
+		res, err := http.Post(server.URL+"/topics/commands?schema={Sensor:u8,Value:f32}", "application/json", strings.NewReader(`{"sensor": 2, "value": 4}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusAccepted {
+			t.Fatalf("unexpected status %d", res.StatusCode)
+		}
+
+		select {
+		case r := <-received:
+			if r != (reading{Sensor: 2, Value: 4}) {
+				t.Errorf("unexpected message %+v", r)
+			}
+			return
+		case <-ctx.Done():
+			t.Fatal("no message received")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestGateway_PublishTaken(t *testing.T) {
+	ns := newNamespace(t, "test_gateway_publish_taken")
+
+	pub, err := spine.NewPublisher[reading](ns, "readings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	g := New(ns, WithTimeout(5*time.Second))
+	defer g.Close()
+	server := httptest.NewServer(g)
+	defer server.Close()
+
+	// the gateway doesn't become a second publisher of a topic
+	res, err := http.Post(server.URL+"/topics/readings?schema={Sensor:u8,Value:f32}", "application/json", strings.NewReader(`{"sensor": 2, "value": 4}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("expected a taken topic to be rejected, got %d", res.StatusCode)
+	}
+}
@@ -5,7 +5,20 @@ go 1.24.3
 
 require github.com/grandcat/zeroconf v1.0.0
 
-require github.com/poisnoir/mad-go v0.0.0-20260213164930-5bea82a451d0
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/pierrec/lz4/v4 v4.1.33
+	github.com/poisnoir/mad-go v0.0.0-20260213164930-5bea82a451d0
+)
+
+require (
+	github.com/eclipse/paho.mqtt.golang v1.5.1
+	github.com/gorilla/websocket v1.5.3
+	github.com/mochi-mqtt/server/v2 v2.7.9
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/rs/xid v1.4.0 // indirect
 
 require (
 	github.com/cenkalti/backoff v2.2.1+incompatible // indirect
@@ -19,7 +32,7 @@ require (
 	golang.org/x/crypto v0.45.0 // indirect
 	golang.org/x/mod v0.25.0 // indirect
 	golang.org/x/net v0.47.0 // indirect
-	golang.org/x/sync v0.15.0 // indirect
+	golang.org/x/sync v0.17.0 // indirect
 	golang.org/x/sys v0.38.0 // indirect
 	golang.org/x/time v0.14.0 // indirect
 	golang.org/x/tools v0.34.0 // indirect
@@ -0,0 +1,141 @@
+package spine
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// ServerInfo describes the request a server interceptor is handling
+type ServerInfo struct {
+	Service  string
+	Metadata Metadata
+}
+
+// Handler is the next step of a server interceptor chain, request is the K of the service and the result its V
+type Handler func(ctx context.Context, request any) (any, error)
+
+// ServerInterceptor wraps the handling of every request of a service.
+// It can return an error without calling next to reject the request.
+type ServerInterceptor func(ctx context.Context, request any, info *ServerInfo, next Handler) (any, error)
+
+// CallInfo describes the call a client interceptor is making
+type CallInfo struct {
+	Service  string
+	Metadata Metadata
+}
+
+// Invoker is the next step of a client interceptor chain, request is the K of the caller and the result its V
+type Invoker func(ctx context.Context, request any) (any, error)
+
+// ClientInterceptor wraps every ServiceCaller.Call.
+// It can return an error without calling next to stop the call.
+type ClientInterceptor func(ctx context.Context, request any, info *CallInfo, next Invoker) (any, error)
+
+// WithServerInterceptors adds interceptors to a service, they run after the namespace's in the given order
+func WithServerInterceptors(interceptors ...ServerInterceptor) Option {
+	return func(o *endpointOptions) {
+		o.serverInterceptors = append(o.serverInterceptors, interceptors...)
+	}
+}
+
+// WithClientInterceptors adds interceptors to a service caller, they run after the namespace's in the given order
+func WithClientInterceptors(interceptors ...ClientInterceptor) Option {
+	return func(o *endpointOptions) {
+		o.clientInterceptors = append(o.clientInterceptors, interceptors...)
+	}
+}
+
+// WithNamespaceServerInterceptors adds interceptors to every service of the namespace
+func WithNamespaceServerInterceptors(interceptors ...ServerInterceptor) NamespaceOption {
+	return func(ns *Namespace) {
+		ns.serverInterceptors = append(ns.serverInterceptors, interceptors...)
+	}
+}
+
+// WithNamespaceClientInterceptors adds interceptors to every service caller of the namespace
+func WithNamespaceClientInterceptors(interceptors ...ClientInterceptor) NamespaceOption {
+	return func(ns *Namespace) {
+		ns.clientInterceptors = append(ns.clientInterceptors, interceptors...)
+	}
+}
+
+// interceptRequests wraps processRequest of a service with the server interceptors
+func interceptRequests[K any, V any](namespace *Namespace, name string, options endpointOptions, processRequest func(context.Context, K) serviceOutput[V]) func(context.Context, K) serviceOutput[V] {
+
+	interceptors := slices.Concat(namespace.serverInterceptors, options.serverInterceptors)
+	if len(interceptors) == 0 {
+		return processRequest
+	}
+
+	handler := Handler(func(ctx context.Context, request any) (any, error) {
+		key, ok := request.(K)
+		if !ok {
+			return nil, fmt.Errorf("interceptor changed request type to %T", request)
+		}
+		output := processRequest(ctx, key)
+		return output.data, output.err
+	})
+
+	return func(ctx context.Context, key K) serviceOutput[V] {
+		info := &ServerInfo{Service: name, Metadata: IncomingMetadata(ctx)}
+
+		next := handler
+		for _, interceptor := range slices.Backward(interceptors[1:]) {
+			inner := next
+			next = func(ctx context.Context, request any) (any, error) {
+				return interceptor(ctx, request, info, inner)
+			}
+		}
+
+		response, err := interceptors[0](ctx, key, info, next)
+		if err != nil {
+			return serviceOutput[V]{err: err}
+		}
+		value, ok := response.(V)
+		if !ok {
+			return serviceOutput[V]{err: fmt.Errorf("interceptor returned %T, want %T", response, value)}
+		}
+		return serviceOutput[V]{data: value}
+	}
+}
+
+// interceptCalls wraps call of a service caller with the client interceptors
+func interceptCalls[K any, V any](namespace *Namespace, name string, options endpointOptions, call func(context.Context, K) (V, error)) func(context.Context, K) (V, error) {
+
+	interceptors := slices.Concat(namespace.clientInterceptors, options.clientInterceptors)
+	if len(interceptors) == 0 {
+		return call
+	}
+
+	invoker := Invoker(func(ctx context.Context, request any) (any, error) {
+		key, ok := request.(K)
+		if !ok {
+			return nil, fmt.Errorf("interceptor changed request type to %T", request)
+		}
+		return call(ctx, key)
+	})
+
+	return func(ctx context.Context, key K) (V, error) {
+		info := &CallInfo{Service: name, Metadata: OutgoingMetadata(ctx)}
+
+		next := invoker
+		for _, interceptor := range slices.Backward(interceptors[1:]) {
+			inner := next
+			next = func(ctx context.Context, request any) (any, error) {
+				return interceptor(ctx, request, info, inner)
+			}
+		}
+
+		response, err := interceptors[0](ctx, key, info, next)
+		if err != nil {
+			var zero V
+			return zero, err
+		}
+		value, ok := response.(V)
+		if !ok {
+			return value, fmt.Errorf("interceptor returned %T, want %T", response, value)
+		}
+		return value, nil
+	}
+}
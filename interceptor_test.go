@@ -0,0 +1,107 @@
+package spine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterceptors(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+	var mu sync.Mutex
+	var order []string
+	record := func(step string) {
+		mu.Lock()
+		order = append(order, step)
+		mu.Unlock()
+	}
+
+	namespaceServer := func(ctx context.Context, request any, info *ServerInfo, next Handler) (any, error) {
+		record("namespace server " + info.Service)
+		return next(ctx, request)
+	}
+	namespaceClient := func(ctx context.Context, request any, info *CallInfo, next Invoker) (any, error) {
+		record("namespace client " + info.Service)
+		return next(ctx, request)
+	}
+
+	ns, err := JointNamespace("test_interceptors", "secret", logger,
+		WithNamespaceServerInterceptors(namespaceServer),
+		WithNamespaceClientInterceptors(namespaceClient),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	reject := func(ctx context.Context, request any, info *ServerInfo, next Handler) (any, error) {
+		record("service")
+		if request.(string) == "FORBIDDEN" {
+			return nil, errors.New("rejected by interceptor")
+		}
+		return next(ctx, request)
+	}
+
+	_, err = NewThreadedService(ns, "echo", func(input string) (string, error) {
+		record("handler")
+		return input, nil
+	}, WithServerInterceptors(reject))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upper := func(ctx context.Context, request any, info *CallInfo, next Invoker) (any, error) {
+		record("caller")
+		return next(ctx, strings.ToUpper(request.(string)))
+	}
+
+	caller, err := NewServiceCaller[string, string](ns, "echo", WithClientInterceptors(upper))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := caller.Call("hello", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != "HELLO" {
+		t.Errorf("expected 'HELLO', got '%s'", resp)
+	}
+
+	expected := []string{"namespace client echo", "caller", "namespace server echo", "service", "handler"}
+	mu.Lock()
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected order %v, got %v", expected, order)
+	}
+	mu.Unlock()
+
+	_, err = caller.Call("forbidden", ctx)
+	if err == nil || !strings.Contains(err.Error(), "rejected by interceptor") {
+		t.Errorf("expected rejection, got %v", err)
+	}
+}
+
+func TestInterceptors_WrongResponseType(t *testing.T) {
+	swap := func(ctx context.Context, request any, info *CallInfo, next Invoker) (any, error) {
+		return 42, nil
+	}
+	options := buildOptions([]Option{WithClientInterceptors(swap)})
+	call := interceptCalls(&Namespace{}, "echo", options, func(ctx context.Context, key string) (string, error) {
+		return key, nil
+	})
+
+	_, err := call(context.Background(), "hello")
+	if err == nil || !strings.Contains(err.Error(), "interceptor returned int, want string") {
+		t.Errorf("expected response type error, got %v", err)
+	}
+}
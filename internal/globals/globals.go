@@ -1,12 +1,21 @@
 package globals
 
 // Header
-const HEADER_LENGTH int = 5
+const HEADER_LENGTH int = 3
 const STATUS_CODE_INDEX int = 0
-const MESSAGE_LENGTH_INDEX int = 1
+const HEADER_FIELDS_LENGTH_INDEX int = 1
+
+// Header fields
+const HEADER_TRACE uint8 = 1
+const HEADER_METADATA uint8 = 2
+const HEADER_MESSAGE_INFO uint8 = 3
+const HEADER_COMPRESSION uint8 = 4
 
 const MAX_PACKET_SIZE int = 4096
 
+// compressed payloads may expand to at most this many bytes
+const MAX_DECOMPRESSED_SIZE int = 16 << 20
+
 // Status Codes
 const OK_STATUS_CODE uint8 = 0
 const PING_CODE uint8 = 1
@@ -15,6 +24,8 @@ const SERVICE_REQUEST uint8 = 3
 const PUBLISER_PUSH uint8 = 4
 const NAMESPACE_INFO uint8 = 5
 
+const ERROR_NOT_LEADER_CODE uint8 = 249
+const ERROR_NODE_INACTIVE_CODE uint8 = 250
 const ERROR_SERIALIZER_ERROR_CODE uint8 = 251
 const ERROR_SERVICE_ERROR_CODE uint8 = 252
 const ERROR_INVALID_OPERATION_CODE uint8 = 253
@@ -27,8 +38,20 @@ const ZERO_CONF_SERVICE = "service"
 const ZERO_CONF_NODE_TYPE = "._spine._tcp"
 const ZERO_CONF_NAMESPACE_TYPE = "_namespace_.spine._tcp"
 const ZERO_CONF_DOMAIN = "local."
+const ZERO_CONF_NODE_NAME = "node"
+const ZERO_CONF_NODE_ID = "node_id"
+const ZERO_CONF_CODE = "code"
+const ZERO_CONF_RESPONSE_CODE = "response_code"
+const ZERO_CONF_SCHEMA = "schema"
+const ZERO_CONF_RESPONSE_SCHEMA = "response_schema"
+const ZERO_CONF_COMPRESSION = "compression"
+
+// txt strings are limited to 255 bytes, longer values are split over several strings with the same key
+const ZERO_CONF_MAX_VALUE = 200
 
 const ERROR_SERVICE_HANDLER = "service handler has an error"
 const ERROR_CORRUPT_PAYLOAD = "CORRUPT_PAYLOAD"
 const ERROR_PING = "service didn't respond to ping"
 const ERROR_PAYLOAD_SIZE = "failed to encode key. key is too big. max key size is 4kb"
+const ERROR_NODE_INACTIVE = "node is not active"
+const ERROR_NOT_LEADER = "service is not the leader of its election"
@@ -0,0 +1,83 @@
+// Package jsonpayload converts payloads of endpoints to and from JSON using the code and schema they advertise.
+package jsonpayload
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/poisnoir/spine-go"
+)
+
+// Code is the code of endpoints using spine.JSONCodec, their payloads are JSON already
+const Code = "json"
+
+// Format converts the payloads of an endpoint with one code and schema, the schema is parsed once
+type Format struct {
+	code   string
+	schema *spine.Schema
+}
+
+// NewFormat returns the format of an endpoint with the advertised code and schema
+func NewFormat(code string, schemaText string) (*Format, error) {
+	if code == Code {
+		return &Format{code: code}, nil
+	}
+	if schemaText == "" {
+		return nil, fmt.Errorf("no schema is advertised for code %s", code)
+	}
+	schema, err := spine.ParseSchema(schemaText)
+	if err != nil {
+		return nil, err
+	}
+	return &Format{code: code, schema: schema}, nil
+}
+
+// Encode encodes document for an endpoint with the advertised code and schema
+func Encode(code string, schemaText string, document []byte) ([]byte, error) {
+	f, err := NewFormat(code, schemaText)
+	if err != nil {
+		return nil, err
+	}
+	return f.Encode(document)
+}
+
+// Decode returns payload of an endpoint with the advertised code and schema as compact JSON
+func Decode(code string, schemaText string, payload []byte) ([]byte, error) {
+	f, err := NewFormat(code, schemaText)
+	if err != nil {
+		return nil, err
+	}
+	return f.Decode(payload)
+}
+
+// Encode encodes document as a payload of the format
+func (f *Format) Encode(document []byte) ([]byte, error) {
+	if f.code == Code {
+		if !json.Valid(document) {
+			return nil, fmt.Errorf("invalid JSON")
+		}
+		return document, nil
+	}
+	payload, err := f.schema.EncodeJSON(document)
+	if err != nil {
+		return nil, fmt.Errorf("%s does not fit %s: %w", document, f.schema, err)
+	}
+	return payload, nil
+}
+
+// Decode returns payload as compact JSON
+func (f *Format) Decode(payload []byte) ([]byte, error) {
+	if f.code == Code {
+		var document bytes.Buffer
+		if err := json.Compact(&document, payload); err != nil {
+			return nil, err
+		}
+		return document.Bytes(), nil
+	}
+	value, err := f.schema.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
@@ -0,0 +1,202 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/poisnoir/spine-go"
+)
+
+// attemptTimeout is how long a client waits for a member before it tries another one
+const attemptTimeout = 2 * time.Second
+
+// Client sends operations to the leader of a store, following it when it changes
+type Client struct {
+	namespace *spine.Namespace
+	store     string
+	members   []string
+
+	mu sync.Mutex
+	// watches have their own callers so a waiting watch does not hold up other operations
+	callers  map[string]*spine.ServiceCaller[request, response]
+	watchers map[string]*spine.ServiceCaller[request, response]
+	leader   string
+	next     int
+}
+
+func NewClient(namespace *spine.Namespace, store string, members []string) (*Client, error) {
+	if len(members) == 0 {
+		return nil, errors.New("the store has no members")
+	}
+	return &Client{
+		namespace: namespace,
+		store:     store,
+		members:   slices.Clone(members),
+		callers:   make(map[string]*spine.ServiceCaller[request, response]),
+		watchers:  make(map[string]*spine.ServiceCaller[request, response]),
+	}, nil
+}
+
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, caller := range c.callers {
+		caller.Close()
+	}
+	for _, caller := range c.watchers {
+		caller.Close()
+	}
+	c.callers, c.watchers = nil, nil
+}
+
+// Get returns the value of key, found is false if it has none
+func (c *Client) Get(ctx context.Context, key string) (kv KeyValue, found bool, err error) {
+	res, err := c.do(ctx, request{Op: operation{Type: opGet, Key: key}})
+	return res.Result.KeyValue, res.Result.Found, err
+}
+
+// Put sets the value of key and returns it with its new revision
+func (c *Client) Put(ctx context.Context, key string, value []byte) (KeyValue, error) {
+	res, err := c.do(ctx, request{Op: operation{Type: opPut, Key: key, Value: value}})
+	return res.Result.KeyValue, err
+}
+
+// Delete removes key and reports whether it had a value
+func (c *Client) Delete(ctx context.Context, key string) (bool, error) {
+	res, err := c.do(ctx, request{Op: operation{Type: opDelete, Key: key}})
+	return res.Result.Found, err
+}
+
+// CompareAndSwap sets the value of key if its revision is revision, 0 if the key must not exist.
+// Otherwise it returns ErrConflict with the current value.
+func (c *Client) CompareAndSwap(ctx context.Context, key string, revision uint64, value []byte) (KeyValue, error) {
+	res, err := c.do(ctx, request{Op: operation{Type: opCAS, Key: key, Value: value}, Revision: revision})
+	if err == nil && res.Result.Conflict {
+		err = ErrConflict
+	}
+	return res.Result.KeyValue, err
+}
+
+// CompareAndDelete removes key if its revision is revision, otherwise it returns ErrConflict with the current value
+func (c *Client) CompareAndDelete(ctx context.Context, key string, revision uint64) (KeyValue, error) {
+	res, err := c.do(ctx, request{Op: operation{Type: opCAS, Key: key, Delete: true}, Revision: revision})
+	if err == nil && res.Result.Conflict {
+		err = ErrConflict
+	}
+	return res.Result.KeyValue, err
+}
+
+// Watch calls handler with every change of the keys starting with prefix from revision from on, in order,
+// until ctx is done. It returns ErrCompacted if from is older than the changes the store keeps.
+func (c *Client) Watch(ctx context.Context, prefix string, from uint64, handler func(Event)) error {
+	from = max(from, 1)
+	for {
+		res, err := c.send(ctx, request{Op: operation{Type: opWatch, Key: prefix}, Revision: from}, true)
+		if err != nil {
+			return err
+		}
+		if res.Compacted {
+			return ErrCompacted
+		}
+		for _, event := range res.Events {
+			handler(event)
+		}
+		// a member that lags behind may answer with an older revision than the last one seen
+		from = max(from, res.Next)
+	}
+}
+
+func (c *Client) do(ctx context.Context, req request) (response, error) {
+	return c.send(ctx, req, false)
+}
+
+// send tries members until the leader answers, or any member for watches
+func (c *Client) send(ctx context.Context, req request, watch bool) (response, error) {
+	timeout := attemptTimeout
+	if watch {
+		timeout += watchWait
+	}
+
+	for {
+		id, caller, err := c.caller(watch)
+		if err != nil {
+			return response{}, err
+		}
+
+		attempt, cancel := context.WithTimeout(ctx, timeout)
+		res, err := caller.Call(req, attempt)
+		cancel()
+
+		switch {
+		case ctx.Err() != nil:
+			return response{}, ctx.Err()
+		case errors.Is(err, context.DeadlineExceeded):
+			c.failed(id, "")
+		case err != nil:
+			// the next operation tries another member in case this one is gone
+			c.failed(id, "")
+			return res, err
+		case res.NotLeader:
+			c.failed(id, res.Leader)
+			if res.Leader == "" {
+				// the members are electing a leader
+				select {
+				case <-time.After(100 * time.Millisecond):
+				case <-ctx.Done():
+					return response{}, ctx.Err()
+				}
+			}
+		default:
+			c.mu.Lock()
+			c.leader = id
+			c.mu.Unlock()
+			return res, nil
+		}
+	}
+}
+
+// caller returns the caller of the leader, or of the next member while it is unknown
+func (c *Client) caller(watch bool) (string, *spine.ServiceCaller[request, response], error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	callers := c.callers
+	if watch {
+		callers = c.watchers
+	}
+	if callers == nil {
+		return "", nil, ErrClosed
+	}
+
+	id := c.leader
+	if id == "" {
+		id = c.members[c.next%len(c.members)]
+	}
+	if caller, ok := callers[id]; ok {
+		return id, caller, nil
+	}
+	caller, err := spine.NewServiceCaller[request, response](c.namespace, kvService(c.store, id),
+		spine.WithCodec(spine.JSONCodec[request]()), spine.WithCodec(spine.JSONCodec[response]()))
+	if err != nil {
+		return "", nil, err
+	}
+	callers[id] = caller
+	return id, caller, nil
+}
+
+// failed moves on from member id to leaderID, or to the next member if it is not known
+func (c *Client) failed(id string, leaderID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if leaderID != "" && slices.Contains(c.members, leaderID) {
+		c.leader = leaderID
+		return
+	}
+	if c.leader == id {
+		c.leader = ""
+	}
+	c.next++
+}
@@ -0,0 +1,267 @@
+package kv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/poisnoir/spine-go"
+)
+
+func newNamespace(t *testing.T, name string) *spine.Namespace {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := spine.JointNamespace(name, "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ns.Disconnect)
+	return ns
+}
+
+// newStore starts every member in a namespace of its own, like members on different machines
+func newStore(t *testing.T, namespace string, store string, ids []string) map[string]*Member {
+	members := make(map[string]*Member, len(ids))
+	for _, id := range ids {
+		m, err := NewMember(newNamespace(t, namespace), Config{
+			Store:             store,
+			ID:                id,
+			Members:           ids,
+			Dir:               t.TempDir(),
+			HeartbeatInterval: 50 * time.Millisecond,
+			ElectionTimeout:   500 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(m.Close)
+		members[id] = m
+	}
+	return members
+}
+
+func leaderOf(t *testing.T, members map[string]*Member) *Member {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, m := range members {
+			if m.IsLeader() {
+				return m
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("no leader was elected")
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	members := newStore(t, "test_kv", "mission", ids)
+
+	client, err := NewClient(newNamespace(t, "test_kv"), "mission", ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	created, err := client.CompareAndSwap(ctx, "mode", 0, []byte("idle"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CompareAndSwap(ctx, "mode", 0, []byte("teleop")); !errors.Is(err, ErrConflict) {
+		t.Errorf("expected a conflict creating an existing key, got %v", err)
+	}
+
+	events := make(chan Event, 10)
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	go client.Watch(watchCtx, "mo", created.Revision, func(e Event) { events <- e })
+
+	swapped, err := client.CompareAndSwap(ctx, "mode", created.Revision, []byte("mission"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(ctx, "other", []byte("ignored by the watch")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"idle", "mission"} {
+		select {
+		case e := <-events:
+			if e.Type != EventPut || string(e.KeyValue.Value) != expected {
+				t.Errorf("expected put %s, got %+v", expected, e)
+			}
+		case <-ctx.Done():
+			t.Fatal("no watch event")
+		}
+	}
+
+	// the store keeps working and keeps its data without its leader
+	first := leaderOf(t, members)
+	first.Close()
+	delete(members, first.ID())
+	if next := leaderOf(t, members); next == first {
+		t.Fatal("the closed member is still the leader")
+	}
+
+	kv, found, err := client.Get(ctx, "mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || string(kv.Value) != "mission" || kv.Revision != swapped.Revision {
+		t.Errorf("unexpected value %+v after the leader left", kv)
+	}
+
+	if _, err := client.CompareAndDelete(ctx, "mode", swapped.Revision); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-events:
+		if e.Type != EventDelete || e.KeyValue.Key != "mode" {
+			t.Errorf("expected the delete of mode, got %+v", e)
+		}
+	case <-ctx.Done():
+		t.Fatal("no watch event for the delete")
+	}
+	if _, found, _ := client.Get(ctx, "mode"); found {
+		t.Error("expected mode to be deleted")
+	}
+}
+
+func TestMember_Restart(t *testing.T) {
+	dir := t.TempDir()
+	config := Config{Store: "restart", ID: "a", Members: []string{"a"}, Dir: dir}
+
+	ns := newNamespace(t, "test_kv_restart")
+	m, err := NewMember(ns, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(ns, "restart", config.Members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if _, err := client.Put(ctx, "robot_mode", []byte("auto")); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	m, err = NewMember(ns, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	kv, found, err := client.Get(ctx, "robot_mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || string(kv.Value) != "auto" {
+		t.Errorf("expected the value to survive the restart, got %+v", kv)
+	}
+}
+
+func TestMember_CompactedHistory(t *testing.T) {
+	m := &Member{data: make(map[string]KeyValue), changed: make(chan struct{})}
+	for revision := uint64(1); revision <= historySize+1; revision++ {
+		m.put("mode", []byte("idle"), revision)
+	}
+	m.lastApplied = historySize + 1
+
+	// the first tenth of the changes is dropped, a watch resumes right after it
+	ctx := context.Background()
+	if _, _, err := m.watch(ctx, "", historySize/10); !errors.Is(err, ErrCompacted) {
+		t.Errorf("expected a dropped revision to be compacted, got %v", err)
+	}
+	events, _, err := m.watch(ctx, "", historySize/10+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || events[0].KeyValue.Revision != historySize/10+1 {
+		t.Errorf("expected the watch to start at revision %d, got %+v", historySize/10+1, events)
+	}
+}
+
+func TestStore_Snapshot(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	configs := make(map[string]Config, len(ids))
+	for _, id := range ids {
+		configs[id] = Config{
+			Store:             "snapshot",
+			ID:                id,
+			Members:           ids,
+			Dir:               t.TempDir(),
+			HeartbeatInterval: 50 * time.Millisecond,
+			ElectionTimeout:   500 * time.Millisecond,
+			SnapshotEntries:   5,
+		}
+	}
+	start := func(id string) *Member {
+		m, err := NewMember(newNamespace(t, "test_kv_snapshot"), configs[id])
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(m.Close)
+		return m
+	}
+	start("a")
+	start("b")
+
+	client, err := NewClient(newNamespace(t, "test_kv_snapshot"), "snapshot", ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var last KeyValue
+	for i := range 20 {
+		if last, err = client.Put(ctx, fmt.Sprintf("waypoint/%d", i), []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// c joins after the entries it is missing were replaced with a snapshot
+	c := start("c")
+	for {
+		c.mu.Lock()
+		applied, keys, first := c.lastApplied, len(c.data), c.firstIndex()
+		c.mu.Unlock()
+		if applied >= last.Revision {
+			if keys != 20 || first == 0 {
+				t.Errorf("expected c to install a snapshot with 20 keys, got %d keys after index %d", keys, first)
+			}
+			break
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("c did not catch up")
+		}
+	}
+
+	// the snapshot and the rest of the log survive a restart
+	c.Close()
+	c = start("c")
+	c.mu.Lock()
+	keys, first := len(c.data), c.firstIndex()
+	c.mu.Unlock()
+	if first == 0 || keys == 0 {
+		t.Errorf("expected c to restart from its snapshot, got %d keys after index %d", keys, first)
+	}
+	kv, found, err := client.Get(ctx, "waypoint/19")
+	if err != nil || !found || kv.Revision != last.Revision {
+		t.Errorf("unexpected value %+v, %v", kv, err)
+	}
+}
@@ -0,0 +1,912 @@
+// Package kv is a small replicated key-value store that runs inside a namespace.
+//
+// A store is a fixed set of members that replicate a log with Raft over spine services, so it keeps working and
+// keeps its data while a majority of them is up. Changes go through the log of the leader and gets are answered by
+// the leader once a majority confirmed it still leads, which makes gets, puts and compare-and-swaps linearizable.
+// Revisions are the log index of the operation that last changed a key, watches stream the changes after a revision.
+// Applied entries are replaced with a snapshot of the data, members missing them receive the snapshot instead.
+//
+// Each member serves <store>/<id>/raft to the other members and <store>/<id>/kv to clients.
+// Requests and responses must fit in a spine frame, so keys and values are small.
+package kv
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poisnoir/spine-go"
+)
+
+const (
+	MaxKeySize   = 256
+	MaxValueSize = 1024
+
+	// entries of one append request are kept under this many bytes of JSON so the request fits in a frame
+	maxAppendSize = 2500
+	// events of one watch response are kept under this many bytes of JSON
+	maxWatchSize = 2500
+	// a snapshot is sent in chunks of this many bytes, they are base64 in the JSON of the request
+	snapshotChunkSize = 768
+	// changes kept for watches, older revisions are compacted
+	historySize = 10000
+	// how long a watch request waits for a change and other requests for their commit
+	watchWait      = 5 * time.Second
+	requestTimeout = 5 * time.Second
+)
+
+var (
+	ErrConflict      = errors.New("revision does not match")
+	ErrCompacted     = errors.New("revision is compacted")
+	ErrLeaderChanged = errors.New("leader changed before the operation was committed")
+	ErrClosed        = errors.New("member is closed")
+)
+
+// Config describes a member of a store
+type Config struct {
+	// Store names the store, its members advertise their endpoints under it
+	Store string
+	// ID of the member, one of Members
+	ID      string
+	Members []string
+	// Dir keeps the member's term, vote and log so it can restart. Without it the member keeps them in memory,
+	// which is fine for tests but a restarted member may then vote twice in a term.
+	Dir string
+	// HeartbeatInterval is 100ms and ElectionTimeout 1s unless set, elections start after one to two timeouts
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	// SnapshotEntries applied entries are replaced with a snapshot of the data, 1000 unless set
+	SnapshotEntries int
+}
+
+func (c *Config) validate() error {
+	if c.Store == "" {
+		return errors.New("the store needs a name")
+	}
+	if !slices.Contains(c.Members, c.ID) {
+		return fmt.Errorf("member %s is not one of %v", c.ID, c.Members)
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = 100 * time.Millisecond
+	}
+	if c.ElectionTimeout == 0 {
+		c.ElectionTimeout = time.Second
+	}
+	if c.SnapshotEntries == 0 {
+		c.SnapshotEntries = 1000
+	}
+	if c.ElectionTimeout <= 2*c.HeartbeatInterval {
+		return fmt.Errorf("election timeout %s must be more than twice the heartbeat interval %s", c.ElectionTimeout, c.HeartbeatInterval)
+	}
+	return nil
+}
+
+type role uint8
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// entry is an operation in the log. log[0] stands for the last entry of the snapshot, or is a placeholder while
+// there is none, and log[i] has index log[0].Index+i.
+type entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Op    operation `json:"op"`
+}
+
+type opType string
+
+const (
+	opNoop   opType = "noop"
+	opGet    opType = "get"
+	opPut    opType = "put"
+	opDelete opType = "delete"
+	// opCAS puts Value, or deletes the key if Delete is set, when the revision of the key is Revision
+	opCAS   opType = "cas"
+	opWatch opType = "watch"
+)
+
+type operation struct {
+	Type     opType `json:"type"`
+	Key      string `json:"key,omitempty"`
+	Value    []byte `json:"value,omitempty"`
+	Revision uint64 `json:"revision,omitempty"`
+	Delete   bool   `json:"delete,omitempty"`
+}
+
+// KeyValue is a key and its value at Revision, the revision of the last change to the key
+type KeyValue struct {
+	Key      string `json:"key"`
+	Value    []byte `json:"value,omitempty"`
+	Revision uint64 `json:"revision"`
+}
+
+type EventType string
+
+const (
+	EventPut    EventType = "put"
+	EventDelete EventType = "delete"
+)
+
+// Event is a change of a key, KeyValue.Revision is the revision of the change
+type Event struct {
+	Type     EventType `json:"type"`
+	KeyValue KeyValue  `json:"kv"`
+}
+
+// snapshot is the data after the entry Index of term Term, it replaces the log up to there
+type snapshot struct {
+	Index uint64     `json:"index"`
+	Term  uint64     `json:"term"`
+	Data  []KeyValue `json:"data"`
+}
+
+// snapshotProgress is how much of the snapshot of Index a follower has received
+type snapshotProgress struct {
+	index  uint64
+	offset int
+}
+
+// result is the outcome of an operation
+type result struct {
+	Found    bool     `json:"found,omitempty"`
+	Conflict bool     `json:"conflict,omitempty"`
+	KeyValue KeyValue `json:"kv"`
+}
+
+type waiter struct {
+	term    uint64
+	results chan result
+}
+
+// Member is a member of a store
+type Member struct {
+	namespace *spine.Namespace
+	config    Config
+	logger    *slog.Logger
+	storage   *storage
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	raftService *spine.ThreadedService[raftRequest, raftResponse]
+	kvService   *spine.ThreadedService[request, response]
+	peers       map[string]*spine.ServiceCaller[raftRequest, raftResponse]
+
+	mu               sync.Mutex
+	role             role
+	term             uint64
+	votedFor         string
+	leader           string
+	log              []entry
+	commitIndex      uint64
+	lastApplied      uint64
+	electionDeadline time.Time
+	lastBroadcast    time.Time
+	nextIndex        map[string]uint64
+	matchIndex       map[string]uint64
+	inflight         map[string]bool
+	waiters          map[uint64]waiter
+
+	// round counts the broadcasts of the leader, acked is the last round each follower answered
+	round uint64
+	acked map[string]uint64
+	// closed and replaced whenever a follower answers or the member loses leadership
+	acknowledged chan struct{}
+
+	// snapshot is the encoded snapshot the log starts after, sending tracks it to followers and receiving from the leader
+	snapshot  []byte
+	sending   map[string]snapshotProgress
+	receiving snapshotProgress
+	received  []byte
+
+	data      map[string]KeyValue
+	history   []Event
+	compacted uint64
+	// closed and replaced whenever entries are applied
+	changed chan struct{}
+}
+
+func raftService(store string, id string) string {
+	return store + "/" + id + "/raft"
+}
+
+func kvService(store string, id string) string {
+	return store + "/" + id + "/kv"
+}
+
+// NewMember starts a member of the store config describes
+func NewMember(namespace *spine.Namespace, config Config) (*Member, error) {
+	config.Members = slices.Clone(config.Members)
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(namespace.Context())
+	m := &Member{
+		namespace: namespace,
+		config:    config,
+		logger:    namespace.Logger().With("store", config.Store, "member", config.ID),
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		peers:      make(map[string]*spine.ServiceCaller[raftRequest, raftResponse]),
+		log:        []entry{{}},
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inflight:   make(map[string]bool),
+		waiters:    make(map[uint64]waiter),
+		acked:      make(map[string]uint64),
+		sending:    make(map[string]snapshotProgress),
+		data:       make(map[string]KeyValue),
+		changed:    make(chan struct{}),
+
+		acknowledged: make(chan struct{}),
+	}
+
+	if config.Dir != "" {
+		s, saved, err := openStorage(config.Dir)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		m.storage = s
+		m.term, m.votedFor = saved.state.Term, saved.state.VotedFor
+		if saved.snapshot != nil {
+			if err := m.restore(saved.snapshot); err != nil {
+				s.close()
+				cancel()
+				return nil, fmt.Errorf("invalid snapshot in %s: %w", config.Dir, err)
+			}
+		}
+		m.log = append(m.log, saved.entries...)
+	}
+
+	jsonCodecs := []spine.Option{
+		spine.WithCodec(spine.JSONCodec[raftRequest]()), spine.WithCodec(spine.JSONCodec[raftResponse]()),
+	}
+	for _, id := range config.Members {
+		if id == config.ID {
+			continue
+		}
+		caller, err := spine.NewServiceCaller[raftRequest, raftResponse](namespace, raftService(config.Store, id), jsonCodecs...)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.peers[id] = caller
+	}
+
+	var err error
+	m.raftService, err = spine.NewThreadedServiceWithContext(namespace, raftService(config.Store, config.ID), m.handleRaft, jsonCodecs...)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	m.kvService, err = spine.NewThreadedServiceWithContext(namespace, kvService(config.Store, config.ID), m.handleRequest,
+		spine.WithCodec(spine.JSONCodec[request]()), spine.WithCodec(spine.JSONCodec[response]()))
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.resetElection()
+	m.mu.Unlock()
+	go m.run()
+	return m, nil
+}
+
+// Close stops the member, the others elect a new leader if it led the store
+func (m *Member) Close() {
+	m.cancel()
+	if m.raftService != nil {
+		m.raftService.Close()
+	}
+	if m.kvService != nil {
+		m.kvService.Close()
+	}
+	for _, peer := range m.peers {
+		peer.Close()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storage.close()
+	m.storage = nil
+}
+
+func (m *Member) ID() string {
+	return m.config.ID
+}
+
+// Leader returns the id of the member this member follows, empty while there is none
+func (m *Member) Leader() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.leader
+}
+
+func (m *Member) IsLeader() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.role == leader
+}
+
+// run starts elections when the leader is silent and sends heartbeats while leading
+func (m *Member) run() {
+	ticker := time.NewTicker(m.config.HeartbeatInterval / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			m.mu.Lock()
+			for index, w := range m.waiters {
+				close(w.results)
+				delete(m.waiters, index)
+			}
+			m.mu.Unlock()
+			return
+		}
+
+		m.mu.Lock()
+		now := time.Now()
+		if m.role == leader {
+			if now.Sub(m.lastBroadcast) >= m.config.HeartbeatInterval {
+				m.broadcast()
+			}
+		} else if now.After(m.electionDeadline) {
+			m.startElection()
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *Member) resetElection() {
+	timeout := m.config.ElectionTimeout
+	m.electionDeadline = time.Now().Add(timeout + rand.N(timeout))
+}
+
+// firstIndex is the index of the last entry of the snapshot, the log holds the entries after it
+func (m *Member) firstIndex() uint64 {
+	return m.log[0].Index
+}
+
+func (m *Member) lastIndex() uint64 {
+	return m.firstIndex() + uint64(len(m.log)-1)
+}
+
+// entryAt returns the entry of index, which is not before firstIndex
+func (m *Member) entryAt(index uint64) entry {
+	return m.log[index-m.firstIndex()]
+}
+
+// saveState persists the term and vote, it must succeed before the member acts on them
+func (m *Member) saveState() error {
+	err := m.storage.saveState(hardState{Term: m.term, VotedFor: m.votedFor})
+	if err != nil {
+		m.logger.Error("unable to save state", "error", err)
+	}
+	return err
+}
+
+func (m *Member) becomeFollower(term uint64, leaderID string) {
+	if term > m.term {
+		m.term, m.votedFor = term, ""
+		m.saveState()
+	}
+	if m.role == leader {
+		m.logger.Info("lost leadership", "term", m.term)
+		m.acknowledge()
+	}
+	m.role = follower
+	m.leader = leaderID
+}
+
+func (m *Member) quorum() int {
+	return len(m.config.Members)/2 + 1
+}
+
+func (m *Member) startElection() {
+	m.role = candidate
+	m.term++
+	m.votedFor = m.config.ID
+	m.leader = ""
+	m.resetElection()
+	if m.saveState() != nil {
+		return
+	}
+
+	term := m.term
+	request := raftRequest{Vote: &voteRequest{
+		Term:      term,
+		Candidate: m.config.ID,
+		LastIndex: m.lastIndex(),
+		LastTerm:  m.entryAt(m.lastIndex()).Term,
+	}}
+	votes := 1
+	if votes >= m.quorum() {
+		m.becomeLeader()
+		return
+	}
+
+	for id, peer := range m.peers {
+		go func() {
+			ctx, cancel := context.WithTimeout(m.ctx, m.config.ElectionTimeout/2)
+			defer cancel()
+			response, err := peer.Call(request, ctx)
+			if err != nil || response.Vote == nil {
+				return
+			}
+
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			if response.Vote.Term > m.term {
+				m.becomeFollower(response.Vote.Term, "")
+				m.resetElection()
+				return
+			}
+			if m.role != candidate || m.term != term || !response.Vote.Granted {
+				return
+			}
+			m.logger.Debug("got vote", "from", id, "term", term)
+			votes++
+			if votes >= m.quorum() {
+				m.becomeLeader()
+			}
+		}()
+	}
+}
+
+func (m *Member) becomeLeader() {
+	m.role = leader
+	m.leader = m.config.ID
+	for id := range m.peers {
+		m.nextIndex[id] = m.lastIndex() + 1
+		m.matchIndex[id] = 0
+	}
+	m.logger.Info("became leader", "term", m.term)
+
+	// entries of earlier terms are only committed with one of the current term
+	if _, err := m.appendEntry(operation{Type: opNoop}); err != nil {
+		m.becomeFollower(m.term, "")
+		return
+	}
+	m.advanceCommit()
+	m.broadcast()
+}
+
+// appendEntry adds op to the leader's log
+func (m *Member) appendEntry(op operation) (entry, error) {
+	e := entry{Index: m.lastIndex() + 1, Term: m.term, Op: op}
+	if err := m.storage.append(e); err != nil {
+		m.logger.Error("unable to append to the log", "error", err)
+		return e, err
+	}
+	m.log = append(m.log, e)
+	return e, nil
+}
+
+// broadcast sends the entries each follower is missing, or a heartbeat, and starts a new round
+func (m *Member) broadcast() {
+	m.lastBroadcast = time.Now()
+	m.round++
+	for id := range m.peers {
+		m.replicate(id)
+	}
+}
+
+func (m *Member) replicate(id string) {
+	if m.inflight[id] {
+		return
+	}
+	next := m.nextIndex[id]
+	if next <= m.firstIndex() {
+		m.replicateSnapshot(id)
+		return
+	}
+	request := &appendRequest{
+		Term:      m.term,
+		Leader:    m.config.ID,
+		PrevIndex: next - 1,
+		PrevTerm:  m.entryAt(next - 1).Term,
+		Commit:    m.commitIndex,
+	}
+	size := 0
+	for _, e := range m.log[next-m.firstIndex():] {
+		encoded, _ := json.Marshal(e)
+		if size += len(encoded) + 1; size > maxAppendSize && len(request.Entries) > 0 {
+			break
+		}
+		request.Entries = append(request.Entries, e)
+	}
+
+	m.inflight[id] = true
+	go m.sendAppend(id, request, m.round)
+}
+
+// replicateSnapshot sends the next chunk of the snapshot to a follower that is missing the entries it replaced
+func (m *Member) replicateSnapshot(id string) {
+	progress := m.sending[id]
+	if progress.index != m.firstIndex() {
+		progress = snapshotProgress{index: m.firstIndex()}
+	}
+	end := min(progress.offset+snapshotChunkSize, len(m.snapshot))
+	request := &snapshotRequest{
+		Term:   m.term,
+		Leader: m.config.ID,
+		Index:  progress.index,
+		Offset: progress.offset,
+		Data:   m.snapshot[progress.offset:end],
+		Done:   end == len(m.snapshot),
+	}
+
+	m.inflight[id] = true
+	go m.sendSnapshot(id, request, m.round)
+}
+
+func (m *Member) sendSnapshot(id string, request *snapshotRequest, round uint64) {
+	ctx, cancel := context.WithTimeout(m.ctx, m.config.ElectionTimeout/2)
+	defer cancel()
+	response, err := m.peers[id].Call(raftRequest{Snapshot: request}, ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inflight[id] = false
+	if err != nil || response.Snapshot == nil {
+		return
+	}
+	if response.Snapshot.Term > m.term {
+		m.becomeFollower(response.Snapshot.Term, "")
+		m.resetElection()
+		return
+	}
+	if m.role != leader || m.term != request.Term {
+		return
+	}
+	m.ack(id, round)
+
+	if request.Done && response.Snapshot.Offset == request.Offset+len(request.Data) {
+		delete(m.sending, id)
+		if request.Index > m.matchIndex[id] {
+			m.matchIndex[id] = request.Index
+			m.nextIndex[id] = request.Index + 1
+			m.advanceCommit()
+		}
+	} else {
+		m.sending[id] = snapshotProgress{index: request.Index, offset: response.Snapshot.Offset}
+	}
+	if m.nextIndex[id] <= m.lastIndex() || m.acked[id] < m.round {
+		m.replicate(id)
+	}
+}
+
+// ack records that a follower answered a request of round, it still followed the leader then
+func (m *Member) ack(id string, round uint64) {
+	if round > m.acked[id] {
+		m.acked[id] = round
+		m.acknowledge()
+	}
+}
+
+func (m *Member) acknowledge() {
+	close(m.acknowledged)
+	m.acknowledged = make(chan struct{})
+}
+
+// confirmed reports whether a majority answered the leader since round started
+func (m *Member) confirmed(round uint64) bool {
+	replicas := 1
+	for _, acked := range m.acked {
+		if acked >= round {
+			replicas++
+		}
+	}
+	return replicas >= m.quorum()
+}
+
+func (m *Member) sendAppend(id string, request *appendRequest, round uint64) {
+	ctx, cancel := context.WithTimeout(m.ctx, m.config.ElectionTimeout/2)
+	defer cancel()
+	response, err := m.peers[id].Call(raftRequest{Append: request}, ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inflight[id] = false
+	if err != nil || response.Append == nil {
+		return
+	}
+	if response.Append.Term > m.term {
+		m.becomeFollower(response.Append.Term, "")
+		m.resetElection()
+		return
+	}
+	if m.role != leader || m.term != request.Term {
+		return
+	}
+	m.ack(id, round)
+
+	if response.Append.Success {
+		match := request.PrevIndex + uint64(len(request.Entries))
+		if match > m.matchIndex[id] {
+			m.matchIndex[id] = match
+			m.nextIndex[id] = match + 1
+			m.advanceCommit()
+		}
+	} else {
+		m.nextIndex[id] = max(1, min(m.nextIndex[id]-1, response.Append.LastIndex+1))
+	}
+	// a follower skipped while a request was in flight still has to answer the current round
+	if m.nextIndex[id] <= m.lastIndex() || m.acked[id] < m.round {
+		m.replicate(id)
+	}
+}
+
+// advanceCommit commits the entries of the current term a majority has
+func (m *Member) advanceCommit() {
+	for n := m.lastIndex(); n > m.commitIndex && m.entryAt(n).Term == m.term; n-- {
+		replicas := 1
+		for _, match := range m.matchIndex {
+			if match >= n {
+				replicas++
+			}
+		}
+		if replicas >= m.quorum() {
+			m.commitIndex = n
+			m.apply()
+			return
+		}
+	}
+}
+
+// apply runs the committed entries on the data and answers their waiters
+func (m *Member) apply() {
+	if m.lastApplied >= m.commitIndex {
+		return
+	}
+	for m.lastApplied < m.commitIndex {
+		m.lastApplied++
+		e := m.entryAt(m.lastApplied)
+		res := m.applyOperation(e)
+		if w, ok := m.waiters[e.Index]; ok {
+			if w.term != e.Term {
+				close(w.results)
+			} else {
+				w.results <- res
+			}
+			delete(m.waiters, e.Index)
+		}
+	}
+	close(m.changed)
+	m.changed = make(chan struct{})
+	m.compact()
+}
+
+// compact replaces the applied entries with a snapshot once there are SnapshotEntries of them
+func (m *Member) compact() {
+	if m.lastApplied-m.firstIndex() < uint64(m.config.SnapshotEntries) {
+		return
+	}
+	s := snapshot{Index: m.lastApplied, Term: m.entryAt(m.lastApplied).Term}
+	s.Data = slices.SortedFunc(maps.Values(m.data), func(a, b KeyValue) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		m.logger.Error("unable to encode a snapshot", "error", err)
+		return
+	}
+	if err := m.storage.saveSnapshot(encoded); err != nil {
+		m.logger.Error("unable to save a snapshot", "error", err)
+		return
+	}
+
+	rest := m.log[s.Index-m.firstIndex()+1:]
+	// the saved log may keep the entries of the snapshot if this fails, they are skipped on restart
+	if err := m.storage.rewrite(rest); err != nil {
+		m.logger.Error("unable to truncate the log", "error", err)
+	}
+	m.log = append([]entry{{Index: s.Index, Term: s.Term}}, rest...)
+	m.snapshot = encoded
+}
+
+// restore replaces the data with an encoded snapshot and the log with its last entry
+func (m *Member) restore(encoded []byte) error {
+	var s snapshot
+	if err := json.Unmarshal(encoded, &s); err != nil {
+		return err
+	}
+	m.log = []entry{{Index: s.Index, Term: s.Term}}
+	m.snapshot = encoded
+	m.commitIndex = max(m.commitIndex, s.Index)
+	m.lastApplied = s.Index
+
+	m.data = make(map[string]KeyValue, len(s.Data))
+	for _, kv := range s.Data {
+		m.data[kv.Key] = kv
+	}
+	// the changes up to the snapshot are gone
+	m.history = nil
+	m.compacted = s.Index
+	close(m.changed)
+	m.changed = make(chan struct{})
+	return nil
+}
+
+func (m *Member) applyOperation(e entry) result {
+	op := e.Op
+	current, found := m.data[op.Key]
+	switch op.Type {
+	case opPut:
+		return m.put(op.Key, op.Value, e.Index)
+	case opDelete:
+		if found {
+			m.delete(op.Key, e.Index)
+		}
+		return result{Found: found, KeyValue: current}
+	case opCAS:
+		if current.Revision != op.Revision {
+			return result{Found: found, Conflict: true, KeyValue: current}
+		}
+		if op.Delete {
+			if found {
+				m.delete(op.Key, e.Index)
+			}
+			return result{Found: found, KeyValue: current}
+		}
+		return m.put(op.Key, op.Value, e.Index)
+	}
+	return result{}
+}
+
+func (m *Member) put(key string, value []byte, revision uint64) result {
+	kv := KeyValue{Key: key, Value: value, Revision: revision}
+	m.data[key] = kv
+	m.record(Event{Type: EventPut, KeyValue: kv})
+	return result{Found: true, KeyValue: kv}
+}
+
+func (m *Member) delete(key string, revision uint64) {
+	delete(m.data, key)
+	m.record(Event{Type: EventDelete, KeyValue: KeyValue{Key: key, Revision: revision}})
+}
+
+func (m *Member) record(event Event) {
+	if len(m.history) == historySize {
+		m.compacted = m.history[historySize/10-1].KeyValue.Revision
+		m.history = slices.Delete(m.history, 0, historySize/10)
+	}
+	m.history = append(m.history, event)
+}
+
+// propose appends op to the log and waits until it is applied
+func (m *Member) propose(ctx context.Context, op operation) (result, string, error) {
+	m.mu.Lock()
+	if m.role != leader {
+		leaderID := m.leader
+		m.mu.Unlock()
+		return result{}, leaderID, errNotLeader
+	}
+	e, err := m.appendEntry(op)
+	if err != nil {
+		m.mu.Unlock()
+		return result{}, "", err
+	}
+	results := make(chan result, 1)
+	m.waiters[e.Index] = waiter{term: e.Term, results: results}
+	m.advanceCommit()
+	m.broadcast()
+	m.mu.Unlock()
+
+	select {
+	case res, ok := <-results:
+		if !ok {
+			if m.ctx.Err() != nil {
+				return res, "", ErrClosed
+			}
+			return res, "", ErrLeaderChanged
+		}
+		return res, "", nil
+	case <-ctx.Done():
+		m.mu.Lock()
+		delete(m.waiters, e.Index)
+		m.mu.Unlock()
+		return result{}, "", ctx.Err()
+	}
+}
+
+// read returns the value of key once a majority confirmed the member still leads, so it is at least as new as
+// any change committed before the read started
+func (m *Member) read(ctx context.Context, key string) (result, string, error) {
+	m.mu.Lock()
+	if m.role != leader {
+		leaderID := m.leader
+		m.mu.Unlock()
+		return result{}, leaderID, errNotLeader
+	}
+	term := m.term
+	m.broadcast()
+	round := m.round
+
+	for {
+		if m.role != leader || m.term != term {
+			leaderID := m.leader
+			m.mu.Unlock()
+			return result{}, leaderID, errNotLeader
+		}
+		// a new leader knows every committed entry once one of its own term is committed
+		if m.entryAt(m.commitIndex).Term == term && m.confirmed(round) {
+			current, found := m.data[key]
+			m.mu.Unlock()
+			return result{Found: found, KeyValue: current}, "", nil
+		}
+		changed, acknowledged := m.changed, m.acknowledged
+		m.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-acknowledged:
+		case <-m.ctx.Done():
+			return result{}, "", ErrClosed
+		case <-ctx.Done():
+			return result{}, "", ctx.Err()
+		}
+		m.mu.Lock()
+	}
+}
+
+// watch returns the events of keys starting with prefix from revision from on, waiting for one if there are none
+func (m *Member) watch(ctx context.Context, prefix string, from uint64) ([]Event, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, watchWait)
+	defer cancel()
+
+	for {
+		m.mu.Lock()
+		if from <= m.compacted {
+			m.mu.Unlock()
+			return nil, 0, ErrCompacted
+		}
+		next := max(from, m.lastApplied+1)
+		var events []Event
+		size := 0
+		start, _ := slices.BinarySearchFunc(m.history, from, func(e Event, revision uint64) int {
+			return cmp.Compare(e.KeyValue.Revision, revision)
+		})
+		for _, event := range m.history[start:] {
+			if !strings.HasPrefix(event.KeyValue.Key, prefix) {
+				continue
+			}
+			encoded, _ := json.Marshal(event)
+			if size += len(encoded) + 1; size > maxWatchSize && len(events) > 0 {
+				next = event.KeyValue.Revision
+				break
+			}
+			events = append(events, event)
+		}
+		changed := m.changed
+		m.mu.Unlock()
+
+		if len(events) > 0 {
+			return events, next, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, next, nil
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// errNotLeader is answered with the leader's id so clients can go to it
+var errNotLeader = errors.New("member is not the leader")
+
+// requests between members, exactly one field is set
+
+type raftRequest struct {
+	Vote     *voteRequest     `json:"vote,omitempty"`
+	Append   *appendRequest   `json:"append,omitempty"`
+	Snapshot *snapshotRequest `json:"snapshot,omitempty"`
+}
+
+type raftResponse struct {
+	Vote     *voteResponse     `json:"vote,omitempty"`
+	Append   *appendResponse   `json:"append,omitempty"`
+	Snapshot *snapshotResponse `json:"snapshot,omitempty"`
+}
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type appendRequest struct {
+	Term      uint64  `json:"term"`
+	Leader    string  `json:"leader"`
+	PrevIndex uint64  `json:"prev_index"`
+	PrevTerm  uint64  `json:"prev_term"`
+	Entries   []entry `json:"entries,omitempty"`
+	Commit    uint64  `json:"commit"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastIndex is the follower's last index, the leader continues from there when the logs differ
+	LastIndex uint64 `json:"last_index"`
+}
+
+// snapshotRequest carries the chunk at Offset of the encoded snapshot up to Index, Done is set on the last one
+type snapshotRequest struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+	Index  uint64 `json:"index"`
+	Offset int    `json:"offset"`
+	Data   []byte `json:"data"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+type snapshotResponse struct {
+	Term uint64 `json:"term"`
+	// Offset is where the follower expects the next chunk
+	Offset int `json:"offset"`
+}
+
+// request of a client, Revision is the expected revision of a compare-and-swap or the first revision of a watch
+type request struct {
+	Op       operation `json:"op"`
+	Revision uint64    `json:"revision,omitempty"`
+}
+
+type response struct {
+	// NotLeader is set when the member can't serve the request, Leader is the member to ask instead if it is known
+	NotLeader bool   `json:"not_leader,omitempty"`
+	Leader    string `json:"leader,omitempty"`
+
+	Result result  `json:"result"`
+	Events []Event `json:"events,omitempty"`
+	// Next is the revision to continue a watch from, Compacted is set if the revision it asked for is gone
+	Next      uint64 `json:"next,omitempty"`
+	Compacted bool   `json:"compacted,omitempty"`
+}
+
+func (m *Member) handleRaft(_ context.Context, request raftRequest) (raftResponse, error) {
+	switch {
+	case request.Vote != nil:
+		return raftResponse{Vote: m.handleVote(request.Vote)}, nil
+	case request.Append != nil:
+		return raftResponse{Append: m.handleAppend(request.Append)}, nil
+	case request.Snapshot != nil:
+		return raftResponse{Snapshot: m.handleSnapshot(request.Snapshot)}, nil
+	}
+	return raftResponse{}, errors.New("empty raft request")
+}
+
+func (m *Member) handleVote(request *voteRequest) *voteResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if request.Term > m.term {
+		m.becomeFollower(request.Term, "")
+	}
+	response := &voteResponse{Term: m.term}
+	if request.Term < m.term || (m.votedFor != "" && m.votedFor != request.Candidate) {
+		return response
+	}
+
+	// only candidates with every committed entry can win
+	lastTerm := m.entryAt(m.lastIndex()).Term
+	if request.LastTerm < lastTerm || (request.LastTerm == lastTerm && request.LastIndex < m.lastIndex()) {
+		return response
+	}
+
+	m.votedFor = request.Candidate
+	if m.saveState() != nil {
+		m.votedFor = ""
+		return response
+	}
+	m.resetElection()
+	response.Granted = true
+	return response
+}
+
+func (m *Member) handleAppend(request *appendRequest) *appendResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	response := &appendResponse{Term: m.term, LastIndex: m.lastIndex()}
+	if request.Term < m.term {
+		return response
+	}
+	if request.Term > m.term || m.role != follower || m.leader != request.Leader {
+		m.becomeFollower(request.Term, request.Leader)
+	}
+	m.resetElection()
+	response.Term = m.term
+
+	// the snapshot holds the committed entries up to the first index
+	if first := m.firstIndex(); request.PrevIndex < first {
+		skip := min(first-request.PrevIndex, uint64(len(request.Entries)))
+		request.Entries = request.Entries[skip:]
+		request.PrevIndex, request.PrevTerm = first, m.log[0].Term
+	}
+
+	if request.PrevIndex > m.lastIndex() || m.entryAt(request.PrevIndex).Term != request.PrevTerm {
+		response.LastIndex = min(m.lastIndex(), request.PrevIndex-1)
+		return response
+	}
+
+	for i, e := range request.Entries {
+		index := request.PrevIndex + 1 + uint64(i)
+		if index <= m.lastIndex() {
+			if m.entryAt(index).Term == e.Term {
+				continue
+			}
+			// entries that conflict with the leader were never committed
+			kept := m.log[:index-m.firstIndex()]
+			if err := m.storage.rewrite(kept[1:]); err != nil {
+				m.logger.Error("unable to truncate the log", "error", err)
+				return response
+			}
+			m.log = kept
+		}
+		if err := m.storage.append(request.Entries[i:]...); err != nil {
+			m.logger.Error("unable to append to the log", "error", err)
+			return response
+		}
+		m.log = append(m.log, request.Entries[i:]...)
+		break
+	}
+
+	if commit := min(request.Commit, request.PrevIndex+uint64(len(request.Entries))); commit > m.commitIndex {
+		m.commitIndex = commit
+		m.apply()
+	}
+	response.Success = true
+	response.LastIndex = m.lastIndex()
+	return response
+}
+
+// handleSnapshot collects the chunks of the leader's snapshot and installs it once it is complete
+func (m *Member) handleSnapshot(request *snapshotRequest) *snapshotResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	response := &snapshotResponse{Term: m.term}
+	if request.Term < m.term {
+		return response
+	}
+	if request.Term > m.term || m.role != follower || m.leader != request.Leader {
+		m.becomeFollower(request.Term, request.Leader)
+	}
+	m.resetElection()
+	response.Term = m.term
+
+	if request.Offset == 0 {
+		m.receiving = snapshotProgress{index: request.Index}
+		m.received = m.received[:0]
+	}
+	if request.Index != m.receiving.index || request.Offset != m.receiving.offset {
+		// the chunks of another snapshot, the leader starts over
+		return response
+	}
+	m.received = append(m.received, request.Data...)
+	m.receiving.offset = len(m.received)
+	if !request.Done {
+		response.Offset = m.receiving.offset
+		return response
+	}
+
+	encoded := m.received
+	m.receiving, m.received = snapshotProgress{}, nil
+	if err := m.installSnapshot(encoded); err != nil {
+		m.logger.Error("unable to install a snapshot", "error", err)
+		return response
+	}
+	response.Offset = len(encoded)
+	return response
+}
+
+// installSnapshot replaces the data with the leader's snapshot, the entries that follow it are kept
+func (m *Member) installSnapshot(encoded []byte) error {
+	var s snapshot
+	if err := json.Unmarshal(encoded, &s); err != nil {
+		return err
+	}
+	if s.Index <= m.lastApplied {
+		return nil
+	}
+
+	var rest []entry
+	if s.Index < m.lastIndex() && m.entryAt(s.Index).Term == s.Term {
+		rest = slices.Clone(m.log[s.Index-m.firstIndex()+1:])
+	}
+	if err := m.storage.saveSnapshot(encoded); err != nil {
+		return err
+	}
+	if err := m.storage.rewrite(rest); err != nil {
+		return err
+	}
+	if err := m.restore(encoded); err != nil {
+		return err
+	}
+	m.log = append(m.log, rest...)
+	return nil
+}
+
+func (m *Member) handleRequest(ctx context.Context, req request) (response, error) {
+	op := req.Op
+	if len(op.Key) > MaxKeySize || len(op.Value) > MaxValueSize {
+		return response{}, fmt.Errorf("keys are limited to %d bytes and values to %d bytes", MaxKeySize, MaxValueSize)
+	}
+
+	switch op.Type {
+	case opWatch:
+		events, next, err := m.watch(ctx, op.Key, req.Revision)
+		if errors.Is(err, ErrCompacted) {
+			return response{Compacted: true}, nil
+		}
+		return response{Events: events, Next: next}, err
+	case opGet, opPut, opDelete, opCAS:
+	default:
+		return response{}, fmt.Errorf("unknown operation %q", op.Type)
+	}
+	if op.Type == opCAS {
+		op.Revision = req.Revision
+	}
+
+	// an operation is not answered while the leader can't reach a majority
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	var res result
+	var leaderID string
+	var err error
+	if op.Type == opGet {
+		res, leaderID, err = m.read(ctx, op.Key)
+	} else {
+		res, leaderID, err = m.propose(ctx, op)
+	}
+	if errors.Is(err, errNotLeader) {
+		return response{NotLeader: true, Leader: leaderID}, nil
+	}
+	return response{Result: res}, err
+}
@@ -0,0 +1,195 @@
+package kv
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// storage keeps the term, vote, snapshot and log of a member in a directory so it can restart without breaking
+// the guarantees of the store. A nil storage keeps nothing.
+//
+//	state.json     {"term":3,"voted_for":"b"}
+//	snapshot.json  {"index":1200,"term":2,"data":[...]}
+//	log.jsonl      one entry per line, the entries after the snapshot
+type storage struct {
+	dir string
+	log *os.File
+}
+
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// saved is what a member finds in its directory, snapshot is nil if it has none
+type saved struct {
+	state    hardState
+	snapshot []byte
+	entries  []entry
+}
+
+// openStorage reads what dir holds, it is created if it does not exist
+func openStorage(dir string) (*storage, saved, error) {
+	var result saved
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, result, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "state.json"))
+	if err == nil {
+		if err := json.Unmarshal(data, &result.state); err != nil {
+			return nil, result, fmt.Errorf("invalid state in %s: %w", dir, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, result, err
+	}
+
+	// the log may still hold the entries of the snapshot if the member stopped before truncating it
+	var first uint64
+	result.snapshot, err = os.ReadFile(filepath.Join(dir, "snapshot.json"))
+	if err == nil {
+		var s snapshot
+		if err := json.Unmarshal(result.snapshot, &s); err != nil {
+			return nil, result, fmt.Errorf("invalid snapshot in %s: %w", dir, err)
+		}
+		first = s.Index
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, result, err
+	}
+
+	path := filepath.Join(dir, "log.jsonl")
+	var entries []entry
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var e entry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				// the last line is torn if the member stopped while writing it
+				break
+			}
+			if e.Index <= first {
+				continue
+			}
+			if last := first + uint64(len(entries)); e.Index != last+1 {
+				f.Close()
+				return nil, result, fmt.Errorf("log in %s skips from %d to %d", dir, last, e.Index)
+			}
+			entries = append(entries, e)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, result, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, result, err
+	}
+
+	s := &storage{dir: dir}
+	// rewriting drops a torn last line and the entries of the snapshot
+	if err := s.rewrite(entries); err != nil {
+		return nil, result, err
+	}
+	result.entries = entries
+	return s, result, nil
+}
+
+func (s *storage) saveState(state hardState) error {
+	if s == nil {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, "state.json.tmp")
+	if err := writeSynced(tmp, data); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, "state.json"))
+}
+
+// saveSnapshot replaces the snapshot, the log is rewritten after it
+func (s *storage) saveSnapshot(encoded []byte) error {
+	if s == nil {
+		return nil
+	}
+	tmp := filepath.Join(s.dir, "snapshot.json.tmp")
+	if err := writeSynced(tmp, encoded); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, "snapshot.json"))
+}
+
+func (s *storage) append(entries ...entry) error {
+	if s == nil {
+		return nil
+	}
+	w := bufio.NewWriter(s.log)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite replaces the log with entries, used when a follower drops entries that conflict with the leader
+// and when a snapshot replaces the first ones
+func (s *storage) rewrite(entries []entry) error {
+	if s == nil {
+		return nil
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+
+	path := filepath.Join(s.dir, "log.jsonl")
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	s.log = f
+	if err := s.append(entries...); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		f.Close()
+		return err
+	}
+	// the open file follows the rename
+	return nil
+}
+
+func (s *storage) close() {
+	if s != nil && s.log != nil {
+		s.log.Close()
+	}
+}
+
+func writeSynced(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
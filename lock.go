@@ -0,0 +1,479 @@
+package spine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLocked is returned by TryAcquire while another holder has the lock
+	ErrLocked = errors.New("lock is held")
+	// ErrLockLost is returned by a lock that expired or was released
+	ErrLockLost = errors.New("lock is lost")
+	// ErrLockServerStarting is returned by TryAcquire while the lock server lets the holders of the server before it
+	// renew their locks, the lock may be free
+	ErrLockServerStarting = errors.New("lock server grants no locks yet")
+)
+
+const (
+	// name of the lock service of a namespace
+	lockService = "/spine/locks"
+	// how long the server holds a blocking acquire before the locker asks again
+	lockWait = 5 * time.Second
+	// holders count their lock as expired this fraction of its ttl early, in case their clock runs slower
+	// than the server's
+	lockClockMargin = 10
+)
+
+type lockOp string
+
+const (
+	lockAcquire lockOp = "acquire"
+	lockRenew   lockOp = "renew"
+	lockRelease lockOp = "release"
+)
+
+type lockRequest struct {
+	Op   lockOp `json:"op"`
+	Name string `json:"name"`
+	// Holder identifies one acquisition of the lock, Token is the fencing token it was granted
+	Holder string        `json:"holder"`
+	Token  uint64        `json:"token,omitempty"`
+	TTL    time.Duration `json:"ttl,omitempty"`
+	// Wait makes an acquire wait for the lock to be free
+	Wait bool `json:"wait,omitempty"`
+}
+
+type lockResponse struct {
+	Granted bool   `json:"granted"`
+	Token   uint64 `json:"token,omitempty"`
+	// Waited is how long a blocking acquire waited for the lock before it was granted
+	Waited time.Duration `json:"waited,omitempty"`
+	// Grace is how long the server still grants no locks after it started or took over
+	Grace time.Duration `json:"grace,omitempty"`
+}
+
+// LockServer grants the locks of a namespace. Locks expire when their holder stops renewing them.
+//
+// Locks are only kept in memory. A server that starts, or takes over WithElection, grants no locks for maxTTL
+// and lets the holders of the server before it renew theirs meanwhile.
+type LockServer struct {
+	namespace *Namespace
+	maxTTL    time.Duration
+	service   *ThreadedService[lockRequest, lockResponse]
+	election  *Election
+	stop      func()
+
+	mu sync.Mutex
+	// token of the leadership the locks were granted under
+	token uint64
+	locks map[string]heldLock
+	// last token granted, the tokens of a server that won an election start after the term of its election token
+	last       uint64
+	graceUntil time.Time
+	// released is closed and replaced whenever a lock is released
+	released chan struct{}
+}
+
+type heldLock struct {
+	holder string
+	token  uint64
+	expiry time.Time
+}
+
+// NewLockServer serves the locks of namespace, allowing TTLs up to maxTTL.
+// opts configure its service, several servers can stand by for each other WithElection.
+func NewLockServer(namespace *Namespace, maxTTL time.Duration, opts ...Option) (*LockServer, error) {
+	if maxTTL <= 0 {
+		return nil, fmt.Errorf("invalid max ttl %s", maxTTL)
+	}
+
+	s := &LockServer{
+		namespace: namespace,
+		maxTTL:    maxTTL,
+
+		locks:      make(map[string]heldLock),
+		graceUntil: time.Now().Add(maxTTL),
+		released:   make(chan struct{}),
+	}
+
+	options := buildOptions(opts)
+	if options.election != nil {
+		s.election = options.election
+		s.stop = options.election.observe(func(leading bool, token uint64) {
+			if leading {
+				s.reset(token)
+			}
+		})
+	}
+
+	opts = append(opts, WithCodec(JSONCodec[lockRequest]()), WithCodec(JSONCodec[lockResponse]()))
+	service, err := NewThreadedServiceWithContext(namespace, lockService, s.handleRequest, opts...)
+	if err != nil {
+		if s.stop != nil {
+			s.stop()
+		}
+		return nil, err
+	}
+	s.service = service
+	return s, nil
+}
+
+func (s *LockServer) Close() {
+	if s.stop != nil {
+		s.stop()
+	}
+	s.service.Close()
+}
+
+// reset forgets the locks when the server takes over from another one
+func (s *LockServer) reset(token uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locks = make(map[string]heldLock)
+	s.token = token
+	s.last = max(s.last, tokenTerm(token)<<32)
+	s.graceUntil = time.Now().Add(s.maxTTL)
+}
+
+func (s *LockServer) handleRequest(ctx context.Context, request lockRequest) (lockResponse, error) {
+	if request.Name == "" || request.Holder == "" {
+		return lockResponse{}, errors.New("a lock request needs a name and a holder")
+	}
+	if request.Op != lockRelease && (request.TTL <= 0 || request.TTL > s.maxTTL) {
+		return lockResponse{}, fmt.Errorf("ttl %s is not between 0 and %s", request.TTL, s.maxTTL)
+	}
+
+	switch request.Op {
+	case lockAcquire:
+		ctx, cancel := context.WithTimeout(ctx, lockWait)
+		defer cancel()
+		start := time.Now()
+		for {
+			response, wait, released, err := s.acquire(request)
+			if err != nil || response.Granted || !request.Wait {
+				if response.Granted {
+					response.Waited = time.Since(start)
+				}
+				return response, err
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-released:
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return response, nil
+			}
+			timer.Stop()
+		}
+	case lockRenew:
+		return s.renew(request)
+	case lockRelease:
+		s.release(request)
+		return lockResponse{Granted: true}, nil
+	}
+	return lockResponse{}, fmt.Errorf("unknown lock operation %q", request.Op)
+}
+
+// leads reports whether the server still leads under the leadership its locks were granted under, s.mu must be held.
+// A server that took over again may lead before it forgot the locks of its former leadership.
+func (s *LockServer) leads() bool {
+	if s.election == nil {
+		return true
+	}
+	leading, token := s.election.leadership()
+	return leading && token == s.token
+}
+
+// acquire grants the lock if it is free, otherwise it returns how long it stays taken at most
+func (s *LockServer) acquire(request lockRequest) (lockResponse, time.Duration, <-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.leads() {
+		return lockResponse{}, 0, nil, ErrNotLeader
+	}
+	now := time.Now()
+	if now.Before(s.graceUntil) {
+		grace := s.graceUntil.Sub(now)
+		return lockResponse{Grace: grace}, grace, s.released, nil
+	}
+	held, ok := s.locks[request.Name]
+	if ok && now.Before(held.expiry) {
+		if held.holder != request.Holder {
+			return lockResponse{}, held.expiry.Sub(now), s.released, nil
+		}
+		// the holder asks again when it missed the answer
+		held.expiry = now.Add(request.TTL)
+		s.locks[request.Name] = held
+		return lockResponse{Granted: true, Token: held.token}, 0, nil, nil
+	}
+
+	s.last++
+	s.locks[request.Name] = heldLock{holder: request.Holder, token: s.last, expiry: now.Add(request.TTL)}
+	return lockResponse{Granted: true, Token: s.last}, 0, nil, nil
+}
+
+func (s *LockServer) renew(request lockRequest) (lockResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.leads() {
+		return lockResponse{}, ErrNotLeader
+	}
+	now := time.Now()
+	held, ok := s.locks[request.Name]
+	switch {
+	case ok && now.Before(held.expiry):
+		if held.holder != request.Holder || held.token != request.Token {
+			return lockResponse{}, nil
+		}
+	case now.Before(s.graceUntil) && request.Token != 0:
+		// a holder of the server before this one
+		held = heldLock{holder: request.Holder, token: request.Token}
+		s.last = max(s.last, request.Token)
+	default:
+		return lockResponse{}, nil
+	}
+	held.expiry = now.Add(request.TTL)
+	s.locks[request.Name] = held
+	return lockResponse{Granted: true, Token: held.token}, nil
+}
+
+func (s *LockServer) release(request lockRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	held, ok := s.locks[request.Name]
+	if !ok || held.holder != request.Holder || held.token != request.Token {
+		return
+	}
+	delete(s.locks, request.Name)
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// Locker acquires locks from the lock server of a namespace
+type Locker struct {
+	namespace *Namespace
+	caller    *ServiceCaller[lockRequest, lockResponse]
+	// blocking acquires wait on their own caller so they don't hold up renewals
+	waiter *ServiceCaller[lockRequest, lockResponse]
+}
+
+func NewLocker(namespace *Namespace) (*Locker, error) {
+	caller, err := NewServiceCaller[lockRequest, lockResponse](namespace, lockService,
+		WithCodec(JSONCodec[lockRequest]()), WithCodec(JSONCodec[lockResponse]()))
+	if err != nil {
+		return nil, err
+	}
+	waiter, err := NewServiceCaller[lockRequest, lockResponse](namespace, lockService,
+		WithCodec(JSONCodec[lockRequest]()), WithCodec(JSONCodec[lockResponse]()))
+	if err != nil {
+		caller.Close()
+		return nil, err
+	}
+	return &Locker{namespace: namespace, caller: caller, waiter: waiter}, nil
+}
+
+// Close stops the locker, its locks expire once their TTL runs out
+func (l *Locker) Close() {
+	l.caller.Close()
+	l.waiter.Close()
+}
+
+// TryAcquire acquires the lock called name for ttl, or returns ErrLocked if another holder has it
+// and ErrLockServerStarting if the server grants no locks yet. The lock is renewed every third of its ttl until it is released or the namespace disconnects.
+func (l *Locker) TryAcquire(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	request, err := newLockRequest(name, ttl)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	response, err := l.caller.Call(request, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if response.Grace > 0 {
+		return nil, fmt.Errorf("%w, it grants them in %s", ErrLockServerStarting, response.Grace)
+	}
+	if !response.Granted {
+		return nil, ErrLocked
+	}
+	return l.hold(request, response.Token, start), nil
+}
+
+// Acquire waits until it acquires the lock called name for ttl or ctx is done.
+// The lock is renewed like the locks of TryAcquire.
+func (l *Locker) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	request, err := newLockRequest(name, ttl)
+	if err != nil {
+		return nil, err
+	}
+	request.Wait = true
+
+	for {
+		attempt, cancel := context.WithTimeout(ctx, lockWait+time.Second)
+		start := time.Now()
+		response, err := l.waiter.Call(request, attempt)
+		cancel()
+		if err == nil && response.Granted {
+			// the ttl runs from the grant, which is at least the wait of the server after the request was sent
+			return l.hold(request, response.Token, start.Add(response.Waited)), nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			// a server that is gone or stood down is asked again, the new one answers once it is found
+			if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, ErrNotLeader) {
+				return nil, err
+			}
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+func newLockRequest(name string, ttl time.Duration) (lockRequest, error) {
+	if name == "" {
+		return lockRequest{}, errors.New("a lock needs a name")
+	}
+	if ttl <= 0 {
+		return lockRequest{}, fmt.Errorf("invalid ttl %s", ttl)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return lockRequest{}, err
+	}
+	return lockRequest{Op: lockAcquire, Name: name, Holder: hex.EncodeToString(id), TTL: ttl}, nil
+}
+
+// hold renews a granted lock, its ttl is counted from start, when the request was sent
+func (l *Locker) hold(request lockRequest, token uint64, start time.Time) *Lock {
+	ctx, cancel := context.WithCancel(l.namespace.ctx)
+	lock := &Lock{
+		locker:  l,
+		name:    request.Name,
+		holder:  request.Holder,
+		token:   token,
+		ttl:     request.TTL,
+		ctx:     ctx,
+		cancel:  cancel,
+		renewed: start,
+	}
+	go lock.heartbeat()
+	return lock
+}
+
+// Lock is a lock held from a lock server
+type Lock struct {
+	locker *Locker
+	name   string
+	holder string
+	token  uint64
+	ttl    time.Duration
+
+	// ctx is done once the lock is released or lost
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// renewed is when the last granted request was sent, the server counts the ttl from a later time
+	mu      sync.Mutex
+	renewed time.Time
+}
+
+func (l *Lock) Name() string {
+	return l.name
+}
+
+// Token is the fencing token of the lock, it is larger than the tokens of the holders before
+func (l *Lock) Token() uint64 {
+	return l.token
+}
+
+// Done is closed when the lock is released or lost, including when the namespace disconnects
+func (l *Lock) Done() <-chan struct{} {
+	return l.ctx.Done()
+}
+
+// Renew extends the lock by its ttl, it returns ErrLockLost if the lock expired or was released
+func (l *Lock) Renew(ctx context.Context) error {
+	if l.ctx.Err() != nil {
+		return ErrLockLost
+	}
+
+	start := time.Now()
+	request := lockRequest{Op: lockRenew, Name: l.name, Holder: l.holder, Token: l.token, TTL: l.ttl}
+	response, err := l.locker.caller.Call(request, ctx)
+	if err != nil {
+		return err
+	}
+	if !response.Granted {
+		l.cancel()
+		return ErrLockLost
+	}
+
+	l.mu.Lock()
+	l.renewed = start
+	l.mu.Unlock()
+	return nil
+}
+
+// Release gives the lock up, a lock that is not released expires once its ttl runs out
+func (l *Lock) Release(ctx context.Context) error {
+	if l.ctx.Err() != nil {
+		return nil
+	}
+	l.cancel()
+	request := lockRequest{Op: lockRelease, Name: l.name, Holder: l.holder, Token: l.token}
+	_, err := l.locker.caller.Call(request, ctx)
+	return err
+}
+
+// expiry is when the lock may have expired on the server, a margin early in case the clock runs slow
+func (l *Lock) expiry() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.renewed.Add(l.ttl - l.ttl/lockClockMargin)
+}
+
+// heartbeat renews the lock until it is released, and gives it up before it could expire unrenewed
+func (l *Lock) heartbeat() {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	var err error
+	for {
+		expired := time.NewTimer(time.Until(l.expiry()))
+		select {
+		case <-l.ctx.Done():
+			expired.Stop()
+			return
+		case <-expired.C:
+			l.locker.namespace.logger.Warn("lock expired", "lock", l.name, "token", l.token, "error", err)
+			l.cancel()
+			return
+		case <-ticker.C:
+			expired.Stop()
+		}
+
+		ctx, cancel := context.WithTimeout(l.ctx, l.ttl/3)
+		err = l.Renew(ctx)
+		cancel()
+		if errors.Is(err, ErrLockLost) {
+			l.locker.namespace.logger.Warn("lost lock", "lock", l.name, "token", l.token)
+			return
+		}
+	}
+}
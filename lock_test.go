@@ -0,0 +1,118 @@
+package spine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	join := func() *Namespace {
+		ns, err := JointNamespace("test_lock", "secret", logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(ns.Disconnect)
+		return ns
+	}
+
+	server, err := NewLockServer(join(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	first, err := NewLocker(join())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	secondNs := join()
+	second, err := NewLocker(secondNs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// the server grants nothing for its max ttl after it starts
+	if _, err := second.TryAcquire(ctx, "flash", 300*time.Millisecond); !errors.Is(err, ErrLockServerStarting) {
+		t.Fatalf("expected the starting server to grant no locks, got %v", err)
+	}
+	lock, err := first.Acquire(ctx, "calibration", 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// heartbeats keep the lock past its ttl
+	time.Sleep(time.Second)
+	if _, err := second.TryAcquire(ctx, "calibration", 300*time.Millisecond); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+	if err := lock.Renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan *Lock, 1)
+	go func() {
+		next, err := second.Acquire(ctx, "calibration", 300*time.Millisecond)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- next
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := lock.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := lock.Renew(ctx); !errors.Is(err, ErrLockLost) {
+		t.Errorf("expected a released lock to be lost, got %v", err)
+	}
+
+	next := <-acquired
+	if next == nil {
+		t.FailNow()
+	}
+	if next.Token() <= lock.Token() {
+		t.Errorf("expected a token after %d, got %d", lock.Token(), next.Token())
+	}
+
+	// the lock of a namespace that disconnects expires
+	secondNs.Disconnect()
+	select {
+	case <-next.Done():
+	case <-ctx.Done():
+		t.Fatal("the lock of a disconnected namespace is still held")
+	}
+	if _, err := first.Acquire(ctx, "calibration", 300*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockServer_FormerLeadership(t *testing.T) {
+	election := &Election{leading: true, token: electionToken(2, "a"), expiry: time.Now().Add(time.Minute)}
+	s := &LockServer{election: election, maxTTL: time.Second, locks: make(map[string]heldLock), released: make(chan struct{})}
+	s.reset(electionToken(1, "a"))
+	s.graceUntil = time.Time{}
+
+	// the candidate leads again but the server has not forgotten the locks of its former leadership yet
+	request := lockRequest{Op: lockAcquire, Name: "calibration", Holder: "h", TTL: time.Second, Wait: true}
+	if _, err := s.handleRequest(context.Background(), request); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("expected an acquire under the former leadership to fail, got %v", err)
+	}
+	if _, err := s.handleRequest(context.Background(), lockRequest{Op: lockRenew, Name: "calibration", Holder: "h", Token: 1, TTL: time.Second}); !errors.Is(err, ErrNotLeader) {
+		t.Errorf("expected a renew under the former leadership to fail, got %v", err)
+	}
+
+	s.reset(election.token)
+	s.graceUntil = time.Time{}
+	if response, err := s.handleRequest(context.Background(), request); err != nil || !response.Granted {
+		t.Errorf("expected the lock to be granted, got %+v, %v", response, err)
+	}
+}
@@ -0,0 +1,99 @@
+package spine
+
+import (
+	"context"
+	"maps"
+	"sync"
+)
+
+// Metadata is side information (auth token, tenant, origin...) sent along with a call or a message
+type Metadata map[string]string
+
+func (md Metadata) Get(key string) string {
+	return md[key]
+}
+
+func (md Metadata) Copy() Metadata {
+	return maps.Clone(md)
+}
+
+type outgoingMetadataKey struct{}
+type incomingMetadataKey struct{}
+type trailerKey struct{}
+
+// NewOutgoingContext returns a copy of ctx whose calls send md
+func NewOutgoingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, outgoingMetadataKey{}, md)
+}
+
+// OutgoingMetadata returns the metadata calls made with ctx will send
+func OutgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(outgoingMetadataKey{}).(Metadata)
+	return md
+}
+
+// IncomingMetadata returns the metadata the caller sent, it is available in handlers and server interceptors
+func IncomingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingMetadataKey{}).(Metadata)
+	return md
+}
+
+func newIncomingContext(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, incomingMetadataKey{}, md)
+}
+
+// trailer collects the response metadata a handler sets
+type trailer struct {
+	mu sync.Mutex
+	md Metadata
+}
+
+func withTrailer(ctx context.Context) (context.Context, *trailer) {
+	t := &trailer{}
+	return context.WithValue(ctx, trailerKey{}, t), t
+}
+
+func (t *trailer) get() Metadata {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.md
+}
+
+// SetTrailer adds md to the metadata sent back with the response of the request ctx belongs to.
+// It returns false if ctx is not the context of a request.
+func SetTrailer(ctx context.Context, md Metadata) bool {
+	t, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.md == nil {
+		t.md = make(Metadata, len(md))
+	}
+	maps.Copy(t.md, md)
+	return true
+}
+
+// CallOption configures a single ServiceCaller.Call
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	metadata Metadata
+	trailer  *Metadata
+}
+
+// WithCallMetadata sends md with the call, on top of the metadata of the context
+func WithCallMetadata(md Metadata) CallOption {
+	return func(o *callOptions) {
+		o.metadata = md
+	}
+}
+
+// WithTrailer stores the metadata the handler sent back in md
+func WithTrailer(md *Metadata) CallOption {
+	return func(o *callOptions) {
+		o.trailer = md
+	}
+}
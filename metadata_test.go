@@ -0,0 +1,184 @@
+package spine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+func TestMetadata_Call(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_metadata", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	_, err = NewServiceWithContext(ns, "whoami", func(ctx context.Context, input string) (string, error) {
+		md := IncomingMetadata(ctx)
+		SetTrailer(ctx, Metadata{"served-by": "whoami"})
+		return md.Get("tenant") + "/" + md.Get("token") + "/" + input, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := NewServiceCaller[string, string](ns, "whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ctx = NewOutgoingContext(ctx, Metadata{"tenant": "acme"})
+
+	var trailer Metadata
+	resp, err := caller.Call("hello", ctx, WithCallMetadata(Metadata{"token": "t0k"}), WithTrailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp != "acme/t0k/hello" {
+		t.Errorf("expected 'acme/t0k/hello', got '%s'", resp)
+	}
+	if trailer.Get("served-by") != "whoami" {
+		t.Errorf("expected trailer, got %v", trailer)
+	}
+}
+
+func TestMetadata_PublisherHeaders(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_headers", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	pub, err := NewPublisher[uint32](ns, "temperature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	received := make(chan MessageInfo, 10)
+	sub, err := NewSubscriberWithInfo(ns, "temperature", func(temp uint32, info MessageInfo) {
+		received <- info
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		pub.PublishWithHeaders(21, Metadata{"unit": "celsius"})
+		select {
+		case info := <-received:
+			if info.Headers.Get("unit") != "celsius" {
+				t.Errorf("expected unit header, got %v", info.Headers)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("no message received")
+		}
+	}
+}
+
+func TestMessageInfo_Stamps(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_message_info", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	node, err := NewNode(ns, "sensor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	if err := node.Configure(); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Activate(); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := NewPublisher[uint32](ns, "stamped", WithNode(node))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan MessageInfo, 10)
+	sub, err := NewSubscriberWithInfo(ns, "stamped", func(_ uint32, info MessageInfo) {
+		received <- info
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	var last uint64
+	timeout := time.After(5 * time.Second)
+	for value := uint32(0); last < 3; value++ {
+		pub.Publish(value)
+		select {
+		case info := <-received:
+			if info.Sequence <= last {
+				t.Fatalf("sequence went from %d to %d", last, info.Sequence)
+			}
+			last = info.Sequence
+			if info.PublisherNodeID != node.ID() {
+				t.Errorf("expected node id %s, got %s", node.ID(), info.PublisherNodeID)
+			}
+			if info.SentAt.IsZero() || info.ReceivedAt.Before(info.SentAt) {
+				t.Errorf("bad timestamps sent %v received %v", info.SentAt, info.ReceivedAt)
+			}
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("no message received")
+		}
+	}
+}
+
+func TestMetadata_ErrorWithLargeTrailer(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_metadata_large", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	_, err = NewServiceWithContext(ns, "fails", func(ctx context.Context, input string) (string, error) {
+		SetTrailer(ctx, Metadata{"dump": strings.Repeat("x", 2*globals.MAX_PACKET_SIZE)})
+		return "", errors.New("broken")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := NewServiceCaller[string, string](ns, "fails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var trailer Metadata
+	_, err = caller.Call("hello", ctx, WithTrailer(&trailer))
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expected handler error, got %v", err)
+	}
+	if trailer.Get("dump") != "" {
+		t.Errorf("expected the trailer to be dropped, got %d bytes", len(trailer.Get("dump")))
+	}
+}
@@ -0,0 +1,113 @@
+package spine
+
+// MetricsSink receives the measurements of every endpoint in a namespace.
+// Labels are shared between calls and must not be modified by the sink.
+type MetricsSink interface {
+	AddCounter(name string, labels map[string]string, value float64)
+	SetGauge(name string, labels map[string]string, value float64)
+	ObserveHistogram(name string, labels map[string]string, value float64)
+}
+
+// Metric names reported by endpoints
+const (
+	MetricRequests          = "spine_service_requests_total"
+	MetricRequestErrors     = "spine_service_errors_total"
+	MetricHandlerDuration   = "spine_service_handler_duration_seconds"
+	MetricQueueDepth        = "spine_service_queue_depth"
+	MetricCalls             = "spine_caller_calls_total"
+	MetricCallErrors        = "spine_caller_errors_total"
+	MetricCallDuration      = "spine_caller_call_duration_seconds"
+	MetricPublished         = "spine_publisher_messages_total"
+	MetricSubscribers       = "spine_publisher_subscribers"
+	MetricCoalesced         = "spine_publisher_coalesced_total"
+	MetricFiltered          = "spine_publisher_filtered_total"
+	MetricOverruns          = "spine_publisher_overruns_total"
+	MetricReceived          = "spine_subscriber_messages_total"
+	MetricReconnects        = "spine_reconnects_total"
+	MetricBytesIn           = "spine_bytes_received_total"
+	MetricBytesOut          = "spine_bytes_sent_total"
+	MetricHandshakeFailures = "spine_handshake_failures_total"
+	MetricHeartbeatFailures = "spine_heartbeat_failures_total"
+	MetricCompressed        = "spine_compressed_messages_total"
+	MetricCompressionSaved  = "spine_compression_saved_bytes_total"
+)
+
+// Endpoint kinds used for the kind label
+const (
+	kindService         = "service"
+	kindThreadedService = "threaded_service"
+	kindServiceCaller   = "service_caller"
+	kindPublisher       = "publisher"
+	kindSubscriber      = "subscriber"
+)
+
+type metricInfo struct {
+	typ  string
+	help string
+}
+
+var metricInfos = map[string]metricInfo{
+	MetricRequests:          {"counter", "Requests received by a service."},
+	MetricRequestErrors:     {"counter", "Requests a service failed to handle."},
+	MetricHandlerDuration:   {"histogram", "Time spent in service handlers."},
+	MetricQueueDepth:        {"gauge", "Requests waiting for a service handler."},
+	MetricCalls:             {"counter", "Calls made by a service caller."},
+	MetricCallErrors:        {"counter", "Calls that returned an error."},
+	MetricCallDuration:      {"histogram", "Round trip time of service calls."},
+	MetricPublished:         {"counter", "Messages sent by a publisher."},
+	MetricSubscribers:       {"gauge", "Subscribers connected to a publisher."},
+	MetricCoalesced:         {"counter", "Messages replaced by a newer one before they were sent."},
+	MetricFiltered:          {"counter", "Messages not sent to a subscriber because they didn't match its filter."},
+	MetricOverruns:          {"counter", "Periods a timer publisher's producer took longer than."},
+	MetricReceived:          {"counter", "Messages received by a subscriber."},
+	MetricReconnects:        {"counter", "Connections re-established after a failure."},
+	MetricBytesIn:           {"counter", "Bytes read from the network."},
+	MetricBytesOut:          {"counter", "Bytes written to the network."},
+	MetricHandshakeFailures: {"counter", "Connections rejected during the type handshake."},
+	MetricHeartbeatFailures: {"counter", "Connections that did not answer a ping."},
+	MetricCompressed:        {"counter", "Payloads sent compressed."},
+	MetricCompressionSaved:  {"counter", "Bytes compression saved on sent payloads."},
+}
+
+type noopSink struct{}
+
+func (noopSink) AddCounter(string, map[string]string, float64)       {}
+func (noopSink) SetGauge(string, map[string]string, float64)         {}
+func (noopSink) ObserveHistogram(string, map[string]string, float64) {}
+
+// endpointMetrics reports to the namespace sink with the labels of one endpoint
+type endpointMetrics struct {
+	sink   MetricsSink
+	labels map[string]string
+}
+
+func newEndpointMetrics(namespace *Namespace, kind string, name string, options endpointOptions) *endpointMetrics {
+	labels := map[string]string{
+		"namespace": namespace.Name(),
+		"kind":      kind,
+		"endpoint":  name,
+	}
+	if options.node != nil {
+		labels["node"] = options.node.Name()
+	}
+	if options.compression != "" {
+		labels["compression"] = string(options.compression)
+	}
+	return &endpointMetrics{sink: namespace.metrics, labels: labels}
+}
+
+func (m *endpointMetrics) inc(name string) {
+	m.sink.AddCounter(name, m.labels, 1)
+}
+
+func (m *endpointMetrics) add(name string, value int) {
+	m.sink.AddCounter(name, m.labels, float64(value))
+}
+
+func (m *endpointMetrics) set(name string, value int) {
+	m.sink.SetGauge(name, m.labels, float64(value))
+}
+
+func (m *endpointMetrics) observe(name string, seconds float64) {
+	m.sink.ObserveHistogram(name, m.labels, seconds)
+}
@@ -0,0 +1,91 @@
+package spine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusSink_Format(t *testing.T) {
+	sink := NewPrometheusSink(0.1, 1)
+	labels := map[string]string{"endpoint": "math", "kind": "service"}
+
+	sink.AddCounter(MetricRequests, labels, 1)
+	sink.AddCounter(MetricRequests, labels, 2)
+	sink.SetGauge(MetricQueueDepth, labels, 4)
+	sink.ObserveHistogram(MetricHandlerDuration, labels, 0.05)
+	sink.ObserveHistogram(MetricHandlerDuration, labels, 0.5)
+
+	rec := httptest.NewRecorder()
+	sink.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	expected := []string{
+		"# TYPE spine_service_requests_total counter",
+		`spine_service_requests_total{endpoint="math",kind="service"} 3`,
+		`spine_service_queue_depth{endpoint="math",kind="service"} 4`,
+		`spine_service_handler_duration_seconds_bucket{endpoint="math",kind="service",le="0.1"} 1`,
+		`spine_service_handler_duration_seconds_bucket{endpoint="math",kind="service",le="1"} 2`,
+		`spine_service_handler_duration_seconds_bucket{endpoint="math",kind="service",le="+Inf"} 2`,
+		`spine_service_handler_duration_seconds_count{endpoint="math",kind="service"} 2`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetrics_Service(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	sink := NewPrometheusSink()
+	ns, err := JointNamespace("test_metrics", "secret", logger, WithMetrics(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	_, err = NewService(ns, "checked", func(input uint32) (uint32, error) {
+		if input == 0 {
+			return 0, errors.New("zero")
+		}
+		return input, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := NewServiceCaller[uint32, uint32](ns, "checked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, input := range []uint32{1, 2, 0} {
+		_, _ = caller.Call(input, ctx)
+	}
+
+	rec := httptest.NewRecorder()
+	sink.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	expected := []string{
+		`spine_service_requests_total{endpoint="checked",kind="service",namespace="test_metrics"} 3`,
+		`spine_service_errors_total{endpoint="checked",kind="service",namespace="test_metrics"} 1`,
+		`spine_caller_calls_total{endpoint="checked",kind="service_caller",namespace="test_metrics"} 3`,
+		`spine_service_handler_duration_seconds_count{endpoint="checked",kind="service",namespace="test_metrics"} 3`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, body)
+		}
+	}
+}
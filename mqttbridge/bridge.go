@@ -0,0 +1,357 @@
+// Package mqttbridge forwards messages between spine topics and the topics of an MQTT broker.
+//
+// With loop prevention, messages the bridge publishes to spine carry the header spine-bridge with its client id
+// and the ones it publishes to MQTT topics it also subscribes to are remembered for a while,
+// so a message the bridge forwarded is dropped when it comes back instead of being forwarded again.
+package mqttbridge
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/poisnoir/spine-go"
+	"github.com/poisnoir/spine-go/internal/globals"
+	"github.com/poisnoir/spine-go/internal/jsonpayload"
+)
+
+// HeaderBridge is the spine header naming the bridge that published a message
+const HeaderBridge = "spine-bridge"
+
+// echoWindow is how long a message published to MQTT is expected to come back within
+const echoWindow = 10 * time.Second
+
+// discoveryWait is how long the bridge looks for another publisher of a topic before it publishes it
+const discoveryWait = time.Second
+
+// Bridge forwards the messages of the mappings of its config
+type Bridge struct {
+	namespace *spine.Namespace
+	config    Config
+	client    mqtt.Client
+	echoes    echoes
+	logger    *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	subscribers []*spine.Subscriber[[]byte]
+	publishers  []*spine.Publisher[[]byte]
+}
+
+// route forwards an MQTT topic to spine
+type route struct {
+	mapping Mapping
+	schema  *spine.Schema
+	format  *jsonpayload.Format
+	// publisher is set once the publisher of the spine topic is created
+	publisher atomic.Pointer[spine.Publisher[[]byte]]
+}
+
+// New connects to the broker of config and starts forwarding. The spine subscribers are created once the publishers
+// of their topics are found, spine topics that already have a publisher are not published to.
+func New(namespace *spine.Namespace, config Config) (*Bridge, error) {
+	config.Mappings = slices.Clone(config.Mappings)
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(namespace.Context())
+
+	b := &Bridge{
+		namespace: namespace,
+		config:    config,
+		echoes:    echoes{sent: make(map[echo][]time.Time)},
+		logger:    namespace.Logger().With("mqtt_bridge", config.ClientID),
+
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	var routes []*route
+	for _, m := range config.Mappings {
+		if m.Direction != ToMQTT {
+			schema, err := spine.ParseSchema(m.Schema)
+			if err != nil {
+				return nil, fmt.Errorf("mapping %s: %w", m.Spine, err)
+			}
+			format, err := jsonpayload.NewFormat(schema.Code(), m.Schema)
+			if err != nil {
+				return nil, fmt.Errorf("mapping %s: %w", m.Spine, err)
+			}
+			routes = append(routes, &route{mapping: m, schema: schema, format: format})
+		}
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetOrderMatters(false).
+		SetOnConnectHandler(func(client mqtt.Client) {
+			// subscriptions don't survive reconnecting with a clean session
+			for _, r := range routes {
+				token := client.Subscribe(r.mapping.MQTT, r.mapping.QoS, b.fromMQTT(r))
+				go b.check(token, "unable to subscribe", r.mapping)
+			}
+		})
+
+	b.client = mqtt.NewClient(opts)
+	if token := b.client.Connect(); token.Wait() && token.Error() != nil {
+		cancel()
+		return nil, fmt.Errorf("unable to connect to %s: %w", config.Broker, token.Error())
+	}
+
+	for _, r := range routes {
+		go b.startPublisher(r)
+	}
+	for _, m := range config.Mappings {
+		if m.Direction != FromMQTT {
+			go b.startSubscriber(m, b.echoed(m.MQTT, routes))
+		}
+	}
+	return b, nil
+}
+
+// Close stops forwarding and disconnects from the broker
+func (b *Bridge) Close() {
+	b.cancel()
+	b.client.Disconnect(250)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, sub := range b.subscribers {
+		sub.Stop()
+	}
+	for _, pub := range b.publishers {
+		pub.Close()
+	}
+	b.subscribers, b.publishers = nil, nil
+}
+
+// resolve waits for the publisher of topic
+func (b *Bridge) resolve(topic string) (spine.Endpoint, error) {
+	for {
+		e, err := b.namespace.Registry().Resolve(b.ctx, topic)
+		if err == nil && e.Type != globals.ZERO_CONF_PUBLISHER {
+			return e, fmt.Errorf("%s is a %s, not a topic", topic, e.Type)
+		} else if err == nil || b.ctx.Err() != nil {
+			return e, err
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-b.ctx.Done():
+			return e, b.ctx.Err()
+		}
+	}
+}
+
+// startSubscriber forwards the spine topic of m to MQTT once its publisher is found
+func (b *Bridge) startSubscriber(m Mapping, echoed bool) {
+	logger := b.logger.With("spine", m.Spine, "mqtt", m.MQTT)
+
+	e, err := b.resolve(m.Spine)
+	if err != nil {
+		if b.ctx.Err() == nil {
+			logger.Error("unable to find the spine topic", "error", err)
+		}
+		return
+	}
+	var format *jsonpayload.Format
+	if m.Encoding == EncodingJSON {
+		if format, err = jsonpayload.NewFormat(e.Code, e.Schema); err != nil {
+			logger.Error("unable to convert the spine topic to JSON", "error", err)
+			return
+		}
+	}
+
+	sub, err := spine.NewRawSubscriber(b.namespace, m.Spine, e.Code, func(payload []byte, info spine.MessageInfo) {
+		if b.config.loopPrevention() && info.Headers.Get(HeaderBridge) == b.config.ClientID {
+			return
+		}
+
+		data := payload
+		if m.Encoding == EncodingJSON {
+			var err error
+			if data, err = format.Decode(payload); err != nil {
+				logger.Error("unable to convert message to JSON", "error", err)
+				return
+			}
+		}
+		if echoed && b.config.loopPrevention() {
+			b.echoes.add(m.MQTT, data)
+		}
+
+		token := b.client.Publish(m.MQTT, m.QoS, m.Retain, data)
+		go b.check(token, "unable to publish", m)
+	})
+	if err != nil {
+		logger.Error("unable to subscribe", "error", err)
+		return
+	}
+	b.keep(sub.Stop, func() { b.subscribers = append(b.subscribers, sub) })
+}
+
+// startPublisher creates the spine publisher of r unless another endpoint has its name
+func (b *Bridge) startPublisher(r *route) {
+	logger := b.logger.With("spine", r.mapping.Spine, "mqtt", r.mapping.MQTT)
+
+	ctx, cancel := context.WithTimeout(b.ctx, discoveryWait)
+	_, err := b.namespace.Registry().Resolve(ctx, r.mapping.Spine)
+	cancel()
+	if b.ctx.Err() != nil {
+		return
+	} else if err == nil {
+		logger.Error("the spine topic is taken by another endpoint")
+		return
+	}
+
+	pub, err := spine.NewRawPublisher(b.namespace, r.mapping.Spine, r.schema.Code(), spine.WithSchema(r.schema))
+	if err != nil {
+		logger.Error("unable to create publisher", "error", err)
+		return
+	}
+	b.keep(pub.Close, func() { b.publishers = append(b.publishers, pub) })
+	r.publisher.Store(pub)
+}
+
+// keep runs add unless the bridge closed while the endpoint was created, in which case it is stopped
+func (b *Bridge) keep(stop func(), add func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ctx.Err() != nil {
+		stop()
+		return
+	}
+	add()
+}
+
+// fromMQTT forwards the messages of r to spine
+func (b *Bridge) fromMQTT(r *route) mqtt.MessageHandler {
+	logger := b.logger.With("spine", r.mapping.Spine, "mqtt", r.mapping.MQTT)
+
+	return func(_ mqtt.Client, msg mqtt.Message) {
+		pub := r.publisher.Load()
+		if pub == nil {
+			logger.Debug("dropping message, the spine publisher is not created yet")
+			return
+		}
+		if b.config.loopPrevention() && b.echoes.consume(msg.Topic(), msg.Payload()) {
+			return
+		}
+
+		payload := msg.Payload()
+		if r.mapping.Encoding == EncodingJSON {
+			var err error
+			if payload, err = r.format.Encode(payload); err != nil {
+				logger.Error("unable to convert message from JSON", "topic", msg.Topic(), "error", err)
+				return
+			}
+		}
+
+		var headers spine.Metadata
+		if b.config.loopPrevention() {
+			headers = spine.Metadata{HeaderBridge: b.config.ClientID}
+		}
+		pub.PublishWithHeaders(payload, headers)
+	}
+}
+
+func (b *Bridge) check(token mqtt.Token, msg string, m Mapping) {
+	if token.Wait() && token.Error() != nil {
+		b.logger.Error(msg, "spine", m.Spine, "mqtt", m.MQTT, "error", token.Error())
+	}
+}
+
+// echoed reports whether messages published to topic come back through one of routes
+func (b *Bridge) echoed(topic string, routes []*route) bool {
+	for _, r := range routes {
+		if matchTopic(r.mapping.MQTT, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTopic reports whether topic matches the MQTT topic filter
+func matchTopic(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// echoes remembers when messages were published to MQTT until they come back
+type echoes struct {
+	mu     sync.Mutex
+	sent   map[echo][]time.Time
+	pruned time.Time
+}
+
+type echo struct {
+	topic string
+	sum   uint64
+}
+
+func newEcho(topic string, payload []byte) echo {
+	h := fnv.New64a()
+	h.Write(payload)
+	return echo{topic: topic, sum: h.Sum64()}
+}
+
+func (e *echoes) add(topic string, payload []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(e.pruned) > echoWindow {
+		for key, times := range e.sent {
+			if now.Sub(times[len(times)-1]) > echoWindow {
+				delete(e.sent, key)
+			}
+		}
+		e.pruned = now
+	}
+
+	key := newEcho(topic, payload)
+	e.sent[key] = append(e.sent[key], now)
+}
+
+// consume reports whether the message was published by the bridge and forgets it
+func (e *echoes) consume(topic string, payload []byte) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := newEcho(topic, payload)
+	times := e.sent[key]
+	for len(times) > 0 && time.Since(times[0]) > echoWindow {
+		times = times[1:]
+	}
+	if len(times) == 0 {
+		delete(e.sent, key)
+		return false
+	}
+	if times = times[1:]; len(times) == 0 {
+		delete(e.sent, key)
+	} else {
+		e.sent[key] = times
+	}
+	return true
+}
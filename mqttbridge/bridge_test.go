@@ -0,0 +1,170 @@
+package mqttbridge
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/poisnoir/spine-go"
+)
+
+type status struct {
+	RobotID uint8
+	Battery float32
+}
+
+// newBroker starts an in-process broker and returns its address
+func newBroker(t *testing.T) string {
+	broker := server.New(&server.Options{
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+		InlineClient: true,
+	})
+	broker.AddHook(new(auth.AllowHook), nil)
+	tcp := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	if err := broker.AddListener(tcp); err != nil {
+		t.Fatal(err)
+	}
+	go broker.Serve()
+	t.Cleanup(func() { broker.Close() })
+	return "tcp://" + tcp.Address()
+}
+
+// newClient connects to the broker and sends what it receives on topic to a channel
+func newClient(t *testing.T, broker string, topic string) (mqtt.Client, chan string) {
+	received := make(chan string, 100)
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID("test_client"))
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(100) })
+	if token := client.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		received <- string(msg.Payload())
+	}); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	return client, received
+}
+
+func newNamespace(t *testing.T, name string) *spine.Namespace {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := spine.JointNamespace(name, "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ns.Disconnect)
+	return ns
+}
+
+func TestBridge_ToMQTT(t *testing.T) {
+	broker := newBroker(t)
+	ns := newNamespace(t, "test_mqtt_to")
+	_, received := newClient(t, broker, "fleet/+/status")
+
+	pub, err := spine.NewPublisher[status](ns, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	path := filepath.Join(t.TempDir(), "bridge.json")
+	config := `{
+		"broker": "` + broker + `",
+		"client_id": "test_bridge",
+		"mappings": [{"spine": "status", "mqtt": "fleet/robot1/status", "direction": "to_mqtt", "qos": 1}]
+	}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bridge, err := New(ns, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bridge.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for {
+		pub.Publish(status{RobotID: 1, Battery: 0.5})
+		select {
+		case message := <-received:
+			if message != `{"Battery":0.5,"RobotID":1}` {
+				t.Errorf("unexpected message %s", message)
+			}
+			return
+		case <-ctx.Done():
+			t.Fatal("no message received")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestBridge_Both(t *testing.T) {
+	broker := newBroker(t)
+	ns := newNamespace(t, "test_mqtt_both")
+	client, echoed := newClient(t, broker, "fleet/commands")
+
+	// the bridge publishes what it receives from MQTT to spine and would forward it back without loop prevention
+	bridge, err := New(ns, Config{
+		Broker:   broker,
+		ClientID: "test_bridge",
+		Mappings: []Mapping{{Spine: "commands", MQTT: "fleet/commands", Direction: Both, Schema: "{Battery:f32,RobotID:u8}", QoS: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bridge.Close()
+
+	received := make(chan status, 10)
+	sub, err := spine.NewSubscriber(ns, "commands", func(s status) { received <- s })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sent := 0
+loop:
+	for {
+		client.Publish("fleet/commands", 1, false, `{"robot_id": 2, "battery": 1}`).Wait()
+		sent++
+		select {
+		case s := <-received:
+			if s != (status{RobotID: 2, Battery: 1}) {
+				t.Errorf("unexpected message %+v", s)
+			}
+			break loop
+		case <-ctx.Done():
+			t.Fatal("no message received")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// the client gets back only its own messages
+	time.Sleep(500 * time.Millisecond)
+	if len(echoed) != sent {
+		t.Errorf("sent %d messages and received %d", sent, len(echoed))
+	}
+
+	if _, err := New(ns, Config{Broker: broker, ClientID: "bad", Mappings: []Mapping{{Spine: "a", MQTT: "a/#", Direction: ToMQTT}}}); err == nil {
+		t.Error("expected publishing to a wildcard to be rejected")
+	}
+	if _, err := New(ns, Config{Broker: broker, ClientID: "bad", Mappings: []Mapping{{Spine: "a", MQTT: "a", Direction: FromMQTT}}}); err == nil {
+		t.Error("expected a mapping to spine without a schema to be rejected")
+	}
+}
@@ -0,0 +1,122 @@
+package mqttbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/poisnoir/spine-go"
+)
+
+// Direction is the way messages of a mapping are forwarded
+type Direction string
+
+const (
+	ToMQTT   Direction = "to_mqtt"
+	FromMQTT Direction = "from_mqtt"
+	Both     Direction = "both"
+)
+
+// Encoding is how payloads look on the MQTT side
+type Encoding string
+
+const (
+	// EncodingJSON converts payloads to and from JSON with the schema of the spine topic
+	EncodingJSON Encoding = "json"
+	// EncodingRaw forwards the spine payloads unchanged
+	EncodingRaw Encoding = "raw"
+)
+
+// Config is the configuration file of a bridge
+//
+//	{
+//	  "broker": "tcp://localhost:1883",
+//	  "client_id": "spine-bridge",
+//	  "mappings": [
+//	    {"spine": "status", "mqtt": "fleet/robot1/status", "direction": "to_mqtt", "qos": 1},
+//	    {"spine": "commands", "mqtt": "fleet/robot1/commands", "direction": "from_mqtt", "schema": "{Speed:f32}"}
+//	  ]
+//	}
+type Config struct {
+	Broker   string `json:"broker"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// LoopPrevention drops the messages the bridge forwarded when they come back to it, it is on unless set to false
+	LoopPrevention *bool     `json:"loop_prevention,omitempty"`
+	Mappings       []Mapping `json:"mappings"`
+}
+
+// Mapping forwards the messages of a spine topic and an MQTT topic
+type Mapping struct {
+	Spine     string    `json:"spine"`
+	MQTT      string    `json:"mqtt"`
+	Direction Direction `json:"direction"`
+	// Encoding is EncodingJSON unless set
+	Encoding Encoding `json:"encoding,omitempty"`
+	// Schema of the messages published to spine, required unless Direction is ToMQTT
+	Schema string `json:"schema,omitempty"`
+	QoS    byte   `json:"qos,omitempty"`
+	Retain bool   `json:"retain,omitempty"`
+}
+
+// LoadConfig reads the configuration file at path
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, config.validate()
+}
+
+func (c *Config) validate() error {
+	if c.Broker == "" {
+		return fmt.Errorf("no broker is configured")
+	}
+	if c.ClientID == "" {
+		return fmt.Errorf("no client id is configured")
+	}
+	for i := range c.Mappings {
+		m := &c.Mappings[i]
+		if m.Spine == "" || m.MQTT == "" {
+			return fmt.Errorf("mapping %d needs a spine and an mqtt topic", i)
+		}
+		switch m.Direction {
+		case ToMQTT, FromMQTT, Both:
+		default:
+			return fmt.Errorf("mapping %s: unknown direction %q", m.Spine, m.Direction)
+		}
+		switch m.Encoding {
+		case "":
+			m.Encoding = EncodingJSON
+		case EncodingJSON, EncodingRaw:
+		default:
+			return fmt.Errorf("mapping %s: unknown encoding %q", m.Spine, m.Encoding)
+		}
+		if m.Direction != ToMQTT {
+			if m.Schema == "" {
+				return fmt.Errorf("mapping %s: no schema is configured for the messages published to spine", m.Spine)
+			}
+			if _, err := spine.ParseSchema(m.Schema); err != nil {
+				return fmt.Errorf("mapping %s: %w", m.Spine, err)
+			}
+		}
+		if m.QoS > 2 {
+			return fmt.Errorf("mapping %s: qos %d is not 0, 1 or 2", m.Spine, m.QoS)
+		}
+		// wildcards are for subscribing only
+		if m.Direction != FromMQTT && strings.ContainsAny(m.MQTT, "+#") {
+			return fmt.Errorf("mapping %s: %s has wildcards and can't be published to", m.Spine, m.MQTT)
+		}
+	}
+	return nil
+}
+
+func (c *Config) loopPrevention() bool {
+	return c.LoopPrevention == nil || *c.LoopPrevention
+}
@@ -0,0 +1,195 @@
+package spine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Names of endpoints are hierarchical like ROS names, segments are separated by '/'.
+//
+//	/left_arm/joint_states  global, used as it is
+//	joint_states            relative, resolved against the namespace of the node (or the default namespace)
+//	~/calibrate             private, resolved against the node's full name
+//
+// Resolved names are advertised without the leading '/', so names that were flat before stay the same.
+//
+// Remapping rules replace a resolved name by another one. They are written from:=to, both sides are resolved like
+// endpoint names, and the first rule that matches wins. The rule __ns:=/left_arm sets the default namespace
+// relative names and node namespaces are resolved against.
+
+// environment variables JointNamespace reads remapping rules from, the rules of SPINE_REMAP come first
+const (
+	RemapEnv     = "SPINE_REMAP"
+	RemapFileEnv = "SPINE_REMAP_FILE"
+)
+
+// name of the rule that sets the default namespace
+const namespaceRule = "__ns"
+
+// Remapping is a set of remapping rules and the default namespace
+type Remapping struct {
+	namespace string
+	rules     []remapRule
+}
+
+type remapRule struct {
+	from, to string
+}
+
+// WithRemapping resolves the endpoint names of the namespace with the rules of r.
+// The rules of SPINE_REMAP and SPINE_REMAP_FILE take precedence over them.
+func WithRemapping(r *Remapping) NamespaceOption {
+	return func(ns *Namespace) {
+		ns.remapping = ns.remapping.merge(r)
+	}
+}
+
+// ParseRemapping parses rules separated by whitespace, commas or newlines, '#' starts a comment that ends with the line
+func ParseRemapping(rules string) (*Remapping, error) {
+	r := &Remapping{}
+	for line := range strings.Lines(rules) {
+		line, _, _ = strings.Cut(line, "#")
+		for _, rule := range strings.FieldsFunc(line, isRuleSeparator) {
+			from, to, ok := strings.Cut(rule, ":=")
+			if !ok || from == "" || to == "" {
+				return nil, fmt.Errorf("invalid remapping rule %q, rules are written from:=to", rule)
+			}
+			if from == namespaceRule {
+				if !strings.HasPrefix(to, "/") {
+					return nil, fmt.Errorf("invalid remapping rule %q, the namespace must be global", rule)
+				}
+				if _, err := expandName(to, "", ""); err != nil {
+					return nil, fmt.Errorf("invalid remapping rule %q: %w", rule, err)
+				}
+				r.namespace = strings.TrimPrefix(to, "/")
+				continue
+			}
+			r.rules = append(r.rules, remapRule{from: from, to: to})
+		}
+	}
+	return r, nil
+}
+
+func isRuleSeparator(c rune) bool {
+	return c == ',' || unicode.IsSpace(c)
+}
+
+// LoadRemapping reads the rules of the file at path
+func LoadRemapping(path string) (*Remapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := ParseRemapping(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// remappingFromEnv returns the rules of SPINE_REMAP followed by the ones of the file SPINE_REMAP_FILE
+func remappingFromEnv() (*Remapping, error) {
+	r, err := ParseRemapping(os.Getenv(RemapEnv))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", RemapEnv, err)
+	}
+	if path := os.Getenv(RemapFileEnv); path != "" {
+		file, err := LoadRemapping(path)
+		if err != nil {
+			return nil, err
+		}
+		r = r.merge(file)
+	}
+	return r, nil
+}
+
+// merge returns the rules of r followed by the ones of other, the namespace of r wins if both set one
+func (r *Remapping) merge(other *Remapping) *Remapping {
+	if r == nil {
+		return other
+	}
+	if other == nil {
+		return r
+	}
+	merged := &Remapping{namespace: r.namespace, rules: append(append([]remapRule(nil), r.rules...), other.rules...)}
+	if merged.namespace == "" {
+		merged.namespace = other.namespace
+	}
+	return merged
+}
+
+// ResolveName returns the name an endpoint created or looked up as name without a node is advertised with
+func (ns *Namespace) ResolveName(name string) (string, error) {
+	return ns.resolveName(name, nil)
+}
+
+// resolveName expands name against the namespace of node and applies the first remapping rule that matches
+func (ns *Namespace) resolveName(name string, node *Node) (string, error) {
+	prefix, nodeName := ns.remapping.defaultNamespace(), ""
+	if node != nil {
+		prefix, nodeName = node.prefix, node.fullName
+	}
+
+	resolved, err := expandName(name, prefix, nodeName)
+	if err != nil {
+		return "", err
+	}
+	if ns.remapping == nil {
+		return resolved, nil
+	}
+	for _, rule := range ns.remapping.rules {
+		// a private rule does not apply outside of nodes
+		if from, err := expandName(rule.from, prefix, nodeName); err == nil && from == resolved {
+			return expandName(rule.to, prefix, nodeName)
+		}
+	}
+	return resolved, nil
+}
+
+func (r *Remapping) defaultNamespace() string {
+	if r == nil {
+		return ""
+	}
+	return r.namespace
+}
+
+// expandName resolves a global, relative or private name, prefix and nodeName are resolved names
+func expandName(name string, prefix string, nodeName string) (string, error) {
+	var resolved string
+	switch {
+	case strings.HasPrefix(name, "/"):
+		resolved = name[1:]
+	case strings.HasPrefix(name, "~"):
+		if nodeName == "" {
+			return "", fmt.Errorf("private name %s needs a node", name)
+		}
+		resolved = joinName(nodeName, strings.TrimPrefix(name[1:], "/"))
+	default:
+		resolved = joinName(prefix, name)
+	}
+
+	if resolved == "" {
+		return "", fmt.Errorf("name %q is empty", name)
+	}
+	for segment := range strings.SplitSeq(resolved, "/") {
+		if segment == "" {
+			return "", fmt.Errorf("name %q has an empty segment", name)
+		}
+		if strings.Contains(segment, "~") {
+			return "", fmt.Errorf("name %q has '~' after its start", name)
+		}
+	}
+	return resolved, nil
+}
+
+func joinName(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	if name == "" {
+		return prefix
+	}
+	return prefix + "/" + name
+}
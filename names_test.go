@@ -0,0 +1,161 @@
+package spine
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandName(t *testing.T) {
+	tests := []struct {
+		name, prefix, node string
+		expected           string
+	}{
+		{"status", "", "", "status"},
+		{"joint_states", "left_arm", "left_arm/controller", "left_arm/joint_states"},
+		{"/joint_states", "left_arm", "left_arm/controller", "joint_states"},
+		{"~/calibrate", "left_arm", "left_arm/controller", "left_arm/controller/calibrate"},
+		{"~calibrate", "", "controller", "controller/calibrate"},
+		{"gripper/state", "left_arm", "", "left_arm/gripper/state"},
+	}
+	for _, test := range tests {
+		resolved, err := expandName(test.name, test.prefix, test.node)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if resolved != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, resolved)
+		}
+	}
+
+	for _, name := range []string{"", "/", "a//b", "a/", "~x", "a/~b"} {
+		if _, err := expandName(name, "", ""); err == nil {
+			t.Errorf("expected %q to be invalid", name)
+		}
+	}
+}
+
+func TestRemapping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "remap")
+	file := "# robot specific\nodom:=/wheel/odom\n"
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(RemapEnv, "__ns:=/left_arm, /left_arm/cmd:=/shared/cmd")
+	t.Setenv(RemapFileEnv, path)
+
+	code, err := ParseRemapping("cmd:=/ignored odom:=/ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_remapping", "secret", logger, WithRemapping(code))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	for name, expected := range map[string]string{
+		"status": "left_arm/status",
+		"cmd":    "shared/cmd",
+		"odom":   "wheel/odom",
+		"/odom":  "odom",
+	} {
+		if resolved, err := ns.ResolveName(name); err != nil || resolved != expected {
+			t.Errorf("%s: expected %s, got %s (%v)", name, expected, resolved, err)
+		}
+	}
+
+	// the node namespace is relative to the default one
+	node, err := NewNode(ns, "controller", WithNodeNamespace("gripper"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	if node.FullName() != "left_arm/gripper/controller" {
+		t.Errorf("unexpected full name %s", node.FullName())
+	}
+	if resolved, _ := node.ResolveName("~/limits"); resolved != "left_arm/gripper/controller/limits" {
+		t.Errorf("unexpected private name %s", resolved)
+	}
+
+	if _, err := ParseRemapping("a=b"); err == nil {
+		t.Error("expected a rule without := to be rejected")
+	}
+	if _, err := ParseRemapping("__ns:=relative"); err == nil {
+		t.Error("expected a relative default namespace to be rejected")
+	}
+}
+
+func TestRemapping_Endpoints(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	remap, err := ParseRemapping("/right_arm/joint_states:=/arms/right")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := JointNamespace("test_remapping_endpoints", "secret", logger, WithRemapping(remap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	// the same code runs for both arms, only the node namespace differs
+	left, err := NewNode(ns, "driver", WithNodeNamespace("left_arm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer left.Close()
+	right, err := NewNode(ns, "driver", WithNodeNamespace("right_arm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer right.Close()
+
+	for _, node := range []*Node{left, right} {
+		pub, err := NewPublisher[string](ns, "joint_states", WithNode(node))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pub.Close()
+		if err := node.Configure(); err != nil {
+			t.Fatal(err)
+		}
+		if err := node.Activate(); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for range 50 {
+				pub.Publish(node.FullName())
+				time.Sleep(100 * time.Millisecond)
+			}
+		}()
+	}
+	received := make(chan string, 10)
+	for _, topic := range []string{"/left_arm/joint_states", "/arms/right"} {
+		sub, err := NewSubscriber(ns, topic, func(s string) { received <- s })
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	seen := map[string]bool{}
+	for len(seen) < 2 {
+		select {
+		case s := <-received:
+			seen[s] = true
+		case <-ctx.Done():
+			t.Fatalf("only received from %v", seen)
+		}
+	}
+	if !seen["left_arm/driver"] || !seen["right_arm/driver"] {
+		t.Errorf("unexpected publishers %v", seen)
+	}
+}
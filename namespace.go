@@ -26,9 +26,42 @@ type Namespace struct {
 
 	listener *kcp.Listener
 	server   *zeroconf.Server
+
+	metrics MetricsSink
+	tracer  Tracer
+
+	clock      Clock
+	clockTopic string
+
+	remapping *Remapping
+
+	serverInterceptors []ServerInterceptor
+	clientInterceptors []ClientInterceptor
+
+	// publisher of the parameter events of every node using the namespace
+	parameterMu     sync.Mutex
+	parameterEvents *Publisher[ParameterEvent]
+	parameterUsers  int
+}
+
+// NamespaceOption configures a namespace when it is joined
+type NamespaceOption func(*Namespace)
+
+// WithTracer traces every service call of the namespace with tracer
+func WithTracer(tracer Tracer) NamespaceOption {
+	return func(ns *Namespace) {
+		ns.tracer = tracer
+	}
 }
 
-func JointNamespace(name string, secretKey string, logger *slog.Logger) (*Namespace, error) {
+// WithMetrics reports the metrics of every endpoint in the namespace to sink
+func WithMetrics(sink MetricsSink) NamespaceOption {
+	return func(ns *Namespace) {
+		ns.metrics = sink
+	}
+}
+
+func JointNamespace(name string, secretKey string, logger *slog.Logger, opts ...NamespaceOption) (*Namespace, error) {
 
 	key := sha256.Sum256([]byte(secretKey))
 	encryption, err := kcp.NewAESBlockCrypt(key[:])
@@ -53,13 +86,36 @@ func JointNamespace(name string, secretKey string, logger *slog.Logger) (*Namesp
 			return &b
 		}},
 		stringSerializer: stringSer,
+
+		metrics: noopSink{},
+		tracer:  noopTracer{},
+		clock:   realClock{},
+	}
+	for _, opt := range opts {
+		opt(ns)
 	}
+
+	// rules from the environment override the ones of the program
+	env, err := remappingFromEnv()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	ns.remapping = env.merge(ns.remapping)
+
 	reg, err := NewRegistry(ns)
 	if err != nil {
 		cancel()
 		return nil, err
 	}
 	ns.reg = reg
+
+	if ns.clockTopic != "" {
+		if err := ns.followClock(); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
 	return ns, nil
 }
 
@@ -86,3 +142,17 @@ func (ns *Namespace) GetService(name string, ctx context.Context) (string, error
 func (ns *Namespace) GetPublisher(name string, ctx context.Context) (string, error) {
 	return ns.reg.Lookup(ctx, name)
 }
+
+// Registry returns the registry the namespace discovers endpoints with
+func (ns *Namespace) Registry() *Registry {
+	return ns.reg
+}
+
+// Clock returns the time of the namespace, the wall clock unless it was joined WithClock or WithClockTopic
+func (ns *Namespace) Clock() Clock {
+	return ns.clock
+}
+
+func (ns *Namespace) Metrics() MetricsSink {
+	return ns.metrics
+}
@@ -1,6 +1,7 @@
 package spine
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -25,6 +26,9 @@ func write(sess io.ReadWriteCloser, buf []byte, requestSize int, hasResponse boo
 func runListener(listener *kcp.Listener, logger *slog.Logger, handler func(io.ReadWriteCloser)) {
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
 		if err != nil {
 			logger.Error("unable to accept connection", "error", err)
 			continue
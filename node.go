@@ -0,0 +1,362 @@
+package spine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+// LifecycleState is the managed state of a node (same states as ROS 2 lifecycle nodes)
+type LifecycleState uint8
+
+const (
+	StateUnconfigured LifecycleState = iota
+	StateInactive
+	StateActive
+	StateFinalized
+)
+
+func (s LifecycleState) String() string {
+	switch s {
+	case StateUnconfigured:
+		return "unconfigured"
+	case StateInactive:
+		return "inactive"
+	case StateActive:
+		return "active"
+	case StateFinalized:
+		return "finalized"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(s))
+	}
+}
+
+// LifecycleTransition moves a node from one state to another
+type LifecycleTransition uint8
+
+const (
+	TransitionConfigure  LifecycleTransition = iota + 1 // unconfigured -> inactive
+	TransitionActivate                                  // inactive -> active
+	TransitionDeactivate                                // active -> inactive
+	TransitionCleanup                                   // inactive -> unconfigured
+	TransitionShutdown                                  // any -> finalized
+)
+
+func (t LifecycleTransition) String() string {
+	switch t {
+	case TransitionConfigure:
+		return "configure"
+	case TransitionActivate:
+		return "activate"
+	case TransitionDeactivate:
+		return "deactivate"
+	case TransitionCleanup:
+		return "cleanup"
+	case TransitionShutdown:
+		return "shutdown"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+var (
+	ErrNodeInactive         = errors.New(globals.ERROR_NODE_INACTIVE)
+	ErrNodeFinalized        = errors.New("node is finalized")
+	ErrTransitionInProgress = errors.New("another transition is in progress")
+)
+
+// suffix of the service every node registers to be managed remotely
+const lifecycleServiceSuffix = "/lifecycle"
+
+// query code for the lifecycle service, returns the state without a transition
+const lifecycleQuery uint8 = 0
+
+// Node groups endpoints under a name and manages their lifecycle.
+// Endpoints join a node with WithNode and only accept traffic while the node is active.
+type Node struct {
+	namespace *Namespace
+	name      string
+	id        string
+	logger    *slog.Logger
+
+	// resolved namespace of the node and its name under it, relative and private names are resolved against them
+	prefix   string
+	fullName string
+
+	state         atomic.Uint32
+	transitionMu  sync.Mutex
+	transitioning bool
+	callbacks     map[LifecycleTransition]func() error
+
+	endpointMu sync.Mutex
+	endpoints  []func()
+
+	lifecycle *Service[uint8, uint8]
+}
+
+// NodeOption configures a node when it is created
+type NodeOption func(*nodeOptions)
+
+type nodeOptions struct {
+	namespace string
+}
+
+// WithNodeNamespace puts the node and its relative names under prefix, for example "left_arm".
+// A relative prefix is resolved against the default namespace set by the __ns remapping rule.
+func WithNodeNamespace(prefix string) NodeOption {
+	return func(o *nodeOptions) {
+		o.namespace = prefix
+	}
+}
+
+func NewNode(namespace *Namespace, name string, opts ...NodeOption) (*Node, error) {
+
+	var options nodeOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	prefix := namespace.remapping.defaultNamespace()
+	if options.namespace != "" {
+		var err error
+		if prefix, err = expandName(options.namespace, prefix, ""); err != nil {
+			return nil, fmt.Errorf("invalid node namespace: %v", err)
+		}
+	}
+	if strings.ContainsAny(name, "/~") || name == "" {
+		return nil, fmt.Errorf("invalid node name %q", name)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		namespace: namespace,
+		name:      name,
+		id:        hex.EncodeToString(id),
+		logger:    namespace.logger.With("namespace", namespace.Name(), "node", joinName(prefix, name)),
+
+		prefix:    prefix,
+		fullName:  joinName(prefix, name),
+		callbacks: make(map[LifecycleTransition]func() error),
+	}
+
+	lifecycle, err := NewService(namespace, "/"+n.fullName+lifecycleServiceSuffix, n.handleLifecycle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lifecycle service: %v", err)
+	}
+	n.lifecycle = lifecycle
+
+	return n, nil
+}
+
+func (n *Node) Name() string {
+	return n.name
+}
+
+// FullName is the name of the node under its namespace, like "left_arm/controller"
+func (n *Node) FullName() string {
+	return n.fullName
+}
+
+// ResolveName returns the name an endpoint of the node created or looked up as name is advertised with
+func (n *Node) ResolveName(name string) (string, error) {
+	return n.namespace.resolveName(name, n)
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+func (n *Node) Namespace() *Namespace {
+	return n.namespace
+}
+
+func (n *Node) State() LifecycleState {
+	return LifecycleState(n.state.Load())
+}
+
+// OnTransition sets the callback run for transition t.
+// If the callback returns an error the node stays in its current state.
+func (n *Node) OnTransition(t LifecycleTransition, callback func() error) {
+	n.transitionMu.Lock()
+	n.callbacks[t] = callback
+	n.transitionMu.Unlock()
+}
+
+func (n *Node) Configure() error {
+	_, err := n.Trigger(TransitionConfigure)
+	return err
+}
+
+func (n *Node) Activate() error {
+	_, err := n.Trigger(TransitionActivate)
+	return err
+}
+
+func (n *Node) Deactivate() error {
+	_, err := n.Trigger(TransitionDeactivate)
+	return err
+}
+
+func (n *Node) Cleanup() error {
+	_, err := n.Trigger(TransitionCleanup)
+	return err
+}
+
+// Shutdown finalizes the node and closes every endpoint it owns
+func (n *Node) Shutdown() error {
+	_, err := n.Trigger(TransitionShutdown)
+	return err
+}
+
+// Trigger runs transition t and returns the state the node ended up in.
+// The callback runs without holding the node's lock, a transition requested while another one runs fails.
+func (n *Node) Trigger(t LifecycleTransition) (LifecycleState, error) {
+	n.transitionMu.Lock()
+	current := n.State()
+	if n.transitioning {
+		n.transitionMu.Unlock()
+		return current, ErrTransitionInProgress
+	}
+	next, ok := nextState(current, t)
+	if !ok {
+		n.transitionMu.Unlock()
+		return current, fmt.Errorf("invalid transition %s from state %s", t, current)
+	}
+	callback := n.callbacks[t]
+	n.transitioning = true
+	n.transitionMu.Unlock()
+
+	var err error
+	if callback != nil {
+		err = callback()
+	}
+
+	n.transitionMu.Lock()
+	n.transitioning = false
+	if err != nil {
+		n.transitionMu.Unlock()
+		n.logger.Error("transition failed", "transition", t.String(), "error", err)
+		return current, err
+	}
+	n.state.Store(uint32(next))
+	n.transitionMu.Unlock()
+	n.logger.Info("changed state", "transition", t.String(), "state", next.String())
+
+	if next == StateFinalized {
+		n.closeEndpoints()
+	}
+	return next, nil
+}
+
+func nextState(current LifecycleState, t LifecycleTransition) (LifecycleState, bool) {
+	switch {
+	case t == TransitionConfigure && current == StateUnconfigured:
+		return StateInactive, true
+	case t == TransitionActivate && current == StateInactive:
+		return StateActive, true
+	case t == TransitionDeactivate && current == StateActive:
+		return StateInactive, true
+	case t == TransitionCleanup && current == StateInactive:
+		return StateUnconfigured, true
+	case t == TransitionShutdown && current != StateFinalized:
+		return StateFinalized, true
+	}
+	return current, false
+}
+
+// accepts reports if endpoints of the node may handle traffic. Endpoints without a node always do.
+func (n *Node) accepts() bool {
+	return n == nil || n.State() == StateActive
+}
+
+// adopt makes the node responsible for closing an endpoint
+func (n *Node) adopt(closeEndpoint func()) error {
+	if n == nil {
+		return nil
+	}
+
+	n.endpointMu.Lock()
+	defer n.endpointMu.Unlock()
+	if n.State() == StateFinalized {
+		return ErrNodeFinalized
+	}
+	n.endpoints = append(n.endpoints, closeEndpoint)
+	return nil
+}
+
+func (n *Node) closeEndpoints() {
+	n.endpointMu.Lock()
+	endpoints := n.endpoints
+	n.endpoints = nil
+	n.endpointMu.Unlock()
+
+	// close in reverse order of creation
+	for _, closeEndpoint := range slices.Backward(endpoints) {
+		closeEndpoint()
+	}
+}
+
+// Close shuts the node down and stops answering lifecycle requests.
+// A node finalized remotely keeps reporting its state until it is closed.
+func (n *Node) Close() {
+	if n.State() != StateFinalized {
+		_ = n.Shutdown()
+	}
+	n.lifecycle.Close()
+}
+
+func (n *Node) handleLifecycle(transition uint8) (uint8, error) {
+	if transition == lifecycleQuery {
+		return uint8(n.State()), nil
+	}
+	state, err := n.Trigger(LifecycleTransition(transition))
+	return uint8(state), err
+}
+
+// LifecycleClient manages a node remotely through its lifecycle service
+type LifecycleClient struct {
+	nodeName string
+	caller   *ServiceCaller[uint8, uint8]
+}
+
+// NewLifecycleClient manages the node nodeName, a relative name is resolved against the default namespace
+func NewLifecycleClient(namespace *Namespace, nodeName string) (*LifecycleClient, error) {
+	caller, err := NewServiceCaller[uint8, uint8](namespace, nodeName+lifecycleServiceSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &LifecycleClient{nodeName: nodeName, caller: caller}, nil
+}
+
+func (c *LifecycleClient) NodeName() string {
+	return c.nodeName
+}
+
+// State returns the current state of the remote node
+func (c *LifecycleClient) State(ctx context.Context) (LifecycleState, error) {
+	state, err := c.caller.Call(lifecycleQuery, ctx)
+	return LifecycleState(state), err
+}
+
+// Trigger runs transition t on the remote node and returns its new state
+func (c *LifecycleClient) Trigger(t LifecycleTransition, ctx context.Context) (LifecycleState, error) {
+	state, err := c.caller.Call(uint8(t), ctx)
+	return LifecycleState(state), err
+}
+
+func (c *LifecycleClient) Close() {
+	c.caller.Close()
+}
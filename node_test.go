@@ -0,0 +1,171 @@
+package spine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestNode_Lifecycle(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_node", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	node, err := NewNode(ns, "arm_controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	configured := false
+	node.OnTransition(TransitionConfigure, func() error {
+		configured = true
+		return nil
+	})
+	node.OnTransition(TransitionActivate, func() error {
+		if !configured {
+			return errors.New("not configured")
+		}
+		return nil
+	})
+
+	if err := node.Activate(); err == nil {
+		t.Error("expected activate from unconfigured to fail")
+	}
+	if err := node.Configure(); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Activate(); err != nil {
+		t.Fatal(err)
+	}
+	if node.State() != StateActive {
+		t.Errorf("expected active, got %s", node.State())
+	}
+	if err := node.Deactivate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := node.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if node.State() != StateUnconfigured {
+		t.Errorf("expected unconfigured, got %s", node.State())
+	}
+}
+
+func TestNode_CallbackUsesNode(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_node_callback", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	node, err := NewNode(ns, "arm_controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	var nested error
+	node.OnTransition(TransitionConfigure, func() error {
+		// callbacks run without the node's lock, they can set callbacks and see a running transition
+		node.OnTransition(TransitionActivate, func() error { return nil })
+		_, nested = node.Trigger(TransitionActivate)
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- node.Configure() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("configure deadlocked")
+	}
+	if !errors.Is(nested, ErrTransitionInProgress) {
+		t.Errorf("expected transition in progress, got %v", nested)
+	}
+	if err := node.Activate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNode_RemoteLifecycle(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_node_remote", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	node, err := NewNode(ns, "driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	_, err = NewService(ns, "driver/echo", func(input string) (string, error) {
+		return input, nil
+	}, WithNode(node))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := NewServiceCaller[string, string](ns, "driver/echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	client, err := NewLifecycleClient(ns, "driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// inactive nodes refuse traffic
+	_, err = caller.Call("hello", ctx)
+	if !errors.Is(err, ErrNodeInactive) {
+		t.Fatalf("expected ErrNodeInactive, got %v", err)
+	}
+
+	for _, transition := range []LifecycleTransition{TransitionConfigure, TransitionActivate} {
+		if _, err := client.Trigger(transition, ctx); err != nil {
+			t.Fatalf("%s failed: %v", transition, err)
+		}
+	}
+
+	state, err := client.State(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != StateActive {
+		t.Errorf("expected active, got %s", state)
+	}
+
+	resp, err := caller.Call("hello", ctx)
+	if err != nil {
+		t.Fatalf("call failed: %v", err)
+	}
+	if resp != "hello" {
+		t.Errorf("expected 'hello', got '%s'", resp)
+	}
+
+	if _, err := client.Trigger(TransitionShutdown, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if node.State() != StateFinalized {
+		t.Errorf("expected finalized, got %s", node.State())
+	}
+}
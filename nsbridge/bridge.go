@@ -0,0 +1,553 @@
+// Package nsbridge forwards topics and services between namespaces on different sites or subnets.
+//
+// Namespaces are discovered with mDNS, which does not leave its subnet. A bridge runs on each site, joined to the
+// local namespace, and the two sides are linked by a single KCP or TCP connection: one side listens and the other
+// connects. Each side exports some of its local topics and services, possibly under other names, and the other side
+// creates a publisher or service with the same types that forwards them over the link.
+//
+// Messages a bridge publishes carry the header spine-bridge with its id, so a topic exported back to the side it
+// came from is not forwarded again.
+package nsbridge
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/poisnoir/spine-go"
+	"github.com/poisnoir/spine-go/internal/globals"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// HeaderBridge is the spine header naming the bridge that published a message,
+// it differs from the header of the MQTT bridge so both can forward the same topic
+const HeaderBridge = "spine-nsbridge"
+
+// ErrLinkDown is returned by forwarded service calls while the other side is not connected
+var ErrLinkDown = errors.New("bridge link is down")
+
+// retryInterval is how long to wait before connecting again and before looking up an export again
+const retryInterval = time.Second
+
+// Bridge is one side of a bridge
+type Bridge struct {
+	namespace *spine.Namespace
+	config    Config
+	id        string
+	logger    *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	listener net.Listener
+
+	mu      sync.Mutex
+	link    *link
+	exports map[string]*export
+	imports map[string]*imported
+}
+
+// export is a local endpoint made available on the other side
+type export struct {
+	config Export
+	// set once the local endpoint is found
+	endpoint   *endpoint
+	subscriber *spine.Subscriber[[]byte]
+	caller     *spine.ServiceCaller[[]byte, []byte]
+}
+
+// imported is the endpoint created for an export of the other side
+type imported struct {
+	endpoint  endpoint
+	publisher *spine.Publisher[[]byte]
+	service   *spine.ThreadedService[[]byte, []byte]
+}
+
+func (i *imported) close() {
+	if i.publisher != nil {
+		i.publisher.Close()
+	}
+	if i.service != nil {
+		i.service.Close()
+	}
+}
+
+// New starts the side of a bridge config describes in namespace. Exports are forwarded once they are found
+// in the namespace and the other side is connected.
+func New(namespace *spine.Namespace, config Config) (*Bridge, error) {
+	config.Exports = slices.Clone(config.Exports)
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(namespace.Context())
+
+	b := &Bridge{
+		namespace: namespace,
+		config:    config,
+		id:        hex.EncodeToString(id),
+		logger:    namespace.Logger().With("bridge", namespace.Name()),
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		exports: make(map[string]*export, len(config.Exports)),
+		imports: make(map[string]*imported),
+	}
+
+	key := sha256.Sum256([]byte(config.LinkSecret))
+	crypt, err := kcp.NewAESBlockCrypt(key[:])
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if config.Listen != "" {
+		if config.Transport == TransportKCP {
+			b.listener, err = kcp.ListenWithOptions(config.Listen, crypt, 10, 3)
+		} else {
+			b.listener, err = net.Listen("tcp", config.Listen)
+		}
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("unable to listen on %s: %w", config.Listen, err)
+		}
+		go b.accept()
+	} else {
+		go b.connect(func() (net.Conn, error) {
+			if config.Transport == TransportKCP {
+				return kcp.DialWithOptions(config.Connect, crypt, 10, 3)
+			}
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "tcp", config.Connect)
+		})
+	}
+
+	for _, e := range config.Exports {
+		x := &export{config: e}
+		b.exports[e.As] = x
+		go b.startExport(x)
+	}
+	return b, nil
+}
+
+// Addr returns the address the bridge listens on, nil if it connects to the other side
+func (b *Bridge) Addr() net.Addr {
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Addr()
+}
+
+// Close stops forwarding, disconnects from the other side and closes the endpoints the bridge created
+func (b *Bridge) Close() {
+	b.cancel()
+	if b.listener != nil {
+		b.listener.Close()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.link != nil {
+		b.link.close()
+		b.link = nil
+	}
+	for _, x := range b.exports {
+		if x.subscriber != nil {
+			x.subscriber.Stop()
+		}
+		if x.caller != nil {
+			x.caller.Close()
+		}
+	}
+	for name, i := range b.imports {
+		i.close()
+		delete(b.imports, name)
+	}
+}
+
+func (b *Bridge) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if b.ctx.Err() != nil || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+				return
+			}
+			b.logger.Error("unable to accept link", "error", err)
+			continue
+		}
+		go b.serve(conn)
+	}
+}
+
+// connect keeps a link to the other side until the bridge closes
+func (b *Bridge) connect(dial func() (net.Conn, error)) {
+	for b.ctx.Err() == nil {
+		conn, err := dial()
+		if err != nil {
+			b.logger.Error("unable to connect", "address", b.config.Connect, "error", err)
+		} else {
+			b.serve(conn)
+		}
+		select {
+		case <-time.After(retryInterval):
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+// serve exchanges frames with the other side until the connection fails, a later link replaces it
+func (b *Bridge) serve(conn net.Conn) {
+	if sess, ok := conn.(*kcp.UDPSession); ok {
+		sess.SetStreamMode(true)
+	}
+	l := newLink(conn)
+	defer l.close()
+
+	if err := l.send(&frame{Kind: frameHello, Name: b.namespace.Name()}); err != nil {
+		b.logger.Error("unable to greet the other side", "error", err)
+		return
+	}
+	hello, err := l.receive()
+	if err != nil || hello.Kind != frameHello {
+		// a different link secret looks like garbage
+		b.logger.Error("the other side did not greet", "address", conn.RemoteAddr(), "error", err)
+		return
+	}
+	logger := b.logger.With("remote", hello.Name)
+	logger.Info("linked", "address", conn.RemoteAddr())
+
+	if !b.attach(l) {
+		return
+	}
+	defer b.detach(l)
+	go l.heartbeat()
+
+	for {
+		f, err := l.receive()
+		if err != nil {
+			if b.ctx.Err() == nil {
+				logger.Error("link is down", "error", err)
+			}
+			return
+		}
+		switch f.Kind {
+		case frameAdvertise:
+			if f.Endpoint != nil {
+				b.importEndpoint(f.Name, *f.Endpoint)
+			}
+		case framePublish:
+			b.publish(f)
+		case frameCall:
+			go b.serveCall(l, f)
+		case frameResponse:
+			l.respond(f)
+		}
+	}
+}
+
+// attach makes l the link of the bridge and advertises the exports found so far
+func (b *Bridge) attach(l *link) bool {
+	b.mu.Lock()
+	if b.ctx.Err() != nil {
+		b.mu.Unlock()
+		return false
+	}
+	if b.link != nil {
+		b.link.close()
+	}
+	b.link = l
+	var adverts []*frame
+	for _, x := range b.exports {
+		if x.endpoint != nil {
+			adverts = append(adverts, x.advert())
+		}
+	}
+	b.mu.Unlock()
+
+	for _, f := range adverts {
+		if err := l.send(f); err != nil {
+			l.close()
+			return false
+		}
+	}
+	return true
+}
+
+// detach closes the imported endpoints when l was the link of the bridge, they can't be served without it
+func (b *Bridge) detach(l *link) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.link != l {
+		return
+	}
+	b.link = nil
+	for name, i := range b.imports {
+		i.close()
+		delete(b.imports, name)
+	}
+}
+
+// send sends f over the current link, if there is one
+func (b *Bridge) send(f *frame) {
+	b.mu.Lock()
+	l := b.link
+	b.mu.Unlock()
+	if l == nil {
+		return
+	}
+	if err := l.send(f); err != nil {
+		b.logger.Error("unable to send over the link", "error", err)
+		l.close()
+	}
+}
+
+func (x *export) advert() *frame {
+	return &frame{Kind: frameAdvertise, Name: x.config.As, Endpoint: x.endpoint}
+}
+
+// resolve waits for the local endpoint name of type endpointType
+func (b *Bridge) resolve(name string, endpointType string) (spine.Endpoint, error) {
+	for {
+		e, err := b.namespace.Registry().Resolve(b.ctx, name)
+		if err == nil && e.Type != endpointType {
+			return e, fmt.Errorf("%s is a %s, not a %s", name, e.Type, endpointType)
+		} else if err == nil || b.ctx.Err() != nil {
+			return e, err
+		}
+		select {
+		case <-time.After(retryInterval):
+		case <-b.ctx.Done():
+			return e, b.ctx.Err()
+		}
+	}
+}
+
+// startExport subscribes to or creates a caller of the local endpoint of x once it is found and advertises it
+func (b *Bridge) startExport(x *export) {
+	logger := b.logger.With("export", x.config.Name, "as", x.config.As)
+
+	endpointType := globals.ZERO_CONF_PUBLISHER
+	if x.config.Kind == Service {
+		endpointType = globals.ZERO_CONF_SERVICE
+	}
+	e, err := b.resolve(x.config.Name, endpointType)
+	if err != nil {
+		if b.ctx.Err() == nil {
+			logger.Error("unable to find the exported endpoint", "error", err)
+		}
+		return
+	}
+
+	advertised := &endpoint{
+		Kind:           x.config.Kind,
+		Code:           e.Code,
+		Schema:         e.Schema,
+		ResponseCode:   e.ResponseCode,
+		ResponseSchema: e.ResponseSchema,
+	}
+
+	var subscriber *spine.Subscriber[[]byte]
+	var caller *spine.ServiceCaller[[]byte, []byte]
+	if x.config.Kind == Topic {
+		subscriber, err = spine.NewRawSubscriber(b.namespace, x.config.Name, e.Code, func(payload []byte, info spine.MessageInfo) {
+			if info.Headers.Get(HeaderBridge) == b.id {
+				return
+			}
+			b.send(&frame{Kind: framePublish, Name: x.config.As, Payload: payload, Headers: info.Headers})
+		})
+	} else {
+		caller, err = spine.NewRawServiceCaller(b.namespace, x.config.Name, e.Code, e.ResponseCode)
+	}
+	if err != nil {
+		logger.Error("unable to create the endpoint", "error", err)
+		return
+	}
+
+	b.mu.Lock()
+	if b.ctx.Err() != nil {
+		b.mu.Unlock()
+		if subscriber != nil {
+			subscriber.Stop()
+		}
+		if caller != nil {
+			caller.Close()
+		}
+		return
+	}
+	x.endpoint, x.subscriber, x.caller = advertised, subscriber, caller
+	b.mu.Unlock()
+
+	logger.Info("exporting", "kind", x.config.Kind)
+	b.send(x.advert())
+}
+
+// importEndpoint creates the endpoint for the export name of the other side, replacing it if its types changed
+func (b *Bridge) importEndpoint(name string, e endpoint) {
+	logger := b.logger.With("import", name)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ctx.Err() != nil {
+		return
+	}
+	if i, ok := b.imports[name]; ok {
+		if i.endpoint == e {
+			return
+		}
+		i.close()
+		delete(b.imports, name)
+	}
+	if _, ok := b.exports[name]; ok {
+		logger.Error("the other side exports a name this side exports too")
+		return
+	}
+
+	var opts []spine.Option
+	if e.Schema != "" {
+		schema, err := spine.ParseSchema(e.Schema)
+		if err != nil {
+			logger.Error("invalid schema", "error", err)
+			return
+		}
+		opts = append(opts, spine.WithSchema(schema))
+	}
+	if e.ResponseSchema != "" {
+		schema, err := spine.ParseSchema(e.ResponseSchema)
+		if err != nil {
+			logger.Error("invalid response schema", "error", err)
+			return
+		}
+		opts = append(opts, spine.WithResponseSchema(schema))
+	}
+
+	i := &imported{endpoint: e}
+	var err error
+	if e.Kind == Service {
+		i.service, err = spine.NewRawThreadedService(b.namespace, name, e.Code, e.ResponseCode, func(ctx context.Context, request []byte) ([]byte, error) {
+			return b.forwardCall(ctx, name, request)
+		}, opts...)
+	} else {
+		i.publisher, err = spine.NewRawPublisher(b.namespace, name, e.Code, opts...)
+	}
+	if err != nil {
+		logger.Error("unable to create the endpoint", "error", err)
+		return
+	}
+	b.imports[name] = i
+	logger.Info("importing", "kind", e.Kind)
+}
+
+// publish publishes a message of the other side on the imported topic
+func (b *Bridge) publish(f *frame) {
+	b.mu.Lock()
+	i, ok := b.imports[f.Name]
+	b.mu.Unlock()
+	if !ok || i.publisher == nil {
+		return
+	}
+
+	headers := spine.Metadata(f.Headers).Copy()
+	if headers == nil {
+		headers = make(spine.Metadata, 1)
+	}
+	headers[HeaderBridge] = b.id
+	i.publisher.PublishWithHeaders(f.Payload, headers)
+}
+
+// forwardCall sends a request of an imported service to the other side and waits for its response
+func (b *Bridge) forwardCall(ctx context.Context, name string, request []byte) ([]byte, error) {
+	b.mu.Lock()
+	l := b.link
+	b.mu.Unlock()
+	if l == nil {
+		return nil, ErrLinkDown
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(b.config.CallTimeout))
+	defer cancel()
+
+	id, responses, ok := l.startCall()
+	if !ok {
+		return nil, ErrLinkDown
+	}
+	defer l.endCall(id)
+
+	if err := l.send(&frame{Kind: frameCall, Name: name, ID: id, Payload: request, Headers: spine.IncomingMetadata(ctx)}); err != nil {
+		l.close()
+		return nil, ErrLinkDown
+	}
+
+	select {
+	case f, ok := <-responses:
+		if !ok {
+			return nil, ErrLinkDown
+		}
+		if len(f.Headers) > 0 {
+			spine.SetTrailer(ctx, f.Headers)
+		}
+		switch {
+		case f.ErrorOf == callErrorNodeInactive:
+			return nil, spine.ErrNodeInactive
+		case f.ErrorOf == callErrorNotLeader:
+			return nil, spine.ErrNotLeader
+		case f.Error != "":
+			return nil, errors.New(f.Error)
+		}
+		return f.Payload, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// serveCall calls the exported service for a request of the other side and sends back the response
+func (b *Bridge) serveCall(l *link, f *frame) {
+	response := &frame{Kind: frameResponse, ID: f.ID}
+
+	b.mu.Lock()
+	x, ok := b.exports[f.Name]
+	var caller *spine.ServiceCaller[[]byte, []byte]
+	if ok {
+		caller = x.caller
+	}
+	b.mu.Unlock()
+
+	if caller == nil {
+		response.Error = fmt.Sprintf("%s is not an exported service", f.Name)
+	} else {
+		ctx, cancel := context.WithTimeout(b.ctx, time.Duration(b.config.CallTimeout))
+		var trailer spine.Metadata
+		payload, err := caller.Call(f.Payload, ctx, spine.WithCallMetadata(f.Headers), spine.WithTrailer(&trailer))
+		cancel()
+		if err != nil {
+			response.Error = err.Error()
+		}
+		// callers on the other side handle these like callers of the service itself
+		if errors.Is(err, spine.ErrNodeInactive) {
+			response.ErrorOf = callErrorNodeInactive
+		} else if errors.Is(err, spine.ErrNotLeader) {
+			response.ErrorOf = callErrorNotLeader
+		}
+		response.Payload, response.Headers = payload, trailer
+	}
+
+	if err := l.send(response); err != nil {
+		b.logger.Error("unable to send response", "service", f.Name, "error", err)
+		l.close()
+	}
+}
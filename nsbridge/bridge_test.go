@@ -0,0 +1,176 @@
+package nsbridge
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/poisnoir/spine-go"
+)
+
+type status struct {
+	RobotID uint8
+	Battery float32
+}
+
+func newNamespace(t *testing.T, name string) *spine.Namespace {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := spine.JointNamespace(name, "secret_"+name, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ns.Disconnect)
+	return ns
+}
+
+// newBridges links a bridge exporting exports from site a to a bridge on site b
+func newBridges(t *testing.T, a *spine.Namespace, b *spine.Namespace, transport Transport, exports []Export) {
+	listening, err := New(a, Config{Listen: "127.0.0.1:0", Transport: transport, LinkSecret: "link", Exports: exports})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(listening.Close)
+
+	connecting, err := New(b, Config{Connect: listening.Addr().String(), Transport: transport, LinkSecret: "link"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(connecting.Close)
+}
+
+func TestBridge_Topic(t *testing.T) {
+	for _, transport := range []Transport{TransportKCP, TransportTCP} {
+		t.Run(string(transport), func(t *testing.T) {
+			a := newNamespace(t, "test_nsbridge_topic_a_"+string(transport))
+			b := newNamespace(t, "test_nsbridge_topic_b_"+string(transport))
+
+			pub, err := spine.NewPublisher[status](a, "status")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pub.Close()
+
+			newBridges(t, a, b, transport, []Export{{Name: "status", As: "site_a/status"}})
+
+			received := make(chan status, 10)
+			sub, err := spine.NewSubscriber(b, "site_a/status", func(s status) { received <- s })
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sub.Stop()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			for {
+				pub.Publish(status{RobotID: 1, Battery: 0.5})
+				select {
+				case s := <-received:
+					if s != (status{RobotID: 1, Battery: 0.5}) {
+						t.Errorf("unexpected message %+v", s)
+					}
+					return
+				case <-ctx.Done():
+					t.Fatal("no message received")
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+		})
+	}
+}
+
+func TestBridge_Service(t *testing.T) {
+	a := newNamespace(t, "test_nsbridge_service_a")
+	b := newNamespace(t, "test_nsbridge_service_b")
+
+	service, err := spine.NewServiceWithContext(a, "double", func(ctx context.Context, n int32) (int32, error) {
+		if n < 0 {
+			return 0, errors.New("negative")
+		}
+		spine.SetTrailer(ctx, spine.Metadata{"caller": spine.IncomingMetadata(ctx).Get("caller")})
+		return n * 2, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	// a service of a node that is not active
+	node, err := spine.NewNode(a, "idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	idle, err := spine.NewService(a, "idle", func(n int32) (int32, error) { return n, nil }, spine.WithNode(node))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	newBridges(t, a, b, TransportKCP, []Export{
+		{Name: "double", As: "site_a/double", Kind: Service},
+		{Name: "/idle", As: "site_a/idle", Kind: Service},
+	})
+
+	caller, err := spine.NewServiceCaller[int32, int32](b, "site_a/double")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var trailer spine.Metadata
+	response, err := caller.Call(21, ctx, spine.WithCallMetadata(spine.Metadata{"caller": "site_b"}), spine.WithTrailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != 42 {
+		t.Errorf("expected 42, got %d", response)
+	}
+	if trailer.Get("caller") != "site_b" {
+		t.Errorf("expected the metadata of the call to reach the service, got trailer %v", trailer)
+	}
+
+	if _, err := caller.Call(-1, ctx); err == nil || !strings.Contains(err.Error(), "negative") {
+		t.Errorf("expected the error of the service, got %v", err)
+	}
+
+	idleCaller, err := spine.NewServiceCaller[int32, int32](b, "site_a/idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idleCaller.Close()
+	if _, err := idleCaller.Call(1, ctx); !errors.Is(err, spine.ErrNodeInactive) {
+		t.Errorf("expected the node of the service to be inactive, got %v", err)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	invalid := []Config{
+		{},
+		{Listen: ":7400", Connect: "site-b:7400"},
+		{Listen: ":7400", Transport: "quic", LinkSecret: "link"},
+		{Listen: ":7400"},
+		{Listen: ":7400", LinkSecret: "link", Exports: []Export{{Name: "status", Kind: "action"}}},
+		{Listen: ":7400", LinkSecret: "link", Exports: []Export{{Name: "a", As: "status"}, {Name: "status"}}},
+	}
+	for _, config := range invalid {
+		if err := config.validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", config)
+		}
+	}
+
+	config := Config{Connect: "site-b:7400", LinkSecret: "link", Exports: []Export{{Name: "status"}}}
+	if err := config.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Transport != TransportKCP || config.Exports[0].As != "status" || config.Exports[0].Kind != Topic {
+		t.Errorf("unexpected defaults %+v", config)
+	}
+}
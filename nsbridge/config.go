@@ -0,0 +1,135 @@
+package nsbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Transport is the protocol of the link between the two sides of a bridge
+type Transport string
+
+const (
+	// TransportKCP links over KCP, encrypted with the link secret
+	TransportKCP Transport = "kcp"
+	// TransportTCP links over plain TCP, it is not encrypted and is meant for links that already are (VPN, ssh tunnel)
+	TransportTCP Transport = "tcp"
+)
+
+// Kind is the kind of an exported endpoint
+type Kind string
+
+const (
+	Topic   Kind = "topic"
+	Service Kind = "service"
+)
+
+// Config is the configuration file of one side of a bridge. One side listens and the other connects to it.
+//
+//	{
+//	  "listen": ":7400",
+//	  "transport": "kcp",
+//	  "link_secret": "shared by both sides",
+//	  "exports": [
+//	    {"name": "status", "as": "site_a/status"},
+//	    {"name": "plan_route", "kind": "service"}
+//	  ]
+//	}
+type Config struct {
+	// Listen is the address to accept the other side on, Connect the address of the other side
+	Listen  string `json:"listen,omitempty"`
+	Connect string `json:"connect,omitempty"`
+	// Transport is TransportKCP unless set
+	Transport  Transport `json:"transport,omitempty"`
+	LinkSecret string    `json:"link_secret,omitempty"`
+	// CallTimeout bounds service calls forwarded over the link, 10s unless set
+	CallTimeout Duration `json:"call_timeout,omitempty"`
+	// Exports are the endpoints of the local namespace made available in the namespace of the other side
+	Exports []Export `json:"exports"`
+}
+
+// Export makes a local topic or service available on the other side
+type Export struct {
+	Name string `json:"name"`
+	// As is the name on the other side, Name unless set
+	As string `json:"as,omitempty"`
+	// Kind is Topic unless set
+	Kind Kind `json:"kind,omitempty"`
+}
+
+// Duration is a time.Duration written like "5s" in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads the configuration file at path
+func LoadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return config, config.validate()
+}
+
+func (c *Config) validate() error {
+	if (c.Listen == "") == (c.Connect == "") {
+		return fmt.Errorf("exactly one of listen and connect must be configured")
+	}
+	switch c.Transport {
+	case "":
+		c.Transport = TransportKCP
+	case TransportKCP, TransportTCP:
+	default:
+		return fmt.Errorf("unknown transport %q", c.Transport)
+	}
+	// the link is encrypted with a key derived from the secret, an empty one is known to everyone
+	if c.Transport == TransportKCP && c.LinkSecret == "" {
+		return fmt.Errorf("a kcp link needs a link_secret")
+	}
+	if c.CallTimeout == 0 {
+		c.CallTimeout = Duration(10 * time.Second)
+	}
+
+	names := make(map[string]bool, len(c.Exports))
+	for i := range c.Exports {
+		e := &c.Exports[i]
+		if e.Name == "" {
+			return fmt.Errorf("export %d needs a name", i)
+		}
+		if e.As == "" {
+			e.As = e.Name
+		}
+		switch e.Kind {
+		case "":
+			e.Kind = Topic
+		case Topic, Service:
+		default:
+			return fmt.Errorf("export %s: unknown kind %q", e.Name, e.Kind)
+		}
+		if names[e.As] {
+			return fmt.Errorf("export %s: %s is exported more than once", e.Name, e.As)
+		}
+		names[e.As] = true
+	}
+	return nil
+}
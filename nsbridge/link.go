@@ -0,0 +1,162 @@
+package nsbridge
+
+import (
+	"encoding/gob"
+	"net"
+	"sync"
+	"time"
+)
+
+// linkTimeout is how long a link may be silent before it is considered down, heartbeats are sent three times as often
+const linkTimeout = 15 * time.Second
+
+type frameKind uint8
+
+const (
+	// frameHello is the first frame on a link, Name is the namespace of the sender
+	frameHello frameKind = iota + 1
+	// frameAdvertise announces the export Name, Endpoint describes its types
+	frameAdvertise
+	// framePublish is a message of the exported topic Name
+	framePublish
+	// frameCall is a request of call ID to the exported service Name
+	frameCall
+	// frameResponse answers call ID, Headers is the trailer of the call
+	frameResponse
+	// frameHeartbeat keeps an idle link alive
+	frameHeartbeat
+)
+
+// callError tells the calling side which spine error a response carries
+type callError uint8
+
+const (
+	// callErrorService is any error of the service, Error is its message
+	callErrorService callError = iota
+	callErrorNodeInactive
+	callErrorNotLeader
+)
+
+// frame is a message on the link, the fields a kind does not use are empty
+type frame struct {
+	Kind     frameKind
+	Name     string
+	ID       uint64
+	Payload  []byte
+	Headers  map[string]string
+	Error    string
+	ErrorOf  callError
+	Endpoint *endpoint
+}
+
+// endpoint describes the types of an export so the other side can create a matching endpoint
+type endpoint struct {
+	Kind           Kind
+	Code           string
+	Schema         string
+	ResponseCode   string
+	ResponseSchema string
+}
+
+// link is a connection to the other side, frames are gob encoded
+type link struct {
+	conn net.Conn
+	dec  *gob.Decoder
+
+	writeMu sync.Mutex
+	enc     *gob.Encoder
+
+	mu       sync.Mutex
+	closed   bool
+	calls    map[uint64]chan *frame
+	nextCall uint64
+	done     chan struct{}
+}
+
+func newLink(conn net.Conn) *link {
+	return &link{
+		conn:  conn,
+		dec:   gob.NewDecoder(conn),
+		enc:   gob.NewEncoder(conn),
+		calls: make(map[uint64]chan *frame),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *link) send(f *frame) error {
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	l.conn.SetWriteDeadline(time.Now().Add(linkTimeout))
+	return l.enc.Encode(f)
+}
+
+func (l *link) receive() (*frame, error) {
+	l.conn.SetReadDeadline(time.Now().Add(linkTimeout))
+	var f frame
+	if err := l.dec.Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// heartbeat keeps the link alive until it is closed
+func (l *link) heartbeat() {
+	ticker := time.NewTicker(linkTimeout / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := l.send(&frame{Kind: frameHeartbeat}); err != nil {
+				l.close()
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// startCall returns the id of a new call and the channel its response is sent to,
+// the channel is closed if the link goes down first
+func (l *link) startCall() (uint64, chan *frame, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, nil, false
+	}
+	l.nextCall++
+	responses := make(chan *frame, 1)
+	l.calls[l.nextCall] = responses
+	return l.nextCall, responses, true
+}
+
+func (l *link) endCall(id uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.calls, id)
+}
+
+func (l *link) respond(f *frame) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if responses, ok := l.calls[f.ID]; ok {
+		responses <- f
+		delete(l.calls, f.ID)
+	}
+}
+
+// close closes the connection and fails the calls waiting for a response
+func (l *link) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	l.conn.Close()
+	close(l.done)
+	for id, responses := range l.calls {
+		close(responses)
+		delete(l.calls, id)
+	}
+}
@@ -0,0 +1,121 @@
+package spine
+
+import (
+	"time"
+
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+// Option configures an endpoint (service, caller, publisher or subscriber) when it is created
+type Option func(*endpointOptions)
+
+type endpointOptions struct {
+	node     *Node
+	recorder *Recorder
+	election *Election
+
+	maxRate   float64
+	onOverrun func(took time.Duration)
+
+	filter         string
+	schema         *Schema
+	responseSchema *Schema
+	codecs         []any
+
+	compression          Compression
+	compressionThreshold int
+
+	serverInterceptors []ServerInterceptor
+	clientInterceptors []ClientInterceptor
+}
+
+func buildOptions(opts []Option) endpointOptions {
+	var o endpointOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithNode makes the endpoint part of node. The endpoint is advertised with the node name and id,
+// refuses traffic while the node is not active and is closed when the node shuts down.
+func WithNode(node *Node) Option {
+	return func(o *endpointOptions) {
+		o.node = node
+	}
+}
+
+// WithElection makes a service serve only while the candidate of election leads. The service is advertised
+// while it leads, callers still connected to it once it stops get ErrNotLeader and look for the new leader.
+func WithElection(election *Election) Option {
+	return func(o *endpointOptions) {
+		o.election = election
+	}
+}
+
+// WithMaxRate limits a publisher to rate messages per second.
+// Data published faster replaces the pending message, subscribers see a gap in MessageInfo.Sequence.
+func WithMaxRate(rate float64) Option {
+	return func(o *endpointOptions) {
+		o.maxRate = rate
+	}
+}
+
+// WithOverrun is called with how long the producer of a timer publisher took when it took longer than the period
+func WithOverrun(onOverrun func(took time.Duration)) Option {
+	return func(o *endpointOptions) {
+		o.onOverrun = onOverrun
+	}
+}
+
+// WithSchema advertises the schema of the payloads of a raw publisher or the requests of a raw service
+// so tools can decode them. Typed endpoints advertise the schema of their types.
+func WithSchema(schema *Schema) Option {
+	return func(o *endpointOptions) {
+		o.schema = schema
+	}
+}
+
+// WithResponseSchema advertises the schema of the responses of a raw service
+func WithResponseSchema(schema *Schema) Option {
+	return func(o *endpointOptions) {
+		o.responseSchema = schema
+	}
+}
+
+// zeroconf txt records describing an endpoint, the response code and schema are only set by services
+// and schemas may be nil
+func (o endpointOptions) text(endpointType string, code string, schema *Schema, responseCode string, responseSchema *Schema) []string {
+	text := []string{
+		"type=" + endpointType,
+		globals.ZERO_CONF_CODE + "=" + code,
+	}
+	text = appendTextValue(text, globals.ZERO_CONF_SCHEMA, schema)
+	if responseCode != "" {
+		text = append(text, globals.ZERO_CONF_RESPONSE_CODE+"="+responseCode)
+	}
+	text = appendTextValue(text, globals.ZERO_CONF_RESPONSE_SCHEMA, responseSchema)
+	if o.compression != "" {
+		text = append(text, globals.ZERO_CONF_COMPRESSION+"="+string(o.compression))
+	}
+	if o.node != nil {
+		text = append(text,
+			globals.ZERO_CONF_NODE_NAME+"="+o.node.FullName(),
+			globals.ZERO_CONF_NODE_ID+"="+o.node.ID(),
+		)
+	}
+	return text
+}
+
+// appendTextValue appends the text form of schema split over as many records as it needs
+func appendTextValue(text []string, key string, schema *Schema) []string {
+	if schema == nil {
+		return text
+	}
+	for value := schema.String(); value != ""; {
+		n := min(len(value), globals.ZERO_CONF_MAX_VALUE)
+		text = append(text, key+"="+value[:n])
+		value = value[n:]
+	}
+	return text
+}
@@ -0,0 +1,567 @@
+package spine
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/poisnoir/spine-go/internal/globals"
+	"gopkg.in/yaml.v3"
+)
+
+// Every node with parameters serves them on its private service ~/parameters, for example left_arm/driver/parameters,
+// and publishes their changes on the parameter events topic of its program. Both are encoded with JSON.
+const parametersServiceSuffix = "/parameters"
+
+// ParameterEventsTopic prefixes the topics the parameter changes of nodes are published on, events name their node.
+// The nodes of a namespace joined by one program share its topic, ParameterEventsTopic/<program id>.
+const ParameterEventsTopic = "/parameter_events"
+
+// ParameterType is the type of a parameter
+type ParameterType interface {
+	bool | int64 | float64 | string | []bool | []int64 | []float64 | []string
+}
+
+var ErrUnknownParameter = errors.New("unknown parameter")
+
+// Parameters are the typed, remotely settable parameters of a node
+type Parameters struct {
+	node *Node
+
+	mu        sync.Mutex
+	params    map[string]*parameter
+	order     []string
+	overrides map[string]*yaml.Node
+
+	// setMu orders changes, each one is applied and published before the next one is committed
+	setMu sync.Mutex
+
+	service   *Service[ParameterRequest, ParameterResponse]
+	events    *Publisher[ParameterEvent]
+	closeOnce sync.Once
+}
+
+// parameter is the untyped side of a Parameter
+type parameter struct {
+	name        string
+	description string
+	typeName    string
+	value       json.RawMessage
+
+	// decode checks value and returns what is stored, apply stores it and runs the change callbacks
+	decode func(value json.RawMessage) (any, error)
+	apply  func(value any)
+}
+
+// Parameter is a declared parameter of type T
+type Parameter[T ParameterType] struct {
+	params *Parameters
+	name   string
+
+	mu        sync.RWMutex
+	value     T
+	validate  func(T) error
+	callbacks []func(T)
+}
+
+// ParameterOption configures a parameter when it is declared
+type ParameterOption[T ParameterType] func(*Parameter[T])
+
+// WithValidator rejects the values validate returns an error for, remote changes get the error
+func WithValidator[T ParameterType](validate func(T) error) ParameterOption[T] {
+	return func(p *Parameter[T]) {
+		p.validate = validate
+	}
+}
+
+// ParameterRequest gets or sets parameters of a node. Set is applied first and only if every value is valid.
+type ParameterRequest struct {
+	// Get names the parameters to return, all of them if Get and Set are empty
+	Get []string                   `json:"get,omitempty"`
+	Set map[string]json.RawMessage `json:"set,omitempty"`
+}
+
+// ParameterResponse holds the parameters a request got or set
+type ParameterResponse struct {
+	Parameters []ParameterInfo `json:"parameters"`
+}
+
+// ParameterInfo describes a parameter and its current value
+type ParameterInfo struct {
+	Name        string          `json:"name"`
+	Type        string          `json:"type"`
+	Description string          `json:"description,omitempty"`
+	Value       json.RawMessage `json:"value"`
+}
+
+// ParameterEvent is published when parameters of a node change
+type ParameterEvent struct {
+	Node    string          `json:"node"`
+	Changed []ParameterInfo `json:"changed"`
+}
+
+// NewParameters serves the parameters of node until the node shuts down
+func NewParameters(node *Node) (*Parameters, error) {
+	p := &Parameters{
+		node:   node,
+		params: make(map[string]*parameter),
+	}
+
+	var err error
+	p.service, err = NewService(node.namespace, "/"+node.fullName+parametersServiceSuffix, p.handleRequest,
+		WithCodec(JSONCodec[ParameterRequest]()), WithCodec(JSONCodec[ParameterResponse]()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create parameter service: %v", err)
+	}
+	p.events, err = node.namespace.acquireParameterEvents()
+	if err != nil {
+		p.service.Close()
+		return nil, fmt.Errorf("failed to create parameter events publisher: %v", err)
+	}
+
+	if err := node.adopt(p.Close); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Parameters) Close() {
+	p.closeOnce.Do(func() {
+		p.service.Close()
+		p.node.namespace.releaseParameterEvents()
+	})
+}
+
+// acquireParameterEvents returns the publisher of the program's parameter events, it is created for the first user
+func (ns *Namespace) acquireParameterEvents() (*Publisher[ParameterEvent], error) {
+	ns.parameterMu.Lock()
+	defer ns.parameterMu.Unlock()
+	if ns.parameterEvents == nil {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		topic := ParameterEventsTopic + "/" + hex.EncodeToString(id)
+		events, err := NewPublisher[ParameterEvent](ns, topic, WithCodec(JSONCodec[ParameterEvent]()))
+		if err != nil {
+			return nil, err
+		}
+		ns.parameterEvents = events
+	}
+	ns.parameterUsers++
+	return ns.parameterEvents, nil
+}
+
+// releaseParameterEvents closes the publisher of the program's parameter events once its last user is done
+func (ns *Namespace) releaseParameterEvents() {
+	ns.parameterMu.Lock()
+	defer ns.parameterMu.Unlock()
+	ns.parameterUsers--
+	if ns.parameterUsers == 0 {
+		ns.parameterEvents.Close()
+		ns.parameterEvents = nil
+	}
+}
+
+// DeclareParameter adds the parameter name to params. Its value is the one loaded from YAML if there is one, or defaultValue.
+func DeclareParameter[T ParameterType](params *Parameters, name string, defaultValue T, description string, opts ...ParameterOption[T]) (*Parameter[T], error) {
+	p := &Parameter[T]{params: params, name: name, value: defaultValue}
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	params.mu.Lock()
+	defer params.mu.Unlock()
+	if _, ok := params.params[name]; ok {
+		return nil, fmt.Errorf("parameter %s is already declared", name)
+	}
+
+	if override, ok := params.overrides[name]; ok {
+		var value T
+		if err := override.Decode(&value); err != nil {
+			return nil, fmt.Errorf("parameter %s: invalid value: %v", name, err)
+		}
+		p.value = value
+	}
+	if p.validate != nil {
+		if err := p.validate(p.value); err != nil {
+			return nil, fmt.Errorf("parameter %s: %v", name, err)
+		}
+	}
+
+	value, err := json.Marshal(p.value)
+	if err != nil {
+		return nil, err
+	}
+	params.params[name] = &parameter{
+		name:        name,
+		description: description,
+		typeName:    reflect.TypeFor[T]().String(),
+		value:       value,
+		decode: func(value json.RawMessage) (any, error) {
+			return p.decode(value)
+		},
+		apply: func(value any) {
+			p.apply(value.(T))
+		},
+	}
+	params.order = append(params.order, name)
+	return p, nil
+}
+
+func (p *Parameter[T]) Name() string {
+	return p.name
+}
+
+func (p *Parameter[T]) Get() T {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.value
+}
+
+// Set changes the value like a remote request would, the validator may reject it
+func (p *Parameter[T]) Set(value T) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = p.params.set(map[string]json.RawMessage{p.name: encoded})
+	return err
+}
+
+// OnChange calls callback with every new value, after it was set
+func (p *Parameter[T]) OnChange(callback func(T)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.callbacks = append(p.callbacks, callback)
+}
+
+func (p *Parameter[T]) decode(encoded json.RawMessage) (any, error) {
+	var value T
+	if err := json.Unmarshal(encoded, &value); err != nil {
+		return nil, fmt.Errorf("parameter %s is a %s: %v", p.name, reflect.TypeFor[T](), err)
+	}
+	if p.validate != nil {
+		if err := p.validate(value); err != nil {
+			return nil, fmt.Errorf("parameter %s: %v", p.name, err)
+		}
+	}
+	return value, nil
+}
+
+func (p *Parameter[T]) apply(value T) {
+	p.mu.Lock()
+	p.value = value
+	callbacks := slices.Clone(p.callbacks)
+	p.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(value)
+	}
+}
+
+// set validates every value before changing any and publishes the change.
+// Concurrent changes are applied in the order they are committed, so callbacks must not set parameters.
+func (p *Parameters) set(values map[string]json.RawMessage) ([]ParameterInfo, error) {
+	p.setMu.Lock()
+	defer p.setMu.Unlock()
+
+	p.mu.Lock()
+	decoded := make(map[string]any, len(values))
+	for name, value := range values {
+		param, ok := p.params[name]
+		if !ok {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("%w %s", ErrUnknownParameter, name)
+		}
+		v, err := param.decode(value)
+		if err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		decoded[name] = v
+	}
+
+	var changed []ParameterInfo
+	var applied []*parameter
+	for _, name := range p.order {
+		v, ok := decoded[name]
+		if !ok {
+			continue
+		}
+		param := p.params[name]
+		param.value, _ = json.Marshal(v)
+		changed = append(changed, param.info())
+		applied = append(applied, param)
+	}
+	p.mu.Unlock()
+
+	// callbacks run outside of the lock so they can read other parameters
+	for _, param := range applied {
+		param.apply(decoded[param.name])
+	}
+	p.events.Publish(ParameterEvent{Node: p.node.fullName, Changed: changed})
+	return changed, nil
+}
+
+func (param *parameter) info() ParameterInfo {
+	return ParameterInfo{
+		Name:        param.name,
+		Type:        param.typeName,
+		Description: param.description,
+		Value:       param.value,
+	}
+}
+
+// Describe returns every parameter in the order they were declared
+func (p *Parameters) Describe() []ParameterInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	infos := make([]ParameterInfo, 0, len(p.order))
+	for _, name := range p.order {
+		infos = append(infos, p.params[name].info())
+	}
+	return infos
+}
+
+func (p *Parameters) handleRequest(request ParameterRequest) (ParameterResponse, error) {
+	var response ParameterResponse
+	if len(request.Set) > 0 {
+		changed, err := p.set(request.Set)
+		if err != nil {
+			return response, err
+		}
+		response.Parameters = changed
+	}
+	if len(request.Get) == 0 && len(request.Set) == 0 {
+		response.Parameters = p.Describe()
+		return response, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, name := range request.Get {
+		param, ok := p.params[name]
+		if !ok {
+			return ParameterResponse{}, fmt.Errorf("%w %s", ErrUnknownParameter, name)
+		}
+		response.Parameters = append(response.Parameters, param.info())
+	}
+	return response, nil
+}
+
+// Parameter files map full node names to their parameters
+//
+//	left_arm/driver:
+//	  max_speed: 1.5
+//	  joints: [shoulder, elbow]
+
+// LoadYAML sets the parameters of the node's section of the YAML file at path.
+// Declared parameters are changed like with Set, the others take the value when they are declared.
+func (p *Parameters) LoadYAML(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file map[string]map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("invalid parameter file %s: %w", path, err)
+	}
+	section := file[p.node.fullName]
+
+	declared := make(map[string]json.RawMessage)
+	p.mu.Lock()
+	if p.overrides == nil {
+		p.overrides = make(map[string]*yaml.Node)
+	}
+	for name, node := range section {
+		if _, ok := p.params[name]; !ok {
+			p.overrides[name] = &node
+			continue
+		}
+		var value any
+		if err := node.Decode(&value); err != nil {
+			p.mu.Unlock()
+			return fmt.Errorf("parameter %s: %w", name, err)
+		}
+		if declared[name], err = json.Marshal(value); err != nil {
+			p.mu.Unlock()
+			return fmt.Errorf("parameter %s: %w", name, err)
+		}
+	}
+	p.mu.Unlock()
+
+	if len(declared) == 0 {
+		return nil
+	}
+	_, err = p.set(declared)
+	return err
+}
+
+// DumpYAML returns the node's parameters as a parameter file LoadYAML reads
+func (p *Parameters) DumpYAML() ([]byte, error) {
+	section := &yaml.Node{Kind: yaml.MappingNode}
+	for _, info := range p.Describe() {
+		var value any
+		if err := json.Unmarshal(info.Value, &value); err != nil {
+			return nil, err
+		}
+		var node yaml.Node
+		if err := node.Encode(value); err != nil {
+			return nil, err
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: info.Name, HeadComment: info.Description}
+		section.Content = append(section.Content, key, &node)
+	}
+	file := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Value: p.node.fullName},
+		section,
+	}}
+	return yaml.Marshal(file)
+}
+
+// ParameterClient gets and sets the parameters of a remote node
+type ParameterClient struct {
+	nodeName string
+	caller   *ServiceCaller[ParameterRequest, ParameterResponse]
+}
+
+// NewParameterClient reaches the parameters of the node nodeName, a relative name is resolved against the default namespace
+func NewParameterClient(namespace *Namespace, nodeName string) (*ParameterClient, error) {
+	caller, err := NewServiceCaller[ParameterRequest, ParameterResponse](namespace, nodeName+parametersServiceSuffix,
+		WithCodec(JSONCodec[ParameterRequest]()), WithCodec(JSONCodec[ParameterResponse]()))
+	if err != nil {
+		return nil, err
+	}
+	return &ParameterClient{nodeName: nodeName, caller: caller}, nil
+}
+
+func (c *ParameterClient) NodeName() string {
+	return c.nodeName
+}
+
+// Get returns the named parameters, every parameter if no name is given
+func (c *ParameterClient) Get(ctx context.Context, names ...string) ([]ParameterInfo, error) {
+	response, err := c.caller.Call(ParameterRequest{Get: names}, ctx)
+	return response.Parameters, err
+}
+
+// Set changes the parameters to the JSON encoding of values, either every one changes or none
+func (c *ParameterClient) Set(ctx context.Context, values map[string]any) ([]ParameterInfo, error) {
+	request := ParameterRequest{Set: make(map[string]json.RawMessage, len(values))}
+	for name, value := range values {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", name, err)
+		}
+		request.Set[name] = encoded
+	}
+	response, err := c.caller.Call(request, ctx)
+	return response.Parameters, err
+}
+
+func (c *ParameterClient) Close() {
+	c.caller.Close()
+}
+
+// ParameterWatcher follows the parameter events of every program of a namespace
+type ParameterWatcher struct {
+	namespace *Namespace
+	handler   func(ParameterEvent)
+	logger    *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	subscribers map[string]*Subscriber[ParameterEvent]
+	// handlerMu keeps the subscribers of two programs from calling handler at once
+	handlerMu sync.Mutex
+}
+
+// WatchParameters calls handler with the changes of the parameters of the node nodeName, of every node if it is empty.
+// The events topics of programs are subscribed to as they are found.
+// Like any topic, an event may be missed in favour of a newer one, Get returns the current values.
+func WatchParameters(namespace *Namespace, nodeName string, handler func(ParameterEvent)) (*ParameterWatcher, error) {
+	if nodeName != "" {
+		fullName, err := expandName(nodeName, namespace.remapping.defaultNamespace(), "")
+		if err != nil {
+			return nil, err
+		}
+		all := handler
+		handler = func(event ParameterEvent) {
+			if event.Node == fullName {
+				all(event)
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(namespace.ctx)
+	w := &ParameterWatcher{
+		namespace: namespace,
+		handler:   handler,
+		logger:    namespace.logger.With("namespace", namespace.Name(), "component", "parameter_watcher"),
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		subscribers: make(map[string]*Subscriber[ParameterEvent]),
+	}
+	go w.discover()
+	return w, nil
+}
+
+// discover subscribes to the events topics found in the namespace
+func (w *ParameterWatcher) discover() {
+	prefix := strings.TrimPrefix(ParameterEventsTopic, "/") + "/"
+	err := w.namespace.reg.Browse(w.ctx, func(endpoint Endpoint) {
+		if endpoint.Type == globals.ZERO_CONF_PUBLISHER && strings.HasPrefix(endpoint.Name, prefix) {
+			w.subscribe(endpoint.Name)
+		}
+	})
+	if err != nil && w.ctx.Err() == nil {
+		w.logger.Error("unable to browse parameter events", "error", err)
+	}
+}
+
+func (w *ParameterWatcher) subscribe(topic string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.subscribers[topic]; ok || w.ctx.Err() != nil {
+		return
+	}
+
+	// the name of the endpoint is resolved already, as a global name it is not resolved again
+	sub, err := NewSubscriber(w.namespace, "/"+topic, func(event ParameterEvent) {
+		w.handlerMu.Lock()
+		defer w.handlerMu.Unlock()
+		w.handler(event)
+	}, WithCodec(JSONCodec[ParameterEvent]()))
+	if err != nil {
+		w.logger.Error("unable to subscribe", "topic", topic, "error", err)
+		return
+	}
+	w.subscribers[topic] = sub
+}
+
+// Stop stops following the events
+func (w *ParameterWatcher) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.cancel()
+	for _, sub := range w.subscribers {
+		sub.Stop()
+	}
+}
@@ -0,0 +1,223 @@
+package spine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParameters(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_parameters", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	node, err := NewNode(ns, "driver", WithNodeNamespace("left_arm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	params, err := NewParameters(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "params.yaml")
+	file := "left_arm/driver:\n  max_speed: 2.5\n  joints: [shoulder, elbow]\nright_arm/driver:\n  max_speed: 9\n"
+	if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := params.LoadYAML(path); err != nil {
+		t.Fatal(err)
+	}
+
+	maxSpeed, err := DeclareParameter(params, "max_speed", 1.0, "fastest joint speed in rad/s", WithValidator(func(v float64) error {
+		if v <= 0 {
+			return errors.New("must be positive")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	joints, err := DeclareParameter(params, "joints", []string{"shoulder"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxSpeed.Get() != 2.5 || len(joints.Get()) != 2 {
+		t.Errorf("expected the values of the file, got %v and %v", maxSpeed.Get(), joints.Get())
+	}
+
+	changed := make(chan float64, 1)
+	// the change is set again until its event is received, the first one is kept
+	maxSpeed.OnChange(func(v float64) {
+		select {
+		case changed <- v:
+		default:
+		}
+	})
+
+	events := make(chan ParameterEvent, 10)
+	watcher, err := WatchParameters(ns, "/left_arm/driver", func(e ParameterEvent) { events <- e })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Stop()
+
+	client, err := NewParameterClient(ns, "/left_arm/driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the changes of another node share the events topic but are not watched
+	other, err := NewNode(ns, "driver", WithNodeNamespace("right_arm"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	otherParams, err := NewParameters(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherParams.Close()
+	if _, err := DeclareParameter(otherParams, "max_speed", 1.0, ""); err != nil {
+		t.Fatal(err)
+	}
+	otherClient, err := NewParameterClient(ns, "/right_arm/driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer otherClient.Close()
+	if _, err := otherClient.Set(ctx, map[string]any{"max_speed": 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := client.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Name != "max_speed" || string(all[0].Value) != "2.5" || all[0].Type != "float64" {
+		t.Errorf("unexpected parameters %+v", all)
+	}
+
+	// the invalid value is rejected and the valid one is not applied either
+	if _, err := client.Set(ctx, map[string]any{"max_speed": -1, "joints": []string{"wrist"}}); err == nil || !strings.Contains(err.Error(), "must be positive") {
+		t.Errorf("expected the validator to reject the change, got %v", err)
+	}
+	if len(joints.Get()) != 2 {
+		t.Errorf("expected joints to stay unchanged, got %v", joints.Get())
+	}
+	if _, err := client.Set(ctx, map[string]any{"max_speed": "fast"}); err == nil {
+		t.Error("expected a value of the wrong type to be rejected")
+	}
+
+	for {
+		if _, err := client.Set(ctx, map[string]any{"max_speed": 3}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case event := <-events:
+			if event.Node != "left_arm/driver" || len(event.Changed) != 1 || string(event.Changed[0].Value) != "3" {
+				t.Errorf("unexpected event %+v", event)
+			}
+		case <-time.After(100 * time.Millisecond):
+			continue
+		case <-ctx.Done():
+			t.Fatal("no event received")
+		}
+		break
+	}
+	if v := <-changed; v != 3 || maxSpeed.Get() != 3 {
+		t.Errorf("expected max_speed to be 3, got %v", v)
+	}
+
+	dumped, err := params.DumpYAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "left_arm/driver:\n    # fastest joint speed in rad/s\n    max_speed: 3\n    joints:\n        - shoulder\n        - elbow\n"
+	if string(dumped) != expected {
+		t.Errorf("unexpected dump\n%s", dumped)
+	}
+}
+
+func TestParameters_Programs(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+	// each namespace stands for a program with its own events topic
+	var clients []*ParameterClient
+	for _, name := range []string{"left", "right"} {
+		ns, err := JointNamespace("test_parameters_programs", "secret", logger)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ns.Disconnect()
+
+		node, err := NewNode(ns, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer node.Close()
+		params, err := NewParameters(node)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := DeclareParameter(params, "gain", 1.0, ""); err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := NewParameterClient(ns, "/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	watching, err := JointNamespace("test_parameters_programs", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watching.Disconnect()
+	events := make(chan ParameterEvent, 10)
+	watcher, err := WatchParameters(watching, "", func(e ParameterEvent) { events <- e })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	seen := make(map[string]bool)
+	for gain := 2; len(seen) < 2; gain++ {
+		for _, client := range clients {
+			if _, err := client.Set(ctx, map[string]any{"gain": gain}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case event := <-events:
+			seen[event.Node] = true
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatalf("received the events of %v only", seen)
+		}
+	}
+	if !seen["left"] || !seen["right"] {
+		t.Errorf("unexpected nodes %v", seen)
+	}
+}
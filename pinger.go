@@ -0,0 +1,70 @@
+package spine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/poisnoir/spine-go/internal/globals"
+	"github.com/xtaci/kcp-go/v5"
+)
+
+// Pinger measures the round trip time to a service with the ping frames used for heartbeats
+type Pinger struct {
+	service string
+	conn    *kcp.UDPSession
+}
+
+// NewPinger connects to service with the type codes it advertises, without knowing its types
+func NewPinger(ns *Namespace, service string, ctx context.Context) (*Pinger, error) {
+	endpoint, err := ns.reg.Resolve(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Type != globals.ZERO_CONF_SERVICE {
+		return nil, fmt.Errorf("%s is a %s, only services answer pings", service, endpoint.Type)
+	}
+
+	conn, err := kcp.DialWithOptions(endpoint.Address, ns.encryption, 10, 3)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	buf := make([]byte, globals.MAX_PACKET_SIZE)
+	for _, code := range []string{endpoint.Code, endpoint.ResponseCode} {
+		n, err := write(conn, buf, copy(buf, code), true)
+		if err == nil && (n != 1 || buf[0] != globals.OK_STATUS_CODE) {
+			err = fmt.Errorf("service rejected its advertised type %s", code)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &Pinger{service: service, conn: conn}, nil
+}
+
+// Ping sends one ping and waits for the pong until ctx is done
+func (p *Pinger) Ping(ctx context.Context) (time.Duration, error) {
+	deadline, _ := ctx.Deadline() // zero without a deadline
+	p.conn.SetDeadline(deadline)
+
+	start := time.Now()
+	if err := ping(p.conn); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+func (p *Pinger) Service() string {
+	return p.service
+}
+
+func (p *Pinger) Close() {
+	p.conn.Close()
+}
@@ -0,0 +1,43 @@
+package spine
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestPinger(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_pinger", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	service, err := NewService(ns, "echo", func(s string) (string, error) { return s, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pinger, err := NewPinger(ns, "echo", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pinger.Close()
+
+	for range 3 {
+		rtt, err := pinger.Ping(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rtt <= 0 {
+			t.Errorf("unexpected round trip time %v", rtt)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package spine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/poisnoir/spine-go/bag"
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+const DefaultDiscoveryWindow = 2 * time.Second
+
+// Player republishes the topics of a bag with their original timing
+type Player struct {
+	namespace *Namespace
+	reader    *bag.Reader
+	logger    *slog.Logger
+
+	rate   float64
+	loop   bool
+	offset time.Duration
+	topics []string
+	window time.Duration
+
+	publishers map[string]*Publisher[[]byte]
+
+	mu         sync.Mutex
+	mismatches []CodeMismatch
+}
+
+// PlayerOption configures a Player when it is created
+type PlayerOption func(*Player)
+
+// WithPlaybackRate plays the bag rate times faster than it was recorded, 0.5 plays at half speed
+func WithPlaybackRate(rate float64) PlayerOption {
+	return func(p *Player) {
+		p.rate = rate
+	}
+}
+
+// WithLoop plays the bag again every time it ends
+func WithLoop() PlayerOption {
+	return func(p *Player) {
+		p.loop = true
+	}
+}
+
+// WithStartOffset skips the first offset of the bag
+func WithStartOffset(offset time.Duration) PlayerOption {
+	return func(p *Player) {
+		p.offset = offset
+	}
+}
+
+// WithTopics only plays topics
+func WithTopics(topics ...string) PlayerOption {
+	return func(p *Player) {
+		p.topics = append(p.topics, topics...)
+	}
+}
+
+// WithDiscoveryWindow sets how long Play waits for subscribers to connect before it starts
+func WithDiscoveryWindow(window time.Duration) PlayerOption {
+	return func(p *Player) {
+		p.window = window
+	}
+}
+
+// CodeMismatch is a subscriber whose type differs from the recorded one
+type CodeMismatch struct {
+	Topic          string
+	RecordedCode   string
+	SubscriberCode string
+}
+
+// CodeMismatchError is returned by Play when subscribers expect other types than the bag holds
+type CodeMismatchError struct {
+	Mismatches []CodeMismatch
+}
+
+func (e *CodeMismatchError) Error() string {
+	topics := make([]string, len(e.Mismatches))
+	for i, m := range e.Mismatches {
+		topics[i] = fmt.Sprintf("%s (recorded %s, subscriber %s)", m.Topic, m.RecordedCode, m.SubscriberCode)
+	}
+	return "subscribers expect different types: " + strings.Join(topics, ", ")
+}
+
+// NewPlayer creates a publisher for every recorded topic of reader
+func NewPlayer(ns *Namespace, reader *bag.Reader, opts ...PlayerOption) (*Player, error) {
+
+	p := &Player{
+		namespace: ns,
+		reader:    reader,
+		logger:    ns.logger.With("namespace", ns.Name(), "component", "player"),
+
+		rate:   1,
+		window: DefaultDiscoveryWindow,
+
+		publishers: make(map[string]*Publisher[[]byte]),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.rate <= 0 {
+		return nil, errors.New("playback rate must be positive")
+	}
+
+	for _, c := range reader.Connections() {
+		if c.Kind != bag.KindTopic || !p.plays(c.Name) {
+			continue
+		}
+		if _, ok := p.publishers[c.Name]; ok {
+			p.logger.Warn("topic was recorded with several types, only the first is played", "topic", c.Name)
+			continue
+		}
+
+		// a rejected subscriber keeps reconnecting, it is recorded once
+		onMismatch := func(code string) {
+			mismatch := CodeMismatch{Topic: c.Name, RecordedCode: c.Code, SubscriberCode: code}
+			p.mu.Lock()
+			if !slices.Contains(p.mismatches, mismatch) {
+				p.mismatches = append(p.mismatches, mismatch)
+			}
+			p.mu.Unlock()
+		}
+
+		var opts []Option
+		if schema, err := ParseSchema(c.Schema); err == nil && schema.Code() == c.Code {
+			opts = append(opts, WithSchema(schema))
+		}
+
+		// recorded names are resolved, they are played under the same names
+		pub, err := newPublisher(ns, "/"+c.Name, RawCodec(c.Code), onMismatch, opts)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.publishers[c.Name] = pub
+	}
+
+	return p, nil
+}
+
+func (p *Player) plays(topic string) bool {
+	return len(p.topics) == 0 || slices.Contains(p.topics, topic)
+}
+
+// Mismatches returns the subscribers that were rejected because their type differs from the recorded one
+func (p *Player) Mismatches() []CodeMismatch {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.mismatches)
+}
+
+// Play waits for subscribers to connect and plays the bag until it ends or ctx is done.
+// It returns a *CodeMismatchError without playing anything if a subscriber expects a different type.
+func (p *Player) Play(ctx context.Context) error {
+
+	select {
+	case <-time.After(p.window):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if mismatches := p.Mismatches(); len(mismatches) > 0 {
+		return &CodeMismatchError{Mismatches: mismatches}
+	}
+
+	for {
+		if err := p.playOnce(ctx); err != nil {
+			return err
+		}
+		if !p.loop {
+			return nil
+		}
+	}
+}
+
+func (p *Player) playOnce(ctx context.Context) error {
+
+	topics := make([]string, 0, len(p.publishers))
+	for topic := range p.publishers {
+		topics = append(topics, topic)
+	}
+	if len(topics) == 0 {
+		return nil
+	}
+
+	query := bag.Query{Start: p.reader.Start().Add(p.offset), Names: topics}
+
+	var first time.Time
+	var started time.Time
+	clock := p.namespace.clock
+
+	for msg, err := range p.reader.Messages(query) {
+		if err != nil {
+			return err
+		}
+
+		if first.IsZero() {
+			first = msg.Time
+			started = clock.Now()
+		}
+
+		due := started.Add(time.Duration(float64(msg.Time.Sub(first)) / p.rate))
+		if wait := due.Sub(clock.Now()); wait > 0 {
+			timer := clock.NewTimer(wait)
+			select {
+			case <-timer.C():
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		pub := p.publishers[msg.Connection.Name]
+		if pub.codec.Code() != msg.Connection.Code {
+			continue
+		}
+
+		code, header, payload, err := decodeFrame(msg.Data)
+		if err != nil || code != globals.PUBLISER_PUSH {
+			p.logger.Error("skipping invalid frame", "topic", msg.Connection.Name, "error", err)
+			continue
+		}
+		// the recorder accepts compressed frames, subscribers of the player get the payload as it was published
+		if header.compression != 0 {
+			if payload, err = decompress(header.compression, payload); err != nil {
+				p.logger.Error("skipping invalid frame", "topic", msg.Connection.Name, "error", err)
+				continue
+			}
+		}
+		pub.PublishWithHeaders(payload, header.metadata)
+	}
+	return nil
+}
+
+// Close closes the publishers of the player, the reader stays open
+func (p *Player) Close() {
+	for _, pub := range p.publishers {
+		pub.Close()
+	}
+}
@@ -0,0 +1,223 @@
+package spine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/poisnoir/mad-go"
+	"github.com/poisnoir/spine-go/bag"
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+// recordCounter writes a bag with values 1 to count published on topic every 10ms
+func recordCounter(t *testing.T, topic string, count int) string {
+	path := filepath.Join(t.TempDir(), "test.bag")
+	w, err := bag.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serializer, _ := mad.NewMad[uint32]()
+	conn, err := w.AddConnection(bag.Connection{Kind: bag.KindTopic, Name: topic, Code: serializer.Code()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	buf := make([]byte, globals.MAX_PACKET_SIZE)
+	for i := range count {
+		value := uint32(i + 1)
+		header := frameHeader{sequence: uint64(value)}
+		n := header.encode(globals.PUBLISER_PUSH, buf)
+		serializer.Encode(&value, buf[n:])
+		n += serializer.GetRequiredSize(&value)
+		if err := w.Write(conn, start.Add(time.Duration(i)*10*time.Millisecond), buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPlayer(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_player", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	r, err := bag.Open(recordCounter(t, "counter", 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	received := make(chan uint32, 100)
+	sub, err := NewSubscriber(ns, "counter", func(value uint32) {
+		received <- value
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	// skips the first 20 messages and plays the remaining 300ms in 150ms
+	player, err := NewPlayer(ns, r, WithPlaybackRate(2), WithStartOffset(195*time.Millisecond), WithDiscoveryWindow(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := player.Play(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start) - time.Second; elapsed < 140*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected playback to take about 150ms, took %v", elapsed)
+	}
+
+	var last uint32
+	for last != 50 {
+		select {
+		case value := <-received:
+			if value <= 20 || value <= last {
+				t.Fatalf("unexpected value %d after %d", value, last)
+			}
+			last = value
+		case <-ctx.Done():
+			t.Fatalf("last message not received, got %d", last)
+		}
+	}
+}
+
+func TestPlayer_CodeMismatch(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_player_mismatch", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	r, err := bag.Open(recordCounter(t, "counter", 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	sub, err := NewSubscriber(ns, "counter", func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	player, err := NewPlayer(ns, r, WithDiscoveryWindow(3*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+
+	var mismatch *CodeMismatchError
+	if err := player.Play(context.Background()); !errors.As(err, &mismatch) {
+		t.Fatalf("expected code mismatch, got %v", err)
+	}
+	if len(mismatch.Mismatches) != 1 || mismatch.Mismatches[0].Topic != "counter" {
+		t.Errorf("unexpected mismatches %+v", mismatch.Mismatches)
+	}
+}
+
+func TestPlayer_Compressed(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_player_compressed", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	// the played payload has to fit a frame uncompressed
+	type profile struct {
+		Heights [250]float32
+	}
+	var message profile
+	for i := range message.Heights {
+		message.Heights[i] = 0.25
+	}
+
+	path := filepath.Join(t.TempDir(), "test.bag")
+	writer, err := bag.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := NewRecorder(ns, writer, "profile")
+
+	pub, err := NewPublisher[profile](ns, "profile", WithCompression(CompressionZstd, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 20 {
+		pub.Publish(message)
+		time.Sleep(100 * time.Millisecond)
+	}
+	pub.Close()
+	recorder.Close()
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := bag.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	compressed := false
+	for m, err := range r.Messages(bag.Query{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, header, _, err := decodeFrame(m.Data); err == nil && header.compression != 0 {
+			compressed = true
+		}
+	}
+	if !compressed {
+		t.Fatal("expected compressed frames in the bag")
+	}
+
+	received := make(chan profile, 100)
+	sub, err := NewSubscriber(ns, "profile", func(p profile) { received <- p })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	player, err := NewPlayer(ns, r, WithDiscoveryWindow(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := player.Play(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-received:
+		if p != message {
+			t.Error("unexpected message")
+		}
+	case <-ctx.Done():
+		t.Fatal("no message received")
+	}
+}
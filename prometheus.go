@@ -0,0 +1,173 @@
+package spine
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets (in seconds) used by the prometheus sink
+var DefaultBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// PrometheusSink keeps metrics in memory and serves them in the prometheus text exposition format
+type PrometheusSink struct {
+	mu       sync.Mutex
+	buckets  []float64
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	typ    string
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labels string
+	value  float64
+
+	// histogram only
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewPrometheusSink creates a sink, histograms use buckets or DefaultBuckets if none are given
+func NewPrometheusSink(buckets ...float64) *PrometheusSink {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+
+	return &PrometheusSink{
+		buckets:  buckets,
+		families: make(map[string]*metricFamily),
+	}
+}
+
+func (p *PrometheusSink) AddCounter(name string, labels map[string]string, value float64) {
+	p.mu.Lock()
+	p.series(name, "counter", labels).value += value
+	p.mu.Unlock()
+}
+
+func (p *PrometheusSink) SetGauge(name string, labels map[string]string, value float64) {
+	p.mu.Lock()
+	p.series(name, "gauge", labels).value = value
+	p.mu.Unlock()
+}
+
+func (p *PrometheusSink) ObserveHistogram(name string, labels map[string]string, value float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.series(name, "histogram", labels)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(p.buckets))
+	}
+	for i, bound := range p.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// must hold mu
+func (p *PrometheusSink) series(name string, typ string, labels map[string]string) *metricSeries {
+	family, ok := p.families[name]
+	if !ok {
+		family = &metricFamily{typ: typ, series: make(map[string]*metricSeries)}
+		p.families[name] = family
+	}
+
+	key := formatLabels(labels)
+	s, ok := family.series[key]
+	if !ok {
+		s = &metricSeries{labels: key}
+		family.series[key] = s
+	}
+	return s
+}
+
+// ServeHTTP writes every metric in the prometheus text format (version 0.0.4)
+func (p *PrometheusSink) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, name := range slices.Sorted(maps.Keys(p.families)) {
+		family := p.families[name]
+		if info, ok := metricInfos[name]; ok {
+			fmt.Fprintf(out, "# HELP %s %s\n", name, info.help)
+		}
+		fmt.Fprintf(out, "# TYPE %s %s\n", name, family.typ)
+
+		for _, key := range slices.Sorted(maps.Keys(family.series)) {
+			s := family.series[key]
+			if family.typ != "histogram" {
+				fmt.Fprintf(out, "%s%s %s\n", name, wrapLabels(s.labels), formatFloat(s.value))
+				continue
+			}
+
+			for i, bound := range p.buckets {
+				fmt.Fprintf(out, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(s.labels, `le="`+formatFloat(bound)+`"`)), s.counts[i])
+			}
+			fmt.Fprintf(out, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(s.labels, `le="+Inf"`)), s.count)
+			fmt.Fprintf(out, "%s_sum%s %s\n", name, wrapLabels(s.labels), formatFloat(s.sum))
+			fmt.Fprintf(out, "%s_count%s %d\n", name, wrapLabels(s.labels), s.count)
+		}
+	}
+}
+
+// formatLabels returns labels sorted by name as `a="1",b="2"`
+func formatLabels(labels map[string]string) string {
+	var b strings.Builder
+	for i, name := range slices.Sorted(maps.Keys(labels)) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[name]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func joinLabels(labels string, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
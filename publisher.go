@@ -1,15 +1,17 @@
 package spine
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"reflect"
 	"slices"
 	"sync"
 	"time"
 
-	"github.com/poisnoir/mad-go"
 	"github.com/poisnoir/spine-go/internal/globals"
 	"github.com/xtaci/kcp-go/v5"
 
@@ -21,25 +23,76 @@ type Publisher[K any] struct {
 	name      string
 	server    *zeroconf.Server
 	logger    *slog.Logger
+	node      *Node
 
-	serializer *mad.Mad[K]
+	ctx    context.Context
+	cancel context.CancelFunc
 
-	listener   *kcp.Listener
-	clients    []io.ReadWriteCloser
+	codec Codec[K]
+
+	listener *kcp.Listener
+	clients  []io.ReadWriteCloser
+	filters  map[io.ReadWriteCloser]*filter
+	// subscribers that accepted the compression in their handshake
+	compressed map[io.ReadWriteCloser]bool
 	clientMu   sync.RWMutex
 	deadClient chan io.ReadWriteCloser
 
-	sendSig    chan struct{}
-	lastDataMu sync.RWMutex
-	lastData   K
+	sendSig     chan struct{}
+	lastDataMu  sync.RWMutex
+	lastData    K
+	lastHeaders Metadata
+	sequence    uint64
+
+	metrics *endpointMetrics
+
+	// zero without a max rate
+	minInterval time.Duration
+
+	compression          Compression
+	compressionThreshold int
+
+	// called with the code of every subscriber whose type differs, used by the player
+	onMismatch func(code string)
 }
 
-func NewPublisher[K any](ns *Namespace, name string) (*Publisher[K], error) {
+func NewPublisher[K any](ns *Namespace, name string, opts ...Option) (*Publisher[K], error) {
+	options := buildOptions(opts)
+	if err := checkCodecs[K, K](options); err != nil {
+		return nil, err
+	}
+	codec, err := codecOf[K](options)
+	if err != nil {
+		return nil, err
+	}
+	return newPublisher(ns, name, codec, nil, opts)
+}
+
+// NewRawPublisher creates a publisher of payloads that are already encoded with the codec code identifies,
+// usually a mad type code. It is NewPublisher[[]byte] with RawCodec(code).
+// A published payload must not be modified afterwards.
+func NewRawPublisher(ns *Namespace, name string, code string, opts ...Option) (*Publisher[[]byte], error) {
+	return newPublisher(ns, name, RawCodec(code), nil, opts)
+}
 
-	serializer, err := mad.NewMad[K]()
+func newPublisher[K any](ns *Namespace, name string, codec Codec[K], onMismatch func(string), opts []Option) (*Publisher[K], error) {
+
+	options := buildOptions(opts)
+	name, err := ns.resolveName(name, options.node)
 	if err != nil {
 		return nil, err
 	}
+	if !options.compression.valid() {
+		return nil, fmt.Errorf("unknown compression %q", options.compression)
+	}
+
+	schema := madSchema(codec)
+	if schema == nil && options.schema != nil {
+		if options.schema.Code() != codec.Code() {
+			return nil, fmt.Errorf("schema %s does not have the code %s", options.schema, codec.Code())
+		}
+		schema = options.schema
+	}
 
 	listener, err := kcp.ListenWithOptions(":0", ns.encryption, 10, 3)
 	if err != nil {
@@ -48,31 +101,52 @@ func NewPublisher[K any](ns *Namespace, name string) (*Publisher[K], error) {
 
 	server, err := zeroconf.Register(
 		name,
-		ns.Name()+globals.ZERO_CONF_NODE_TYPE,
+		"_"+ns.Name()+globals.ZERO_CONF_NODE_TYPE,
 		globals.ZERO_CONF_DOMAIN,
 		listener.Addr().(*net.UDPAddr).Port,
-		[]string{
-			"type=" + globals.ZERO_CONF_PUBLISHER,
-		},
+		options.text(globals.ZERO_CONF_PUBLISHER, codec.Code(), schema, "", nil),
 		nil,
 	)
 	if err != nil {
+		listener.Close()
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ns.ctx)
+
 	p := &Publisher[K]{
 		namespace: ns,
 		name:      name,
 		server:    server,
 		logger:    ns.logger,
+		node:      options.node,
 
-		serializer: serializer,
+		ctx:    ctx,
+		cancel: cancel,
+
+		codec: codec,
 
 		listener:   listener,
 		deadClient: make(chan io.ReadWriteCloser, 100),
 		clients:    make([]io.ReadWriteCloser, 0),
+		filters:    make(map[io.ReadWriteCloser]*filter),
+		compressed: make(map[io.ReadWriteCloser]bool),
 
 		sendSig: make(chan struct{}, 1),
+		metrics: newEndpointMetrics(ns, kindPublisher, name, options),
+
+		onMismatch: onMismatch,
+
+		compression:          options.compression,
+		compressionThreshold: options.compressionThreshold,
+	}
+	if options.maxRate > 0 {
+		p.minInterval = time.Duration(float64(time.Second) / options.maxRate)
+	}
+
+	if err := options.node.adopt(p.Close); err != nil {
+		p.Close()
+		return nil, err
 	}
 
 	go runListener(listener, ns.logger, p.registerSubscriber)
@@ -83,62 +157,64 @@ func NewPublisher[K any](ns *Namespace, name string) (*Publisher[K], error) {
 
 func (p *Publisher[K]) run() {
 
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := p.namespace.clock.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
-	for {
-		select {
-		case <-p.sendSig:
-			p.lastDataMu.RLock()
-			tempData := p.lastData
-			p.lastDataMu.RUnlock()
-
-			payloadSize := p.serializer.GetRequiredSize(&tempData) + 1
-			if payloadSize > globals.MAX_PACKET_SIZE {
-				p.logger.Error("payload size too big", "size", payloadSize)
-				continue
-			}
-			ticker.Reset(10 * time.Second)
-			bufPtr := p.namespace.bufferPool.Get().(*[]byte)
-			buf := *bufPtr
-			buf[0] = globals.PUBLISER_PUSH
-			p.serializer.Encode(&tempData, buf[1:])
+	var lastSent uint64
 
-			var wg sync.WaitGroup
+	// with a max rate, data published too early is sent once the interval has passed
+	var nextSend time.Time
+	var throttle Timer
+	var throttled <-chan time.Time
+	defer func() {
+		if throttle != nil {
+			throttle.Stop()
+		}
+	}()
 
-			p.clientMu.RLock()
-			snapClients := make([]io.ReadWriteCloser, len(p.clients))
-			copy(snapClients, p.clients)
-			p.clientMu.RUnlock()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
 
-			for _, client := range snapClients {
-				wg.Add(1)
-				go func(target io.ReadWriteCloser) {
-					_, err := write(target, buf, payloadSize, false)
-					if err != nil {
-						select {
-						case p.deadClient <- target:
-						default:
-						}
+		case <-p.sendSig:
+			if p.minInterval > 0 {
+				if throttled != nil {
+					continue // the pending send picks up the latest data
+				}
+				if wait := nextSend.Sub(p.namespace.clock.Now()); wait > 0 {
+					if throttle != nil {
+						throttle.Stop()
 					}
-					wg.Done()
-				}(client)
+					throttle = p.namespace.clock.NewTimer(wait)
+					throttled = throttle.C()
+					continue
+				}
+				nextSend = p.namespace.clock.Now().Add(p.minInterval)
+			}
+			if p.send(&lastSent) {
+				ticker.Reset(10 * time.Second)
 			}
 
-			go func(b *[]byte) {
-				wg.Wait()
-				p.namespace.bufferPool.Put(b)
-			}(bufPtr)
+		case <-throttled:
+			throttled = nil
+			nextSend = p.namespace.clock.Now().Add(p.minInterval)
+			if p.send(&lastSent) {
+				ticker.Reset(10 * time.Second)
+			}
 
 		case deadClient := <-p.deadClient:
 			p.clientMu.Lock()
 			p.clients = slices.DeleteFunc(p.clients, func(c io.ReadWriteCloser) bool {
 				return c == deadClient
 			})
+			delete(p.filters, deadClient)
+			delete(p.compressed, deadClient)
 			deadClient.Close()
+			p.metrics.set(MetricSubscribers, len(p.clients))
 			p.clientMu.Unlock()
 
-		case <-ticker.C:
+		case <-ticker.C():
 			p.clientMu.RLock()
 			snapClients := make([]io.ReadWriteCloser, len(p.clients))
 			copy(snapClients, p.clients)
@@ -147,6 +223,7 @@ func (p *Publisher[K]) run() {
 				go func(conn io.ReadWriteCloser) {
 					err := ping(conn)
 					if err != nil {
+						p.metrics.inc(MetricHeartbeatFailures)
 						select {
 						case p.deadClient <- conn:
 						default:
@@ -158,6 +235,114 @@ func (p *Publisher[K]) run() {
 	}
 }
 
+// send writes the latest data to every subscriber unless it was already sent
+func (p *Publisher[K]) send(lastSent *uint64) bool {
+	p.lastDataMu.RLock()
+	tempData := p.lastData
+	header := frameHeader{metadata: p.lastHeaders, sequence: p.sequence}
+	p.lastDataMu.RUnlock()
+
+	// a message published while the previous one was sent is picked up early
+	if header.sequence == *lastSent {
+		return false
+	}
+	if coalesced := header.sequence - *lastSent - 1; coalesced > 0 {
+		p.metrics.add(MetricCoalesced, int(coalesced))
+	}
+	*lastSent = header.sequence
+
+	header.sentAt = p.namespace.clock.Now().UnixNano()
+	if p.node != nil {
+		header.source = p.node.ID()
+	}
+
+	// subscribers that accepted the compression get the compressed payload when it is smaller
+	var compressed []byte
+	size := p.codec.Size(&tempData)
+	if p.compression != "" && size >= p.compressionThreshold {
+		encoded := make([]byte, size)
+		if err := p.codec.Encode(&tempData, encoded); err == nil {
+			var id uint8
+			if compressed, id = compressPayload(p.compression, p.compressionThreshold, encoded); id == 0 {
+				compressed = nil
+			}
+		}
+	}
+	p.metrics.inc(MetricPublished)
+
+	// subscribers whose filter doesn't match never see the message
+	value := reflect.ValueOf(&tempData).Elem()
+	var plainClients, compressedClients []io.ReadWriteCloser
+	p.clientMu.RLock()
+	for _, client := range p.clients {
+		switch {
+		case !p.filters[client].match(value):
+			p.metrics.inc(MetricFiltered)
+		case compressed != nil && p.compressed[client]:
+			compressedClients = append(compressedClients, client)
+		default:
+			plainClients = append(plainClients, client)
+		}
+	}
+	p.clientMu.RUnlock()
+
+	if len(plainClients) > 0 {
+		if size+header.size() > globals.MAX_PACKET_SIZE {
+			p.logger.Error("payload size too big", "size", size+header.size())
+		} else {
+			bufPtr := p.namespace.bufferPool.Get().(*[]byte)
+			start := header.encode(globals.PUBLISER_PUSH, *bufPtr)
+			if err := p.codec.Encode(&tempData, (*bufPtr)[start:]); err != nil {
+				p.logger.Error("unable to encode data", "error", err)
+				p.namespace.bufferPool.Put(bufPtr)
+			} else {
+				p.write(plainClients, bufPtr, start+size)
+			}
+		}
+	}
+
+	if len(compressedClients) > 0 {
+		header.compression = p.compression.id()
+		if len(compressed)+header.size() > globals.MAX_PACKET_SIZE {
+			p.logger.Error("compressed payload size too big", "size", len(compressed)+header.size())
+		} else {
+			bufPtr := p.namespace.bufferPool.Get().(*[]byte)
+			start := header.encode(globals.PUBLISER_PUSH, *bufPtr)
+			copy((*bufPtr)[start:], compressed)
+			p.write(compressedClients, bufPtr, start+len(compressed))
+			p.metrics.inc(MetricCompressed)
+			p.metrics.add(MetricCompressionSaved, (size-len(compressed))*len(compressedClients))
+		}
+	}
+
+	return true
+}
+
+// write sends the frame in the pooled buffer to clients and returns the buffer once every write is done
+func (p *Publisher[K]) write(clients []io.ReadWriteCloser, bufPtr *[]byte, size int) {
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		wg.Add(1)
+		go func(target io.ReadWriteCloser) {
+			_, err := write(target, *bufPtr, size, false)
+			if err == nil {
+				p.metrics.add(MetricBytesOut, size)
+			} else {
+				select {
+				case p.deadClient <- target:
+				default:
+				}
+			}
+			wg.Done()
+		}(client)
+	}
+
+	go func() {
+		wg.Wait()
+		p.namespace.bufferPool.Put(bufPtr)
+	}()
+}
+
 func (p *Publisher[K]) registerSubscriber(conn io.ReadWriteCloser) {
 
 	var err error
@@ -176,12 +361,30 @@ func (p *Publisher[K]) registerSubscriber(conn io.ReadWriteCloser) {
 		return
 	}
 
-	if !slices.Equal([]byte(p.serializer.Code()), buf[:n]) {
+	// [code], [code][0][filter] or [code][0][filter][0][accepted compressions]
+	code, rest, _ := bytes.Cut(buf[:n], []byte{0})
+	expr, accepted, _ := bytes.Cut(rest, []byte{0})
+
+	if !slices.Equal([]byte(p.codec.Code()), code) {
 		err = fmt.Errorf("invalid data code")
+		p.metrics.inc(MetricHandshakeFailures)
+		if p.onMismatch != nil {
+			p.onMismatch(string(code))
+		}
 		conn.Write([]byte{globals.ERROR_MISMATCH_PAYLOAD_CODE})
 		return
 	}
 
+	// the subscriber checks its filter too, so one that doesn't fit this type gets every message
+	var f *filter
+	if len(expr) > 0 {
+		var filterErr error
+		f, filterErr = compileFilter(string(expr), reflect.TypeFor[K]())
+		if filterErr != nil {
+			p.logger.Warn("unable to apply subscriber filter", "publisher", p.name, "error", filterErr)
+		}
+	}
+
 	_, err = conn.Write([]byte{globals.OK_STATUS_CODE})
 	if err != nil {
 		return
@@ -189,13 +392,28 @@ func (p *Publisher[K]) registerSubscriber(conn io.ReadWriteCloser) {
 
 	p.clientMu.Lock()
 	p.clients = append(p.clients, conn)
+	p.filters[conn] = f
+	p.compressed[conn] = p.compression != "" && accepts(accepted, p.compression)
+	p.metrics.set(MetricSubscribers, len(p.clients))
 	p.clientMu.Unlock()
 
 }
 
+// Publish sends data to every subscriber. Data is dropped while the publisher's node is not active.
 func (p *Publisher[K]) Publish(data K) {
+	p.PublishWithHeaders(data, nil)
+}
+
+// PublishWithHeaders sends data with headers subscribers can read from MessageInfo
+func (p *Publisher[K]) PublishWithHeaders(data K, headers Metadata) {
+	if !p.node.accepts() {
+		return
+	}
+
 	p.lastDataMu.Lock()
 	p.lastData = data
+	p.lastHeaders = headers
+	p.sequence++
 	p.lastDataMu.Unlock()
 
 	select {
@@ -203,3 +421,20 @@ func (p *Publisher[K]) Publish(data K) {
 	default:
 	}
 }
+
+func (p *Publisher[K]) Close() {
+	p.cancel()
+	p.server.Shutdown()
+	p.listener.Close()
+
+	p.clientMu.Lock()
+	for _, client := range p.clients {
+		client.Close()
+	}
+	p.clients = nil
+	p.clientMu.Unlock()
+}
+
+func (p *Publisher[K]) Name() string {
+	return p.name
+}
@@ -0,0 +1,194 @@
+package spine
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/poisnoir/spine-go/bag"
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+// Recorder writes the frames published on topics to a bag.
+// Services created WithRecorder also write their requests and responses to it,
+// a response is written right after its request.
+type Recorder struct {
+	namespace *Namespace
+	writer    *bag.Writer
+	logger    *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu          sync.Mutex
+	subscribers map[string]*Subscriber[[]byte]
+	// request and response connections by service and codes
+	services map[string][2]uint32
+}
+
+// NewRecorder records topics to writer, every topic found through the registry is recorded when none are given.
+// The writer is not closed with the recorder.
+func NewRecorder(ns *Namespace, writer *bag.Writer, topics ...string) *Recorder {
+
+	ctx, cancel := context.WithCancel(ns.ctx)
+
+	r := &Recorder{
+		namespace: ns,
+		writer:    writer,
+		logger:    ns.logger.With("namespace", ns.Name(), "component", "recorder"),
+
+		ctx:    ctx,
+		cancel: cancel,
+
+		subscribers: make(map[string]*Subscriber[[]byte]),
+		services:    make(map[string][2]uint32),
+	}
+
+	if len(topics) == 0 {
+		go r.recordAll()
+	}
+	for _, topic := range topics {
+		go r.recordTopic(topic)
+	}
+
+	return r
+}
+
+// WithRecorder writes the requests and responses of a service to recorder
+func WithRecorder(recorder *Recorder) Option {
+	return func(o *endpointOptions) {
+		o.recorder = recorder
+	}
+}
+
+func (r *Recorder) recordAll() {
+	err := r.namespace.reg.Browse(r.ctx, func(endpoint Endpoint) {
+		if endpoint.Type == globals.ZERO_CONF_PUBLISHER {
+			r.subscribe(endpoint)
+		}
+	})
+	if err != nil && r.ctx.Err() == nil {
+		r.logger.Error("unable to browse topics", "error", err)
+	}
+}
+
+func (r *Recorder) recordTopic(topic string) {
+	endpoint, err := r.namespace.reg.Resolve(r.ctx, topic)
+	if err != nil {
+		return // only fails when the recorder closes
+	}
+	if endpoint.Type != globals.ZERO_CONF_PUBLISHER {
+		r.logger.Error("endpoint is not a topic", "topic", topic, "type", endpoint.Type)
+		return
+	}
+	r.subscribe(endpoint)
+}
+
+func (r *Recorder) subscribe(endpoint Endpoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.subscribers[endpoint.Name]; ok || r.ctx.Err() != nil {
+		return
+	}
+
+	conn, err := r.writer.AddConnection(bag.Connection{Kind: bag.KindTopic, Name: endpoint.Name, Code: endpoint.Code, Schema: endpoint.Schema})
+	if err != nil {
+		r.logger.Error("unable to add topic", "topic", endpoint.Name, "error", err)
+		return
+	}
+
+	onFrame := func(frame []byte, receivedAt time.Time) {
+		if err := r.writer.Write(conn, receivedAt, frame); err != nil {
+			r.logger.Error("unable to record frame", "topic", endpoint.Name, "error", err)
+		}
+	}
+
+	// the name of the endpoint is resolved already, as a global name it is not resolved again
+	sub, err := newSubscriber(r.namespace, "/"+endpoint.Name, RawCodec(endpoint.Code), func([]byte, MessageInfo) {}, onFrame, nil)
+	if err != nil {
+		r.logger.Error("unable to subscribe", "topic", endpoint.Name, "error", err)
+		return
+	}
+	r.subscribers[endpoint.Name] = sub
+}
+
+// recordCall writes a request frame and its response frame, it does nothing on a nil recorder
+func recordCall[K any, V any](r *Recorder, service string, keyCode string, valueCode string, request []byte, response []byte) {
+	if r == nil {
+		return
+	}
+
+	requestConn, responseConn, err := serviceConnections[K, V](r, service, keyCode, valueCode)
+	if err != nil {
+		r.logger.Error("unable to add service", "service", service, "error", err)
+		return
+	}
+
+	now := r.namespace.clock.Now()
+	if err := r.writer.Write(requestConn, now, request); err != nil {
+		r.logger.Error("unable to record request", "service", service, "error", err)
+		return
+	}
+	if err := r.writer.Write(responseConn, now, response); err != nil {
+		r.logger.Error("unable to record response", "service", service, "error", err)
+	}
+}
+
+// serviceConnections returns the request and response connections of a service,
+// their schemas are only derived the first time
+func serviceConnections[K any, V any](r *Recorder, service string, keyCode string, valueCode string) (uint32, uint32, error) {
+	key := service + "\x00" + keyCode + "\x00" + valueCode
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if conns, ok := r.services[key]; ok {
+		return conns[0], conns[1], nil
+	}
+
+	request := bag.Connection{Kind: bag.KindRequest, Name: service, Code: keyCode}
+	// schemas only describe mad encodings
+	if schema, err := SchemaOf[K](); err == nil && schema.Code() == keyCode {
+		request.Schema = schema.String()
+	}
+	response := bag.Connection{Kind: bag.KindResponse, Name: service, Code: valueCode}
+	if schema, err := SchemaOf[V](); err == nil && schema.Code() == valueCode {
+		response.Schema = schema.String()
+	}
+
+	requestConn, err := r.writer.AddConnection(request)
+	if err != nil {
+		return 0, 0, err
+	}
+	responseConn, err := r.writer.AddConnection(response)
+	if err != nil {
+		return 0, 0, err
+	}
+	r.services[key] = [2]uint32{requestConn, responseConn}
+	return requestConn, responseConn, nil
+}
+
+// Topics returns the topics being recorded
+func (r *Recorder) Topics() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	topics := make([]string, 0, len(r.subscribers))
+	for topic := range r.subscribers {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Close stops recording, the bag's writer stays open
+func (r *Recorder) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cancel()
+	for _, sub := range r.subscribers {
+		sub.Stop()
+	}
+}
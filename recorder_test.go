@@ -0,0 +1,178 @@
+package spine
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/poisnoir/mad-go"
+	"github.com/poisnoir/spine-go/bag"
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+func TestRecorder(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_recorder", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	path := filepath.Join(t.TempDir(), "test.bag")
+	writer, err := bag.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := NewRecorder(ns, writer)
+
+	pub, err := NewPublisher[uint32](ns, "odometry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	service, err := NewService(ns, "double", func(x uint32) (uint32, error) { return 2 * x, nil }, WithRecorder(recorder))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	caller, err := NewServiceCaller[uint32, uint32](ns, "double")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := caller.Call(21, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// publish until the recorder has found the topic and connected
+	for value := uint32(1); value <= 20; value++ {
+		pub.Publish(value)
+		time.Sleep(100 * time.Millisecond)
+	}
+	recorder.Close()
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := bag.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	serializer, _ := mad.NewMad[uint32]()
+	kinds := make(map[string]int)
+	for m, err := range r.Messages(bag.Query{}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Connection.Code != serializer.Code() {
+			t.Errorf("unexpected code %s for %s", m.Connection.Code, m.Connection.Name)
+		}
+
+		code, _, payload, err := decodeFrame(m.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value uint32
+		if err := serializer.Decode(payload, &value); err != nil {
+			t.Fatal(err)
+		}
+
+		switch m.Connection.Kind {
+		case bag.KindTopic:
+			if code != globals.PUBLISER_PUSH || value == 0 || value > 20 {
+				t.Errorf("unexpected frame %d with %d", code, value)
+			}
+		case bag.KindRequest:
+			if value != 21 {
+				t.Errorf("expected request 21, got %d", value)
+			}
+		case bag.KindResponse:
+			if code != globals.OK_STATUS_CODE || value != 42 {
+				t.Errorf("expected response 42, got %d", value)
+			}
+		}
+		kinds[m.Connection.Kind]++
+	}
+
+	if kinds[bag.KindTopic] == 0 || kinds[bag.KindRequest] != 1 || kinds[bag.KindResponse] != 1 {
+		t.Errorf("unexpected recorded messages %v", kinds)
+	}
+}
+
+func TestRecorder_Remapped(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	remap, err := ParseRemapping("__ns:=/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := JointNamespace("test_recorder_remapped", "secret", logger, WithRemapping(remap))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	path := filepath.Join(t.TempDir(), "test.bag")
+	writer, err := bag.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// found names are resolved already, the recorder must not put them under /x again
+	recorder := NewRecorder(ns, writer)
+
+	pub, err := NewPublisher[uint32](ns, "odometry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for value := uint32(1); value <= 20; value++ {
+		pub.Publish(value)
+		time.Sleep(100 * time.Millisecond)
+	}
+	pub.Close()
+	recorder.Close()
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := bag.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.Connections()) != 1 || r.Connections()[0].Name != "x/odometry" || r.MessageCount(0) == 0 {
+		t.Fatalf("expected messages of x/odometry, got %+v", r.Connections())
+	}
+
+	received := make(chan uint32, 100)
+	sub, err := NewSubscriber(ns, "odometry", func(value uint32) { received <- value })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	player, err := NewPlayer(ns, r, WithDiscoveryWindow(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := player.Play(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+	case <-ctx.Done():
+		t.Fatal("played messages were not received under x/odometry")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/grandcat/zeroconf"
@@ -16,52 +17,182 @@ import (
 // add ipv6
 
 type Registry struct {
-	name     string
-	mu       sync.RWMutex
-	logger   *slog.Logger
-	resolver *zeroconf.Resolver
+	name   string
+	mu     sync.RWMutex
+	logger *slog.Logger
+
+	resolveName func(string) (string, error)
 }
 
 func NewRegistry(namespace *Namespace) (*Registry, error) {
-	resolver, err := zeroconf.NewResolver(nil)
-	if err != nil {
-		return nil, err
-	}
 
 	logger := namespace.Logger().With("registry", namespace.Name())
 
 	reg := &Registry{
-		name:     namespace.Name(),
-		resolver: resolver,
-		logger:   logger,
+		name:   namespace.Name(),
+		logger: logger,
+
+		resolveName: namespace.ResolveName,
 	}
 
 	return reg, nil
 }
 
+// Endpoint is a service or publisher advertised in the namespace
+type Endpoint struct {
+	Name    string
+	Type    string
+	Address string
+	// Code is the mad type code of the published data or of the service's input
+	Code string
+	// ResponseCode is the mad type code of the service's output
+	ResponseCode string
+	// Schema and ResponseSchema are the text forms of the schemas of Code and ResponseCode,
+	// empty when the endpoint does not advertise them
+	Schema         string
+	ResponseSchema string
+	// Compression the publisher or service compresses large payloads with, empty if none
+	Compression string
+	Node        string
+	NodeID      string
+}
+
 func (r *Registry) Lookup(ctx context.Context, name string) (string, error) {
+	endpoint, err := r.Resolve(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return endpoint.Address, nil
+}
+
+// Resolve waits until the endpoint called name is found or ctx is done.
+// name is resolved and remapped like the names of endpoints without a node.
+func (r *Registry) Resolve(ctx context.Context, name string) (Endpoint, error) {
+	name, err := r.resolveName(name)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	return r.find(ctx, name)
+}
+
+// find waits for the endpoint with the resolved name
+func (r *Registry) find(ctx context.Context, name string) (Endpoint, error) {
+
+	// a resolver shares its sockets between lookups and closes them when a lookup ends,
+	// so every lookup gets its own
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return Endpoint{}, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	// Use a buffer of 1 to prevent goroutine leaks
 	entries := make(chan *zeroconf.ServiceEntry, 1)
-	if err := r.resolver.Lookup(ctx, name, "_"+r.name+globals.ZERO_CONF_NODE_TYPE, globals.ZERO_CONF_DOMAIN, entries); err != nil {
-		return "", err
+	if err := resolver.Lookup(ctx, name, "_"+r.name+globals.ZERO_CONF_NODE_TYPE, globals.ZERO_CONF_DOMAIN, entries); err != nil {
+		return Endpoint{}, err
 	}
 
-	select {
-	case entry := <-entries:
-		if entry == nil {
-			return "", errors.New("service entry is nil (channel closed with no results)")
+	for {
+		select {
+		case entry := <-entries:
+			if entry == nil {
+				return Endpoint{}, errors.New("service entry is nil (channel closed with no results)")
+			}
+			// the resolver reports every instance of the namespace that answers
+			if instanceName(entry) != name {
+				continue
+			}
+			return newEndpoint(entry)
+		case <-ctx.Done():
+			return Endpoint{}, ctx.Err()
 		}
-		if len(entry.AddrIPv4) > 0 {
-			return net.JoinHostPort(entry.AddrIPv4[0].String(), strconv.Itoa(entry.Port)), nil
+	}
+}
+
+// Browse calls found for every endpoint of the namespace until ctx is done.
+// Endpoints are reported once, when they are first seen.
+func (r *Registry) Browse(ctx context.Context, found func(Endpoint)) error {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		return err
+	}
+
+	entries := make(chan *zeroconf.ServiceEntry, 10)
+	if err := resolver.Browse(ctx, "_"+r.name+globals.ZERO_CONF_NODE_TYPE, globals.ZERO_CONF_DOMAIN, entries); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return ctx.Err()
+			}
+			endpoint, err := newEndpoint(entry)
+			if err != nil {
+				r.logger.Error("invalid endpoint", "endpoint", instanceName(entry), "error", err)
+				continue
+			}
+			found(endpoint)
+		case <-ctx.Done():
+			return ctx.Err()
 		}
+	}
+}
+
+func newEndpoint(entry *zeroconf.ServiceEntry) (Endpoint, error) {
+	endpoint := Endpoint{Name: instanceName(entry)}
+
+	switch {
+	case len(entry.AddrIPv4) > 0:
+		endpoint.Address = net.JoinHostPort(entry.AddrIPv4[0].String(), strconv.Itoa(entry.Port))
+	case len(entry.AddrIPv6) > 0:
+		endpoint.Address = net.JoinHostPort(entry.AddrIPv6[0].String(), strconv.Itoa(entry.Port))
+	default:
+		return endpoint, errors.New("no IP address found for service")
+	}
 
-		if len(entry.AddrIPv6) > 0 {
-			return net.JoinHostPort(entry.AddrIPv6[0].String(), strconv.Itoa(entry.Port)), nil
+	for _, text := range entry.Text {
+		key, value, _ := strings.Cut(text, "=")
+		switch key {
+		case "type":
+			endpoint.Type = value
+		case globals.ZERO_CONF_CODE:
+			endpoint.Code = value
+		case globals.ZERO_CONF_RESPONSE_CODE:
+			endpoint.ResponseCode = value
+		case globals.ZERO_CONF_SCHEMA:
+			endpoint.Schema += value
+		case globals.ZERO_CONF_RESPONSE_SCHEMA:
+			endpoint.ResponseSchema += value
+		case globals.ZERO_CONF_COMPRESSION:
+			endpoint.Compression = value
+		case globals.ZERO_CONF_NODE_NAME:
+			endpoint.Node = value
+		case globals.ZERO_CONF_NODE_ID:
+			endpoint.NodeID = value
 		}
+	}
+	return endpoint, nil
+}
 
-		return "", errors.New("no IP address found for service")
-	case <-ctx.Done():
-		return "", ctx.Err()
+// instanceName returns the instance name of an entry without dns escaping
+func instanceName(entry *zeroconf.ServiceEntry) string {
+	if !strings.Contains(entry.Instance, "\\") {
+		return entry.Instance
+	}
+
+	var b strings.Builder
+	escaped := false
+	for _, c := range entry.Instance {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(c)
 	}
+	return b.String()
 }
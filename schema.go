@@ -0,0 +1,769 @@
+package spine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/poisnoir/spine-go/internal/globals"
+)
+
+// Schema describes how a type is encoded precisely enough to decode it without the type.
+// Its text form is advertised next to the mad code, for example
+//
+//	{Battery:{Level:f32},Joints:[3]{Blocked:bool},RobotID:u8,Status:str}
+type Schema struct {
+	Kind SchemaKind
+	// Len and Elem describe arrays
+	Len  int
+	Elem *Schema
+	// Fields of a struct in the order they are encoded
+	Fields []SchemaField
+}
+
+type SchemaField struct {
+	Name   string
+	Schema *Schema
+}
+
+type SchemaKind uint8
+
+const (
+	SchemaBool SchemaKind = iota + 1
+	SchemaInt8
+	SchemaInt16
+	SchemaInt32
+	SchemaInt64
+	SchemaUint8
+	SchemaUint16
+	SchemaUint32
+	SchemaUint64
+	SchemaFloat32
+	SchemaFloat64
+	SchemaString
+	SchemaArray
+	SchemaStruct
+)
+
+var schemaKindNames = map[SchemaKind]string{
+	SchemaBool:    "bool",
+	SchemaInt8:    "i8",
+	SchemaInt16:   "i16",
+	SchemaInt32:   "i32",
+	SchemaInt64:   "i64",
+	SchemaUint8:   "u8",
+	SchemaUint16:  "u16",
+	SchemaUint32:  "u32",
+	SchemaUint64:  "u64",
+	SchemaFloat32: "f32",
+	SchemaFloat64: "f64",
+	SchemaString:  "str",
+}
+
+var reflectSchemaKinds = map[reflect.Kind]SchemaKind{
+	reflect.Bool:    SchemaBool,
+	reflect.Int8:    SchemaInt8,
+	reflect.Int16:   SchemaInt16,
+	reflect.Int32:   SchemaInt32,
+	reflect.Int64:   SchemaInt64,
+	reflect.Uint8:   SchemaUint8,
+	reflect.Uint16:  SchemaUint16,
+	reflect.Uint32:  SchemaUint32,
+	reflect.Uint64:  SchemaUint64,
+	reflect.Float32: SchemaFloat32,
+	reflect.Float64: SchemaFloat64,
+	reflect.String:  SchemaString,
+}
+
+// SchemaOf returns the schema of T, it supports the same types as mad
+func SchemaOf[T any]() (*Schema, error) {
+	return schemaOf(reflect.TypeFor[T]())
+}
+
+func schemaOf(typ reflect.Type) (*Schema, error) {
+	if typ == nil {
+		return nil, fmt.Errorf("unsupported type: <nil>")
+	}
+	if kind, ok := reflectSchemaKinds[typ.Kind()]; ok {
+		return &Schema{Kind: kind}, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Array:
+		elem, err := schemaOf(typ.Elem())
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Kind: SchemaArray, Len: typ.Len(), Elem: elem}, nil
+
+	case reflect.Struct:
+		s := &Schema{Kind: SchemaStruct}
+		for i := range typ.NumField() {
+			f := typ.Field(i)
+			fieldSchema, err := schemaOf(f.Type)
+			if err != nil {
+				return nil, err
+			}
+			s.Fields = append(s.Fields, SchemaField{Name: f.Name, Schema: fieldSchema})
+		}
+		// mad encodes fields sorted by name
+		sort.Slice(s.Fields, func(i, j int) bool { return s.Fields[i].Name < s.Fields[j].Name })
+		return s, nil
+	}
+	return nil, fmt.Errorf("unsupported type: %v", typ)
+}
+
+// Code returns the mad code of the schema
+func (s *Schema) Code() string {
+	switch s.Kind {
+	case SchemaBool, SchemaInt8, SchemaUint8:
+		return "0"
+	case SchemaInt16, SchemaUint16:
+		return "1"
+	case SchemaInt32, SchemaUint32, SchemaFloat32:
+		return "2"
+	case SchemaInt64, SchemaUint64, SchemaFloat64:
+		return "3"
+	case SchemaString:
+		return "4"
+	case SchemaArray:
+		return "5" + s.Elem.Code()
+	default:
+		var b strings.Builder
+		b.WriteString("7")
+		for _, f := range s.Fields {
+			b.WriteString(f.Schema.Code())
+		}
+		return b.String()
+	}
+}
+
+func (s *Schema) String() string {
+	var b strings.Builder
+	s.write(&b)
+	return b.String()
+}
+
+func (s *Schema) write(b *strings.Builder) {
+	switch s.Kind {
+	case SchemaArray:
+		fmt.Fprintf(b, "[%d]", s.Len)
+		s.Elem.write(b)
+	case SchemaStruct:
+		b.WriteByte('{')
+		for i, f := range s.Fields {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(f.Name)
+			b.WriteByte(':')
+			f.Schema.write(b)
+		}
+		b.WriteByte('}')
+	default:
+		b.WriteString(schemaKindNames[s.Kind])
+	}
+}
+
+// ParseSchema parses the text form of a schema
+func ParseSchema(text string) (*Schema, error) {
+	s, rest, err := parseSchema(text)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("schema: unexpected %q", rest)
+	}
+	return s, nil
+}
+
+func parseSchema(text string) (*Schema, string, error) {
+	switch {
+	case strings.HasPrefix(text, "["):
+		end := strings.IndexByte(text, ']')
+		if end < 0 {
+			return nil, "", fmt.Errorf("schema: missing ]")
+		}
+		length, err := strconv.Atoi(text[1:end])
+		if err != nil || length < 0 {
+			return nil, "", fmt.Errorf("schema: invalid array length %q", text[1:end])
+		}
+		// no frame holds a longer array, the limit keeps advertised schemas from allocating too much
+		if length > globals.MAX_PACKET_SIZE {
+			return nil, "", fmt.Errorf("schema: array length %d is longer than a frame", length)
+		}
+		elem, rest, err := parseSchema(text[end+1:])
+		if err != nil {
+			return nil, "", err
+		}
+		return &Schema{Kind: SchemaArray, Len: length, Elem: elem}, rest, nil
+
+	case strings.HasPrefix(text, "{"):
+		s := &Schema{Kind: SchemaStruct}
+		rest := text[1:]
+		if strings.HasPrefix(rest, "}") {
+			return s, rest[1:], nil
+		}
+		for {
+			colon := strings.IndexByte(rest, ':')
+			if colon <= 0 {
+				return nil, "", fmt.Errorf("schema: expected a field name in %q", rest)
+			}
+			name := rest[:colon]
+			fieldSchema, after, err := parseSchema(rest[colon+1:])
+			if err != nil {
+				return nil, "", err
+			}
+			s.Fields = append(s.Fields, SchemaField{Name: name, Schema: fieldSchema})
+
+			switch {
+			case strings.HasPrefix(after, ","):
+				rest = after[1:]
+			case strings.HasPrefix(after, "}"):
+				return s, after[1:], nil
+			default:
+				return nil, "", fmt.Errorf("schema: expected , or } in %q", after)
+			}
+		}
+
+	default:
+		end := strings.IndexAny(text, ",}")
+		if end < 0 {
+			end = len(text)
+		}
+		for kind, name := range schemaKindNames {
+			if text[:end] == name {
+				return &Schema{Kind: kind}, text[end:], nil
+			}
+		}
+		return nil, "", fmt.Errorf("schema: unknown type %q", text[:end])
+	}
+}
+
+// Decode decodes a payload into bools, numbers of the schema's Go type, strings,
+// []any for arrays and map[string]any for structs
+func (s *Schema) Decode(payload []byte) (any, error) {
+	value, rest, err := s.decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("payload is %d bytes longer than its schema", len(rest))
+	}
+	return value, nil
+}
+
+func (s *Schema) decode(buf []byte) (any, []byte, error) {
+	size := s.fixedSize()
+	if len(buf) < size {
+		return nil, nil, fmt.Errorf("payload too short for %s", s)
+	}
+
+	switch s.Kind {
+	case SchemaBool:
+		return buf[0] != 0, buf[1:], nil
+	case SchemaInt8:
+		return int8(buf[0]), buf[1:], nil
+	case SchemaUint8:
+		return buf[0], buf[1:], nil
+	case SchemaInt16:
+		return int16(binary.BigEndian.Uint16(buf)), buf[2:], nil
+	case SchemaUint16:
+		return binary.BigEndian.Uint16(buf), buf[2:], nil
+	case SchemaInt32:
+		return int32(binary.BigEndian.Uint32(buf)), buf[4:], nil
+	case SchemaUint32:
+		return binary.BigEndian.Uint32(buf), buf[4:], nil
+	case SchemaFloat32:
+		return math.Float32frombits(binary.BigEndian.Uint32(buf)), buf[4:], nil
+	case SchemaInt64:
+		return int64(binary.BigEndian.Uint64(buf)), buf[8:], nil
+	case SchemaUint64:
+		return binary.BigEndian.Uint64(buf), buf[8:], nil
+	case SchemaFloat64:
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), buf[8:], nil
+
+	case SchemaString:
+		n := int(binary.BigEndian.Uint32(buf))
+		if len(buf) < 4+n {
+			return nil, nil, fmt.Errorf("payload too short for string of %d bytes", n)
+		}
+		return string(buf[4 : 4+n]), buf[4+n:], nil
+
+	case SchemaArray:
+		// every element takes at least a byte unless it is empty
+		if s.Len > len(buf) && !s.Elem.empty() {
+			return nil, nil, fmt.Errorf("payload too short for array of %d", s.Len)
+		}
+		values := make([]any, s.Len)
+		for i := range values {
+			var err error
+			if values[i], buf, err = s.Elem.decode(buf); err != nil {
+				return nil, nil, err
+			}
+		}
+		return values, buf, nil
+
+	default:
+		values := make(map[string]any, len(s.Fields))
+		for _, f := range s.Fields {
+			value, rest, err := f.Schema.decode(buf)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", f.Name, err)
+			}
+			values[f.Name] = value
+			buf = rest
+		}
+		return values, buf, nil
+	}
+}
+
+// empty reports whether values of the schema are encoded with no bytes
+func (s *Schema) empty() bool {
+	switch s.Kind {
+	case SchemaArray:
+		return s.Len == 0 || s.Elem.empty()
+	case SchemaStruct:
+		for _, f := range s.Fields {
+			if !f.Schema.empty() {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// fixedSize is the size of the primitive kinds and of a string's length
+func (s *Schema) fixedSize() int {
+	switch s.Kind {
+	case SchemaBool, SchemaInt8, SchemaUint8:
+		return 1
+	case SchemaInt16, SchemaUint16:
+		return 2
+	case SchemaInt32, SchemaUint32, SchemaFloat32, SchemaString:
+		return 4
+	case SchemaInt64, SchemaUint64, SchemaFloat64:
+		return 8
+	}
+	return 0
+}
+
+// Encode encodes a value shaped like the result of Decode or of json.Unmarshal.
+// Struct fields are matched ignoring case and underscores and missing fields are zero.
+func (s *Schema) Encode(value any) ([]byte, error) {
+	return s.encode(nil, value)
+}
+
+// EncodeJSON encodes a JSON document into a payload
+func (s *Schema) EncodeJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return s.Encode(value)
+}
+
+func (s *Schema) encode(buf []byte, value any) ([]byte, error) {
+	switch s.Kind {
+	case SchemaBool:
+		b, ok := value.(bool)
+		if value != nil && !ok {
+			return nil, fmt.Errorf("expected a bool, got %T", value)
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+
+	case SchemaInt8, SchemaInt16, SchemaInt32, SchemaInt64:
+		bits := s.fixedSize() * 8
+		i, err := toInt(value, bits)
+		if err != nil {
+			return nil, err
+		}
+		return appendBits(buf, uint64(i), s.fixedSize()), nil
+
+	case SchemaUint8, SchemaUint16, SchemaUint32, SchemaUint64:
+		bits := s.fixedSize() * 8
+		u, err := toUint(value, bits)
+		if err != nil {
+			return nil, err
+		}
+		return appendBits(buf, u, s.fixedSize()), nil
+
+	case SchemaFloat32:
+		f, err := toFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint32(buf, math.Float32bits(float32(f))), nil
+
+	case SchemaFloat64:
+		f, err := toFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(f)), nil
+
+	case SchemaString:
+		str, ok := value.(string)
+		if value != nil && !ok {
+			return nil, fmt.Errorf("expected a string, got %T", value)
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(str)))
+		return append(buf, str...), nil
+
+	case SchemaArray:
+		var values []any
+		if value != nil {
+			var ok bool
+			if values, ok = value.([]any); !ok {
+				return nil, fmt.Errorf("expected an array, got %T", value)
+			}
+		}
+		if len(values) > s.Len {
+			return nil, fmt.Errorf("expected at most %d elements, got %d", s.Len, len(values))
+		}
+		for i := range s.Len {
+			var elem any
+			if i < len(values) {
+				elem = values[i]
+			}
+			var err error
+			if buf, err = s.Elem.encode(buf, elem); err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+		return buf, nil
+
+	default:
+		var values map[string]any
+		if value != nil {
+			var ok bool
+			if values, ok = value.(map[string]any); !ok {
+				return nil, fmt.Errorf("expected an object, got %T", value)
+			}
+		}
+
+		fields := make(map[string]any, len(values))
+		for key, v := range values {
+			f, ok := s.field(key)
+			if !ok {
+				return nil, fmt.Errorf("unknown field %s", key)
+			}
+			fields[f.Name] = v
+		}
+		for _, f := range s.Fields {
+			var err error
+			if buf, err = f.Schema.encode(buf, fields[f.Name]); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+		return buf, nil
+	}
+}
+
+// field finds a struct field the way filters do, ignoring case and underscores
+func (s *Schema) field(name string) (SchemaField, bool) {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.ReplaceAll(s, "_", ""))
+	}
+	want := normalize(name)
+	for _, f := range s.Fields {
+		if normalize(f.Name) == want {
+			return f, true
+		}
+	}
+	return SchemaField{}, false
+}
+
+func appendBits(buf []byte, bits uint64, size int) []byte {
+	switch size {
+	case 1:
+		return append(buf, byte(bits))
+	case 2:
+		return binary.BigEndian.AppendUint16(buf, uint16(bits))
+	case 4:
+		return binary.BigEndian.AppendUint32(buf, uint32(bits))
+	}
+	return binary.BigEndian.AppendUint64(buf, bits)
+}
+
+func toInt(value any, bits int) (int64, error) {
+	var i int64
+	switch v := value.(type) {
+	case nil:
+	case json.Number:
+		var err error
+		if i, err = strconv.ParseInt(v.String(), 10, 64); err != nil {
+			return 0, fmt.Errorf("expected an integer, got %s", v)
+		}
+	default:
+		rv := reflect.ValueOf(value)
+		switch {
+		case rv.CanInt():
+			i = rv.Int()
+		case rv.CanUint() && rv.Uint() <= math.MaxInt64:
+			i = int64(rv.Uint())
+		case rv.CanFloat() && rv.Float() == math.Trunc(rv.Float()) && math.Abs(rv.Float()) <= 1<<53:
+			i = int64(rv.Float())
+		default:
+			return 0, fmt.Errorf("expected an integer, got %v", value)
+		}
+	}
+
+	if min, max := int64(-1)<<(bits-1), int64(1)<<(bits-1)-1; i < min || i > max {
+		return 0, fmt.Errorf("%d overflows a %d bit integer", i, bits)
+	}
+	return i, nil
+}
+
+func toUint(value any, bits int) (uint64, error) {
+	var u uint64
+	switch v := value.(type) {
+	case nil:
+	case json.Number:
+		var err error
+		if u, err = strconv.ParseUint(v.String(), 10, 64); err != nil {
+			return 0, fmt.Errorf("expected an unsigned integer, got %s", v)
+		}
+	default:
+		rv := reflect.ValueOf(value)
+		switch {
+		case rv.CanUint():
+			u = rv.Uint()
+		case rv.CanInt() && rv.Int() >= 0:
+			u = uint64(rv.Int())
+		case rv.CanFloat() && rv.Float() >= 0 && rv.Float() == math.Trunc(rv.Float()) && rv.Float() <= 1<<53:
+			u = uint64(rv.Float())
+		default:
+			return 0, fmt.Errorf("expected an unsigned integer, got %v", value)
+		}
+	}
+
+	if bits < 64 && u > uint64(1)<<bits-1 {
+		return 0, fmt.Errorf("%d overflows a %d bit unsigned integer", u, bits)
+	}
+	return u, nil
+}
+
+func toFloat(value any) (float64, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		return v.Float64()
+	}
+	rv := reflect.ValueOf(value)
+	switch {
+	case rv.CanFloat():
+		return rv.Float(), nil
+	case rv.CanInt():
+		return float64(rv.Int()), nil
+	case rv.CanUint():
+		return float64(rv.Uint()), nil
+	}
+	return 0, fmt.Errorf("expected a number, got %v", value)
+}
+
+// SchemaMismatchError is returned when payloads written with one schema cannot be read with another
+type SchemaMismatchError struct {
+	// Field is the path of the field that differs, empty for the top level value
+	Field  string
+	Writer *Schema
+	Reader *Schema
+}
+
+func (e *SchemaMismatchError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("written as %s, read as %s", e.Writer, e.Reader)
+	}
+	return fmt.Sprintf("field %s: written as %s, read as %s", e.Field, e.Writer, e.Reader)
+}
+
+// CheckCompatible returns a *SchemaMismatchError if payloads written with writer cannot be read with reader.
+// Struct fields are matched by name, fields only the writer has are dropped and fields only the reader has
+// are zero. Integers and floats may be widened, arrays must keep their length.
+func CheckCompatible(writer *Schema, reader *Schema) error {
+	return checkCompatible("", writer, reader)
+}
+
+func checkCompatible(path string, writer *Schema, reader *Schema) error {
+	mismatch := &SchemaMismatchError{Field: path, Writer: writer, Reader: reader}
+
+	switch {
+	case writer.Kind == SchemaArray && reader.Kind == SchemaArray:
+		if writer.Len != reader.Len {
+			return mismatch
+		}
+		return checkCompatible(path+"[]", writer.Elem, reader.Elem)
+
+	case writer.Kind == SchemaStruct && reader.Kind == SchemaStruct:
+		shared := 0
+		for _, rf := range reader.Fields {
+			wf, ok := writer.fieldNamed(rf.Name)
+			if !ok {
+				continue
+			}
+			shared++
+			fieldPath := rf.Name
+			if path != "" {
+				fieldPath = path + "." + rf.Name
+			}
+			if err := checkCompatible(fieldPath, wf.Schema, rf.Schema); err != nil {
+				return err
+			}
+		}
+		// structs without a field in common are different types, not versions of one
+		if shared == 0 && len(reader.Fields) > 0 && len(writer.Fields) > 0 {
+			return mismatch
+		}
+		return nil
+
+	case widens(writer.Kind, reader.Kind):
+		return nil
+	}
+	return mismatch
+}
+
+// widens reports whether every value of the primitive kind from is a value of to
+func widens(from SchemaKind, to SchemaKind) bool {
+	if from == to {
+		return from != SchemaArray && from != SchemaStruct
+	}
+
+	// indexes are the sizes in ascending order
+	signed := []SchemaKind{SchemaInt8, SchemaInt16, SchemaInt32, SchemaInt64}
+	unsigned := []SchemaKind{SchemaUint8, SchemaUint16, SchemaUint32, SchemaUint64}
+	fromSigned, toSigned := slices.Index(signed, from), slices.Index(signed, to)
+	fromUnsigned, toUnsigned := slices.Index(unsigned, from), slices.Index(unsigned, to)
+
+	switch {
+	case fromSigned >= 0 && toSigned >= 0:
+		return toSigned > fromSigned
+	case fromUnsigned >= 0 && toUnsigned >= 0:
+		return toUnsigned > fromUnsigned
+	case fromUnsigned >= 0 && toSigned >= 0:
+		return toSigned > fromUnsigned
+	}
+	return from == SchemaFloat32 && to == SchemaFloat64
+}
+
+// fieldNamed finds a struct field by its exact name
+func (s *Schema) fieldNamed(name string) (SchemaField, bool) {
+	for _, f := range s.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return SchemaField{}, false
+}
+
+// schemaConverter rewrites payloads of a compatible writer schema into the reader schema
+type schemaConverter struct {
+	writer *Schema
+	reader *Schema
+}
+
+func newSchemaConverter(writer *Schema, reader *Schema) (*schemaConverter, error) {
+	if err := CheckCompatible(writer, reader); err != nil {
+		return nil, err
+	}
+	return &schemaConverter{writer: writer, reader: reader}, nil
+}
+
+// converterFor returns the converter between an endpoint's advertised code and schema and a local one,
+// nil if the schemas are the same, or the codes match and a schema is unknown.
+// Types with the same code can still differ in their field names, so known schemas are compared.
+// The endpoint writes when read is set, otherwise it reads.
+func converterFor(remoteCode string, remoteSchema string, localCode string, local *Schema, read bool) (*schemaConverter, error) {
+	if remoteSchema == "" || local == nil {
+		return nil, nil
+	}
+	remote, err := ParseSchema(remoteSchema)
+	if err != nil {
+		if remoteCode == localCode {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if remote.String() == local.String() {
+		return nil, nil
+	}
+	if read {
+		return newSchemaConverter(remote, local)
+	}
+	return newSchemaConverter(local, remote)
+}
+
+func (c *schemaConverter) convert(payload []byte) ([]byte, error) {
+	out, rest, err := convertPayload(nil, payload, c.writer, c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("payload is %d bytes longer than its schema", len(rest))
+	}
+	return out, nil
+}
+
+// convertPayload appends the value at the start of payload, written with writer, to buf as reader
+// and returns the rest of the payload
+func convertPayload(buf []byte, payload []byte, writer *Schema, reader *Schema) ([]byte, []byte, error) {
+	switch writer.Kind {
+	case SchemaArray:
+		for range writer.Len {
+			var err error
+			if buf, payload, err = convertPayload(buf, payload, writer.Elem, reader.Elem); err != nil {
+				return nil, nil, err
+			}
+		}
+		return buf, payload, nil
+
+	case SchemaStruct:
+		// fields are encoded in the same order, so only the position of dropped and added fields differ
+		values := make(map[string][]byte, len(writer.Fields))
+		for _, f := range writer.Fields {
+			_, rest, err := f.Schema.decode(payload)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", f.Name, err)
+			}
+			values[f.Name] = payload[:len(payload)-len(rest)]
+			payload = rest
+		}
+		for _, rf := range reader.Fields {
+			wf, ok := writer.fieldNamed(rf.Name)
+			var err error
+			if !ok {
+				buf, err = rf.Schema.encode(buf, nil)
+			} else {
+				buf, _, err = convertPayload(buf, values[rf.Name], wf.Schema, rf.Schema)
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", rf.Name, err)
+			}
+		}
+		return buf, payload, nil
+	}
+
+	value, rest, err := writer.decode(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	if writer.Kind == reader.Kind {
+		return append(buf, payload[:len(payload)-len(rest)]...), rest, nil
+	}
+	buf, err = reader.encode(buf, value)
+	return buf, rest, err
+}
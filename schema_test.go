@@ -0,0 +1,347 @@
+package spine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/poisnoir/mad-go"
+)
+
+type schemaJoint struct {
+	Angle   float32
+	Blocked bool
+}
+
+type schemaStatus struct {
+	RobotID  uint8
+	Name     string
+	Offset   int16
+	Position [2]float64
+	Joints   [2]schemaJoint
+	Uptime   uint64
+	Delta    int64
+}
+
+func TestSchema_MatchesMad(t *testing.T) {
+	enc, err := mad.NewMad[schemaStatus]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := SchemaOf[schemaStatus]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Code() != enc.Code() {
+		t.Fatalf("schema code %s, mad code %s", schema.Code(), enc.Code())
+	}
+
+	parsed, err := ParseSchema(schema.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.String() != schema.String() {
+		t.Fatalf("parsed %s, expected %s", parsed, schema)
+	}
+
+	status := schemaStatus{
+		RobotID:  7,
+		Name:     "arm",
+		Offset:   -3,
+		Position: [2]float64{1.5, -2.25},
+		Joints:   [2]schemaJoint{{Angle: 0.5, Blocked: true}},
+		Uptime:   1 << 60,
+		Delta:    -1 << 40,
+	}
+	payload := make([]byte, enc.GetRequiredSize(&status))
+	if err := enc.Encode(&status, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := parsed.Decode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// field names are matched ignoring case and underscores
+	text = bytes.Replace(text, []byte(`"RobotID"`), []byte(`"robot_id"`), 1)
+	encoded, err := parsed.EncodeJSON(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(encoded, payload) {
+		t.Fatalf("json %s encoded to %v, expected %v", text, encoded, payload)
+	}
+
+	if _, err := parsed.EncodeJSON([]byte(`{"RobotID": 300}`)); err == nil {
+		t.Error("expected an overflow error")
+	}
+	if _, err := parsed.EncodeJSON([]byte(`{"Speed": 1}`)); err == nil {
+		t.Error("expected an unknown field error")
+	}
+	if _, err := parsed.Decode(payload[:len(payload)-1]); err == nil {
+		t.Error("expected a short payload error")
+	}
+}
+
+func TestSchema_ArrayLength(t *testing.T) {
+	if _, err := ParseSchema("[1000000000]u8"); err == nil {
+		t.Error("expected an array longer than a frame to be rejected")
+	}
+
+	schema, err := ParseSchema("[4000]u32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := schema.Decode([]byte{1, 2, 3}); err == nil {
+		t.Error("expected a short payload error")
+	}
+
+	empty, err := ParseSchema("[3]{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := empty.Decode(nil); err != nil || len(value.([]any)) != 3 {
+		t.Errorf("expected 3 empty structs, got %v, %v", value, err)
+	}
+}
+
+func TestSchema_Advertised(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_schema", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	pub, err := NewPublisher[schemaStatus](ns, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	endpoint, err := ns.Registry().Resolve(ctx, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, _ := SchemaOf[schemaStatus]()
+	if endpoint.Schema != schema.String() {
+		t.Errorf("advertised schema %q, expected %q", endpoint.Schema, schema)
+	}
+}
+
+func TestRawServiceCaller_JSON(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_raw_caller", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	_, err = NewService(ns, "halve", func(j schemaJoint) (schemaJoint, error) {
+		return schemaJoint{Angle: j.Angle / 2, Blocked: !j.Blocked}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	endpoint, err := ns.Registry().Resolve(ctx, "halve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestSchema, err := ParseSchema(endpoint.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responseSchema, err := ParseSchema(endpoint.ResponseSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := NewRawServiceCaller(ns, "halve", endpoint.Code, endpoint.ResponseCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	request, err := requestSchema.EncodeJSON([]byte(`{"angle": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := caller.Call(request, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := responseSchema.Decode(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := json.Marshal(value)
+	if string(text) != `{"Angle":1.5,"Blocked":true}` {
+		t.Errorf("unexpected response %s", text)
+	}
+}
+
+type statusV1 struct {
+	RobotID uint8
+	Battery float32
+}
+
+type statusV2 struct {
+	RobotID uint16
+	Battery float32
+	Mode    string
+}
+
+func TestCheckCompatible(t *testing.T) {
+	v1, _ := SchemaOf[statusV1]()
+	v2, _ := SchemaOf[statusV2]()
+
+	// new readers widen RobotID and zero Mode, old readers drop Mode
+	if err := CheckCompatible(v1, v2); err != nil {
+		t.Errorf("v1 should be readable as v2: %v", err)
+	}
+	err := CheckCompatible(v2, v1)
+	var mismatch *SchemaMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Field != "RobotID" {
+		t.Errorf("expected RobotID to differ, got %v", err)
+	}
+
+	joints, _ := ParseSchema("{Joints:[2]{Angle:f32}}")
+	blocked, _ := ParseSchema("{Joints:[2]{Angle:bool}}")
+	if err := CheckCompatible(joints, blocked); err == nil || err.Error() != "field Joints[].Angle: written as f32, read as bool" {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	converter, err := newSchemaConverter(v1, v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := v1.EncodeJSON([]byte(`{"RobotID": 200, "Battery": 0.5}`))
+	converted, err := converter.convert(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := v2.Decode(converted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := json.Marshal(value)
+	if string(text) != `{"Battery":0.5,"Mode":"","RobotID":200}` {
+		t.Errorf("unexpected conversion %s", text)
+	}
+}
+
+func TestConverterFor_SameCode(t *testing.T) {
+	local, err := ParseSchema("{Left:f32,Right:f32}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped := "{Right:f32,Left:f32}"
+
+	if c, err := converterFor(local.Code(), local.String(), local.Code(), local, true); err != nil || c != nil {
+		t.Errorf("expected no converter for the same schema, got %v, %v", c, err)
+	}
+
+	// the codes match but the fields were swapped
+	converter, err := converterFor(local.Code(), swapped, local.Code(), local, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converter == nil {
+		t.Fatal("expected a converter for a schema with other field names")
+	}
+	remote, _ := ParseSchema(swapped)
+	payload, _ := remote.EncodeJSON([]byte(`{"Left": 1, "Right": 2}`))
+	converted, err := converter.convert(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := local.Decode(converted)
+	if text, _ := json.Marshal(value); string(text) != `{"Left":1,"Right":2}` {
+		t.Errorf("unexpected conversion %s", text)
+	}
+}
+
+func TestSchema_Evolution(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_schema_evolution", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	type reportV1 struct{ Battery float32 }
+	type reportV2 struct {
+		Battery float32
+		Mode    string
+	}
+
+	// an old node publishes v1 and calls with v1 while an updated node subscribes and serves v2
+	pub, err := NewPublisher[statusV1](ns, "status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	received := make(chan statusV2, 10)
+	sub, err := NewSubscriber(ns, "status", func(s statusV2) { received <- s })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	_, err = NewService(ns, "charge", func(s statusV2) (reportV2, error) {
+		return reportV2{Battery: 1, Mode: fmt.Sprintf("charged %d", s.RobotID)}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caller, err := NewServiceCaller[statusV1, reportV1](ns, "charge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer caller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	report, err := caller.Call(statusV1{RobotID: 4, Battery: 0.2}, ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Battery != 1 {
+		t.Errorf("unexpected response %+v", report)
+	}
+
+	for {
+		pub.Publish(statusV1{RobotID: 200, Battery: 0.5})
+		select {
+		case s := <-received:
+			if s != (statusV2{RobotID: 200, Battery: 0.5}) {
+				t.Errorf("unexpected message %+v", s)
+			}
+			return
+		case <-ctx.Done():
+			t.Fatal("no message received")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -4,34 +4,56 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
 
-	"github.com/grandcat/zeroconf"
-	"github.com/poisnoir/mad-go"
 	"github.com/xtaci/kcp-go/v5"
 )
 
 type Service[K any, V any] struct {
-	namespace *Namespace
-	name      string
-	server    *zeroconf.Server
+	serviceEndpoint[K, V]
+	server   *advertisement
+	node     *Node
+	election *Election
 
-	keySerializer   *mad.Mad[K]
-	valueSerializer *mad.Mad[V]
-
-	context  context.Context
 	listener *kcp.Listener
 	cancel   context.CancelFunc
 
-	handler  func(K) (V, error)
+	handler  func(context.Context, K) (V, error)
 	requests chan serviceRequest[K, V]
 }
 
-func NewService[K any, V any](namespace *Namespace, name string, handler func(K) (V, error)) (*Service[K, V], error) {
+func NewService[K any, V any](namespace *Namespace, name string, handler func(K) (V, error), opts ...Option) (*Service[K, V], error) {
+	return NewServiceWithContext(namespace, name, withoutContext(handler), opts...)
+}
+
+// NewServiceWithContext creates a service whose handler receives the context of the request.
+// The context carries the caller's trace and is canceled when the service closes.
+func NewServiceWithContext[K any, V any](namespace *Namespace, name string, handler func(context.Context, K) (V, error), opts ...Option) (*Service[K, V], error) {
+	keyCodec, valueCodec, err := serviceCodecs[K, V](buildOptions(opts))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service: %v", err)
+	}
+	return newService(namespace, name, keyCodec, valueCodec, handler, opts)
+}
+
+// NewRawService creates a service of payloads that are already encoded with the codecs keyCode and valueCode identify.
+// WithSchema and WithResponseSchema advertise the schemas of the payloads.
+func NewRawService(namespace *Namespace, name string, keyCode string, valueCode string, handler func(context.Context, []byte) ([]byte, error), opts ...Option) (*Service[[]byte, []byte], error) {
+	return newService(namespace, name, RawCodec(keyCode), RawCodec(valueCode), handler, opts)
+}
+
+func newService[K any, V any](namespace *Namespace, name string, keySer Codec[K], valueSer Codec[V], handler func(context.Context, K) (V, error), opts []Option) (*Service[K, V], error) {
 
 	// fix me pls
 	logger := namespace.logger
+	options := buildOptions(opts)
 
-	keySer, valueSer, listener, server, err := generateService[K, V](namespace, name)
+	name, err := namespace.resolveName(name, options.node)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service: %v", err)
+	}
+
+	listener, server, err := generateService(namespace, name, keySer, valueSer, options)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create service: %v", err)
 	}
@@ -39,14 +61,24 @@ func NewService[K any, V any](namespace *Namespace, name string, handler func(K)
 	ctx, cancel := context.WithCancel(namespace.ctx)
 
 	s := &Service[K, V]{
-		namespace: namespace,
-		name:      name,
-		server:    server,
+		serviceEndpoint: serviceEndpoint[K, V]{
+			namespace: namespace,
+			name:      name,
+			context:   ctx,
+
+			keyCodec:   keySer,
+			valueCodec: valueSer,
 
-		keySerializer:   keySer,
-		valueSerializer: valueSer,
+			metrics:  newEndpointMetrics(namespace, kindService, name, options),
+			recorder: options.recorder,
+
+			compression:          options.compression,
+			compressionThreshold: options.compressionThreshold,
+		},
+		server:   server,
+		node:     options.node,
+		election: options.election,
 
-		context:  ctx,
 		cancel:   cancel,
 		listener: listener,
 
@@ -54,6 +86,13 @@ func NewService[K any, V any](namespace *Namespace, name string, handler func(K)
 		handler:  handler,
 	}
 
+	s.interceptedRequest = interceptRequests(namespace, name, options, s.processRequest)
+
+	if err := options.node.adopt(s.Close); err != nil {
+		s.Close()
+		return nil, err
+	}
+
 	go s.runHandler()
 	go runListener(listener, logger, s.clientHandler) // stops when listener closes
 	return s, nil
@@ -71,27 +110,28 @@ func (s *Service[K, V]) clientHandler(conn io.ReadWriteCloser) {
 	bufPtr := s.namespace.bufferPool.Get().(*[]byte)
 	defer s.namespace.bufferPool.Put(bufPtr)
 
-	handleCallerRequest(
-		conn,
-		s.keySerializer,
-		s.valueSerializer,
-		s.namespace.stringSerializer,
-		*bufPtr,
-		s.processRequest,
-		logger,
-	)
+	s.handleCaller(conn, *bufPtr, logger)
 
 }
 
-func (s *Service[K, V]) processRequest(key K) serviceOutput[V] {
+func (s *Service[K, V]) processRequest(ctx context.Context, key K) serviceOutput[V] {
+	if !s.node.accepts() {
+		return serviceOutput[V]{err: ErrNodeInactive}
+	}
+	if !s.election.leads() {
+		return serviceOutput[V]{err: ErrNotLeader}
+	}
+
 	// send to handler
 	hr := serviceRequest[K, V]{
+		ctx:    ctx,
 		input:  key,
 		output: make(chan serviceOutput[V], 1),
 	}
 
 	// todo: need some timeout shit
 	s.requests <- hr
+	s.metrics.set(MetricQueueDepth, len(s.requests))
 	return <-hr.output
 }
 
@@ -107,7 +147,10 @@ func (s *Service[K, V]) runHandler() {
 	for {
 		select {
 		case request := <-s.requests:
-			response, err := s.handler(request.input)
+			s.metrics.set(MetricQueueDepth, len(s.requests))
+			start := time.Now()
+			response, err := s.handler(request.ctx, request.input)
+			s.metrics.observe(MetricHandlerDuration, time.Since(start).Seconds())
 			if err != nil {
 				logger.Error("unable to handle request", "error", err)
 				// Todo: Change To return error instead of default
@@ -121,6 +164,7 @@ func (s *Service[K, V]) runHandler() {
 }
 
 func (s *Service[K, V]) Close() {
+	s.server.Shutdown()
 	s.listener.Close()
 	s.cancel()
 }
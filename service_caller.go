@@ -2,7 +2,10 @@ package spine
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"net"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -14,27 +17,63 @@ import (
 type ServiceCaller[K any, V any] struct {
 	namespace   *Namespace
 	serviceName string
+	node        *Node
 
-	keySerializer   *mad.Mad[K]
-	valueSerializer *mad.Mad[V]
+	keyCodec        Codec[K]
+	valueCodec      Codec[V]
 	errorSerializer *mad.Mad[string]
 
+	// schemas of K and V, nil unless they are encoded with mad. The converters rewrite requests and responses
+	// for a service whose types are compatible versions of K and V, they are nil when the codes match.
+	keySchema         *Schema
+	valueSchema       *Schema
+	requestConverter  *schemaConverter
+	responseConverter *schemaConverter
+
 	ctx    context.Context
 	cancel context.CancelFunc
 
 	conn        *kcp.UDPSession
 	requests    chan serviceRequest[K, V]
 	isConnected bool
+	connections int
+	metrics     *endpointMetrics
+
+	// call wrapped in the client interceptors
+	interceptedCall func(context.Context, K) (V, error)
 }
 
-func NewServiceCaller[K any, V any](namespace *Namespace, serviceName string) (*ServiceCaller[K, V], error) {
+func NewServiceCaller[K any, V any](namespace *Namespace, serviceName string, opts ...Option) (*ServiceCaller[K, V], error) {
+
+	options := buildOptions(opts)
+	if err := checkCodecs[K, V](options); err != nil {
+		return nil, err
+	}
 
-	keySer, err := mad.NewMad[K]()
+	keyCodec, err := codecOf[K](options)
 	if err != nil {
 		return nil, err
 	}
 
-	valueSer, err := mad.NewMad[V]()
+	valueCodec, err := codecOf[V](options)
+	if err != nil {
+		return nil, err
+	}
+
+	return newServiceCaller(namespace, serviceName, keyCodec, valueCodec, opts)
+}
+
+// NewRawServiceCaller creates a caller that sends requests already encoded with the codec keyCode identifies
+// and returns the encoded responses of the codec valueCode identifies
+func NewRawServiceCaller(namespace *Namespace, serviceName string, keyCode string, valueCode string, opts ...Option) (*ServiceCaller[[]byte, []byte], error) {
+	return newServiceCaller(namespace, serviceName, RawCodec(keyCode), RawCodec(valueCode), opts)
+}
+
+func newServiceCaller[K any, V any](namespace *Namespace, serviceName string, keyCodec Codec[K], valueCodec Codec[V], opts []Option) (*ServiceCaller[K, V], error) {
+
+	options := buildOptions(opts)
+
+	serviceName, err := namespace.resolveName(serviceName, options.node)
 	if err != nil {
 		return nil, err
 	}
@@ -46,16 +85,28 @@ func NewServiceCaller[K any, V any](namespace *Namespace, serviceName string) (*
 	sc := &ServiceCaller[K, V]{
 		namespace:   namespace,
 		serviceName: serviceName,
+		node:        options.node,
 
-		keySerializer:   keySer,
-		valueSerializer: valueSer,
+		keyCodec:        keyCodec,
+		valueCodec:      valueCodec,
 		errorSerializer: errSer,
 
+		keySchema:   madSchema(keyCodec),
+		valueSchema: madSchema(valueCodec),
+
 		ctx:    ctx,
 		cancel: cancel,
 
 		isConnected: false,
 		requests:    make(chan serviceRequest[K, V], 100),
+		metrics:     newEndpointMetrics(namespace, kindServiceCaller, serviceName, options),
+	}
+
+	sc.interceptedCall = interceptCalls(namespace, serviceName, options, sc.call)
+
+	if err := options.node.adopt(sc.Close); err != nil {
+		cancel()
+		return nil, err
 	}
 
 	go sc.run()
@@ -67,29 +118,36 @@ func (sc *ServiceCaller[K, V]) run() {
 
 	// timer heartbeat
 	// make sure connection is open and alive
-	ticker := time.NewTicker(10 * time.Second)
+	ticker := sc.namespace.clock.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-sc.ctx.Done():
-			sc.conn.Close()
+			if sc.conn != nil {
+				sc.conn.Close()
+			}
 			return
 		default:
 			if sc.isConnected {
 				select {
-				case <-ticker.C:
+				case <-sc.ctx.Done():
+					// closed while idle, the outer select closes the connection
+				case <-ticker.C():
 					if err := ping(sc.conn); err != nil {
+						sc.metrics.inc(MetricHeartbeatFailures)
 						sc.isConnected = false
 					}
 				case requestData := <-sc.requests:
 					// Postpone heartbeat
 					ticker.Reset(10 * time.Second)
-					output, err := sc.send(requestData.input)
+					output, err := sc.send(requestData.ctx, requestData.input)
 					if err != nil {
+						// only transport errors drop the connection
 						sc.isConnected = false
+						output.err = err
 					}
-					requestData.output <- serviceOutput[V]{data: output, err: err}
+					requestData.output <- output
 				}
 			} else {
 				bo := backoff.WithContext(backoff.NewExponentialBackOff(backoff.WithMaxElapsedTime(0)), sc.ctx)
@@ -101,50 +159,155 @@ func (sc *ServiceCaller[K, V]) run() {
 }
 
 // send is the gateway to kcp connection. It acts as multiplexer
-func (sc *ServiceCaller[K, V]) send(key K) (V, error) {
-	var v V
+// errors of the service are returned in the output, the error is for the connection
+func (sc *ServiceCaller[K, V]) send(ctx context.Context, key K) (serviceOutput[V], error) {
+	var output serviceOutput[V]
+
+	header := frameHeader{trace: SpanContextFromContext(ctx), metadata: OutgoingMetadata(ctx)}
+	keySize := sc.keyCodec.Size(&key)
+
+	// the request is encoded as K and rewritten into the service's version of K
+	var converted []byte
+	if sc.requestConverter != nil {
+		encoded := make([]byte, keySize)
+		if err := sc.keyCodec.Encode(&key, encoded); err != nil {
+			output.err = err
+			return output, nil
+		}
+		if converted, output.err = sc.requestConverter.convert(encoded); output.err != nil {
+			return output, nil
+		}
+		keySize = len(converted)
+	}
 
-	requestSize := sc.keySerializer.GetRequiredSize(&key) + 1
+	requestSize := keySize + header.size()
 	if requestSize > globals.MAX_PACKET_SIZE {
-		return v, fmt.Errorf(globals.ERROR_PAYLOAD_SIZE)
+		output.err = fmt.Errorf(globals.ERROR_PAYLOAD_SIZE)
+		return output, nil
 	}
 
 	bufPtr := sc.namespace.bufferPool.Get().(*[]byte)
 	defer sc.namespace.bufferPool.Put(bufPtr)
 	buf := *bufPtr
-	buf[0] = globals.SERVICE_REQUEST
-	sc.keySerializer.Encode(&key, buf[1:])
+	start := header.encode(globals.SERVICE_REQUEST, buf)
+	if converted != nil {
+		copy(buf[start:], converted)
+	} else if err := sc.keyCodec.Encode(&key, buf[start:]); err != nil {
+		output.err = err
+		return output, nil
+	}
 
-	_, err := write(sc.conn, buf, requestSize, true)
+	// a service that went away never answers, the deadline of the call drops the connection instead of hanging
+	if deadline, ok := ctx.Deadline(); ok {
+		sc.conn.SetDeadline(deadline)
+		defer sc.conn.SetDeadline(time.Time{})
+	}
+
+	n, err := write(sc.conn, buf, requestSize, true)
 	if err != nil {
-		return v, err
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			err = context.DeadlineExceeded
+		}
+		return output, err
 	}
+	sc.metrics.add(MetricBytesOut, requestSize)
+	sc.metrics.add(MetricBytesIn, n)
 
-	if buf[0] != globals.OK_STATUS_CODE {
-		var errMsg string
-		_ = sc.errorSerializer.Decode(buf[1:], &errMsg)
-		return v, fmt.Errorf("call error: %s", errMsg)
+	code, responseHeader, payload, err := decodeFrame(buf[:n])
+	if err != nil {
+		return output, err
 	}
+	output.trailer = responseHeader.metadata
 
-	_ = sc.valueSerializer.Decode(buf, &v)
-	return v, nil
+	switch code {
+	case globals.OK_STATUS_CODE:
+		if responseHeader.compression != 0 {
+			if payload, output.err = decompress(responseHeader.compression, payload); output.err != nil {
+				return output, nil
+			}
+		}
+		if sc.responseConverter != nil {
+			if payload, output.err = sc.responseConverter.convert(payload); output.err != nil {
+				return output, nil
+			}
+		}
+		output.err = sc.valueCodec.Decode(payload, &output.data)
+	case globals.ERROR_NODE_INACTIVE_CODE:
+		output.err = ErrNodeInactive
+	case globals.ERROR_NOT_LEADER_CODE:
+		// the connection is dropped so the next call finds the new leader
+		output.err = ErrNotLeader
+		return output, ErrNotLeader
+	default:
+		var errMsg string
+		_ = sc.errorSerializer.Decode(payload, &errMsg)
+		output.err = fmt.Errorf("call error: %s", errMsg)
+	}
+	return output, nil
 }
 
 // Call sends key to the service and returns V from service
-// context is used for establishing connection
-func (sc *ServiceCaller[K, V]) Call(key K, ctx context.Context) (V, error) {
+// context is used for establishing connection and carries the trace and metadata of the call,
+// a call past the deadline of the context drops the connection
+func (sc *ServiceCaller[K, V]) Call(key K, ctx context.Context, opts ...CallOption) (V, error) {
+
+	if !sc.node.accepts() {
+		var zero V
+		return zero, ErrNodeInactive
+	}
+
+	var options callOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.metadata != nil {
+		md := OutgoingMetadata(ctx).Copy()
+		if md == nil {
+			md = make(Metadata, len(options.metadata))
+		}
+		maps.Copy(md, options.metadata)
+		ctx = NewOutgoingContext(ctx, md)
+	}
+	if options.trailer != nil {
+		ctx = context.WithValue(ctx, callTrailerKey{}, options.trailer)
+	}
+
+	return sc.interceptedCall(ctx, key)
+}
+
+type callTrailerKey struct{}
+
+// call sends one request through the connection, it is the end of the client interceptor chain
+func (sc *ServiceCaller[K, V]) call(ctx context.Context, key K) (V, error) {
 
 	var zero V
+	ctx, span := sc.namespace.tracer.Start(ctx, sc.serviceName, SpanKindClient)
+	defer span.End()
+
 	data := serviceRequest[K, V]{
+		ctx:    ctx,
 		input:  key,
 		output: make(chan serviceOutput[V], 1),
 	}
+	sc.metrics.inc(MetricCalls)
+	start := time.Now()
 	sc.requests <- data
 
 	select {
 	case <-ctx.Done():
+		sc.metrics.inc(MetricCallErrors)
+		span.RecordError(ctx.Err())
 		return zero, ctx.Err()
 	case output := <-data.output:
+		sc.metrics.observe(MetricCallDuration, time.Since(start).Seconds())
+		if trailer, ok := ctx.Value(callTrailerKey{}).(*Metadata); ok {
+			*trailer = output.trailer
+		}
+		if output.err != nil {
+			sc.metrics.inc(MetricCallErrors)
+			span.RecordError(output.err)
+		}
 		return output.data, output.err
 	}
 }
@@ -163,14 +326,36 @@ func (sc *ServiceCaller[K, V]) connect() error {
 	)
 
 	// finding the service
-	address, err := sc.namespace.GetService(sc.serviceName, sc.ctx)
+	endpoint, err := sc.namespace.reg.find(sc.ctx, sc.serviceName)
 	if err != nil {
 		logger.Error("unable to find the service", "error", err)
 		return err // the only way to fail here is to run out of context
 	}
 
+	keyCode := sc.keyCodec.Code()
+	sc.requestConverter, err = converterFor(endpoint.Code, endpoint.Schema, keyCode, sc.keySchema, false)
+	if err != nil {
+		logger.Error("service input type is incompatible", "error", err)
+		sc.metrics.inc(MetricHandshakeFailures)
+		return err
+	}
+	if sc.requestConverter != nil {
+		keyCode = endpoint.Code
+	}
+
+	valueCode := sc.valueCodec.Code()
+	sc.responseConverter, err = converterFor(endpoint.ResponseCode, endpoint.ResponseSchema, valueCode, sc.valueSchema, true)
+	if err != nil {
+		logger.Error("service output type is incompatible", "error", err)
+		sc.metrics.inc(MetricHandshakeFailures)
+		return err
+	}
+	if sc.responseConverter != nil {
+		valueCode = endpoint.ResponseCode
+	}
+
 	// establishing connection
-	sess, err := kcp.DialWithOptions(address, sc.namespace.encryption, 10, 3)
+	sess, err := kcp.DialWithOptions(endpoint.Address, sc.namespace.encryption, 10, 3)
 	if err != nil {
 		logger.Error("failed to dial service", "error", err)
 		return err
@@ -181,9 +366,13 @@ func (sc *ServiceCaller[K, V]) connect() error {
 	defer sc.namespace.bufferPool.Put(bufPtr)
 	buf := *bufPtr
 
-	// validating input/output service types
-	keyCode := sc.keySerializer.Code()
+	// validating input/output service types, the compressions are offered only to services that compress
 	n := copy(buf, keyCode)
+	if endpoint.Compression != "" {
+		buf[n] = 0
+		n++
+		n += copy(buf[n:], acceptedCompressions())
+	}
 
 	n, err = write(sess, buf, n, true)
 	if err != nil {
@@ -196,15 +385,16 @@ func (sc *ServiceCaller[K, V]) connect() error {
 	} else if buf[0] != globals.OK_STATUS_CODE {
 		err = fmt.Errorf("service data type is different")
 		logger.Error("failed to validate service input type", "error", err)
+		sc.metrics.inc(MetricHandshakeFailures)
 		return err
 	}
 
-	valueCode := sc.valueSerializer.Code()
 	n = copy(buf, valueCode)
 
 	n, err = write(sess, buf, n, true)
 	if err != nil {
 		logger.Error("failed to validate service output type", "error", err)
+		return err
 	} else if n != 1 {
 		err = fmt.Errorf("response is corrupted")
 		logger.Error("failed to validate service output type", "error", err)
@@ -212,11 +402,17 @@ func (sc *ServiceCaller[K, V]) connect() error {
 	} else if buf[0] != globals.OK_STATUS_CODE {
 		err = fmt.Errorf("service data type is different")
 		logger.Error("failed to validate service output type", "error", err)
+		sc.metrics.inc(MetricHandshakeFailures)
 		return err
 	}
 	sc.conn = sess
 	sc.isConnected = true
 
+	sc.connections++
+	if sc.connections > 1 {
+		sc.metrics.inc(MetricReconnects)
+	}
+
 	return nil
 
 }
@@ -1,21 +1,53 @@
 package spine
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"slices"
+	"sync"
 
 	"github.com/grandcat/zeroconf"
-	"github.com/poisnoir/mad-go"
 	"github.com/poisnoir/spine-go/internal/globals"
 	"github.com/xtaci/kcp-go/v5"
 )
 
 // bunch of same operations in service and threaded service
 
-func generateService[K any, V any](namespace *Namespace, name string) (*mad.Mad[K], *mad.Mad[V], *kcp.Listener, *zeroconf.Server, error) {
+// serviceCodecs returns the codecs of the keys and values of a typed service
+func serviceCodecs[K any, V any](options endpointOptions) (Codec[K], Codec[V], error) {
+	if err := checkCodecs[K, V](options); err != nil {
+		return nil, nil, err
+	}
+
+	keyEnc, err := codecOf[K](options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	valueEnc, err := codecOf[V](options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keyEnc, valueEnc, nil
+}
+
+// serviceSchema is the schema of a codec, set by WithSchema or WithResponseSchema for raw codecs
+func serviceSchema[T any](codec Codec[T], schema *Schema) (*Schema, error) {
+	if madSchema := madSchema(codec); madSchema != nil || schema == nil {
+		return madSchema, nil
+	}
+	if schema.Code() != codec.Code() {
+		return nil, fmt.Errorf("schema %s does not have the code %s", schema, codec.Code())
+	}
+	return schema, nil
+}
+
+func generateService[K any, V any](namespace *Namespace, name string, keyEnc Codec[K], valueEnc Codec[V], options endpointOptions) (*kcp.Listener, *advertisement, error) {
 	logger := namespace.logger.With(
 		namespace.Name(),
 		"service",
@@ -23,78 +55,168 @@ func generateService[K any, V any](namespace *Namespace, name string) (*mad.Mad[
 		"new service",
 	)
 
-	keyEnc, err := mad.NewMad[K]()
-	if err != nil {
-		logger.Error("unable to create key encoder", "error", err)
-		return nil, nil, nil, nil, err
+	if !options.compression.valid() {
+		err := fmt.Errorf("unknown compression %q", options.compression)
+		logger.Error("unable to create service", "error", err)
+		return nil, nil, err
 	}
 
-	valueEnc, err := mad.NewMad[V]()
+	keySchema, err := serviceSchema(keyEnc, options.schema)
 	if err != nil {
-		logger.Error("unable to create value encoder", "error", err)
-		return nil, nil, nil, nil, err
+		logger.Error("unable to create service", "error", err)
+		return nil, nil, err
+	}
+	valueSchema, err := serviceSchema(valueEnc, options.responseSchema)
+	if err != nil {
+		logger.Error("unable to create service", "error", err)
+		return nil, nil, err
 	}
 
 	listener, err := kcp.ListenWithOptions(":0", namespace.encryption, 10, 3)
 	if err != nil {
 		logger.Error("unable to create listener", "error", err)
-		return nil, nil, nil, nil, err
+		return nil, nil, err
 	}
 
-	server, err := zeroconf.Register(
-		name,
-		"_"+namespace.Name()+globals.ZERO_CONF_NODE_TYPE,
-		globals.ZERO_CONF_DOMAIN,
-		listener.Addr().(*net.UDPAddr).Port,
-		[]string{"type=" + globals.ZERO_CONF_SERVICE},
-		nil,
-	)
+	server := &advertisement{
+		register: func() (*zeroconf.Server, error) {
+			return zeroconf.Register(
+				name,
+				"_"+namespace.Name()+globals.ZERO_CONF_NODE_TYPE,
+				globals.ZERO_CONF_DOMAIN,
+				listener.Addr().(*net.UDPAddr).Port,
+				options.text(globals.ZERO_CONF_SERVICE, keyEnc.Code(), keySchema, valueEnc.Code(), valueSchema),
+				nil,
+			)
+		},
+		logger: logger,
+	}
 
-	if err != nil {
+	// a service of an election is only advertised while its candidate leads
+	if options.election != nil {
+		server.stop = options.election.observe(func(leading bool, _ uint64) { server.set(leading) })
+		return listener, server, nil
+	}
+
+	if err := server.set(true); err != nil {
 		logger.Error("unable to register service to zeroconf", "error", err)
-		return nil, nil, nil, nil, err
+		listener.Close()
+		return nil, nil, err
 	}
 
-	return keyEnc, valueEnc, listener, server, nil
+	return listener, server, nil
 
 }
 
-func establishConnection(conn io.ReadWriteCloser, keyCode []byte, valueCode []byte, buf []byte, logger *slog.Logger) error {
-	n, err := conn.Read(buf)
+// advertisement is the zeroconf registration of a service, it can be withdrawn and registered again
+type advertisement struct {
+	register func() (*zeroconf.Server, error)
+	logger   *slog.Logger
+	stop     func()
+
+	mu     sync.Mutex
+	server *zeroconf.Server
+	closed bool
+}
+
+// set registers the service or withdraws it
+func (a *advertisement) set(advertised bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !advertised || a.closed {
+		if a.server != nil {
+			a.server.Shutdown()
+			a.server = nil
+		}
+		return nil
+	}
+	if a.server != nil {
+		return nil
+	}
+	server, err := a.register()
 	if err != nil {
+		a.logger.Error("unable to register service to zeroconf", "error", err)
 		return err
 	}
+	a.server = server
+	return nil
+}
 
-	if !slices.Equal(keyCode, buf[:n]) {
+// Shutdown withdraws the service for good
+func (a *advertisement) Shutdown() {
+	if a.stop != nil {
+		a.stop()
+	}
+	a.mu.Lock()
+	a.closed = true
+	a.mu.Unlock()
+	a.set(false)
+}
+
+// establishConnection checks the codes of a caller and reports whether it accepted compression
+func establishConnection(conn io.ReadWriteCloser, keyCode []byte, valueCode []byte, buf []byte, compression Compression, logger *slog.Logger) (bool, error) {
+	n, err := conn.Read(buf)
+	if err != nil {
+		return false, err
+	}
+
+	// [key code] or [key code][0][accepted compressions]
+	code, accepted, _ := bytes.Cut(buf[:n], []byte{0})
+	if !slices.Equal(keyCode, code) {
 		logger.Error("failed to establish connection")
-		return fmt.Errorf("invalid key code")
+		conn.Write([]byte{globals.ERROR_MISMATCH_PAYLOAD_CODE})
+		return false, fmt.Errorf("invalid key code")
 	}
+	compress := compression != "" && accepts(accepted, compression)
 
 	_, err = conn.Write([]byte{globals.OK_STATUS_CODE})
 	if err != nil {
 		logger.Error("failed to establish connection")
-		return err
+		return false, err
 	}
 
 	n, err = conn.Read(buf)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if !slices.Equal(valueCode, buf[:n]) {
 		logger.Error("failed to establish connection")
-		return fmt.Errorf("invalid value code")
+		conn.Write([]byte{globals.ERROR_MISMATCH_PAYLOAD_CODE})
+		return false, fmt.Errorf("invalid value code")
 	}
 	_, err = conn.Write([]byte{globals.OK_STATUS_CODE})
 
-	return err
+	return compress, err
 }
 
-func handleCallerRequest[K any, V any](conn io.ReadWriteCloser, keySerializer *mad.Mad[K], valueSerializer *mad.Mad[V], stringSerializer *mad.Mad[string], buf []byte, processRequest func(K) serviceOutput[V], logger *slog.Logger) {
+// serviceEndpoint is the state Service and ThreadedService answer their callers with
+type serviceEndpoint[K any, V any] struct {
+	namespace *Namespace
+	name      string
+	// context of the requests, canceled when the service closes
+	context context.Context
+
+	keyCodec   Codec[K]
+	valueCodec Codec[V]
+
+	metrics  *endpointMetrics
+	recorder *Recorder
 
+	compression          Compression
+	compressionThreshold int
+
+	// processRequest wrapped in the server interceptors
+	interceptedRequest func(context.Context, K) serviceOutput[V]
+}
+
+// handleCaller answers the requests of one caller until its connection closes, buf holds a frame
+func (e *serviceEndpoint[K, V]) handleCaller(conn io.ReadWriteCloser, buf []byte, logger *slog.Logger) {
 	defer conn.Close()
-	err := establishConnection(conn, []byte(keySerializer.Code()), []byte(valueSerializer.Code()), buf, logger)
+	compress, err := establishConnection(conn, []byte(e.keyCodec.Code()), []byte(e.valueCodec.Code()), buf, e.compression, logger)
 	if err != nil {
+		e.metrics.inc(MetricHandshakeFailures)
 		return
 	}
 
@@ -104,35 +226,120 @@ func handleCallerRequest[K any, V any](conn io.ReadWriteCloser, keySerializer *m
 			logger.Error("unable to read from connection", "error", err)
 			return
 		}
+		e.metrics.add(MetricBytesIn, n)
 
 		switch buf[0] {
 		case globals.PING_CODE:
 			conn.Write([]byte{globals.PONG_CODE})
 
 		case globals.SERVICE_REQUEST:
+			e.metrics.inc(MetricRequests)
+			var request []byte
+			if e.recorder != nil {
+				// buf is reused for the response
+				request = bytes.Clone(buf[:n])
+			}
+			_, header, payload, err := decodeFrame(buf[:n])
+			if err != nil {
+				logger.Error("unable to decode frame", "error", err)
+				e.metrics.inc(MetricRequestErrors)
+				conn.Write([]byte{globals.ERROR_MISMATCH_PAYLOAD_CODE})
+				continue
+			}
+
+			// the caller's span is the parent of the server span
+			requestCtx := e.context
+			if header.trace.IsValid() {
+				requestCtx = ContextWithSpanContext(requestCtx, header.trace)
+			}
+			if header.metadata != nil {
+				requestCtx = newIncomingContext(requestCtx, header.metadata)
+			}
+			requestCtx, trailer := withTrailer(requestCtx)
+			requestCtx, span := e.namespace.tracer.Start(requestCtx, e.name, SpanKindServer)
+
 			var key K
-			err = keySerializer.Decode(buf[1:n], &key)
+			err = e.keyCodec.Decode(payload, &key)
 			if err != nil {
 				logger.Error("unable to decode key", "error", err)
+				e.metrics.inc(MetricRequestErrors)
+				span.RecordError(err)
+				span.End()
 				conn.Write([]byte{globals.ERROR_SERIALIZER_ERROR_CODE})
 				continue
 			}
 
-			res := processRequest(key)
+			res := e.interceptedRequest(requestCtx, key)
+			span.RecordError(res.err)
+			span.End()
+
+			responseHeader := frameHeader{metadata: trailer.get()}
+
 			if res.err != nil {
-				logger.Error("handler failed", "error", err)
+				logger.Error("handler failed", "error", res.err)
+				e.metrics.inc(MetricRequestErrors)
 				errMsg := res.err.Error()
-				buf[0] = globals.ERROR_SERVICE_ERROR_CODE
-				stringSerializer.Encode(&errMsg, buf[1:])
-				_, err = conn.Write(buf[:stringSerializer.GetRequiredSize(&errMsg)])
+				code := globals.ERROR_SERVICE_ERROR_CODE
+				if errors.Is(res.err, ErrNodeInactive) {
+					code = globals.ERROR_NODE_INACTIVE_CODE
+				} else if errors.Is(res.err, ErrNotLeader) {
+					code = globals.ERROR_NOT_LEADER_CODE
+				}
+				// the error has to reach the caller, the trailer and then the message are cut to fit a frame
+				if responseHeader.size()+e.namespace.stringSerializer.GetRequiredSize(&errMsg) > globals.MAX_PACKET_SIZE {
+					logger.Error("error response is too big, dropping its trailer")
+					responseHeader.metadata = nil
+				}
+				if over := responseHeader.size() + e.namespace.stringSerializer.GetRequiredSize(&errMsg) - globals.MAX_PACKET_SIZE; over > 0 {
+					errMsg = errMsg[:max(len(errMsg)-over, 0)]
+				}
+				start := responseHeader.encode(code, buf)
+				e.namespace.stringSerializer.Encode(&errMsg, buf[start:])
+				n, err = conn.Write(buf[:start+e.namespace.stringSerializer.GetRequiredSize(&errMsg)])
+				e.metrics.add(MetricBytesOut, n)
+				recordCall[K, V](e.recorder, e.name, e.keyCodec.Code(), e.valueCodec.Code(), request, buf[:n])
 				if err != nil {
 					logger.Error("failed to write from connection", "error", err)
 					return
 				}
+				continue
+			}
+
+			// callers that accepted the e.compression get the compressed response when it is smaller
+			valueSize := e.valueCodec.Size(&res.data)
+			var compressed []byte
+			if compress && valueSize >= e.compressionThreshold {
+				encoded := make([]byte, valueSize)
+				if err := e.valueCodec.Encode(&res.data, encoded); err == nil {
+					compressed, responseHeader.compression = compressPayload(e.compression, e.compressionThreshold, encoded)
+				}
+			}
+			if responseHeader.compression != 0 {
+				e.metrics.inc(MetricCompressed)
+				e.metrics.add(MetricCompressionSaved, valueSize-len(compressed))
+				valueSize = len(compressed)
+			}
+
+			responseSize := valueSize + responseHeader.size()
+			if responseSize > globals.MAX_PACKET_SIZE {
+				logger.Error("response is too big", "size", responseSize)
+				e.metrics.inc(MetricRequestErrors)
+				conn.Write([]byte{globals.ERROR_SERIALIZER_ERROR_CODE})
+				continue
 			}
 
-			valueSerializer.Encode(&res.data, buf)
-			_, err = conn.Write(buf[:valueSerializer.GetRequiredSize(&res.data)])
+			start := responseHeader.encode(globals.OK_STATUS_CODE, buf)
+			if responseHeader.compression != 0 {
+				copy(buf[start:], compressed)
+			} else if err := e.valueCodec.Encode(&res.data, buf[start:]); err != nil {
+				logger.Error("unable to encode response", "error", err)
+				e.metrics.inc(MetricRequestErrors)
+				conn.Write([]byte{globals.ERROR_SERIALIZER_ERROR_CODE})
+				continue
+			}
+			n, err = conn.Write(buf[:responseSize])
+			e.metrics.add(MetricBytesOut, n)
+			recordCall[K, V](e.recorder, e.name, e.keyCodec.Code(), e.valueCodec.Code(), request, buf[:n])
 			if err != nil {
 				logger.Error("failed to write from connection", "error", err)
 				return
@@ -147,11 +354,19 @@ func handleCallerRequest[K any, V any](conn io.ReadWriteCloser, keySerializer *m
 }
 
 type serviceRequest[K any, V any] struct {
+	ctx    context.Context
 	input  K
 	output chan serviceOutput[V]
 }
 
 type serviceOutput[V any] struct {
-	data V
-	err  error
+	data    V
+	err     error
+	trailer Metadata
+}
+
+func withoutContext[K any, V any](handler func(K) (V, error)) func(context.Context, K) (V, error) {
+	return func(_ context.Context, key K) (V, error) {
+		return handler(key)
+	}
 }
@@ -3,10 +3,11 @@ package spine
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/cenkalti/backoff/v4"
-	"github.com/poisnoir/mad-go"
 	"github.com/poisnoir/spine-go/internal/globals"
 	"github.com/xtaci/kcp-go/v5"
 )
@@ -14,32 +15,102 @@ import (
 type Subscriber[K any] struct {
 	namespace    *Namespace
 	subscribedTo string
+	node         *Node
 
 	conn        *kcp.UDPSession
 	ctx         context.Context
 	cancel      context.CancelFunc
 	isConnected bool
+	// stopClose stops closing conn when the subscriber stops
+	stopClose func() bool
 
 	mutex    sync.RWMutex
 	lastData K
-	handler  func(K)
+	lastInfo MessageInfo
+	lastFrom messageSource
+	handler  func(K, MessageInfo)
 	pushSig  chan struct{}
 
-	serializer *mad.Mad[K]
+	codec       Codec[K]
+	connections int
+	metrics     *endpointMetrics
+
+	filter *filter
+
+	// schema of K, nil unless K is encoded with mad. converter rewrites payloads of a publisher
+	// whose type is a compatible version of K, it is nil when the codes match.
+	schema    *Schema
+	converter *schemaConverter
+
+	// called with every frame before it is decoded, used by the recorder
+	onFrame func(frame []byte, receivedAt time.Time)
+}
+
+// MessageInfo describes a received message
+type MessageInfo struct {
+	// Headers the publisher attached to the message
+	Headers Metadata
+	// SentAt is when the publisher sent the message, by the publisher's clock, zero if the frame has no timestamp
+	SentAt time.Time
+	// ReceivedAt is when the subscriber read the message from the network
+	ReceivedAt time.Time
+	// Sequence counts the messages published on the topic starting at 1.
+	// A gap means messages were missed, either dropped in favour of a newer message, filtered out or lost.
+	Sequence uint64
+	// PublisherNodeID is the id of the publisher's node, empty if it has none
+	PublisherNodeID string
+}
+
+func NewSubscriber[K any](namespace *Namespace, topic string, handler func(K), opts ...Option) (*Subscriber[K], error) {
+	return NewSubscriberWithInfo(namespace, topic, func(data K, _ MessageInfo) { handler(data) }, opts...)
+}
+
+// NewSubscriberWithHeaders creates a subscriber whose handler also receives the headers of each message
+func NewSubscriberWithHeaders[K any](namespace *Namespace, topic string, handler func(K, Metadata), opts ...Option) (*Subscriber[K], error) {
+	return NewSubscriberWithInfo(namespace, topic, func(data K, info MessageInfo) { handler(data, info.Headers) }, opts...)
 }
 
-func NewSubscriber[K any](namespace *Namespace, topic string, handler func(K)) (*Subscriber[K], error) {
+// NewSubscriberWithInfo creates a subscriber whose handler also receives information about each message
+func NewSubscriberWithInfo[K any](namespace *Namespace, topic string, handler func(K, MessageInfo), opts ...Option) (*Subscriber[K], error) {
 
-	decoder, err := mad.NewMad[K]()
+	options := buildOptions(opts)
+	if err := checkCodecs[K, K](options); err != nil {
+		return nil, err
+	}
+	codec, err := codecOf[K](options)
 	if err != nil {
 		return nil, err
 	}
+	return newSubscriber(namespace, topic, codec, handler, nil, opts)
+}
+
+// NewRawSubscriber creates a subscriber that receives the encoded payloads of a topic whose codec code identifies
+func NewRawSubscriber(namespace *Namespace, topic string, code string, handler func([]byte, MessageInfo), opts ...Option) (*Subscriber[[]byte], error) {
+	return newSubscriber(namespace, topic, RawCodec(code), handler, nil, opts)
+}
+
+func newSubscriber[K any](namespace *Namespace, topic string, codec Codec[K], handler func(K, MessageInfo), onFrame func([]byte, time.Time), opts []Option) (*Subscriber[K], error) {
+
+	options := buildOptions(opts)
+
+	topic, err := namespace.resolveName(topic, options.node)
+	if err != nil {
+		return nil, err
+	}
+
+	var f *filter
+	if options.filter != "" {
+		if f, err = compileFilter(options.filter, reflect.TypeFor[K]()); err != nil {
+			return nil, err
+		}
+	}
 
 	ctx, cancel := context.WithCancel(namespace.ctx)
 
 	sub := &Subscriber[K]{
 		namespace:    namespace,
 		subscribedTo: topic,
+		node:         options.node,
 
 		ctx:         ctx,
 		cancel:      cancel,
@@ -48,7 +119,16 @@ func NewSubscriber[K any](namespace *Namespace, topic string, handler func(K)) (
 		handler: handler,
 		pushSig: make(chan struct{}, 1),
 
-		serializer: decoder,
+		codec:   codec,
+		schema:  madSchema(codec),
+		metrics: newEndpointMetrics(namespace, kindSubscriber, topic, options),
+		onFrame: onFrame,
+		filter:  f,
+	}
+
+	if err := options.node.adopt(sub.Stop); err != nil {
+		cancel()
+		return nil, err
 	}
 
 	go sub.run()
@@ -57,17 +137,37 @@ func NewSubscriber[K any](namespace *Namespace, topic string, handler func(K)) (
 	return sub, nil
 }
 
+// messageSource identifies a message, sequences restart with every publisher and every connection to it
+type messageSource struct {
+	connection int
+	node       string
+	sequence   uint64
+}
+
 func (s *Subscriber[K]) runHandler() {
+	var lastHandled messageSource
 	for {
 
 		select {
 		case <-s.ctx.Done():
 			return
 		case <-s.pushSig:
+			// messages are dropped while the node is not active
+			if !s.node.accepts() {
+				continue
+			}
 			s.mutex.RLock()
 			snap := s.lastData
+			info := s.lastInfo
+			from := s.lastFrom
 			s.mutex.RUnlock()
-			s.handler(snap)
+
+			// a message received while the previous one was handled is picked up early
+			if from.sequence != 0 && from == lastHandled {
+				continue
+			}
+			lastHandled = from
+			s.handler(snap, info)
 		}
 	}
 }
@@ -77,28 +177,71 @@ func (s *Subscriber[K]) run() {
 	bufPtr := s.namespace.bufferPool.Get().(*[]byte)
 	buf := *bufPtr
 
+	defer s.namespace.bufferPool.Put(bufPtr)
+
 	var data K
 
-	for {
+	defer func() {
+		if s.isConnected {
+			s.disconnect()
+		}
+	}()
+	for s.ctx.Err() == nil {
 		if s.isConnected {
-			_, err := s.conn.Read(buf)
+			n, err := s.conn.Read(buf)
 			if err != nil {
-				s.isConnected = false
+				s.disconnect()
 				continue
 			}
+			receivedAt := s.namespace.clock.Now()
 
 			if buf[0] == globals.PING_CODE {
 				_, err = s.conn.Write([]byte{globals.PONG_CODE})
 				if err != nil {
-					s.isConnected = false
-					continue
+					s.disconnect()
 				}
+				continue
 			}
 
-			s.serializer.Decode(buf[1:], &data)
+			s.metrics.inc(MetricReceived)
+			s.metrics.add(MetricBytesIn, n)
+			if s.onFrame != nil {
+				s.onFrame(buf[:n], receivedAt)
+			}
+			_, header, payload, err := decodeFrame(buf[:n])
+			if err != nil {
+				continue
+			}
+			if header.compression != 0 {
+				if payload, err = decompress(header.compression, payload); err != nil {
+					continue
+				}
+			}
+			if s.converter != nil {
+				if payload, err = s.converter.convert(payload); err != nil {
+					continue
+				}
+			}
+			if err := s.codec.Decode(payload, &data); err != nil {
+				continue
+			}
+			if !s.filter.match(reflect.ValueOf(&data).Elem()) {
+				continue
+			}
 
 			s.mutex.Lock()
 			s.lastData = data
+			s.lastInfo = MessageInfo{
+				Headers:         header.metadata,
+				ReceivedAt:      receivedAt,
+				Sequence:        header.sequence,
+				PublisherNodeID: header.source,
+			}
+			// frames of publishers that don't stamp them leave SentAt zero
+			if header.sentAt != 0 {
+				s.lastInfo.SentAt = time.Unix(0, header.sentAt)
+			}
+			s.lastFrom = messageSource{connection: s.connections, node: header.source, sequence: header.sequence}
 			s.mutex.Unlock()
 
 			select {
@@ -113,6 +256,13 @@ func (s *Subscriber[K]) run() {
 	}
 }
 
+// disconnect closes the session with the publisher, run connects again
+func (s *Subscriber[K]) disconnect() {
+	s.isConnected = false
+	s.stopClose()
+	s.conn.Close()
+}
+
 func (s *Subscriber[K]) connect() error {
 
 	logger := s.namespace.logger.With(
@@ -123,14 +273,25 @@ func (s *Subscriber[K]) connect() error {
 	)
 
 	// finding the service
-	address, err := s.namespace.GetService(s.subscribedTo, s.ctx)
+	endpoint, err := s.namespace.reg.find(s.ctx, s.subscribedTo)
 	if err != nil {
 		logger.Error("unable to find the service", "error", err)
 		return err // the only way to fail here is to run out of context
 	}
 
+	keyCode := s.codec.Code()
+	s.converter, err = converterFor(endpoint.Code, endpoint.Schema, keyCode, s.schema, true)
+	if err != nil {
+		logger.Error("publisher data type is incompatible", "error", err)
+		s.metrics.inc(MetricHandshakeFailures)
+		return err
+	}
+	if s.converter != nil {
+		keyCode = endpoint.Code
+	}
+
 	// establishing connection
-	sess, err := kcp.DialWithOptions(address, s.namespace.encryption, 10, 3)
+	sess, err := kcp.DialWithOptions(endpoint.Address, s.namespace.encryption, 10, 3)
 	if err != nil {
 		logger.Error("failed to dial service", "error", err)
 		return err
@@ -142,26 +303,50 @@ func (s *Subscriber[K]) connect() error {
 	buf := *bufPtr
 
 	// validating input/output service types
-	keyCode := s.serializer.Code()
 	n := copy(buf, keyCode)
+	if s.filter != nil || endpoint.Compression != "" {
+		buf[n] = 0
+		n++
+		if s.filter != nil {
+			n += copy(buf[n:], s.filter.expr)
+		}
+	}
+	// only publishers that compress know the compressions field
+	if endpoint.Compression != "" {
+		buf[n] = 0
+		n++
+		n += copy(buf[n:], acceptedCompressions())
+	}
 
 	n, err = write(sess, buf, n, true)
 	if err != nil {
 		logger.Error("failed to validate service input type", "error", err)
+		sess.Close()
 		return err
 	} else if n != 1 {
 		err = fmt.Errorf("response is corrupted")
 		logger.Error("failed to validate service input type", "error", err)
+		sess.Close()
 		return err
 	} else if buf[0] != globals.OK_STATUS_CODE {
 		err = fmt.Errorf("service data type is different")
 		logger.Error("failed to validate service input type", "error", err)
+		s.metrics.inc(MetricHandshakeFailures)
+		sess.Close()
 		return err
 	}
 
+	// unblocks run when the subscriber stops
+	s.stopClose = context.AfterFunc(s.ctx, func() { sess.Close() })
+
 	s.conn = sess
 	s.isConnected = true
 
+	s.connections++
+	if s.connections > 1 {
+		s.metrics.inc(MetricReconnects)
+	}
+
 	return nil
 }
 
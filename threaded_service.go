@@ -4,31 +4,51 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"time"
 
-	"github.com/grandcat/zeroconf"
-	"github.com/poisnoir/mad-go"
 	"github.com/xtaci/kcp-go/v5"
 )
 
 type ThreadedService[K any, V any] struct {
-	namespace *Namespace
-	name      string
-	server    *zeroconf.Server
+	serviceEndpoint[K, V]
+	server   *advertisement
+	node     *Node
+	election *Election
 
-	context  context.Context
 	cancel   context.CancelFunc
 	listener *kcp.Listener
 
-	keySerializer   *mad.Mad[K]
-	valueSerializer *mad.Mad[V]
-
 	requests chan serviceRequest[K, V]
-	handler  func(K) (V, error)
+	handler  func(context.Context, K) (V, error)
+}
+
+func NewThreadedService[K any, V any](namespace *Namespace, name string, handler func(K) (V, error), opts ...Option) (*ThreadedService[K, V], error) {
+	return NewThreadedServiceWithContext(namespace, name, withoutContext(handler), opts...)
+}
+
+// NewThreadedServiceWithContext creates a threaded service whose handler receives the context of the request
+func NewThreadedServiceWithContext[K any, V any](namespace *Namespace, name string, handler func(context.Context, K) (V, error), opts ...Option) (*ThreadedService[K, V], error) {
+	keyEnc, valueEnc, err := serviceCodecs[K, V](buildOptions(opts))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service: %v", err)
+	}
+	return newThreadedService(namespace, name, keyEnc, valueEnc, handler, opts)
+}
+
+// NewRawThreadedService is NewRawService handling every request in its own goroutine
+func NewRawThreadedService(namespace *Namespace, name string, keyCode string, valueCode string, handler func(context.Context, []byte) ([]byte, error), opts ...Option) (*ThreadedService[[]byte, []byte], error) {
+	return newThreadedService(namespace, name, RawCodec(keyCode), RawCodec(valueCode), handler, opts)
 }
 
-func NewThreadedService[K any, V any](namespace *Namespace, name string, handler func(K) (V, error)) (*ThreadedService[K, V], error) {
+func newThreadedService[K any, V any](namespace *Namespace, name string, keyEnc Codec[K], valueEnc Codec[V], handler func(context.Context, K) (V, error), opts []Option) (*ThreadedService[K, V], error) {
 
-	keyEnc, valueEnc, listener, server, err := generateService[K, V](namespace, name)
+	options := buildOptions(opts)
+	name, err := namespace.resolveName(name, options.node)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service: %v", err)
+	}
+
+	listener, server, err := generateService(namespace, name, keyEnc, valueEnc, options)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create service: %v", err)
 	}
@@ -36,20 +56,38 @@ func NewThreadedService[K any, V any](namespace *Namespace, name string, handler
 	ctx, cancel := context.WithCancel(namespace.ctx)
 
 	ts := &ThreadedService[K, V]{
-		namespace: namespace,
-		name:      name,
-		server:    server,
+		serviceEndpoint: serviceEndpoint[K, V]{
+			namespace: namespace,
+			name:      name,
+			context:   ctx,
+
+			keyCodec:   keyEnc,
+			valueCodec: valueEnc,
 
-		context: ctx,
-		cancel:  cancel,
+			metrics:  newEndpointMetrics(namespace, kindThreadedService, name, options),
+			recorder: options.recorder,
 
-		handler:         handler,
-		keySerializer:   keyEnc,
-		valueSerializer: valueEnc,
+			compression:          options.compression,
+			compressionThreshold: options.compressionThreshold,
+		},
+		server:   server,
+		node:     options.node,
+		election: options.election,
 
+		cancel:   cancel,
+		listener: listener,
+
+		handler:  handler,
 		requests: make(chan serviceRequest[K, V], 100),
 	}
 
+	ts.interceptedRequest = interceptRequests(namespace, name, options, ts.processRequest)
+
+	if err := options.node.adopt(ts.Close); err != nil {
+		ts.Close()
+		return nil, err
+	}
+
 	// todo fix me pls
 	logger := namespace.logger
 
@@ -69,15 +107,29 @@ func (s *ThreadedService[K, V]) clientHandler(conn io.ReadWriteCloser) {
 	bufPtr := s.namespace.bufferPool.Get().(*[]byte)
 	defer s.namespace.bufferPool.Put(bufPtr)
 
-	handleCallerRequest(conn, s.keySerializer, s.valueSerializer, s.namespace.stringSerializer, *bufPtr, s.processRequest, logger)
+	s.handleCaller(conn, *bufPtr, logger)
 
 }
 
-func (ts *ThreadedService[K, V]) processRequest(key K) serviceOutput[V] {
-	result, err := ts.handler(key)
+func (ts *ThreadedService[K, V]) processRequest(ctx context.Context, key K) serviceOutput[V] {
+	if !ts.node.accepts() {
+		return serviceOutput[V]{err: ErrNodeInactive}
+	}
+	if !ts.election.leads() {
+		return serviceOutput[V]{err: ErrNotLeader}
+	}
+	start := time.Now()
+	result, err := ts.handler(ctx, key)
+	ts.metrics.observe(MetricHandlerDuration, time.Since(start).Seconds())
 	return serviceOutput[V]{data: result, err: err}
 }
 
 func (ts *ThreadedService[K, V]) Close() {
+	ts.server.Shutdown()
+	ts.listener.Close()
 	ts.cancel()
 }
+
+func (ts *ThreadedService[K, V]) Name() string {
+	return ts.name
+}
@@ -0,0 +1,48 @@
+package spine
+
+import (
+	"errors"
+	"time"
+)
+
+// NewTimerPublisher publishes what produce returns rate times per second, timed by the namespace clock,
+// until the publisher closes or the namespace disconnects.
+// Periods missed by a slow producer are skipped and counted as overruns, the producer is timed by the wall clock.
+func NewTimerPublisher[K any](ns *Namespace, name string, rate float64, produce func() K, opts ...Option) (*Publisher[K], error) {
+	if rate <= 0 {
+		return nil, errors.New("rate must be positive")
+	}
+
+	p, err := NewPublisher[K](ns, name, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	period := time.Duration(float64(time.Second) / rate)
+	onOverrun := buildOptions(opts).onOverrun
+
+	ticker := ns.clock.NewTicker(period)
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-ticker.C():
+				// the producer's work takes wall time even while a simulated clock is paused
+				start := time.Now()
+				p.Publish(produce())
+
+				if took := time.Since(start); took > period {
+					p.metrics.inc(MetricOverruns)
+					if onOverrun != nil {
+						onOverrun(took)
+					}
+				}
+			}
+		}
+	}()
+
+	return p, nil
+}
@@ -0,0 +1,123 @@
+package spine
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestPublisher_MaxRate(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ns, err := JointNamespace("test_max_rate", "secret", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	pub, err := NewPublisher[uint32](ns, "burst", WithMaxRate(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	received := make(chan MessageInfo, 1000)
+	sub, err := NewSubscriberWithInfo(ns, "burst", func(_ uint32, info MessageInfo) {
+		received <- info
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Stop()
+
+	// wait for the subscriber to connect
+	timeout := time.After(5 * time.Second)
+	for connected := false; !connected; {
+		pub.Publish(0)
+		select {
+		case <-received:
+			connected = true
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("subscriber did not connect")
+		}
+	}
+
+	start := time.Now()
+	for i := range uint32(500) {
+		pub.Publish(i + 1)
+		time.Sleep(time.Millisecond)
+	}
+	pub.lastDataMu.RLock()
+	last := pub.sequence
+	pub.lastDataMu.RUnlock()
+
+	count := 0
+	for {
+		select {
+		case info := <-received:
+			count++
+			if info.Sequence != last {
+				continue
+			}
+			// 10 per second plus the first message of the burst
+			if limit := int(time.Since(start).Seconds()*10) + 2; count > limit {
+				t.Errorf("received %d messages, limit is %d", count, limit)
+			}
+			return
+		case <-timeout:
+			t.Fatal("latest message not received")
+		}
+	}
+}
+
+func TestTimerPublisher_Overrun(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	clock := NewSimClock(time.Unix(0, 0))
+	ns, err := JointNamespace("test_timer_publisher", "secret", logger, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	produced := make(chan uint32, 10)
+	overruns := make(chan time.Duration, 10)
+	var n uint32
+	produce := func() uint32 {
+		n++
+		if n == 3 {
+			time.Sleep(300 * time.Millisecond)
+		}
+		produced <- n
+		return n
+	}
+
+	pub, err := NewTimerPublisher(ns, "ticks", 10, produce, WithOverrun(func(took time.Duration) {
+		overruns <- took
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	for i := range uint32(3) {
+		clock.Advance(100 * time.Millisecond)
+		select {
+		case value := <-produced:
+			if value != i+1 {
+				t.Fatalf("expected %d, got %d", i+1, value)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("producer not called after %d periods", i+1)
+		}
+	}
+
+	select {
+	case took := <-overruns:
+		if took < 300*time.Millisecond {
+			t.Errorf("expected an overrun of at least 300ms, got %v", took)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("overrun not reported")
+	}
+}
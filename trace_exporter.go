@@ -0,0 +1,150 @@
+package spine
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// SpanData is a finished span handed to an exporter
+type SpanData struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+// SpanExporter receives spans when they end, e.g. to forward them to an OTLP collector
+type SpanExporter interface {
+	ExportSpan(span SpanData)
+}
+
+// NewTracer returns a tracer that samples every span and hands it to exporter when it ends
+func NewTracer(exporter SpanExporter) Tracer {
+	return &recordingTracer{exporter: exporter}
+}
+
+type recordingTracer struct {
+	exporter SpanExporter
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span) {
+	parent := SpanContextFromContext(ctx)
+
+	sc := SpanContext{Flags: FlagSampled}
+	if parent.IsValid() {
+		sc.TraceID = parent.TraceID
+		sc.Flags = parent.Flags
+	} else {
+		binary.BigEndian.PutUint64(sc.TraceID[:8], rand.Uint64())
+		binary.BigEndian.PutUint64(sc.TraceID[8:], rand.Uint64())
+	}
+	binary.BigEndian.PutUint64(sc.SpanID[:], rand.Uint64()|1) // never zero
+
+	s := &recordingSpan{
+		tracer: t,
+		data: SpanData{
+			Name:    name,
+			Kind:    kind,
+			Context: sc,
+			Parent:  parent.SpanID,
+			Start:   time.Now(),
+		},
+	}
+	return ContextWithSpanContext(ctx, sc), s
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	mu     sync.Mutex
+	ended  bool
+	data   SpanData
+}
+
+func (s *recordingSpan) SpanContext() SpanContext {
+	return s.data.Context
+}
+
+func (s *recordingSpan) SetAttribute(key string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string)
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.data.Error = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *recordingSpan) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	if data.Context.IsSampled() {
+		s.tracer.exporter.ExportSpan(data)
+	}
+}
+
+// FileExporter writes every span as a line of json, useful for tests and offline analysis
+type FileExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewFileExporter(w io.Writer) *FileExporter {
+	return &FileExporter{enc: json.NewEncoder(w)}
+}
+
+type jsonSpan struct {
+	Name         string            `json:"name"`
+	Kind         string            `json:"kind"`
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+func (e *FileExporter) ExportSpan(span SpanData) {
+	js := jsonSpan{
+		Name:       span.Name,
+		Kind:       span.Kind.String(),
+		TraceID:    span.Context.TraceID.String(),
+		SpanID:     span.Context.SpanID.String(),
+		Start:      span.Start,
+		End:        span.End,
+		Attributes: span.Attributes,
+		Error:      span.Error,
+	}
+	if span.Parent != (SpanID{}) {
+		js.ParentSpanID = span.Parent.String()
+	}
+
+	e.mu.Lock()
+	_ = e.enc.Encode(js)
+	e.mu.Unlock()
+}
@@ -0,0 +1,96 @@
+package spine
+
+import (
+	"context"
+	"encoding/hex"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext identifies a span across process boundaries (same fields as W3C trace context)
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   uint8
+}
+
+const FlagSampled uint8 = 1
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+type SpanKind uint8
+
+const (
+	SpanKindInternal SpanKind = iota
+	SpanKindClient
+	SpanKindServer
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindClient:
+		return "client"
+	case SpanKindServer:
+		return "server"
+	default:
+		return "internal"
+	}
+}
+
+type Span interface {
+	SpanContext() SpanContext
+	SetAttribute(key string, value string)
+	RecordError(err error)
+	End()
+}
+
+// Tracer starts spans for service calls.
+// The parent of a span is SpanContextFromContext(ctx) and the returned context must carry the new span,
+// an OpenTelemetry SDK can be plugged in by wrapping it in a Tracer.
+type Tracer interface {
+	Start(ctx context.Context, name string, kind SpanKind) (context.Context, Span)
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx carrying sc as the current span
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the current span of ctx, it is invalid if there is none
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// noopTracer records nothing but keeps propagating the incoming trace
+type noopTracer struct{}
+
+type noopSpan struct {
+	sc SpanContext
+}
+
+func (noopTracer) Start(ctx context.Context, _ string, _ SpanKind) (context.Context, Span) {
+	return ctx, noopSpan{sc: SpanContextFromContext(ctx)}
+}
+
+func (s noopSpan) SpanContext() SpanContext  { return s.sc }
+func (noopSpan) SetAttribute(string, string) {}
+func (noopSpan) RecordError(error)           {}
+func (noopSpan) End()                        {}
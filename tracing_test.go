@@ -0,0 +1,78 @@
+package spine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestTracing_CallChain(t *testing.T) {
+	logger := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	var out bytes.Buffer
+	exporter := NewFileExporter(&out)
+	ns, err := JointNamespace("test_tracing", "secret", logger, WithTracer(NewTracer(exporter)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Disconnect()
+
+	_, err = NewService(ns, "driver", func(input uint32) (uint32, error) {
+		return input + 1, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	driver, err := NewServiceCaller[uint32, uint32](ns, "driver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Close()
+
+	_, err = NewServiceWithContext(ns, "controller", func(ctx context.Context, input uint32) (uint32, error) {
+		return driver.Call(input, ctx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller, err := NewServiceCaller[uint32, uint32](ns, "controller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer controller.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := controller.Call(1, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]jsonSpan)
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var span jsonSpan
+		if err := dec.Decode(&span); err != nil {
+			t.Fatal(err)
+		}
+		spans[span.Kind+" "+span.Name] = span
+	}
+
+	chain := []string{"client controller", "server controller", "client driver", "server driver"}
+	for i, key := range chain {
+		span, ok := spans[key]
+		if !ok {
+			t.Fatalf("missing span %q, got %v", key, spans)
+		}
+		if span.TraceID != spans[chain[0]].TraceID {
+			t.Errorf("span %q is not part of the trace", key)
+		}
+		if i > 0 && span.ParentSpanID != spans[chain[i-1]].SpanID {
+			t.Errorf("span %q has parent %s, expected %s", key, span.ParentSpanID, spans[chain[i-1]].SpanID)
+		}
+	}
+}